@@ -0,0 +1,63 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+	"github.com/Yashasv-Prajapati/vantadb/internal/kv"
+
+	"github.com/spf13/cobra"
+)
+
+var compactFilePath string
+
+// compactCmd represents the compact command
+var compactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Defragments a disk and truncates its free space",
+	Long: `Moves the pages of every value of a .vdsk file into one contiguous run, filling the holes
+at the front of the disk first, and truncates the free pages left at the end of the file.
+
+A value is copied before its inode is switched to the copy and its old pages are freed afterwards, a
+crash never loses it, fsck --repair frees the pages it leaves behind. The disk must not be in use, a
+running server compacts with POST /admin/compact and keeps serving while it does.`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		key, err := diskKey(compactFilePath)
+		if err != nil {
+			fmt.Println("Open failed:", err)
+			os.Exit(1)
+		}
+		db, err := kv.Open(compactFilePath, kv.Options{Key: key})
+		if err != nil {
+			fmt.Println("Open failed:", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		report, err := db.Compact()
+		if err != nil {
+			fmt.Println("Compaction failed:", err)
+			os.Exit(1)
+		}
+		printCompactReport(report)
+	},
+}
+
+func printCompactReport(report fs.CompactReport) {
+	fmt.Printf("moved %d pages of %d inodes, %d fragmented before, %d after\n",
+		report.PagesMoved, report.InodesMoved, report.FragmentedBefore, report.FragmentedAfter)
+	fmt.Printf("disk went from %d to %d pages, %d bytes reclaimed\n",
+		report.PagesBefore, report.PagesAfter, report.BytesReclaimed)
+}
+
+func init() {
+	rootCmd.AddCommand(compactCmd)
+
+	compactCmd.Flags().StringVarP(&compactFilePath, "file", "f", "", "Path to the .vdsk file")
+	compactCmd.MarkFlagRequired("file")
+}
@@ -5,7 +5,6 @@ package cmd
 
 import (
 	"fmt"
-	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
 	"github.com/Yashasv-Prajapati/vantadb/internal/kv"
 
 	"github.com/spf13/cobra"
@@ -19,14 +18,19 @@ var delCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		key := args[1]
 
-		disk, err := fs.Mount("")
+		encryptionKey, err := diskKey("")
 		if err != nil {
-			fmt.Println("Mount failed:", err)
+			fmt.Println("Open failed:", err)
 			return
 		}
-		kv.Init(disk)
+		db, err := kv.Open("", kv.Options{Key: encryptionKey})
+		if err != nil {
+			fmt.Println("Open failed:", err)
+			return
+		}
+		defer db.Close()
 		
-		fmt.Println(kv.Del(key))
+		fmt.Println(db.Del(key))
 	},
 }
 
@@ -0,0 +1,81 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+
+	"github.com/spf13/cobra"
+)
+
+var fsckFilePath string
+var repair bool
+
+// fsckCmd represents the fsck command
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "Checks the consistency of a disk",
+	Long: `Cross checks the inode table against the bitmap of a .vdsk file. It reports pages marked
+used that no inode owns, pages owned by more than one inode, inodes whose size disagrees with their
+page count, duplicate keys, keys missing from the indexes and pages failing their checksum.
+
+With --repair the bitmap and the indexes are rebuilt from the inode table. The disk must not be in use.`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		key, err := diskKey(fsckFilePath)
+		if err != nil {
+			fmt.Println("Mount failed:", err)
+			os.Exit(1)
+		}
+		disk, err := fs.Mount(fsckFilePath, fs.MountOptions{Key: key})
+		if err != nil {
+			fmt.Println("Mount failed:", err)
+			os.Exit(1)
+		}
+		defer disk.Close()
+
+		report := disk.Check()
+		printFsckReport(report)
+
+		if repair && !report.Clean() {
+			if err := disk.RebuildBitmap(); err != nil {
+				fmt.Println("Repair failed:", err)
+				os.Exit(1)
+			}
+			if err := disk.RebuildHashIndex(); err != nil {
+				fmt.Println("Repair failed:", err)
+				os.Exit(1)
+			}
+			if err := disk.RebuildBTree(); err != nil {
+				fmt.Println("Repair failed:", err)
+				os.Exit(1)
+			}
+			fmt.Println("Bitmap and indexes rebuilt from the inode table, checking again")
+			report = disk.Check()
+			printFsckReport(report)
+		}
+
+		if !report.Clean() {
+			os.Exit(1)
+		}
+	},
+}
+
+func printFsckReport(report *fs.FsckReport) {
+	for _, problem := range report.Problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("%d inodes in use, %d pages in use, %d problems\n", report.InodesInUse, report.PagesInUse, len(report.Problems))
+}
+
+func init() {
+	rootCmd.AddCommand(fsckCmd)
+
+	fsckCmd.Flags().StringVarP(&fsckFilePath, "file", "f", "", "Path to the .vdsk file")
+	fsckCmd.Flags().BoolVar(&repair, "repair", false, "Rebuild the bitmap and the indexes from the inode table")
+	fsckCmd.MarkFlagRequired("file")
+}
@@ -5,6 +5,8 @@ package cmd
 
 import (
 	"fmt"
+	"github.com/Yashasv-Prajapati/vantadb/internal/codec"
+	"github.com/Yashasv-Prajapati/vantadb/internal/crypt"
 	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
 
 	"github.com/spf13/cobra"
@@ -18,15 +20,75 @@ var initCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		filePath := args[0]
-		err := fs.CreateVDSKStorageData(filePath)
+		engine, err := fs.ParseEngine(engineName)
 		if err != nil {
 			fmt.Printf("Failed to create disk: %v\n", err)
 			return
 		}
+		c, err := codec.ByName(compression)
+		if err != nil {
+			fmt.Printf("Failed to create disk: %v\n", err)
+			return
+		}
+		// lsm tables are read a block at a time, they are never compressed as a whole
+		if c != nil && engine == fs.ENGINE_LSM {
+			fmt.Println("Failed to create disk: compression is only supported by the inode engine")
+			return
+		}
+		// a key in the environment doesn't encrypt a disk by itself
+		var key *crypt.Key
+		if encrypt {
+			key, err = crypt.LoadKey(keyFile)
+			if err != nil {
+				fmt.Printf("Failed to create disk: %v\n", err)
+				return
+			}
+			if key == nil {
+				fmt.Printf("Failed to create disk: --encrypt needs a key, from --key-file or $%s\n", crypt.KEY_ENV)
+				return
+			}
+		}
+		err = fs.CreateVDSKStorageData(filePath, pageSize, engine)
+		if err != nil {
+			fmt.Printf("Failed to create disk: %v\n", err)
+			return
+		}
+		// before anything mounts it, the first mount already writes the indexes to data pages
+		if key != nil {
+			if err := fs.EncryptNewDisk(filePath, key); err != nil {
+				fmt.Printf("Failed to encrypt disk: %v\n", err)
+				return
+			}
+		}
+		if c != nil {
+			if err := setCompression(filePath, key, c.ID(), compressMin); err != nil {
+				fmt.Printf("Failed to set compression: %v\n", err)
+				return
+			}
+		}
 		fmt.Println("Disk created:", args[0])
 	},
 }
 
+var pageSize int
+var engineName string
+var compression string
+var compressMin int
+var encrypt bool
+
+// setCompression records the codec and threshold in the superblock of a new disk
+func setCompression(filePath string, key *crypt.Key, codecID byte, minSize int) error {
+	disk, err := fs.Mount(filePath, fs.MountOptions{Key: key})
+	if err != nil {
+		return err
+	}
+	if err := disk.SetCompression(codecID, minSize); err != nil {
+		disk.Close()
+		return err
+	}
+	return disk.Close()
+}
+
 func init() {
 	rootCmd.AddCommand(initCmd)
 
@@ -39,4 +101,9 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// initCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	initCmd.Flags().IntVar(&pageSize, "page-size", fs.DEFAULT_PAGE_SIZE, "Page size in bytes, a power of two between 512 and 65536")
+	initCmd.Flags().StringVar(&engineName, "engine", "inode", "Storage engine, inode or lsm")
+	initCmd.Flags().StringVar(&compression, "compression", "none", fmt.Sprintf("Codec values are compressed with, one of %v", codec.Names()))
+	initCmd.Flags().BoolVar(&encrypt, "encrypt", false, fmt.Sprintf("Encrypt the data pages and the WAL with the key from --key-file or $%s, the first %d bytes of each key stay readable in the inode table", crypt.KEY_ENV, fs.INLINE_KEY_SIZE))
+	initCmd.Flags().IntVar(&compressMin, "compress-min", 128, "Values smaller than this many bytes are stored uncompressed")
 }
@@ -6,35 +6,65 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/kv"
 
 	"github.com/spf13/cobra"
 )
 
+var keysFilePath string
+var keysStart string
+var keysEnd string
+var keysPrefix string
+var keysLimit int
+
 // keysCmd represents the keys command
 var keysCmd = &cobra.Command{
 	Use:   "keys",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+	Short: "Lists the keys of a disk in order",
+	Long: `Lists the keys of a .vdsk file in byte order, one per line. --start and --end bound the
+listing to start <= key < end, --prefix lists the keys starting with a prefix and --limit stops after
+that many keys. To page through the keys, start the next page right after the last key printed.`,
+	Args: cobra.ExactArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("keys called")
+		key, err := diskKey(keysFilePath)
+		if err != nil {
+			fmt.Println("Open failed:", err)
+			os.Exit(1)
+		}
+		db, err := kv.Open(keysFilePath, kv.Options{ReadOnly: true, Key: key})
+		if err != nil {
+			fmt.Println("Open failed:", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		start, end := keysStart, keysEnd
+		if keysPrefix != "" {
+			start, end = keysPrefix, kv.PrefixEnd(keysPrefix)
+		}
+
+		keys, err := db.Keys(start, end, keysLimit)
+		if err != nil {
+			fmt.Println("Listing keys failed:", err)
+			os.Exit(1)
+		}
+		for _, key := range keys {
+			fmt.Println(key)
+		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(keysCmd)
 
-	// Here you will define your flags and configuration settings.
-
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// keysCmd.PersistentFlags().String("foo", "", "A help for foo")
-
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// keysCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	keysCmd.Flags().StringVarP(&keysFilePath, "file", "f", "", "Path to the .vdsk file")
+	keysCmd.Flags().StringVar(&keysStart, "start", "", "First key to list")
+	keysCmd.Flags().StringVar(&keysEnd, "end", "", "List the keys before this one")
+	keysCmd.Flags().StringVar(&keysPrefix, "prefix", "", "List the keys starting with this prefix")
+	keysCmd.Flags().IntVarP(&keysLimit, "limit", "n", 0, "Maximum number of keys to list, 0 for all")
+	keysCmd.MarkFlagRequired("file")
+	keysCmd.MarkFlagsMutuallyExclusive("prefix", "start")
+	keysCmd.MarkFlagsMutuallyExclusive("prefix", "end")
 }
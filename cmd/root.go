@@ -5,11 +5,33 @@ Copyright © 2025 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"fmt"
 	"os"
 
+	"github.com/Yashasv-Prajapati/vantadb/internal/crypt"
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
 	"github.com/spf13/cobra"
 )
 
+// the file with the key of an encrypted disk, the environment has it otherwise
+var keyFile string
+
+// diskKey returns the key to open the disk at filePath with, nil if it isn't encrypted. The key is only
+// read for an encrypted disk, a key left in the environment doesn't get in the way of the others
+func diskKey(filePath string) (*crypt.Key, error) {
+	id, err := fs.ReadKeyID(filePath)
+	if err != nil || id == (crypt.KeyID{}) {
+		return nil, err
+	}
+	key, err := crypt.LoadKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("disk is encrypted with key %s, it is read from --key-file or $%s", id, crypt.KEY_ENV)
+	}
+	return key, nil
+}
 
 
 // rootCmd represents the base command when called without any subcommands
@@ -36,6 +58,7 @@ func init() {
 	// will be global for your application.
 
 	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.vantadb.yaml)")
+	rootCmd.PersistentFlags().StringVar(&keyFile, "key-file", "", "File with the hex key of an encrypted disk, defaults to $"+crypt.KEY_ENV)
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -5,10 +5,13 @@ package cmd
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
 	"github.com/Yashasv-Prajapati/vantadb/internal/kv"
 
@@ -18,18 +21,36 @@ import (
 
 var port int
 var filePath string
+var cachePages int
+var ioMode string
+var durability string
+var syncInterval int
+var readOnly bool
 
 // serveCmd represents the serve command
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Start the vantadb server",
 	Run: func(cmd *cobra.Command, args []string) {
-		disk, err := fs.Mount(filePath)
+		key, err := diskKey(filePath)
 		if err != nil {
-			log.Fatalf("Failed to mount disk: %v", err)
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		db, err := kv.Open(filePath, kv.Options{
+			BufferPoolPages: cachePages,
+			IO:              ioMode,
+			Durability:      durability,
+			SyncInterval:    time.Duration(syncInterval) * time.Millisecond,
+			ReadOnly:        readOnly,
+			Key:             key,
+		})
+		if err != nil {
+			log.Fatalf("Failed to open database: %v", err)
+		}
+		defer db.Close()
+		if replayed := db.DurabilityStats(); replayed.SkippedWrites > 0 {
+			log.Printf("%d of the %d writes replayed from the WAL could not be applied and are lost", replayed.SkippedWrites, replayed.ReplayedWrites)
 		}
-
-		kv.Init(disk)
 
 		http.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
 			key := r.URL.Query().Get("key")
@@ -37,7 +58,11 @@ var serveCmd = &cobra.Command{
 				http.Error(w, "Missing key", http.StatusBadRequest)
 				return
 			}
-			val, err := kv.Get(key)
+			val, err := db.Get(key)
+			if errors.Is(err, kv.ErrCorruptPage) {
+				http.Error(w, "Value is corrupted: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
 			if err != nil {
 				http.Error(w, "Key not found", http.StatusNotFound)
 				return
@@ -45,25 +70,112 @@ var serveCmd = &cobra.Command{
 			fmt.Fprint(w, val)
 		})
 
-		http.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
-			var payload struct {
-				Key   string `json:"key"`
-				Value string `json:"value"`
+		// /range?start=a&end=b&limit=10 or /range?prefix=a, pairs ordered by key
+		// when the limit is hit, next is the start of the following page
+		http.HandleFunc("/range", func(w http.ResponseWriter, r *http.Request) {
+			query := r.URL.Query()
+			start, end := query.Get("start"), query.Get("end")
+			if prefix := query.Get("prefix"); prefix != "" {
+				start, end = prefix, kv.PrefixEnd(prefix)
+			}
+
+			limit := 0
+			if query.Get("limit") != "" {
+				var err error
+				limit, err = strconv.Atoi(query.Get("limit"))
+				if err != nil || limit < 0 {
+					http.Error(w, "Invalid limit", http.StatusBadRequest)
+					return
+				}
 			}
-			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-				http.Error(w, "Invalid JSON", http.StatusBadRequest)
+
+			pairs, err := db.Range(start, end, limit)
+			if err != nil {
+				http.Error(w, "Failed to scan keys: "+err.Error(), http.StatusInternalServerError)
 				return
 			}
-			_, err := kv.Set(payload.Key, payload.Value)
+
+			var response struct {
+				Pairs []kv.KeyValue `json:"pairs"`
+				Next  string        `json:"next,omitempty"`
+			}
+			response.Pairs = pairs
+			if limit > 0 && len(pairs) == limit {
+				response.Next = pairs[len(pairs)-1].Key + "\x00" // smallest key after the last one
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(response)
+		})
+
+		// /stats, hits and misses of the buffer pool to size it with --cache-pages, the durability and
+		// how well values compress
+		http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+			stats := db.BufferPoolStats()
+			compression, err := db.CompressionStats()
 			if err != nil {
-				errmsg := "Failed to set value: " + string(err.Error())
-				http.Error(w, errmsg, http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			// fmt.Println(msg)
-			w.WriteHeader(http.StatusOK)
+			response := struct {
+				BufferPool  fs.BufferPoolStats   `json:"buffer_pool"`
+				HitRate     float64              `json:"hit_rate"`
+				Durability  kv.DurabilityStats   `json:"durability"`
+				Compression kv.CompressionStats `json:"compression"`
+			}{stats, stats.HitRate(), db.DurabilityStats(), compression}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(response)
 		})
 
+		// a read-only server only has the read endpoints
+		if !readOnly {
+			// /set?durability=none overrides --durability for this write
+			http.HandleFunc("/set", func(w http.ResponseWriter, r *http.Request) {
+				writeDurability := r.URL.Query().Get("durability")
+				if writeDurability != "" {
+					if err := kv.ValidateDurability(writeDurability); err != nil {
+						http.Error(w, err.Error(), http.StatusBadRequest)
+						return
+					}
+				}
+				var payload struct {
+					Key   string `json:"key"`
+					Value string `json:"value"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+					http.Error(w, "Invalid JSON", http.StatusBadRequest)
+					return
+				}
+				_, err := db.SetWithDurability(payload.Key, payload.Value, writeDurability)
+				if err != nil {
+					errmsg := "Failed to set value: " + string(err.Error())
+					http.Error(w, errmsg, http.StatusInternalServerError)
+					return
+				}
+				// fmt.Println(msg)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			// POST /admin/compact defragments the disk, reads and writes are served while it runs
+			http.HandleFunc("/admin/compact", func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost {
+					http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+					return
+				}
+				report, err := db.Compact()
+				if errors.Is(err, kv.ErrCompacting) {
+					http.Error(w, err.Error(), http.StatusConflict)
+					return
+				}
+				if err != nil {
+					http.Error(w, "Compaction failed: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(report)
+			})
+		}
+
 		go func() {
 			addr := fmt.Sprintf(":%d", port)
 			fmt.Println("Serving on http://localhost" + addr)
@@ -102,7 +214,7 @@ var serveCmd = &cobra.Command{
 					return
 				}
 				key := parts[1]
-				value, err := kv.Get(key)
+				value, err := db.Get(key)
 				if err != nil {
 					fmt.Printf("could not get key value: %v", err)
 					continue
@@ -116,12 +228,35 @@ var serveCmd = &cobra.Command{
 				}
 				key := parts[1]
 				value := parts[2]
-				msg, err := kv.Set(key, value)
+				msg, err := db.Set(key, value)
 				if err != nil {
 					fmt.Printf("could not set key value: %v\n", err)
 					continue
 				}
 				fmt.Println(msg)
+
+			case "stats":
+				stats := db.BufferPoolStats()
+				fmt.Printf("buffer pool: %d/%d pages, %d dirty, %d hits, %d misses (%.1f%% hit rate), %d evictions, %d write backs\n",
+					stats.Pages, stats.Capacity, stats.Dirty, stats.Hits, stats.Misses, 100*stats.HitRate(), stats.Evictions, stats.WriteBacks)
+				durabilityStats := db.DurabilityStats()
+				fmt.Printf("durability: %s, sync interval %dms, %d WAL syncs, %d writes replayed on open, %d skipped, %d torn bytes\n",
+					durabilityStats.Mode, durabilityStats.SyncIntervalMS, durabilityStats.WALSyncs,
+					durabilityStats.ReplayedWrites, durabilityStats.SkippedWrites, durabilityStats.TornBytes)
+				compression, err := db.CompressionStats()
+				if err != nil {
+					fmt.Printf("could not read compression stats: %v\n", err)
+					continue
+				}
+				printCompressionStats(compression)
+
+			case "compact":
+				report, err := db.Compact()
+				if err != nil {
+					fmt.Printf("could not compact: %v\n", err)
+					continue
+				}
+				printCompactReport(report)
 			default:
 				fmt.Println("unknown command")
 			}
@@ -136,5 +271,10 @@ func init() {
 
 	serveCmd.Flags().IntVarP(&port, "port", "p", 8080, "Port to run the server on")
 	serveCmd.Flags().StringVarP(&filePath, "file", "f", "", "Path to the .vdsk file")
+	serveCmd.Flags().IntVar(&cachePages, "cache-pages", fs.DEFAULT_BUFFER_POOL_PAGES, "Number of pages the buffer pool caches")
+	serveCmd.Flags().StringVar(&ioMode, "io", kv.IO_FILE, "How the disk file is accessed, file or mmap")
+	serveCmd.Flags().StringVar(&durability, "durability", kv.DURABILITY_ALWAYS, "When the WAL is synced: always, before a write is acknowledged, interval or none")
+	serveCmd.Flags().IntVar(&syncInterval, "sync-interval", int(kv.DEFAULT_SYNC_INTERVAL.Milliseconds()), "Milliseconds between syncs of the WAL with --durability=interval")
+	serveCmd.Flags().BoolVar(&readOnly, "read-only", false, "Mount the disk read-only and only serve reads, the file has to be a disk already")
 	serveCmd.MarkFlagRequired("file")
 }
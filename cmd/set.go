@@ -5,7 +5,6 @@ package cmd
 
 import (
 	"fmt"
-	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
 	"github.com/Yashasv-Prajapati/vantadb/internal/kv"
 
 	"github.com/spf13/cobra"
@@ -21,14 +20,19 @@ var setCmd = &cobra.Command{
 		key := args[1]
 		value := args[2]
 
-		disk, err := fs.Mount("")
+		encryptionKey, err := diskKey("")
 		if err != nil {
-			fmt.Println("Mount failed:", err)
+			fmt.Println("Open failed:", err)
 			return
 		}
-		kv.Init(disk)
+		db, err := kv.Open("", kv.Options{Key: encryptionKey})
+		if err != nil {
+			fmt.Println("Open failed:", err)
+			return
+		}
+		defer db.Close()
 
-		fmt.Println(kv.Set(key, value))
+		fmt.Println(db.Set(key, value))
 		// if err != nil || !ok {
 		// 	fmt.Println("Set failed:", err)
 		// } else {
@@ -0,0 +1,61 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/kv"
+
+	"github.com/spf13/cobra"
+)
+
+var statsFilePath string
+
+// statsCmd represents the stats command
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Shows how well the values of a disk compress",
+	Long: `Mounts a .vdsk file read-only and shows the codec new values are compressed with, how many
+values are compressed and how many bytes the values take on the disk against their real size.`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		key, err := diskKey(statsFilePath)
+		if err != nil {
+			fmt.Println("Open failed:", err)
+			os.Exit(1)
+		}
+		db, err := kv.Open(statsFilePath, kv.Options{ReadOnly: true, Key: key})
+		if err != nil {
+			fmt.Println("Open failed:", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		stats, err := db.CompressionStats()
+		if err != nil {
+			fmt.Println("Reading stats failed:", err)
+			os.Exit(1)
+		}
+		printCompressionStats(stats)
+	},
+}
+
+func printCompressionStats(stats kv.CompressionStats) {
+	if stats.Codec == "none" {
+		fmt.Println("compression: none")
+	} else {
+		fmt.Printf("compression: %s, values of %d bytes or more\n", stats.Codec, stats.MinSize)
+	}
+	fmt.Printf("%d of %d values compressed, %d bytes stored for %d bytes of values, ratio %.2fx\n",
+		stats.Compressed, stats.Values, stats.StoredBytes, stats.LogicalBytes, stats.Ratio)
+}
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+
+	statsCmd.Flags().StringVarP(&statsFilePath, "file", "f", "", "Path to the .vdsk file")
+	statsCmd.MarkFlagRequired("file")
+}
@@ -0,0 +1,43 @@
+/*
+Copyright © 2025 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+
+	"github.com/spf13/cobra"
+)
+
+var upgradeFilePath string
+
+// upgradeCmd represents the upgrade command
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Upgrades a disk to the current on-disk format",
+	Long: `Rewrites a .vdsk file from an older on-disk format version to the current one.
+The disk must not be in use. The upgrade is done on a copy which replaces the original
+only once it is complete, and a backup of the original is kept next to it.`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		from, backupPath, err := fs.Upgrade(upgradeFilePath)
+		if err != nil {
+			fmt.Println("Upgrade failed:", err)
+			return
+		}
+		if backupPath == "" {
+			fmt.Printf("Disk is already at version %s\n", from[:])
+			return
+		}
+		fmt.Printf("Upgraded %s from version %s to %s, backup at %s\n", upgradeFilePath, from[:], fs.CURRENT_VERSION[:], backupPath)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(upgradeCmd)
+
+	upgradeCmd.Flags().StringVarP(&upgradeFilePath, "file", "f", "", "Path to the .vdsk file")
+	upgradeCmd.MarkFlagRequired("file")
+}
@@ -5,9 +5,7 @@ package cmd
 
 import (
 	"fmt"
-	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
 	"github.com/Yashasv-Prajapati/vantadb/internal/kv"
-	"github.com/Yashasv-Prajapati/vantadb/internal/wal"
 
 	"github.com/spf13/cobra"
 )
@@ -20,19 +18,29 @@ var walCmd = &cobra.Command{
 	Short: "Get WAL logs",
 	Args:  cobra.ExactArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
-		disk, err := fs.Mount("")
+		encryptionKey, err := diskKey("")
 		if err != nil {
-			fmt.Println("Mount failed:", err)
+			fmt.Println("Open failed:", err)
 			return
 		}
-		kv.Init(disk)
+		db, err := kv.Open("", kv.Options{Key: encryptionKey})
+		if err != nil {
+			fmt.Println("Open failed:", err)
+			return
+		}
+		defer db.Close()
 		
 		if recover {
-			kv.RecoverFromLogs()
+			db.RecoverFromLogs()
 			return
 		}
 
-		fmt.Println(wal.GetAllWALRecords())
+		records, err := db.WALRecords()
+		if err != nil {
+			fmt.Println("Reading WAL failed:", err)
+			return
+		}
+		fmt.Println(records)
 	},
 }
 
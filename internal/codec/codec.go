@@ -0,0 +1,133 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+/*
+Codecs compress values before they are written to the disk. Each codec has an ID, which is what the
+disk records, in the superblock for the codec new values are compressed with and in the inode of every
+compressed value, so a codec can never change its ID once values were written with it. IDs go up to
+MAX_ID, the inode only has room for that many, and NONE means the value is stored as it is.
+
+A codec is added by implementing Codec and registering it in an init function, like deflate below.
+*/
+const (
+	NONE    = 0
+	DEFLATE = 1
+	MAX_ID  = 3
+)
+
+// Codec compresses and decompresses values, it has to be safe for concurrent use
+type Codec interface {
+	ID() byte
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	// Decompress returns the size bytes data was compressed from, more or less of them is an error
+	Decompress(data []byte, size int) ([]byte, error)
+}
+
+var codecs = map[byte]Codec{}
+
+// Register makes a codec available by its ID and name, it panics on a taken or out of range ID
+func Register(c Codec) {
+	if c.ID() == NONE || c.ID() > MAX_ID {
+		panic(fmt.Sprintf("codec %s has ID %d, must be between 1 and %d", c.Name(), c.ID(), MAX_ID))
+	}
+	if other, ok := codecs[c.ID()]; ok {
+		panic(fmt.Sprintf("codec %s has the ID %d of %s", c.Name(), c.ID(), other.Name()))
+	}
+	codecs[c.ID()] = c
+}
+
+// ByID returns the codec with the given ID, nil for NONE
+func ByID(id byte) (Codec, error) {
+	if id == NONE {
+		return nil, nil
+	}
+	c, ok := codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %d", id)
+	}
+	return c, nil
+}
+
+// ByName returns the codec with the given name, nil for "none"
+func ByName(name string) (Codec, error) {
+	if name == "none" {
+		return nil, nil
+	}
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown codec %q, must be one of %v", name, Names())
+}
+
+// Names returns the name of every codec, "none" first and the rest by ID
+func Names() []string {
+	names := []string{"none"}
+	for id := byte(1); id <= MAX_ID; id++ {
+		if c, ok := codecs[id]; ok {
+			names = append(names, c.Name())
+		}
+	}
+	return names
+}
+
+// Name returns the name of the codec with the given ID, for printing
+func Name(id byte) string {
+	if id == NONE {
+		return "none"
+	}
+	if c, ok := codecs[id]; ok {
+		return c.Name()
+	}
+	return fmt.Sprintf("unknown (%d)", id)
+}
+
+// ----------------------------------- deflate -----------------------------------
+
+// deflate is compress/flate at the default level, JSON and text shrink a lot with it
+type deflate struct{}
+
+func init() {
+	Register(deflate{})
+}
+
+func (deflate) ID() byte     { return DEFLATE }
+func (deflate) Name() string { return "deflate" }
+
+func (deflate) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflate) Decompress(data []byte, size int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	// a corrupt value can't make us allocate more than it claims to hold
+	out := make([]byte, size)
+	if _, err := io.ReadFull(r, out); err != nil {
+		return nil, fmt.Errorf("could not inflate value: %v", err)
+	}
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		return nil, fmt.Errorf("inflated value is longer than %d bytes", size)
+	}
+	return out, nil
+}
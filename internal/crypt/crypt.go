@@ -0,0 +1,122 @@
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+/*
+Keys encrypt data pages and WAL records with AES-GCM. A key is 16, 24 or 32 random bytes, AES-128, 192
+or 256, written as hex in a key file or in the VANTADB_KEY environment variable, e.g. from
+`openssl rand -hex 32`.
+
+Every sealed message is the NONCE_SIZE bytes of a random nonce, the ciphertext and the TAG_SIZE bytes of
+the tag, OVERHEAD bytes longer than the plaintext. The key itself is never stored, only its ID, the
+first 8 bytes of a SHA-256 of it, which tells a wrong key from a corrupted page.
+*/
+const (
+	NONCE_SIZE = 12
+	TAG_SIZE   = 16
+	OVERHEAD   = NONCE_SIZE + TAG_SIZE
+
+	KEY_ENV = "VANTADB_KEY"
+)
+
+var ErrDecrypt = errors.New("message doesn't decrypt, wrong key or corrupted")
+
+// KeyID names a key without giving it away, the zero ID is no key
+type KeyID [8]byte
+
+func (id KeyID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Key is an AES-GCM key, it is safe for concurrent use
+type Key struct {
+	ID   KeyID
+	aead cipher.AEAD
+}
+
+// NewKey returns the key of 16, 24 or 32 raw bytes
+func NewKey(raw []byte) (*Key, error) {
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, fmt.Errorf("key must be 16, 24 or 32 bytes, got %d", len(raw))
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// the ID is hashed with a label, it can't be mistaken for a hash of the key used somewhere else
+	sum := sha256.Sum256(append([]byte("vantadb key id\x00"), raw...))
+	key := &Key{aead: aead}
+	copy(key.ID[:], sum[:])
+	return key, nil
+}
+
+// ParseKey returns the key written as hex in text, surrounding whitespace is ignored
+func ParseKey(text string) (*Key, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return nil, fmt.Errorf("key must be written in hex: %v", err)
+	}
+	return NewKey(raw)
+}
+
+// ReadKeyFile returns the key in the file at path
+func ReadKeyFile(path string) (*Key, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read key file: %v", err)
+	}
+	key, err := ParseKey(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
+
+// LoadKey returns the key in the file at path, or in KEY_ENV if path is empty, nil if neither has one
+func LoadKey(path string) (*Key, error) {
+	if path != "" {
+		return ReadKeyFile(path)
+	}
+	text, ok := os.LookupEnv(KEY_ENV)
+	if !ok || strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	key, err := ParseKey(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", KEY_ENV, err)
+	}
+	return key, nil
+}
+
+// Seal encrypts plaintext, additionalData is authenticated with it and has to be given to Open again
+func (k *Key) Seal(plaintext []byte, additionalData []byte) ([]byte, error) {
+	sealed := make([]byte, NONCE_SIZE, NONCE_SIZE+len(plaintext)+TAG_SIZE)
+	if _, err := rand.Read(sealed); err != nil {
+		return nil, fmt.Errorf("could not make a nonce: %v", err)
+	}
+	return k.aead.Seal(sealed, sealed[:NONCE_SIZE], plaintext, additionalData), nil
+}
+
+// Open decrypts what Seal returned, ErrDecrypt if it was sealed with another key or changed since
+func (k *Key) Open(sealed []byte, additionalData []byte) ([]byte, error) {
+	if len(sealed) < OVERHEAD {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := k.aead.Open(nil, sealed[:NONCE_SIZE], sealed[NONCE_SIZE:], additionalData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
@@ -1,27 +1,91 @@
 package fs
 
-// size of bitmap - 512B - 1page - 512 * 8 = 4096 bits
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// each bitmap page is page size bytes = 512 * 8 = 4096 bits with 512B pages, so one bitmap page tracks 4096 data pages
+// the bitmap spans SuperBlock.BitmapPages pages and grows together with the disk
+const (
+	// data page 0 is never handed out, so a page number of 0 can mean "no page" in inodes and indirect pages
+	RESERVED_PAGES = 1
+
+	// the bitmap is searched 64 pages, one word, at a time, and summarized in groups of 512 pages
+	WORD_PAGES  = 64
+	GROUP_PAGES = 8 * WORD_PAGES
+)
+
 type Bitmap struct {
-	bits [PAGE_SIZE]byte
+	bits     []byte
+	pages    int // number of data pages actually tracked, can be less than len(bits)*8
+	pageSize int
+
+	// in memory only, see extent allocation below
+	hint    int            // next-fit, the page after the last one allocated
+	summary []groupSummary // one for every GROUP_PAGES pages, nil until the first search
 }
 
-func NewBitmap() *Bitmap {
+func NewBitmap(dataPages int, pageSize int) *Bitmap {
 	return &Bitmap{
-		bits: [512]byte{0},
+		bits:     make([]byte, bitmapPagesFor(dataPages, pageSize)*pageSize),
+		pages:    dataPages,
+		pageSize: pageSize,
 	}
 }
 
-func ReadBitmap(dataBytes []byte, superblock *SuperBlock) *Bitmap {
+func ReadBitmap(r io.ReaderAt, superblock *SuperBlock) (*Bitmap, error) {
 
 	offset := superblock.BitmapStartOffset
 
-	bitmapdata := make([]byte, PAGE_SIZE)
+	bitmapdata := make([]byte, superblock.BitmapPageCount()*int(superblock.Pagesize))
+
+	_, err := r.ReadAt(bitmapdata, int64(offset))
+	if err != nil {
+		return nil, fmt.Errorf("could not read bitmap: %v", err)
+	}
+
+	// never track more pages than the bitmap has bits for
+	pages := superblock.DataPageCount()
+	if pages > len(bitmapdata)*8 {
+		pages = len(bitmapdata) * 8
+	}
 
-	copy(bitmapdata[:], dataBytes[offset:offset+PAGE_SIZE])
 	return &Bitmap{
-		bits: [512]byte(bitmapdata),
+		bits:     bitmapdata,
+		pages:    pages,
+		pageSize: int(superblock.Pagesize),
+	}, nil
+
+}
+
+// bitmapPagesFor returns the number of bitmap pages needed to track dataPages pages
+func bitmapPagesFor(dataPages int, pageSize int) int {
+	bitsPerPage := pageSize * 8
+	pages := (dataPages + bitsPerPage - 1) / bitsPerPage // ceil division
+	if pages == 0 {
+		pages = 1
+	}
+	return pages
+}
+
+// Resize changes the number of data pages tracked by the bitmap, the new pages start as free
+func (bm *Bitmap) Resize(dataPages int) {
+	needed := bitmapPagesFor(dataPages, bm.pageSize) * bm.pageSize
+	if needed > len(bm.bits) {
+		bits := make([]byte, needed)
+		copy(bits, bm.bits)
+		bm.bits = bits
 	}
+	bm.pages = dataPages
+	bm.summary = nil // the last group changed size
+}
 
+// Pages returns the number of data pages tracked by the bitmap
+func (bm *Bitmap) Pages() int {
+	return bm.pages
 }
 
 func (bm *Bitmap) AllocatePage(position int) {
@@ -35,6 +99,8 @@ func (bm *Bitmap) AllocatePage(position int) {
 	// set bit as index -> position
 	bm.bits[byteIndex] |= (1 << bitIndex)
 
+	bm.hint = position + 1
+	bm.touch(position)
 }
 
 func (bm *Bitmap) FreePage(position int) {
@@ -48,6 +114,12 @@ func (bm *Bitmap) FreePage(position int) {
 	// set bit as index -> position
 	bm.bits[byteIndex] &= ^(1 << bitIndex)
 
+	bm.touch(position)
+}
+
+// IsAllocated reports whether the page is marked as used
+func (bm *Bitmap) IsAllocated(position int) bool {
+	return bm.bits[position/8]&(1<<(position%8)) != 0
 }
 
 func (bm *Bitmap) GetBits() []byte {
@@ -57,13 +129,12 @@ func (bm *Bitmap) GetBits() []byte {
 // FindFreePages returns a slice of free page indices. If numberOfPages <= 0, returns all free pages. Else if numberOfPages > free pages, gives error
 func (bm *Bitmap) FindFreePages(numberOfPages int) []int {
 	freePages := []int{}
-	for i := 0; i < len(bm.bits)*8; i++ {
-		byteIndex := i / 8
-		bitIndex := i % 8
-		if (bm.bits[byteIndex] & (1 << bitIndex)) == 0 {
-			freePages = append(freePages, i)
+	for w := 0; w < bm.words(); w++ {
+		// every set bit of the inverted word is a free page
+		for free := ^bm.word(w); free != 0; free &= free - 1 {
+			freePages = append(freePages, w*WORD_PAGES+bits.TrailingZeros64(free))
 			if numberOfPages > 0 && len(freePages) == numberOfPages {
-				break
+				return freePages
 			}
 		}
 	}
@@ -76,12 +147,184 @@ func (bm *Bitmap) FindFreePages(numberOfPages int) []int {
 }
 
 func (bm *Bitmap) FindFreePage() int {
-	for i := 0; i < len(bm.bits)*8; i++ {
-		byteIndex := i / 8
-		bitIndex := i % 8
-		if (bm.bits[byteIndex] & (1 << bitIndex)) == 0 {
-			return i
+	for w := 0; w < bm.words(); w++ {
+		if free := ^bm.word(w); free != 0 {
+			return w*WORD_PAGES + bits.TrailingZeros64(free)
 		}
 	}
 	return -1 // no free page found
 }
+
+/*
+Extent allocation.
+
+A value is best kept in one extent, a run of contiguous pages, so FindFreeExtent looks for a run that
+holds all of its pages. Searching bit by bit would be O(pages) for every allocation, so the bitmap is
+read a 64 bit word at a time, and every GROUP_PAGES pages are summarized: how many pages are free, the
+longest free run, and the free runs at the start and the end of the group, which is all it takes to
+find runs that cross into the next group. A group with no run long enough is skipped without looking
+at its words. Summaries are only kept in memory, they are computed when a search first needs them and
+dropped when a page of their group is allocated or freed.
+
+FindFreeExtent is next-fit, it starts at the group of the page after the last allocation and wraps
+around, so consecutive allocations don't scan the same full groups at the front again and again.
+FindFreeRun always returns the lowest run, which is what compaction wants.
+*/
+
+type groupSummary struct {
+	fresh   bool
+	free    int // free pages in the group
+	longest int // longest run of free pages inside the group
+	head    int // free pages at the start of the group
+	tail    int // free pages at the end of the group
+}
+
+func (bm *Bitmap) words() int {
+	return (bm.pages + WORD_PAGES - 1) / WORD_PAGES
+}
+
+func (bm *Bitmap) groups() int {
+	return (bm.pages + GROUP_PAGES - 1) / GROUP_PAGES
+}
+
+// word returns the bits of the pages w*64 to w*64+63, pages that can't be handed out, the reserved
+// ones and those past the end, read as used
+func (bm *Bitmap) word(w int) uint64 {
+	word := binary.LittleEndian.Uint64(bm.bits[w*8:])
+	if w == 0 {
+		word |= 1<<RESERVED_PAGES - 1
+	}
+	if end := bm.pages - w*WORD_PAGES; end < WORD_PAGES {
+		word |= ^uint64(0) << max(end, 0)
+	}
+	return word
+}
+
+// touch drops the summary of the group holding position
+func (bm *Bitmap) touch(position int) {
+	if g := position / GROUP_PAGES; g < len(bm.summary) {
+		bm.summary[g].fresh = false
+	}
+}
+
+// group returns the summary of group g, computing it if it isn't fresh
+func (bm *Bitmap) group(g int) groupSummary {
+	if len(bm.summary) != bm.groups() {
+		bm.summary = make([]groupSummary, bm.groups())
+	}
+	if bm.summary[g].fresh {
+		return bm.summary[g]
+	}
+
+	s := groupSummary{fresh: true}
+	run, head := 0, true
+	for w := g * GROUP_PAGES / WORD_PAGES; w < (g+1)*GROUP_PAGES/WORD_PAGES; w++ {
+		word := bm.word(w)
+		s.free += WORD_PAGES - bits.OnesCount64(word)
+		switch word {
+		case 0:
+			run += WORD_PAGES
+		case ^uint64(0):
+			s.longest = max(s.longest, run)
+			if head {
+				s.head, head = run, false
+			}
+			run = 0
+		default:
+			for b := 0; b < WORD_PAGES; b++ {
+				if word&(1<<b) == 0 {
+					run++
+					continue
+				}
+				s.longest = max(s.longest, run)
+				if head {
+					s.head, head = run, false
+				}
+				run = 0
+			}
+		}
+	}
+	s.longest = max(s.longest, run)
+	if head {
+		s.head = run
+	}
+	s.tail = run
+
+	bm.summary[g] = s
+	return s
+}
+
+// FreePageCount returns how many pages can still be handed out
+func (bm *Bitmap) FreePageCount() int {
+	free := 0
+	for g := 0; g < bm.groups(); g++ {
+		free += bm.group(g).free
+	}
+	return free
+}
+
+// FindFreeRun returns the first of the lowest numberOfPages contiguous free pages, -1 if there is no such run
+func (bm *Bitmap) FindFreeRun(numberOfPages int) int {
+	return bm.findRun(numberOfPages, 0)
+}
+
+// FindFreeExtent returns the first of numberOfPages contiguous free pages, searching from the next-fit
+// hint on, -1 if there is no such run
+func (bm *Bitmap) FindFreeExtent(numberOfPages int) int {
+	if start := bm.findRun(numberOfPages, bm.hint/GROUP_PAGES); start >= 0 {
+		return start
+	}
+	return bm.findRun(numberOfPages, 0)
+}
+
+// findRun returns the first run of n free pages that starts in group first or after it
+func (bm *Bitmap) findRun(n int, first int) int {
+	if n <= 0 {
+		return -1
+	}
+	run, runStart := 0, 0 // free pages at the end of the groups before
+	for g := first; g < bm.groups(); g++ {
+		s := bm.group(g)
+		start := g * GROUP_PAGES
+		if run == 0 {
+			runStart = start
+		}
+		switch {
+		case run+s.head >= n:
+			return runStart
+		case s.longest >= n:
+			return bm.scanRun(start, n)
+		case s.head == GROUP_PAGES:
+			run += GROUP_PAGES
+		default:
+			run, runStart = s.tail, start+GROUP_PAGES-s.tail
+		}
+	}
+	return -1
+}
+
+// scanRun returns the first run of n free pages in the group starting at page start, the caller knows
+// there is one
+func (bm *Bitmap) scanRun(start int, n int) int {
+	run, runStart := 0, start
+	for w := start / WORD_PAGES; w < (start+GROUP_PAGES)/WORD_PAGES; w++ {
+		word := bm.word(w)
+		if word == ^uint64(0) {
+			run = 0
+			continue
+		}
+		for b := 0; b < WORD_PAGES; b++ {
+			if word&(1<<b) != 0 {
+				run = 0
+				continue
+			}
+			if run == 0 {
+				runStart = w*WORD_PAGES + b
+			}
+			if run++; run == n {
+				return runStart
+			}
+		}
+	}
+	return -1
+}
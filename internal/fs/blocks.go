@@ -0,0 +1,245 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+Block mapping for inodes.
+
+An inode with at most MAX_PAGES pages keeps all of its page numbers directly in PageNumbers, this is
+the layout every inode had before indirect pages existed, so older disks stay readable.
+
+A bigger value sets INODE_FLAG_INDIRECT and uses DIRECT_PAGES direct pointers, then a single indirect
+page and, if still needed, a double indirect page. An indirect page is just PointersPerPage uint32
+page numbers, 0 meaning empty, which is why data page 0 is never handed out by the bitmap.
+
+Values written now are mapped by extents when they can be, see extents.go, both layouts are read the
+same way through InodePages.
+*/
+
+// PointersPerPage returns how many page numbers fit in one indirect page
+func (disk *Disk) PointersPerPage() int {
+	return disk.PageSize() / 4 // each page number is a uint32
+}
+
+// MaxInodePages returns the number of data pages one inode can map
+func (disk *Disk) MaxInodePages() int {
+	pointers := disk.PointersPerPage()
+	return DIRECT_PAGES + pointers + pointers*pointers
+}
+
+// valueSize returns the size stored in the inode
+func (i *Inode) valueSize() int {
+	return int(binary.LittleEndian.Uint32(i.Size[:]))
+}
+
+// IndirectPagesNeeded returns how many indirect pages are needed to map dataPages data pages
+func (disk *Disk) IndirectPagesNeeded(dataPages int) int {
+	if dataPages <= MAX_PAGES {
+		return 0
+	}
+
+	pointers := disk.PointersPerPage()
+	rest := dataPages - DIRECT_PAGES - pointers
+	if rest <= 0 {
+		return 1 // only the single indirect page
+	}
+
+	// single indirect + double indirect + one single indirect page for each PointersPerPage pages left
+	return 2 + (rest+pointers-1)/pointers
+}
+
+// PagesNeeded returns how many data pages a value of size bytes needs
+func (disk *Disk) PagesNeeded(size int) int {
+	return (size + disk.PageSize() - 1) / disk.PageSize() // ceil division
+}
+
+// InodePages returns the data pages of an inode in order, and the indirect or extent pages used to map them
+func (disk *Disk) InodePages(inode *Inode) ([]int, []int, error) {
+	if inode.Inline() {
+		return []int{}, []int{}, nil // see inline.go
+	}
+	if inode.Flags[0]&INODE_FLAG_EXTENTS != 0 {
+		return disk.extentPages(inode)
+	}
+
+	dataPages := []int{}
+	indirectPages := []int{}
+
+	if inode.Flags[0]&INODE_FLAG_INDIRECT == 0 {
+		for i := 0; i < int(inode.NumberofPages[0]) && i < MAX_PAGES; i++ {
+			dataPages = append(dataPages, int(inode.PageNumbers[i]))
+		}
+		return dataPages, indirectPages, nil
+	}
+
+	pagesNeeded := disk.PagesNeeded(inode.valueSize())
+	for i := 0; i < DIRECT_PAGES && len(dataPages) < pagesNeeded; i++ {
+		dataPages = append(dataPages, int(inode.PageNumbers[i]))
+	}
+
+	if single := inode.PageNumbers[SINGLE_INDIRECT]; single != 0 && len(dataPages) < pagesNeeded {
+		pointers, err := disk.readPointerPage(int(single))
+		if err != nil {
+			return nil, nil, err
+		}
+		indirectPages = append(indirectPages, int(single))
+		dataPages = appendPointers(dataPages, pointers, pagesNeeded)
+	}
+
+	if double := inode.PageNumbers[DOUBLE_INDIRECT]; double != 0 && len(dataPages) < pagesNeeded {
+		children, err := disk.readPointerPage(int(double))
+		if err != nil {
+			return nil, nil, err
+		}
+		indirectPages = append(indirectPages, int(double))
+
+		for _, child := range children {
+			if child == 0 || len(dataPages) >= pagesNeeded {
+				break
+			}
+			pointers, err := disk.readPointerPage(int(child))
+			if err != nil {
+				return nil, nil, err
+			}
+			indirectPages = append(indirectPages, int(child))
+			dataPages = appendPointers(dataPages, pointers, pagesNeeded)
+		}
+	}
+
+	if len(dataPages) != pagesNeeded {
+		return nil, nil, fmt.Errorf("inode maps %d pages, expected %d", len(dataPages), pagesNeeded)
+	}
+
+	return dataPages, indirectPages, nil
+}
+
+// MapInodePages points the inode at dataPages, as extents or page numbers, writing mapPages as an extent
+// page or as pointer pages when the inode can't hold them. len(mapPages) must be MapPagesNeeded(dataPages)
+func (disk *Disk) MapInodePages(inode *Inode, dataPages []int, mapPages []int) error {
+	if len(dataPages) > disk.MaxInodePages() {
+		return fmt.Errorf("value needs %d pages, inode can map at most %d", len(dataPages), disk.MaxInodePages())
+	}
+	if len(mapPages) != disk.MapPagesNeeded(dataPages) {
+		return fmt.Errorf("got %d pages to map the value, need %d", len(mapPages), disk.MapPagesNeeded(dataPages))
+	}
+
+	inode.PageNumbers = [MAX_PAGES]uint32{}
+	inode.Flags[0] &^= INODE_FLAG_INDIRECT | INODE_FLAG_EXTENTS | INODE_FLAG_INLINE
+
+	extents := Extents(dataPages)
+	switch {
+	case len(extents) <= INLINE_EXTENTS:
+		return disk.mapExtents(inode, extents, 0)
+	case len(dataPages) <= MAX_PAGES:
+		return disk.mapBlocks(inode, dataPages, nil)
+	case len(extents) <= disk.ExtentsPerPage():
+		return disk.mapExtents(inode, extents, mapPages[0])
+	default:
+		return disk.mapBlocks(inode, dataPages, mapPages)
+	}
+}
+
+// mapBlocks points the inode at dataPages by page number, with indirectPages as pointer pages when the
+// value doesn't fit in the direct pointers
+func (disk *Disk) mapBlocks(inode *Inode, dataPages []int, indirectPages []int) error {
+	if len(dataPages) <= MAX_PAGES {
+		for i, page := range dataPages {
+			inode.PageNumbers[i] = uint32(page)
+		}
+		inode.NumberofPages[0] = byte(len(dataPages))
+		return nil
+	}
+
+	inode.Flags[0] |= INODE_FLAG_INDIRECT
+	for i := 0; i < DIRECT_PAGES; i++ {
+		inode.PageNumbers[i] = uint32(dataPages[i])
+	}
+	rest := dataPages[DIRECT_PAGES:]
+
+	// single indirect
+	pointers := disk.PointersPerPage()
+	n := min(len(rest), pointers)
+	if err := disk.writePointerPage(indirectPages[0], rest[:n]); err != nil {
+		return err
+	}
+	inode.PageNumbers[SINGLE_INDIRECT] = uint32(indirectPages[0])
+	inode.NumberofPages[0] = SINGLE_INDIRECT + 1
+	rest = rest[n:]
+	indirectPages = indirectPages[1:]
+
+	if len(rest) == 0 {
+		return nil
+	}
+
+	// double indirect
+	double := indirectPages[0]
+	indirectPages = indirectPages[1:]
+	children := []int{}
+	for len(rest) > 0 {
+		n := min(len(rest), pointers)
+		if err := disk.writePointerPage(indirectPages[0], rest[:n]); err != nil {
+			return err
+		}
+		children = append(children, indirectPages[0])
+		indirectPages = indirectPages[1:]
+		rest = rest[n:]
+	}
+	if err := disk.writePointerPage(double, children); err != nil {
+		return err
+	}
+	inode.PageNumbers[DOUBLE_INDIRECT] = uint32(double)
+	inode.NumberofPages[0] = DOUBLE_INDIRECT + 1
+
+	return nil
+}
+
+// FreeInodePages marks every page of the inode, data, indirect and extent pages, as free in the bitmap
+func (disk *Disk) FreeInodePages(inode *Inode) error {
+	dataPages, indirectPages, err := disk.InodePages(inode)
+	if err != nil {
+		return err
+	}
+
+	for _, page := range dataPages {
+		disk.Bitmap.FreePage(page)
+	}
+	for _, page := range indirectPages {
+		disk.Bitmap.FreePage(page)
+	}
+	return nil
+}
+
+func (disk *Disk) readPointerPage(pageNumber int) ([]uint32, error) {
+	data, err := disk.ReadPageFromDisk(pageNumber)
+	if err != nil {
+		return nil, fmt.Errorf("could not read indirect page %d: %w", pageNumber, err)
+	}
+
+	pointers := make([]uint32, disk.PointersPerPage())
+	for i := range pointers {
+		pointers[i] = binary.LittleEndian.Uint32(data[i*4 : i*4+4])
+	}
+	return pointers, nil
+}
+
+func (disk *Disk) writePointerPage(pageNumber int, pointers []int) error {
+	data := disk.NewPage()
+	for i, pointer := range pointers {
+		binary.LittleEndian.PutUint32(data[i*4:i*4+4], uint32(pointer))
+	}
+	return disk.WritePageToDisk(pageNumber, data)
+}
+
+// appendPointers appends non zero pointers to pages until it holds limit pages
+func appendPointers(pages []int, pointers []uint32, limit int) []int {
+	for _, pointer := range pointers {
+		if pointer == 0 || len(pages) >= limit {
+			break
+		}
+		pages = append(pages, int(pointer))
+	}
+	return pages
+}
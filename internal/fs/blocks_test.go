@@ -0,0 +1,125 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+)
+
+// putScattered stores value on every other free page, with the pages in between held back while it is
+// allocated, so its pages are as far from one extent as they get
+func putScattered(t *testing.T, disk *Disk, key string, value []byte) int {
+	t.Helper()
+
+	held := []int{}
+	for i, page := range disk.Bitmap.FindFreePages(0) {
+		if i%2 == 1 {
+			disk.Bitmap.AllocatePage(page)
+			held = append(held, page)
+		}
+	}
+	idx := putValue(t, disk, key, value)
+	for _, page := range held {
+		disk.Bitmap.FreePage(page)
+	}
+	if err := disk.WriteBitmapToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+// patterned returns pages pages of bytes that differ from one page to the next
+func patterned(pages int, pageSize int) []byte {
+	value := make([]byte, pages*pageSize)
+	for i := range value {
+		value[i] = byte(i/pageSize + i%7)
+	}
+	return value
+}
+
+func TestIndirectBlocks(t *testing.T) {
+	device := NewMemoryDevice(nil)
+	if err := FormatDevice(device, 512, ENGINE_INODE); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := MountDevice(device, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pointers := disk.PointersPerPage()
+
+	// too many extents for an extent page, the pages are mapped one by one
+	values := map[string][]byte{
+		"single": patterned(DIRECT_PAGES+pointers, 512),    // the direct pages and one pointer page
+		"double": patterned(DIRECT_PAGES+pointers+70, 512), // and the double indirect page with one child
+	}
+	for key, value := range values {
+		idx := putScattered(t, disk, key, value)
+		pages, indirect, err := disk.InodePages(disk.Inodes[idx])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if disk.Inodes[idx].Flags[0]&INODE_FLAG_INDIRECT == 0 {
+			t.Fatalf("%s isn't mapped with indirect pages", key)
+		}
+		if len(pages) != len(value)/512 || len(indirect) != disk.IndirectPagesNeeded(len(pages)) {
+			t.Fatalf("%s maps %d pages with %d indirect ones, want %d with %d",
+				key, len(pages), len(indirect), len(value)/512, disk.IndirectPagesNeeded(len(pages)))
+		}
+	}
+	for key, value := range values {
+		if got := readValue(t, disk, key); !bytes.Equal(got, value) {
+			t.Fatalf("%s reads back %d bytes that differ, wrote %d", key, len(got), len(value))
+		}
+	}
+	if err := disk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	disk, err = MountDevice(device, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	for key, value := range values {
+		if got := readValue(t, disk, key); !bytes.Equal(got, value) {
+			t.Fatalf("%s reads back %d bytes that differ after a remount, wrote %d", key, len(got), len(value))
+		}
+	}
+	if report := disk.Check(); !report.Clean() {
+		t.Fatalf("fsck: %v", report.Problems)
+	}
+
+	// the pointer pages are freed with the value
+	free := disk.Bitmap.FreePageCount()
+	deleteValue(t, disk, "double")
+	pages := len(values["double"]) / 512
+	if freed := disk.Bitmap.FreePageCount() - free; freed != pages+disk.IndirectPagesNeeded(pages) {
+		t.Fatalf("deleting freed %d pages, the value had %d and %d indirect ones", freed, pages, disk.IndirectPagesNeeded(pages))
+	}
+	if report := disk.Check(); !report.Clean() {
+		t.Fatalf("fsck after the delete: %v", report.Problems)
+	}
+}
+
+// the largest value an inode maps reads back whole, one page more doesn't fit
+func TestMaxInodePages(t *testing.T) {
+	device := NewMemoryDevice(nil)
+	if err := FormatDevice(device, 512, ENGINE_INODE); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := MountDevice(device, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+
+	pointers := disk.PointersPerPage()
+	if want := DIRECT_PAGES + pointers + pointers*pointers; disk.MaxInodePages() != want {
+		t.Fatalf("an inode maps %d pages, want %d", disk.MaxInodePages(), want)
+	}
+	inode := disk.Inodes[0]
+	tooMany := make([]int, disk.MaxInodePages()+1)
+	if err := disk.MapInodePages(inode, tooMany, nil); err == nil {
+		t.Fatal("mapped more pages than an inode holds")
+	}
+}
@@ -0,0 +1,716 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/*
+B+tree of the keys, ordered by key bytes, for range scans. Point lookups go through the hash index.
+
+Every node is one data page:
+[0]   - BTREE_LEAF or BTREE_INTERNAL
+[1:3] - number of entries
+[3:7] - leaves: next leaf, 0 for the last one. internal nodes: child for keys before the first entry
+[7:]  - entries, sorted by key
+
+Leaf entry:     key length (2B), key, inode number (4B)
+Internal entry: key length (2B), key, [first overflow page (4B)], child for keys >= key (4B)
+
+A key longer than btreeMaxLocal only keeps its first btreeMaxLocal bytes in the node. The rest of a
+leaf key is read from the inode the entry points to. Internal keys are separators that no inode has
+to hold, a long one is stored whole in key overflow pages, like the long keys of inodes. Separators
+are kept as short as possible, so that is rare.
+
+A delete that leaves a node less than a quarter full merges it with a sibling when both fit in one
+page, the right one is freed and its separator removed from the parent, which can leave the parent
+underfull in turn. An empty leaf always fits, so it never stays in the chain. A root left without
+entries is freed, its only child becomes the root.
+
+SuperBlock.BTreePage points to a header page:
+[0:4]  - "BTRE"
+[4:8]  - root page
+[8:12] - digest of the inode table, see inodeDigest
+
+Nodes changed since the last WriteBTreeToDisk are only kept in memory. Like the hash index, the tree is
+written after the inodes and rebuilt on mount when the digest doesn't match, in memory only on a read-only
+mount, see allocIndexPages.
+*/
+
+const (
+	BTREE_LEAF        = 1
+	BTREE_INTERNAL    = 2
+	BTREE_NODE_HEADER = 7
+)
+
+var BTREE_MAGIC = [4]byte{'B', 'T', 'R', 'E'}
+
+type BTree struct {
+	header    int
+	root      int
+	dirty     map[int][]byte // nodes changed since the last write, by page
+	allocated bool           // pages were allocated or freed since the last write
+}
+
+type btreeNode struct {
+	page    int
+	leaf    bool
+	link    uint32 // leaves: next leaf, internal nodes: first child
+	entries []btreeEntry
+}
+
+type btreeEntry struct {
+	key      []byte // the key, or its first btreeMaxLocal bytes
+	keyLen   int
+	overflow uint32 // internal nodes only, first overflow page of a long key
+	ptr      uint32 // leaves: inode number, internal nodes: child
+}
+
+// KeyEntry is a key found by a range scan, and the inode holding it
+type KeyEntry struct {
+	Key   string
+	Inode int
+}
+
+// btreeMaxLocal returns how many bytes of a key are kept in a node, at least four entries fit in a page
+func (disk *Disk) btreeMaxLocal() int {
+	return disk.PageSize()/4 - 16
+}
+
+func (e btreeEntry) long() bool {
+	return e.keyLen > len(e.key)
+}
+
+func (disk *Disk) entrySize(leaf bool, e btreeEntry) int {
+	size := 2 + len(e.key) + 4
+	if !leaf && e.long() {
+		size += 4
+	}
+	return size
+}
+
+func (disk *Disk) nodeSize(node *btreeNode) int {
+	size := BTREE_NODE_HEADER
+	for _, e := range node.entries {
+		size += disk.entrySize(node.leaf, e)
+	}
+	return size
+}
+
+func (disk *Disk) encodeNode(node *btreeNode) []byte {
+	data := disk.NewPage()
+	data[0] = BTREE_INTERNAL
+	if node.leaf {
+		data[0] = BTREE_LEAF
+	}
+	binary.LittleEndian.PutUint16(data[1:3], uint16(len(node.entries)))
+	binary.LittleEndian.PutUint32(data[3:7], node.link)
+
+	offset := BTREE_NODE_HEADER
+	for _, e := range node.entries {
+		binary.LittleEndian.PutUint16(data[offset:], uint16(e.keyLen))
+		offset += 2
+		offset += copy(data[offset:], e.key)
+		if !node.leaf && e.long() {
+			binary.LittleEndian.PutUint32(data[offset:], e.overflow)
+			offset += 4
+		}
+		binary.LittleEndian.PutUint32(data[offset:], e.ptr)
+		offset += 4
+	}
+	return data
+}
+
+func (disk *Disk) decodeNode(page int, data []byte) (*btreeNode, error) {
+	if data[0] != BTREE_LEAF && data[0] != BTREE_INTERNAL {
+		return nil, fmt.Errorf("page %d is not a b+tree node", page)
+	}
+	node := &btreeNode{
+		page:    page,
+		leaf:    data[0] == BTREE_LEAF,
+		link:    binary.LittleEndian.Uint32(data[3:7]),
+		entries: make([]btreeEntry, binary.LittleEndian.Uint16(data[1:3])),
+	}
+
+	offset := BTREE_NODE_HEADER
+	for i := range node.entries {
+		if offset+2 > len(data) {
+			return nil, fmt.Errorf("b+tree node %d is corrupted", page)
+		}
+		e := btreeEntry{keyLen: int(binary.LittleEndian.Uint16(data[offset:]))}
+		offset += 2
+
+		localLen := min(e.keyLen, disk.btreeMaxLocal())
+		size := localLen + 4
+		if !node.leaf && e.keyLen > localLen {
+			size += 4
+		}
+		if offset+size > len(data) {
+			return nil, fmt.Errorf("b+tree node %d is corrupted", page)
+		}
+
+		e.key = append([]byte{}, data[offset:offset+localLen]...)
+		offset += localLen
+		if !node.leaf && e.long() {
+			e.overflow = binary.LittleEndian.Uint32(data[offset:])
+			offset += 4
+		}
+		e.ptr = binary.LittleEndian.Uint32(data[offset:])
+		offset += 4
+
+		node.entries[i] = e
+	}
+	return node, nil
+}
+
+func (disk *Disk) readNode(page int) (*btreeNode, error) {
+	data, ok := disk.BTree.dirty[page]
+	if !ok {
+		var err error
+		data, err = disk.ReadPageFromDisk(page)
+		if err != nil {
+			return nil, fmt.Errorf("could not read b+tree node %d: %w", page, err)
+		}
+	}
+	return disk.decodeNode(page, data)
+}
+
+func (disk *Disk) writeNode(node *btreeNode) {
+	disk.BTree.dirty[node.page] = disk.encodeNode(node)
+}
+
+func (disk *Disk) allocateNode(leaf bool) (*btreeNode, error) {
+	pages, err := disk.allocIndexPages(1)
+	if err != nil {
+		return nil, fmt.Errorf("could not allocate b+tree node: %v", err)
+	}
+	disk.BTree.allocated = true
+
+	return &btreeNode{page: pages[0], leaf: leaf}, nil
+}
+
+// entryKey returns the whole key of an entry
+func (disk *Disk) entryKey(leaf bool, e btreeEntry) (string, error) {
+	if !e.long() {
+		return string(e.key), nil
+	}
+	if leaf {
+		return disk.InodeKey(disk.Inodes[e.ptr])
+	}
+	return disk.readKeyPages(e.overflow, e.keyLen)
+}
+
+// compareEntry compares key with the key of an entry, it only reads the whole key of a long entry
+// when key starts with its local bytes
+func (disk *Disk) compareEntry(key string, leaf bool, e btreeEntry) (int, error) {
+	if !e.long() {
+		return strings.Compare(key, string(e.key)), nil
+	}
+
+	n := min(len(key), len(e.key))
+	if c := strings.Compare(key[:n], string(e.key[:n])); c != 0 {
+		return c, nil
+	}
+	if len(key) <= len(e.key) {
+		return -1, nil // key is a prefix of the entry key
+	}
+
+	entryKey, err := disk.entryKey(leaf, e)
+	if err != nil {
+		return 0, err
+	}
+	return strings.Compare(key, entryKey), nil
+}
+
+// search returns the position of the first entry >= key, and whether it is equal to key
+func (disk *Disk) search(node *btreeNode, key string) (int, bool, error) {
+	var err error
+	found := false
+	pos := sort.Search(len(node.entries), func(i int) bool {
+		if err != nil {
+			return true
+		}
+		c, cerr := disk.compareEntry(key, node.leaf, node.entries[i])
+		if cerr != nil {
+			err = cerr
+			return true
+		}
+		if c == 0 {
+			found = true
+		}
+		return c <= 0
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return pos, found && pos < len(node.entries), nil
+}
+
+// child returns the position of the entry pointing to the child that covers key, -1 for node.link
+func (disk *Disk) child(node *btreeNode, key string) (int, uint32, error) {
+	pos, found, err := disk.search(node, key)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !found {
+		pos-- // the last entry < key
+	}
+	if pos < 0 {
+		return -1, node.link, nil
+	}
+	return pos, node.entries[pos].ptr, nil
+}
+
+// findLeaf walks down to the leaf that covers key, it returns the internal nodes on the way and the
+// position of the entry followed in each of them
+func (disk *Disk) findLeaf(key string) (*btreeNode, []*btreeNode, []int, error) {
+	path := []*btreeNode{}
+	positions := []int{}
+
+	node, err := disk.readNode(disk.BTree.root)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for !node.leaf {
+		pos, child, err := disk.child(node, key)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		path = append(path, node)
+		positions = append(positions, pos)
+
+		if node, err = disk.readNode(int(child)); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return node, path, positions, nil
+}
+
+// BTreeInsert adds key, held by inode inodeIndex, to the b+tree
+func (disk *Disk) BTreeInsert(key string, inodeIndex int) error {
+	leaf, path, positions, err := disk.findLeaf(key)
+	if err != nil {
+		return err
+	}
+
+	pos, found, err := disk.search(leaf, key)
+	if err != nil {
+		return err
+	}
+	if found {
+		leaf.entries[pos].ptr = uint32(inodeIndex)
+		disk.writeNode(leaf)
+		return nil
+	}
+
+	entry := btreeEntry{
+		key:    []byte(key[:min(len(key), disk.btreeMaxLocal())]),
+		keyLen: len(key),
+		ptr:    uint32(inodeIndex),
+	}
+	leaf.entries = append(leaf.entries[:pos], append([]btreeEntry{entry}, leaf.entries[pos:]...)...)
+
+	// split up the path as long as the node doesn't fit in its page
+	node := leaf
+	for disk.nodeSize(node) > disk.PageSize() {
+		right, separator, err := disk.split(node)
+		if err != nil {
+			return err
+		}
+		separator.ptr = uint32(right.page)
+		disk.writeNode(right)
+
+		if len(path) == 0 {
+			// the root split, the tree grows by one level
+			root, err := disk.allocateNode(false)
+			if err != nil {
+				return err
+			}
+			root.link = uint32(node.page)
+			root.entries = []btreeEntry{separator}
+			disk.writeNode(node)
+			disk.writeNode(root)
+			disk.BTree.root = root.page
+			return nil
+		}
+
+		disk.writeNode(node)
+		parent := path[len(path)-1]
+		at := positions[len(positions)-1] + 1
+		parent.entries = append(parent.entries[:at], append([]btreeEntry{separator}, parent.entries[at:]...)...)
+
+		node = parent
+		path = path[:len(path)-1]
+		positions = positions[:len(positions)-1]
+	}
+
+	disk.writeNode(node)
+	return nil
+}
+
+// split moves the upper half of node to a new node, and returns it with the separator to put in the parent
+func (disk *Disk) split(node *btreeNode) (*btreeNode, btreeEntry, error) {
+	right, err := disk.allocateNode(node.leaf)
+	if err != nil {
+		return nil, btreeEntry{}, err
+	}
+
+	// split by size, not by count, entries can be of very different sizes
+	mid, size := 0, BTREE_NODE_HEADER
+	for mid < len(node.entries)-1 && size < disk.nodeSize(node)/2 {
+		size += disk.entrySize(node.leaf, node.entries[mid])
+		mid++
+	}
+	mid = max(mid, 1)
+
+	if !node.leaf {
+		// the middle entry moves up, its child becomes the first child of the right node
+		separator := node.entries[mid]
+		right.link = separator.ptr
+		right.entries = append([]btreeEntry{}, node.entries[mid+1:]...)
+		node.entries = node.entries[:mid]
+		return right, separator, nil
+	}
+
+	right.entries = append([]btreeEntry{}, node.entries[mid:]...)
+	node.entries = node.entries[:mid]
+	right.link = node.link
+	node.link = uint32(right.page)
+
+	left, err := disk.entryKey(true, node.entries[len(node.entries)-1])
+	if err != nil {
+		return nil, btreeEntry{}, err
+	}
+	first, err := disk.entryKey(true, right.entries[0])
+	if err != nil {
+		return nil, btreeEntry{}, err
+	}
+
+	separator, err := disk.separatorEntry(shortestSeparator(left, first))
+	return right, separator, err
+}
+
+// shortestSeparator returns the shortest prefix of right that is still greater than left, left < right
+func shortestSeparator(left string, right string) string {
+	i := 0
+	for i < len(left) && i < len(right) && left[i] == right[i] {
+		i++
+	}
+	return right[:i+1]
+}
+
+// separatorEntry makes an internal entry for key, writing it to overflow pages if it is long
+func (disk *Disk) separatorEntry(key string) (btreeEntry, error) {
+	entry := btreeEntry{
+		key:    []byte(key[:min(len(key), disk.btreeMaxLocal())]),
+		keyLen: len(key),
+	}
+	if !entry.long() {
+		return entry, nil
+	}
+
+	pages, err := disk.allocIndexPages(disk.KeyPagesNeeded(len(key)))
+	if err != nil {
+		return entry, fmt.Errorf("could not allocate separator key pages: %v", err)
+	}
+	disk.BTree.allocated = true
+
+	entry.overflow = uint32(pages[0])
+	return entry, disk.writeKeyPages(key, pages)
+}
+
+// BTreeDelete removes key from the b+tree, and merges the nodes that end up underfull
+func (disk *Disk) BTreeDelete(key string) error {
+	leaf, path, positions, err := disk.findLeaf(key)
+	if err != nil {
+		return err
+	}
+
+	pos, found, err := disk.search(leaf, key)
+	if err != nil || !found {
+		return err
+	}
+	leaf.entries = append(leaf.entries[:pos], leaf.entries[pos+1:]...)
+
+	// merge up the path as long as the node is underfull and fits with a sibling
+	node := leaf
+	for len(path) > 0 && disk.underfull(node) {
+		parent := path[len(path)-1]
+		merged, err := disk.mergeChild(parent, positions[len(positions)-1], node)
+		if err != nil {
+			return err
+		}
+		if !merged {
+			break
+		}
+
+		node = parent
+		path = path[:len(path)-1]
+		positions = positions[:len(positions)-1]
+	}
+
+	if len(path) == 0 && !node.leaf && len(node.entries) == 0 {
+		// the root is down to one child, the tree shrinks by one level
+		disk.BTree.root = int(node.link)
+		disk.freeNode(node.page)
+		return nil
+	}
+	disk.writeNode(node)
+	return nil
+}
+
+// underfull reports whether a node should be merged with a sibling
+func (disk *Disk) underfull(node *btreeNode) bool {
+	return disk.nodeSize(node) < disk.PageSize()/4
+}
+
+// mergeChild merges node, the child of parent at position at, with its left sibling, or with its right
+// one when it is the first child, if the two fit in one page. The right node of the two is freed and its
+// separator removed from parent, which is only changed in memory
+func (disk *Disk) mergeChild(parent *btreeNode, at int, node *btreeNode) (bool, error) {
+	var left, right *btreeNode
+	var err error
+	sep := at
+	if at >= 0 {
+		leftPage := parent.link
+		if at > 0 {
+			leftPage = parent.entries[at-1].ptr
+		}
+		if left, err = disk.readNode(int(leftPage)); err != nil {
+			return false, err
+		}
+		right = node
+	} else {
+		if len(parent.entries) == 0 {
+			return false, nil // an only child has no sibling
+		}
+		if right, err = disk.readNode(int(parent.entries[0].ptr)); err != nil {
+			return false, err
+		}
+		left = node
+		sep = 0
+	}
+
+	separator := parent.entries[sep]
+	merged := &btreeNode{page: left.page, leaf: left.leaf, link: left.link}
+	merged.entries = append(merged.entries, left.entries...)
+	if left.leaf {
+		merged.link = right.link // right leaves the chain
+	} else {
+		// the separator comes down, it points to the first child of the right node
+		separator.ptr = right.link
+		merged.entries = append(merged.entries, separator)
+	}
+	merged.entries = append(merged.entries, right.entries...)
+	if disk.nodeSize(merged) > disk.PageSize() {
+		return false, nil
+	}
+
+	if left.leaf {
+		if err := disk.freeSeparator(separator); err != nil {
+			return false, err
+		}
+	}
+	disk.freeNode(right.page)
+	disk.writeNode(merged)
+	parent.entries = append(parent.entries[:sep], parent.entries[sep+1:]...)
+	return true, nil
+}
+
+// freeNode gives the page of a node that is no longer in the tree back to the bitmap
+func (disk *Disk) freeNode(page int) {
+	delete(disk.BTree.dirty, page)
+	disk.Bitmap.FreePage(page)
+	disk.BTree.allocated = true
+}
+
+// freeSeparator frees the overflow pages of a separator that is dropped from the tree
+func (disk *Disk) freeSeparator(e btreeEntry) error {
+	if !e.long() {
+		return nil
+	}
+	pages, err := disk.keyPages(e.overflow, e.keyLen)
+	if err != nil {
+		return err
+	}
+	for _, page := range pages {
+		disk.Bitmap.FreePage(page)
+	}
+	disk.BTree.allocated = true
+	return nil
+}
+
+// BTreeRange returns the keys >= start and < end in order, at most limit of them
+// an empty end means no upper bound, limit <= 0 means no limit
+func (disk *Disk) BTreeRange(start string, end string, limit int) ([]KeyEntry, error) {
+	entries := []KeyEntry{}
+
+	leaf, _, _, err := disk.findLeaf(start)
+	if err != nil {
+		return nil, err
+	}
+	pos, _, err := disk.search(leaf, start)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		for _, e := range leaf.entries[pos:] {
+			if limit > 0 && len(entries) >= limit {
+				return entries, nil
+			}
+			key, err := disk.entryKey(true, e)
+			if err != nil {
+				return nil, err
+			}
+			if end != "" && key >= end {
+				return entries, nil
+			}
+			entries = append(entries, KeyEntry{Key: key, Inode: int(e.ptr)})
+		}
+
+		if leaf.link == 0 {
+			return entries, nil
+		}
+		if leaf, err = disk.readNode(int(leaf.link)); err != nil {
+			return nil, err
+		}
+		pos = 0
+	}
+}
+
+// BTreePages returns every page used by the b+tree, the header, the nodes and the separator key pages
+func (disk *Disk) BTreePages() ([]int, error) {
+	pages := []int{disk.BTree.header}
+
+	queue := []int{disk.BTree.root}
+	for len(queue) > 0 {
+		node, err := disk.readNode(queue[0])
+		if err != nil {
+			return pages, err
+		}
+		queue = queue[1:]
+		pages = append(pages, node.page)
+
+		if node.leaf {
+			continue
+		}
+		queue = append(queue, int(node.link))
+		for _, e := range node.entries {
+			queue = append(queue, int(e.ptr))
+			if e.long() {
+				keyPages, err := disk.keyPages(e.overflow, e.keyLen)
+				if err != nil {
+					return pages, err
+				}
+				pages = append(pages, keyPages...)
+			}
+		}
+	}
+	return pages, nil
+}
+
+// WriteBTreeToDisk writes the nodes changed since the last write, then the header
+func (disk *Disk) WriteBTreeToDisk() error {
+	tree := disk.BTree
+
+	for page, data := range tree.dirty {
+		if err := disk.WritePageToDisk(page, data); err != nil {
+			return fmt.Errorf("could not write b+tree node: %v", err)
+		}
+		delete(tree.dirty, page)
+	}
+	if tree.allocated {
+		if err := disk.WriteBitmapToDisk(); err != nil {
+			return err
+		}
+		tree.allocated = false
+	}
+
+	header := disk.NewPage()
+	copy(header[0:4], BTREE_MAGIC[:])
+	binary.LittleEndian.PutUint32(header[4:8], uint32(tree.root))
+	binary.LittleEndian.PutUint32(header[8:12], disk.inodeDigest())
+	return disk.WritePageToDisk(tree.header, header)
+}
+
+// loadBTree reads the b+tree of the disk, and builds it again when it is missing or stale
+func (disk *Disk) loadBTree() error {
+	headerPage := int(disk.SuperBlock.BTreePage)
+	if headerPage < RESERVED_PAGES || headerPage >= disk.Bitmap.Pages() {
+		return disk.RebuildBTree()
+	}
+
+	header, err := disk.ReadPageFromDisk(headerPage)
+	if err != nil || [4]byte(header[0:4]) != BTREE_MAGIC {
+		return disk.RebuildBTree()
+	}
+
+	disk.BTree = &BTree{
+		header: headerPage,
+		root:   int(binary.LittleEndian.Uint32(header[4:8])),
+		dirty:  map[int][]byte{},
+	}
+	if binary.LittleEndian.Uint32(header[8:12]) != disk.inodeDigest() {
+		return disk.RebuildBTree()
+	}
+	return nil
+}
+
+// RebuildBTree builds the b+tree from the inode table on new pages and writes it, the pages of the old
+// tree are freed. A read-only disk builds it in memory and writes nothing, see allocIndexPages
+func (disk *Disk) RebuildBTree() error {
+	if disk.BTree != nil {
+		// a broken tree can't be walked completely, fsck finds the pages it leaves behind
+		pages, _ := disk.BTreePages()
+		for _, page := range pages {
+			if disk.readOnly {
+				disk.stalePages = append(disk.stalePages, page)
+			} else {
+				disk.Bitmap.FreePage(page)
+			}
+		}
+	}
+
+	disk.BTree = &BTree{dirty: map[int][]byte{}}
+	pages, err := disk.allocIndexPages(1)
+	if err != nil {
+		return fmt.Errorf("could not allocate b+tree: %v", err)
+	}
+	disk.BTree.header = pages[0]
+
+	root, err := disk.allocateNode(true)
+	if err != nil {
+		return err
+	}
+	disk.writeNode(root)
+	disk.BTree.root = root.page
+
+	for i, inode := range disk.Inodes {
+		if inode.InUse[0] != 1 {
+			continue
+		}
+		key, err := disk.InodeKey(inode)
+		if err != nil {
+			continue // the key can't be read back, fsck reports the inode
+		}
+		if err := disk.BTreeInsert(key, i); err != nil {
+			return fmt.Errorf("could not add inode %d to the b+tree: %v", i, err)
+		}
+	}
+	if disk.readOnly {
+		return nil // the nodes stay in BTree.dirty
+	}
+
+	// the pages are written and marked used before the superblock points to them
+	if err := disk.WriteBTreeToDisk(); err != nil {
+		return err
+	}
+	if err := disk.WriteBitmapToDisk(); err != nil {
+		return err
+	}
+	disk.SuperBlock.BTreePage = uint32(disk.BTree.header)
+	return disk.WriteSuperblockToDisk()
+}
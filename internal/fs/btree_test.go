@@ -0,0 +1,246 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// deleteValue removes key the way the inode engine does
+func deleteValue(t *testing.T, disk *Disk, key string) {
+	t.Helper()
+
+	idx := lookupKey(t, disk, key)
+	if idx < 0 {
+		t.Fatalf("key %q not found", key)
+	}
+	inode := disk.Inodes[idx]
+	if err := disk.FreeInodePages(inode); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.FreeInodeKeyPages(inode); err != nil {
+		t.Fatal(err)
+	}
+	disk.UnindexKey(key, idx)
+	if err := disk.BTreeDelete(key); err != nil {
+		t.Fatal(err)
+	}
+	inode.InUse[0] = 0
+
+	if err := disk.WriteBitmapToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.WriteInodeToDisk(idx, inode); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.WriteIndexesToDisk(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// btreeKey returns the i-th test key, every seventh one is longer than fits in a node
+func btreeKey(i int) string {
+	if i%7 == 0 {
+		return fmt.Sprintf("key%04d-%s", i, strings.Repeat("l", 200))
+	}
+	return fmt.Sprintf("key%04d", i)
+}
+
+func checkRange(t *testing.T, disk *Disk, keys map[string]bool) {
+	t.Helper()
+
+	want := []string{}
+	for key := range keys {
+		want = append(want, key)
+	}
+	sort.Strings(want)
+
+	entries, err := disk.BTreeRange("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("range has %d keys, want %d", len(entries), len(want))
+	}
+	for i, entry := range entries {
+		if entry.Key != want[i] {
+			t.Fatalf("key %d of the range is %q, want %q", i, entry.Key, want[i])
+		}
+		if lookupKey(t, disk, entry.Key) != entry.Inode {
+			t.Fatalf("%q points to inode %d, the hash index to %d", entry.Key, entry.Inode, lookupKey(t, disk, entry.Key))
+		}
+	}
+	if report := disk.Check(); !report.Clean() {
+		t.Fatalf("fsck: %v", report.Problems)
+	}
+}
+
+func TestBTreeSplitAndScan(t *testing.T) {
+	disk, device := newTestDisk(t)
+	keys := map[string]bool{}
+	for _, i := range rand.New(rand.NewSource(1)).Perm(600) {
+		key := btreeKey(i)
+		putValue(t, disk, key, []byte("v"))
+		keys[key] = true
+	}
+
+	root, err := disk.readNode(disk.BTree.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.leaf {
+		t.Fatal("600 keys fit in the root leaf, the tree never split")
+	}
+	checkRange(t, disk, keys)
+
+	// bounded scans stop at end and at limit
+	entries, err := disk.BTreeRange("key0100", "key0200", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 100 || !strings.HasPrefix(entries[0].Key, "key0100") || !strings.HasPrefix(entries[99].Key, "key0199") {
+		t.Fatalf("range [key0100, key0200) has %d keys", len(entries))
+	}
+	if entries, err = disk.BTreeRange("key0550", "", 10); err != nil || len(entries) != 10 {
+		t.Fatalf("limited range has %d keys, %v", len(entries), err)
+	}
+
+	// the tree is read back from the device
+	if err := disk.FlushPages(); err != nil {
+		t.Fatal(err)
+	}
+	mounted, err := MountDevice(device, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mounted.BTree.root != disk.BTree.root {
+		t.Fatalf("the tree was rebuilt on mount, root %d, was %d", mounted.BTree.root, disk.BTree.root)
+	}
+	checkRange(t, mounted, keys)
+}
+
+func TestBTreeDeleteMergesNodes(t *testing.T) {
+	disk, _ := newTestDisk(t)
+	free := disk.Bitmap.FreePageCount()
+
+	keys := map[string]bool{}
+	for i := 0; i < 600; i++ {
+		key := btreeKey(i)
+		putValue(t, disk, key, []byte("v"))
+		keys[key] = true
+	}
+	pages, err := disk.BTreePages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := len(pages)
+
+	// delete all but every tenth key, in random order
+	for _, i := range rand.New(rand.NewSource(2)).Perm(600) {
+		if i%10 == 0 {
+			continue
+		}
+		deleteValue(t, disk, btreeKey(i))
+		delete(keys, btreeKey(i))
+	}
+	checkRange(t, disk, keys)
+
+	if pages, err = disk.BTreePages(); err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) > full/4 {
+		t.Fatalf("the tree still has %d pages after deleting 90%% of the keys, it had %d", len(pages), full)
+	}
+
+	// no leaf in the chain is empty
+	leaf, _, _, err := disk.findLeaf("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if len(leaf.entries) == 0 && leaf.page != disk.BTree.root {
+			t.Fatalf("leaf %d is empty and still in the chain", leaf.page)
+		}
+		if leaf.link == 0 {
+			break
+		}
+		if leaf, err = disk.readNode(int(leaf.link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// deleting everything shrinks the tree back to a single leaf
+	for key := range keys {
+		deleteValue(t, disk, key)
+	}
+	checkRange(t, disk, map[string]bool{})
+	root, err := disk.readNode(disk.BTree.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.leaf {
+		t.Fatal("the root of an empty tree isn't a leaf")
+	}
+	if disk.Bitmap.FreePageCount() != free {
+		t.Fatalf("%d free pages after deleting every key, %d before", disk.Bitmap.FreePageCount(), free)
+	}
+}
+
+// a snapshot taken between writing an inode and writing the indexes has stale ones, a read-only mount
+// rebuilds them in memory and leaves the device as it is
+func TestReadOnlyMountRebuildsStaleIndexes(t *testing.T) {
+	disk, device := newTestDisk(t)
+	keys := map[string]bool{}
+	for i := 0; i < 600; i++ {
+		key := btreeKey(i)
+		putValue(t, disk, key, []byte("v"))
+		keys[key] = true
+	}
+
+	// a delete got as far as the inode, the value is inline and the key short, it has no pages to free
+	deleted := btreeKey(1)
+	idx := lookupKey(t, disk, deleted)
+	disk.Inodes[idx].InUse[0] = 0
+	if err := disk.WriteInodeToDisk(idx, disk.Inodes[idx]); err != nil {
+		t.Fatal(err)
+	}
+	delete(keys, deleted)
+	snapshot := device.Bytes()
+
+	readOnly, err := MountDevice(NewMemoryDevice(snapshot), MountOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(readOnly.memPages) == 0 {
+		t.Fatal("the indexes weren't rebuilt, they aren't stale")
+	}
+	checkRange(t, readOnly, keys)
+	if got := lookupKey(t, readOnly, deleted); got != -1 {
+		t.Fatalf("deleted key found at inode %d", got)
+	}
+	if err := readOnly.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing was written, a mount that can write rebuilds the indexes for good
+	device = NewMemoryDevice(snapshot)
+	readOnly, err = MountDevice(device, MountOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readOnly.Close()
+	if !bytes.Equal(device.Bytes(), snapshot) {
+		t.Fatal("the read-only mount changed the device")
+	}
+	mounted, err := MountDevice(device, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRange(t, mounted, keys)
+	if len(mounted.memPages) != 0 {
+		t.Fatal("a disk that can write kept its indexes in memory")
+	}
+}
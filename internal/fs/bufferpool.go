@@ -0,0 +1,255 @@
+package fs
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+)
+
+/*
+The buffer pool caches data pages between the Disk and its file.
+
+ReadPageFromDisk is served from the pool when the page is there, otherwise the page is read from the
+file, verified against its checksum and kept. WritePageToDisk only updates the page in the pool and
+marks it dirty, the file and the checksum table get it when the page is written back.
+
+Dirty pages are written back before any metadata - an inode, the bitmap or the superblock - is written,
+so what is on disk never points at a page that only exists in the pool. Outside of batch mode that is at
+the end of every operation, in batch mode the pool holds the writes until the engine flushes, the same
+point the WAL is checkpointed at. Nothing is written back before its WAL record, the kv package logs an
+operation before the engine touches a page.
+
+When the pool is full the least recently used page that isn't pinned is evicted, written back first if
+it is dirty. A pinned page stays in the pool until it is unpinned.
+
+Everything here runs under disk.Mutex.
+*/
+
+const DEFAULT_BUFFER_POOL_PAGES = 1024
+
+type frame struct {
+	page    int
+	data    []byte
+	dirty   bool
+	pins    int
+	element *list.Element // in BufferPool.lru
+}
+
+type BufferPool struct {
+	capacity int
+	frames   map[int]*frame
+	lru      *list.List // front is the most recently used
+	dirty    map[int]*frame
+	stats    BufferPoolStats
+}
+
+// BufferPoolStats tells how well the pool is sized, a low hit rate means it is too small
+type BufferPoolStats struct {
+	Capacity   int    `json:"capacity"`
+	Pages      int    `json:"pages"`
+	Dirty      int    `json:"dirty"`
+	Pinned     int    `json:"pinned"`
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Evictions  uint64 `json:"evictions"`
+	WriteBacks uint64 `json:"write_backs"`
+}
+
+// HitRate returns the share of reads served from the pool
+func (s BufferPoolStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+func NewBufferPool(capacity int) *BufferPool {
+	return &BufferPool{
+		capacity: max(capacity, 1),
+		frames:   map[int]*frame{},
+		lru:      list.New(),
+		dirty:    map[int]*frame{},
+	}
+}
+
+// fetch returns the frame holding page, pinned, reading it from the file if it isn't in the pool
+// with load false the page is about to be overwritten and isn't read
+func (disk *Disk) fetch(page int, load bool) (*frame, error) {
+	pool := disk.Pool
+	if f, ok := pool.frames[page]; ok {
+		if load {
+			pool.stats.Hits++
+		}
+		f.pins++
+		pool.lru.MoveToFront(f.element)
+		return f, nil
+	}
+
+	if err := disk.makeRoom(); err != nil {
+		return nil, err
+	}
+
+	f := &frame{page: page, data: disk.NewPage(), pins: 1}
+	if load {
+		pool.stats.Misses++
+		offset := int64(disk.SuperBlock.DataStartOffset) + int64(page)*int64(disk.pageBytes())
+		raw := make([]byte, disk.pageBytes())
+		if err := disk.readAt(raw, offset); err != nil {
+			return nil, err
+		}
+		// a corrupted page isn't kept, the next read goes to the file again
+		if err := disk.verifyPage(page, raw); err != nil {
+			return nil, err
+		}
+		data, err := disk.openPage(page, raw)
+		if err != nil {
+			return nil, err
+		}
+		f.data = data
+	}
+
+	f.element = pool.lru.PushFront(f)
+	pool.frames[page] = f
+	return f, nil
+}
+
+// makeRoom evicts the least recently used unpinned page if the pool is full
+func (disk *Disk) makeRoom() error {
+	pool := disk.Pool
+	if len(pool.frames) < pool.capacity {
+		return nil
+	}
+
+	for element := pool.lru.Back(); element != nil; element = element.Prev() {
+		f := element.Value.(*frame)
+		if f.pins > 0 {
+			continue
+		}
+		if err := disk.writeBack(f); err != nil {
+			return err
+		}
+		pool.lru.Remove(element)
+		delete(pool.frames, f.page)
+		pool.stats.Evictions++
+		return nil
+	}
+	return fmt.Errorf("buffer pool is full, all %d pages are pinned", pool.capacity)
+}
+
+// writeBack writes a dirty page and its checksum to the file
+func (disk *Disk) writeBack(f *frame) error {
+	if !f.dirty {
+		return nil
+	}
+
+	sealed, err := disk.sealPage(f.page, f.data)
+	if err != nil {
+		return err
+	}
+	offset := int64(disk.SuperBlock.DataStartOffset) + int64(f.page)*int64(disk.pageBytes())
+	if err := disk.writeAt(sealed, offset); err != nil {
+		return err
+	}
+	if err := disk.writeChecksum(f.page, pageChecksum(sealed)); err != nil {
+		return err
+	}
+
+	f.dirty = false
+	delete(disk.Pool.dirty, f.page)
+	disk.Pool.stats.WriteBacks++
+	return nil
+}
+
+// flushPages writes back every dirty page, in page order so the writes go through the file forward
+func (disk *Disk) flushPages() error {
+	pool := disk.Pool
+	if len(pool.dirty) == 0 {
+		return nil
+	}
+
+	pages := make([]int, 0, len(pool.dirty))
+	for page := range pool.dirty {
+		pages = append(pages, page)
+	}
+	sort.Ints(pages)
+
+	for _, page := range pages {
+		if err := disk.writeBack(pool.dirty[page]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushPages writes every dirty page of the pool to the file
+func (disk *Disk) FlushPages() error {
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	return disk.flushPages()
+}
+
+// FetchPage pins a data page in the pool and returns its buffer, which stays valid until UnpinPage
+// changes to the buffer have to be reported with dirty, they are written back like WritePageToDisk
+func (disk *Disk) FetchPage(page int) ([]byte, error) {
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	f, err := disk.fetch(page, true)
+	if err != nil {
+		return nil, err
+	}
+	return f.data, nil
+}
+
+func (disk *Disk) UnpinPage(page int, dirty bool) error {
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	f, ok := disk.Pool.frames[page]
+	if !ok || f.pins == 0 {
+		return fmt.Errorf("data page %d isn't pinned", page)
+	}
+	if dirty && disk.readOnly {
+		f.pins--
+		return ErrReadOnly
+	}
+	if dirty {
+		f.dirty = true
+		disk.Pool.dirty[page] = f
+	}
+	f.pins--
+	return nil
+}
+
+// SetBufferPoolSize changes how many pages the pool holds, evicting pages if it shrinks
+func (disk *Disk) SetBufferPoolSize(pages int) error {
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	pool := disk.Pool
+	pool.capacity = max(pages, 1)
+	for len(pool.frames) > pool.capacity {
+		if err := disk.makeRoom(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (disk *Disk) BufferPoolStats() BufferPoolStats {
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	pool := disk.Pool
+	stats := pool.stats
+	stats.Capacity = pool.capacity
+	stats.Pages = len(pool.frames)
+	stats.Dirty = len(pool.dirty)
+	for _, f := range pool.frames {
+		if f.pins > 0 {
+			stats.Pinned++
+		}
+	}
+	return stats
+}
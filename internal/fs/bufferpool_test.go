@@ -0,0 +1,165 @@
+package fs
+
+import (
+	"bytes"
+	"testing"
+)
+
+// filled returns a page of b
+func filled(disk *Disk, b byte) []byte {
+	return bytes.Repeat([]byte{b}, disk.PageSize())
+}
+
+// onDevice returns what the file holds for a data page, past the pool
+func onDevice(disk *Disk, device *MemoryDevice, page int) []byte {
+	offset := int(disk.SuperBlock.DataStartOffset) + page*disk.PageSize()
+	return device.Bytes()[offset : offset+disk.PageSize()]
+}
+
+func cached(disk *Disk) map[int]bool {
+	pages := map[int]bool{}
+	for page := range disk.Pool.frames {
+		pages[page] = true
+	}
+	return pages
+}
+
+func TestBufferPoolEvictsLeastRecentlyUsed(t *testing.T) {
+	disk, _ := newTestDisk(t)
+	defer disk.Close()
+	if err := disk.SetBufferPoolSize(3); err != nil {
+		t.Fatal(err)
+	}
+	pages := []int{10, 11, 12, 13}
+	for i, page := range pages[:3] {
+		if err := disk.WritePageToDisk(page, filled(disk, byte('a'+i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := disk.FlushPages(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reading 10 makes 11 the least recently used
+	if _, err := disk.ReadPageFromDisk(10); err != nil {
+		t.Fatal(err)
+	}
+	before := disk.BufferPoolStats()
+	if err := disk.WritePageToDisk(13, filled(disk, 'd')); err != nil {
+		t.Fatal(err)
+	}
+	if in := cached(disk); in[11] || !in[10] || !in[12] || !in[13] {
+		t.Fatalf("pool has %v after the eviction, 11 should have gone", in)
+	}
+	stats := disk.BufferPoolStats()
+	if stats.Evictions != before.Evictions+1 || stats.Pages != 3 || stats.Capacity != 3 {
+		t.Fatalf("stats %+v after one eviction", stats)
+	}
+
+	// 11 comes back from the file, a miss, 10 is still a hit
+	if data, err := disk.ReadPageFromDisk(11); err != nil || !bytes.Equal(data, filled(disk, 'b')) {
+		t.Fatalf("page 11 after its eviction: %v", err)
+	}
+	if _, err := disk.ReadPageFromDisk(13); err != nil {
+		t.Fatal(err)
+	}
+	after := disk.BufferPoolStats()
+	if after.Misses != stats.Misses+1 || after.Hits != stats.Hits+1 {
+		t.Fatalf("stats %+v, want one more miss and one more hit than %+v", after, stats)
+	}
+}
+
+func TestBufferPoolWritesBackDirtyPages(t *testing.T) {
+	disk, device := newTestDisk(t)
+	defer disk.Close()
+	if err := disk.SetBufferPoolSize(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.WritePageToDisk(20, filled(disk, 'x')); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.WritePageToDisk(21, filled(disk, 'y')); err != nil {
+		t.Fatal(err)
+	}
+	// the pages mount left in the pool are gone, the pool holds the two dirty ones
+	base := disk.BufferPoolStats()
+	if in := cached(disk); base.Dirty != 2 || !in[20] || !in[21] {
+		t.Fatalf("stats %+v, pool has %v after two writes", base, in)
+	}
+	if bytes.Equal(onDevice(disk, device, 20), filled(disk, 'x')) {
+		t.Fatal("a dirty page reached the file before it was written back")
+	}
+
+	// 20 is evicted, it is written back on the way out
+	if err := disk.WritePageToDisk(22, filled(disk, 'z')); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(onDevice(disk, device, 20), filled(disk, 'x')) {
+		t.Fatal("the evicted dirty page wasn't written back")
+	}
+	if stats := disk.BufferPoolStats(); stats.Dirty != 2 || stats.WriteBacks != base.WriteBacks+1 || stats.Evictions != base.Evictions+1 {
+		t.Fatalf("stats %+v after the eviction, %+v before", stats, base)
+	}
+
+	// with its checksum, reading it back verifies it
+	if data, err := disk.ReadPageFromDisk(20); err != nil || !bytes.Equal(data, filled(disk, 'x')) {
+		t.Fatalf("page 20 after its write back: %v", err)
+	}
+
+	// a shrinking pool writes back what it evicts too
+	if err := disk.SetBufferPoolSize(1); err != nil {
+		t.Fatal(err)
+	}
+	for page, b := range map[int]byte{21: 'y', 22: 'z'} {
+		if !cached(disk)[page] && !bytes.Equal(onDevice(disk, device, page), filled(disk, b)) {
+			t.Fatalf("page %d was evicted without being written back", page)
+		}
+	}
+	if err := disk.FlushPages(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := disk.BufferPoolStats(); stats.Dirty != 0 || stats.Pages != 1 {
+		t.Fatalf("stats %+v after the flush", stats)
+	}
+	for page, b := range map[int]byte{21: 'y', 22: 'z'} {
+		if !bytes.Equal(onDevice(disk, device, page), filled(disk, b)) {
+			t.Fatalf("page %d isn't in the file after the flush", page)
+		}
+	}
+}
+
+func TestBufferPoolKeepsPinnedPages(t *testing.T) {
+	disk, _ := newTestDisk(t)
+	defer disk.Close()
+	if err := disk.SetBufferPoolSize(2); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := disk.FetchPage(30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(data, "pinned")
+	if _, err := disk.FetchPage(31); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := disk.ReadPageFromDisk(32); err == nil {
+		t.Fatal("read a page into a pool of pinned pages")
+	}
+
+	if err := disk.UnpinPage(30, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.UnpinPage(30, false); err == nil {
+		t.Fatal("unpinned a page that wasn't pinned")
+	}
+	if _, err := disk.ReadPageFromDisk(32); err != nil {
+		t.Fatal(err)
+	}
+	if in := cached(disk); in[30] || !in[31] {
+		t.Fatalf("pool has %v, the pinned page 31 should have stayed", in)
+	}
+	if got, err := disk.ReadPageFromDisk(30); err != nil || !bytes.HasPrefix(got, []byte("pinned")) {
+		t.Fatalf("page 30 lost the change made while it was pinned: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+/*
+Every data page has a CRC32C checksum, kept in the checksum table that sits between the bitmap and the
+data region. Entry i is 4 bytes at ChecksumStartOffset + 4*i and belongs to data page i.
+
+A page and its checksum are written to the file together, when the buffer pool writes the page back,
+ReadPageFromDisk verifies a page read from the file against it. An entry of 0 means the page was never written, it is not verified.
+A page whose CRC is 0 is stored as CHECKSUM_ZERO instead, so every page that was written is verified.
+A torn write leaves the page and its checksum out of sync, which is reported just like bit rot.
+*/
+
+// the entry of a page whose CRC is 0, 0 itself marks a page that was never written
+const CHECKSUM_ZERO = 0xffffffff
+
+var ErrCorruptPage = errors.New("page checksum mismatch, page is corrupted")
+
+// checksumPagesFor returns how many pages the checksum table needs for dataPages data pages
+func checksumPagesFor(dataPages int, pageSize int) int {
+	entriesPerPage := pageSize / 4
+	return (dataPages + entriesPerPage - 1) / entriesPerPage // ceil division
+}
+
+// pageChecksum returns the checksum table entry for a page, never 0
+func pageChecksum(data []byte) uint32 {
+	if checksum := crc32.Checksum(data, crcTable); checksum != 0 {
+		return checksum
+	}
+	return CHECKSUM_ZERO
+}
+
+// ReadChecksums reads the checksum table of a disk
+func ReadChecksums(r io.ReaderAt, superblock *SuperBlock) ([]uint32, error) {
+	tableData := make([]byte, int(superblock.ChecksumPages)*int(superblock.Pagesize))
+	if _, err := r.ReadAt(tableData, int64(superblock.ChecksumStartOffset)); err != nil {
+		return nil, fmt.Errorf("could not read checksum table: %v", err)
+	}
+
+	checksums := make([]uint32, len(tableData)/4)
+	for i := range checksums {
+		checksums[i] = binary.LittleEndian.Uint32(tableData[i*4 : i*4+4])
+	}
+	return checksums, nil
+}
+
+// verifyPage checks a page read from disk against its checksum, caller holds disk.Mutex
+func (disk *Disk) verifyPage(pageNumber int, data []byte) error {
+	if pageNumber >= len(disk.Checksums) || disk.Checksums[pageNumber] == 0 {
+		return nil // never written
+	}
+	if pageChecksum(data) != disk.Checksums[pageNumber] {
+		return fmt.Errorf("%w: data page %d", ErrCorruptPage, pageNumber)
+	}
+	return nil
+}
+
+// writeChecksum records the checksum of a page and writes its entry of the table, caller holds disk.Mutex
+func (disk *Disk) writeChecksum(pageNumber int, checksum uint32) error {
+	if pageNumber >= len(disk.Checksums) {
+		return fmt.Errorf("data page %d is outside of the checksum table", pageNumber)
+	}
+	disk.Checksums[pageNumber] = checksum
+
+	entry := make([]byte, 4)
+	binary.LittleEndian.PutUint32(entry, checksum)
+	offset := int64(disk.SuperBlock.ChecksumStartOffset) + int64(pageNumber)*4
+
+	return disk.writeAt(entry, offset)
+}
+
+// writeChecksumTable writes the whole checksum table, caller holds disk.Mutex
+func (disk *Disk) writeChecksumTable() error {
+	tableData := make([]byte, int(disk.SuperBlock.ChecksumPages)*disk.pageBytes())
+	for i, checksum := range disk.Checksums {
+		binary.LittleEndian.PutUint32(tableData[i*4:i*4+4], checksum)
+	}
+
+	return disk.writeAt(tableData, int64(disk.SuperBlock.ChecksumStartOffset))
+}
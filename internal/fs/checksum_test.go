@@ -0,0 +1,100 @@
+package fs
+
+import (
+	"errors"
+	"hash/crc32"
+	"testing"
+)
+
+// zeroCRC changes the last 4 bytes of data so that its CRC32C is 0. A CRC is affine over GF(2), so the
+// bits to flip are found by solving a 32x32 linear system
+func zeroCRC(data []byte) {
+	tail := len(data) - 4
+	for i := tail; i < len(data); i++ {
+		data[i] = 0
+	}
+	zero := make([]byte, len(data))
+	base := crc32.Checksum(zero, crcTable)
+
+	// column i is what flipping bit i of the tail does to the CRC
+	rows := [32]uint64{}
+	for i := 0; i < 32; i++ {
+		zero[tail+i/8] = 1 << (i % 8)
+		delta := crc32.Checksum(zero, crcTable) ^ base
+		zero[tail+i/8] = 0
+		for bit := 0; bit < 32; bit++ {
+			if delta&(1<<bit) != 0 {
+				rows[bit] |= 1 << i
+			}
+		}
+	}
+	target := crc32.Checksum(data, crcTable)
+	for bit := 0; bit < 32; bit++ {
+		if target&(1<<bit) != 0 {
+			rows[bit] |= 1 << 32
+		}
+	}
+
+	// gauss-jordan elimination, the right hand side is bit 32 of every row
+	for col := 0; col < 32; col++ {
+		pivot := col
+		for pivot < 32 && rows[pivot]&(1<<col) == 0 {
+			pivot++
+		}
+		if pivot == 32 {
+			panic("singular system")
+		}
+		rows[col], rows[pivot] = rows[pivot], rows[col]
+		for r := 0; r < 32; r++ {
+			if r != col && rows[r]&(1<<col) != 0 {
+				rows[r] ^= rows[col]
+			}
+		}
+	}
+	for i := 0; i < 32; i++ {
+		if rows[i]&(1<<32) != 0 {
+			data[tail+i/8] ^= 1 << (i % 8)
+		}
+	}
+}
+
+func TestPageWithZeroCRCIsVerified(t *testing.T) {
+	disk, device := newTestDisk(t)
+
+	data := disk.NewPage()
+	copy(data, "a page whose crc is zero")
+	zeroCRC(data)
+	if crc32.Checksum(data, crcTable) != 0 {
+		t.Fatal("could not make a page with a CRC of 0")
+	}
+
+	page := disk.Bitmap.FindFreePage()
+	disk.Bitmap.AllocatePage(page)
+	if err := disk.WritePageToDisk(page, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.FlushPages(); err != nil {
+		t.Fatal(err)
+	}
+	if disk.Checksums[page] != CHECKSUM_ZERO {
+		t.Fatalf("checksum entry is %#x, want %#x", disk.Checksums[page], CHECKSUM_ZERO)
+	}
+
+	mounted, err := MountDevice(device, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mounted.ReadPageFromDisk(page); err != nil {
+		t.Fatalf("reading the page back: %v", err)
+	}
+
+	// flip a bit on the device, the page has to fail its checksum
+	offset := int64(disk.SuperBlock.DataStartOffset) + int64(page*disk.pageBytes())
+	device.WriteAt([]byte{data[0] ^ 1}, offset)
+	if mounted, err = MountDevice(device, MountOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mounted.ReadPageFromDisk(page); !errors.Is(err, ErrCorruptPage) {
+		t.Fatalf("corrupted page read with %v", err)
+	}
+}
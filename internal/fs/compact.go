@@ -0,0 +1,257 @@
+package fs
+
+import (
+	"fmt"
+	"slices"
+)
+
+/*
+Compaction, moving the pages of every inode into one contiguous run near the front of the data region
+and giving the free pages at the end of the disk back to the file system.
+
+After enough churn there are no runs left that are long enough for a new value, it is spread over the
+holes, and the disk keeps the size it once grew to. RelocateInode moves one inode at a time and never
+writes to a page the inode still points at: its data pages are copied into a free run and mapped as a
+single extent, its key pages are written there again, and the run is marked used and synced before the
+inode is switched over with a single write of its 64 bytes. Only then are the old pages freed. A crash
+before the switch leaves the copies as orphaned pages and a crash after it leaves the old ones, fsck
+--repair frees either, the value itself is never lost.
+
+Shrink cuts the free pages off the end of the data region. Like resize it never shrinks the bitmap or the
+checksum table, the superblock is written with the new size before the file is truncated, so a crash in
+between leaves a file longer than the disk, which Mount accepts.
+*/
+
+// CompactReport is what a compaction did
+type CompactReport struct {
+	InodesMoved      int    `json:"inodes_moved"`
+	PagesMoved       int    `json:"pages_moved"`
+	FragmentedBefore int    `json:"fragmented_before"` // inodes whose pages weren't one contiguous run
+	FragmentedAfter  int    `json:"fragmented_after"`
+	PagesBefore      uint32 `json:"pages_before"` // size of the disk in pages, metadata included
+	PagesAfter       uint32 `json:"pages_after"`
+	BytesReclaimed   int64  `json:"bytes_reclaimed"`
+}
+
+// inodeLayout returns every page of an inode in the order a relocated inode has them, data pages, then
+// indirect pages, then key pages
+func (disk *Disk) inodeLayout(inode *Inode) (data []int, indirect []int, key []int, err error) {
+	data, indirect, err = disk.InodePages(inode)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	key, err = disk.InodeKeyPages(inode)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return data, indirect, key, nil
+}
+
+func contiguous(pages []int) bool {
+	for i, page := range pages {
+		if page != pages[0]+i {
+			return false
+		}
+	}
+	return true
+}
+
+// Fragmented reports whether the pages of an inode in use aren't one contiguous run
+func (disk *Disk) Fragmented(idx int) bool {
+	inode := disk.Inodes[idx]
+	if inode.InUse[0] != 1 {
+		return false
+	}
+	data, indirect, key, err := disk.inodeLayout(inode)
+	if err != nil {
+		return false
+	}
+	return !contiguous(slices.Concat(data, indirect, key))
+}
+
+// CompactionOrder returns the inodes in use that own pages, ordered by the lowest page they own, moving
+// them in this order fills the holes at the front of the disk first
+func (disk *Disk) CompactionOrder() []int {
+	first := map[int]int{}
+	order := []int{}
+	for i, inode := range disk.Inodes {
+		if inode.InUse[0] != 1 {
+			continue
+		}
+		data, indirect, key, err := disk.inodeLayout(inode)
+		pages := slices.Concat(data, indirect, key)
+		if err != nil || len(pages) == 0 {
+			continue // fsck reports an inode that can't be read, there is nothing to move for an empty one
+		}
+		first[i] = slices.Min(pages)
+		order = append(order, i)
+	}
+	slices.SortFunc(order, func(a, b int) int { return first[a] - first[b] })
+	return order
+}
+
+// RelocateInode moves the pages of an inode into the lowest free run that holds all of them, when that
+// makes them contiguous or moves them closer to the front, it returns the number of pages moved
+func (disk *Disk) RelocateInode(idx int) (int, error) {
+	if disk.readOnly {
+		return 0, ErrReadOnly
+	}
+	inode := disk.Inodes[idx]
+	if inode.InUse[0] != 1 {
+		return 0, nil
+	}
+	data, indirect, keyPages, err := disk.inodeLayout(inode)
+	if err != nil {
+		return 0, fmt.Errorf("could not read the pages of inode %d: %v", idx, err)
+	}
+	old := slices.Concat(data, indirect, keyPages)
+	if len(old) == 0 {
+		return 0, nil
+	}
+
+	// in one run the value is one extent, it doesn't need indirect pages anymore
+	size := len(data) + len(keyPages)
+	start := disk.Bitmap.FindFreeRun(size)
+	if start < 0 || (contiguous(old) && start > old[0]) {
+		return 0, nil
+	}
+	run := make([]int, size)
+	for i := range run {
+		run[i] = start + i
+		disk.Bitmap.AllocatePage(run[i])
+	}
+
+	moved, err := disk.copyInode(inode, data, run)
+	if err == nil {
+		err = disk.WriteBitmapToDisk()
+	}
+	if err == nil {
+		err = disk.Sync()
+	}
+	if err != nil {
+		// the inode still points at its old pages, the run was never used
+		for _, page := range run {
+			disk.Bitmap.FreePage(page)
+		}
+		return 0, fmt.Errorf("could not copy inode %d: %v", idx, err)
+	}
+
+	// the switch, the inode points at the copies from here on
+	*inode = moved
+	if err := disk.WriteInodeToDisk(idx, inode); err != nil {
+		return 0, err
+	}
+	if err := disk.Sync(); err != nil {
+		return 0, err
+	}
+
+	for _, page := range old {
+		disk.Bitmap.FreePage(page)
+	}
+	if err := disk.WriteBitmapToDisk(); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// copyInode writes the pages of inode to run, laid out like inodeLayout, and returns the inode pointing at
+// them, the inode itself isn't changed
+func (disk *Disk) copyInode(inode *Inode, data []int, run []int) (Inode, error) {
+	moved := *inode
+	newData := run[:len(data)]
+	newIndirect := run[len(data) : len(data)+disk.MapPagesNeeded(newData)]
+	newKey := run[len(newData)+len(newIndirect):]
+
+	for i, page := range data {
+		pageData, err := disk.ReadPageFromDisk(page)
+		if err != nil {
+			return moved, err
+		}
+		if err := disk.WritePageToDisk(newData[i], pageData); err != nil {
+			return moved, err
+		}
+	}
+	// pointer pages and key pages hold page numbers, they are written again instead of copied
+	if err := disk.MapInodePages(&moved, newData, newIndirect); err != nil {
+		return moved, err
+	}
+	if len(newKey) > 0 {
+		key, err := disk.InodeKey(inode)
+		if err != nil {
+			return moved, err
+		}
+		if err := disk.SetInodeKey(&moved, key, newKey); err != nil {
+			return moved, err
+		}
+	}
+	return moved, disk.FlushPages()
+}
+
+// Shrink cuts the free pages at the end of the data region off the disk and returns how many it cut, a
+// disk never gets smaller than a new one
+func (disk *Disk) Shrink() (int, error) {
+	if disk.readOnly {
+		return 0, ErrReadOnly
+	}
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	sb := disk.SuperBlock
+	pageSize := int(sb.Pagesize)
+	metadataPages := int(sb.DataStartOffset) / pageSize
+	oldDataPages := sb.DataPageCount()
+
+	dataPages := max(TOTAL_DISK_SIZE/pageSize-metadataPages, RESERVED_PAGES)
+	for page := oldDataPages - 1; page >= dataPages; page-- {
+		if disk.Bitmap.IsAllocated(page) {
+			dataPages = page + 1
+			break
+		}
+	}
+	if dataPages >= oldDataPages {
+		return 0, nil
+	}
+
+	// the pages past the new end are all free, nothing the pool has of them needs to be written
+	disk.dropPages(dataPages)
+	disk.Bitmap.Resize(dataPages)
+	for page := dataPages; page < min(oldDataPages, len(disk.Checksums)); page++ {
+		disk.Checksums[page] = 0
+	}
+	sb.TotalPages = uint32(metadataPages + dataPages)
+
+	if err := disk.writeBitmap(); err != nil {
+		return 0, err
+	}
+	if err := disk.writeChecksumTable(); err != nil {
+		return 0, err
+	}
+	if err := disk.writeSuperblock(); err != nil {
+		return 0, err
+	}
+	if err := disk.sync(); err != nil {
+		return 0, err
+	}
+
+	if err := disk.Device.Truncate(int64(sb.TotalPages) * int64(pageSize)); err != nil {
+		return 0, err
+	}
+	if err := disk.remap(); err != nil {
+		return 0, err
+	}
+	return oldDataPages - dataPages, disk.sync()
+}
+
+// dropPages removes the data pages from page on from the buffer pool without writing them back, caller
+// holds disk.Mutex
+func (disk *Disk) dropPages(page int) {
+	pool := disk.Pool
+	for number, f := range pool.frames {
+		if number < page {
+			continue
+		}
+		pool.lru.Remove(f.element)
+		delete(pool.frames, number)
+		delete(pool.dirty, number)
+	}
+}
@@ -0,0 +1,109 @@
+package fs
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// putFragmented stores value spread over the holes the deleted fillers left, with the free pages past them
+// held back so no run is long enough for it, and returns its inode
+func putFragmented(t *testing.T, disk *Disk, key string, value []byte) int {
+	t.Helper()
+
+	for i := 0; i < 40; i++ {
+		putValue(t, disk, fmt.Sprintf("fill%02d", i), bytes.Repeat([]byte{'f'}, disk.PageSize()))
+	}
+	for i := 1; i < 40; i += 2 {
+		deleteValue(t, disk, fmt.Sprintf("fill%02d", i))
+	}
+
+	dataPages := disk.PagesNeeded(len(value))
+	needed := dataPages + disk.MapPagesNeeded(make([]int, dataPages)) + disk.KeyPagesNeeded(len(key))
+	free := disk.Bitmap.FindFreePages(0)
+	for _, page := range free[needed:] {
+		disk.Bitmap.AllocatePage(page)
+	}
+	idx := putValue(t, disk, key, value)
+	for _, page := range free[needed:] {
+		disk.Bitmap.FreePage(page)
+	}
+	if err := disk.WriteBitmapToDisk(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !disk.Fragmented(idx) {
+		t.Fatalf("%q was stored in one run, there was nothing to relocate", key)
+	}
+	return idx
+}
+
+func TestRelocateFragmentedValue(t *testing.T) {
+	cases := []struct {
+		name     string
+		pageSize int
+		key      string
+	}{
+		// too many extents for the inode, they are kept in an extent page
+		{"extent page", DEFAULT_PAGE_SIZE, "big"},
+		// the key takes a chain of key pages, they move with the value
+		{"key pages", 512, strings.Repeat("k", 1000)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			device := NewMemoryDevice(nil)
+			if err := FormatDevice(device, c.pageSize, ENGINE_INODE); err != nil {
+				t.Fatal(err)
+			}
+			disk, err := MountDevice(device, MountOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			value := make([]byte, (MAX_PAGES+4)*c.pageSize)
+			for i := range value {
+				value[i] = byte(i % 251)
+			}
+			idx := putFragmented(t, disk, c.key, value)
+			if _, mapPages, err := disk.InodePages(disk.Inodes[idx]); err != nil || len(mapPages) != 1 {
+				t.Fatalf("%d extent pages, %v", len(mapPages), err)
+			}
+			if keyPages, err := disk.InodeKeyPages(disk.Inodes[idx]); err != nil || len(keyPages) != disk.KeyPagesNeeded(len(c.key)) {
+				t.Fatalf("%d key pages, %v", len(keyPages), err)
+			}
+
+			moved, err := disk.RelocateInode(idx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// one extent, the extent page isn't needed anymore
+			if want := MAX_PAGES + 4 + disk.KeyPagesNeeded(len(c.key)); moved != want {
+				t.Fatalf("moved %d pages, want %d", moved, want)
+			}
+			if disk.Fragmented(idx) {
+				t.Fatal("the value is still fragmented")
+			}
+			if got := readValue(t, disk, c.key); !bytes.Equal(got, value) {
+				t.Fatalf("read %d bytes back after the move, wrote %d", len(got), len(value))
+			}
+			if report := disk.Check(); !report.Clean() {
+				t.Fatalf("fsck after the move: %v", report.Problems)
+			}
+			if err := disk.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			disk, err = MountDevice(device, MountOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer disk.Close()
+			if got := readValue(t, disk, c.key); !bytes.Equal(got, value) {
+				t.Fatalf("read %d bytes back after a remount, wrote %d", len(got), len(value))
+			}
+			if report := disk.Check(); !report.Clean() {
+				t.Fatalf("fsck after a remount: %v", report.Problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package fs
+
+import "fmt"
+
+/*
+Compressed values.
+
+The kv package can compress a value before it is stored, the disk only records which codec did it, as
+an ID from internal/codec in bits 4 and 5 of the inode flags, 0 being a value stored as it is. Size and
+the pages of the inode are those of the compressed bytes, the layout flags don't care what is in them.
+
+Which codec new values are compressed with, and the smallest value worth compressing, are chosen when
+the disk is created and kept in the superblock, Codec and CompressMinSize. Values already written keep
+the codec of their inode whatever the superblock says.
+*/
+const (
+	INODE_CODEC_SHIFT = 4
+	INODE_CODEC_MASK  = 0b11 << INODE_CODEC_SHIFT // ID of the codec the value is compressed with
+
+	MAX_CODEC_ID = INODE_CODEC_MASK >> INODE_CODEC_SHIFT
+)
+
+// Codec returns the ID of the codec the value of the inode is compressed with, 0 if it isn't
+func (i *Inode) Codec() byte {
+	return (i.Flags[0] & INODE_CODEC_MASK) >> INODE_CODEC_SHIFT
+}
+
+// SetCodec records the codec the value of the inode is compressed with
+func (i *Inode) SetCodec(id byte) error {
+	if id > MAX_CODEC_ID {
+		return fmt.Errorf("codec %d doesn't fit in the inode, at most %d", id, MAX_CODEC_ID)
+	}
+	i.Flags[0] = i.Flags[0]&^INODE_CODEC_MASK | id<<INODE_CODEC_SHIFT
+	return nil
+}
+
+// SetCompression sets the codec new values are compressed with, 0 for none, and the size a value needs
+// to be compressed, and writes the superblock
+func (disk *Disk) SetCompression(codec byte, minSize int) error {
+	if disk.readOnly {
+		return ErrReadOnly
+	}
+	if codec > MAX_CODEC_ID {
+		return fmt.Errorf("codec %d doesn't fit in the inode, at most %d", codec, MAX_CODEC_ID)
+	}
+	if minSize < 0 {
+		return fmt.Errorf("minimum size to compress can't be negative, got %d", minSize)
+	}
+
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	disk.SuperBlock.Codec[0] = codec
+	disk.SuperBlock.CompressMinSize = uint32(minSize)
+	if err := disk.writeSuperblock(); err != nil {
+		return err
+	}
+	return disk.sync()
+}
+
+// Compression returns the codec new values are compressed with and the size a value needs to be compressed
+func (disk *Disk) Compression() (byte, int) {
+	return disk.SuperBlock.Codec[0], int(disk.SuperBlock.CompressMinSize)
+}
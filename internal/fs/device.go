@@ -0,0 +1,194 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+/*
+A Disk keeps its pages on a BlockDevice. Mount puts it on a FileDevice, MountDevice on any other
+device, a MemoryDevice for a database that only lives as long as the process or a FaultyDevice to see
+what a disk looks like after a failed write or a crash, see faulty.go.
+
+Every read and write of the disk goes through readAt and writeAt, which use the mapping instead when
+the disk is memory mapped, see mapping.go.
+*/
+
+type BlockDevice interface {
+	io.ReaderAt
+	io.WriterAt
+	// makes every write so far durable
+	Sync() error
+	// returns the size of the device in bytes
+	Size() (int64, error)
+	Truncate(size int64) error
+	Close() error
+}
+
+// FileDevice is a device on an OS file
+type FileDevice struct {
+	*os.File
+}
+
+func NewFileDevice(file *os.File) *FileDevice {
+	return &FileDevice{File: file}
+}
+
+func (f *FileDevice) Size() (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// MemoryDevice keeps the device in memory, Sync does nothing and Close keeps the data, so the device
+// can be mounted again
+type MemoryDevice struct {
+	mutex sync.Mutex
+	data  []byte
+}
+
+// NewMemoryDevice returns a device holding a copy of data
+func NewMemoryDevice(data []byte) *MemoryDevice {
+	return &MemoryDevice{data: append([]byte{}, data...)}
+}
+
+func (m *MemoryDevice) ReadAt(p []byte, offset int64) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if offset >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p at offset, the device grows if the write goes past its end
+func (m *MemoryDevice) WriteAt(p []byte, offset int64) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if end := offset + int64(len(p)); end > int64(len(m.data)) {
+		m.resize(end)
+	}
+	return copy(m.data[offset:], p), nil
+}
+
+func (m *MemoryDevice) Sync() error {
+	return nil
+}
+
+func (m *MemoryDevice) Size() (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return int64(len(m.data)), nil
+}
+
+func (m *MemoryDevice) Truncate(size int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.resize(size)
+	return nil
+}
+
+func (m *MemoryDevice) Close() error {
+	return nil
+}
+
+// Bytes returns a copy of the whole device
+func (m *MemoryDevice) Bytes() []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]byte{}, m.data...)
+}
+
+// resize grows the device with zeroes or cuts it, caller holds m.mutex
+func (m *MemoryDevice) resize(size int64) {
+	if size <= int64(len(m.data)) {
+		m.data = m.data[:size]
+		return
+	}
+	data := make([]byte, size)
+	copy(data, m.data)
+	m.data = data
+}
+
+// readAt reads len(p) bytes at offset, from the mapping if there is one, caller holds disk.Mutex
+func (disk *Disk) readAt(p []byte, offset int64) error {
+	if disk.mapping == nil {
+		_, err := disk.Device.ReadAt(p, offset)
+		return err
+	}
+	if offset < 0 || offset > int64(len(disk.mapping)) {
+		return io.EOF
+	}
+	if n := copy(p, disk.mapping[offset:]); n < len(p) {
+		return io.EOF
+	}
+	return nil
+}
+
+// writeAt writes p at offset, to the mapping if there is one, caller holds disk.Mutex
+func (disk *Disk) writeAt(p []byte, offset int64) error {
+	if disk.readOnly {
+		return ErrReadOnly
+	}
+	if disk.mapping == nil {
+		_, err := disk.Device.WriteAt(p, offset)
+		return err
+	}
+	if offset < 0 || offset+int64(len(p)) > int64(len(disk.mapping)) {
+		return fmt.Errorf("write of %d bytes at %d is past the end of the mapping", len(p), offset)
+	}
+	copy(disk.mapping[offset:], p)
+	return nil
+}
+
+// sync makes everything written so far durable, caller holds disk.Mutex
+func (disk *Disk) sync() error {
+	if disk.mapping != nil {
+		if err := syncMapping(disk.mapping); err != nil {
+			return err
+		}
+	}
+	return disk.Device.Sync()
+}
+
+// Sync writes back the buffer pool and waits for the device, and the mapping, to make it durable
+func (disk *Disk) Sync() error {
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	if err := disk.flushPages(); err != nil {
+		return err
+	}
+	return disk.sync()
+}
+
+// Close writes back the buffer pool, unmaps the file if it is mapped and closes the device
+func (disk *Disk) Close() error {
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	err := disk.flushPages()
+	if disk.mapping != nil {
+		if syncErr := syncMapping(disk.mapping); err == nil {
+			err = syncErr
+		}
+		if unmapErr := unmapFile(disk.mapping); err == nil {
+			err = unmapErr
+		}
+		disk.mapping = nil
+	}
+	if closeErr := disk.Device.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
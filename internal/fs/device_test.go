@@ -0,0 +1,118 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestMemoryDevice(t *testing.T) {
+	device := NewMemoryDevice(nil)
+	if _, err := device.WriteAt([]byte("hello"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := device.Size(); size != 15 {
+		t.Fatalf("size %d after writing up to 15", size)
+	}
+
+	p := make([]byte, 5)
+	if _, err := device.ReadAt(p, 10); err != nil || string(p) != "hello" {
+		t.Fatalf("read %q, %v", p, err)
+	}
+	if _, err := device.ReadAt(p, 12); err == nil {
+		t.Fatal("read past the end didn't fail")
+	}
+
+	if err := device.Truncate(12); err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := device.Size(); size != 12 {
+		t.Fatalf("size %d after truncating to 12", size)
+	}
+}
+
+func TestFaultyDeviceCrash(t *testing.T) {
+	device := NewFaultyDevice([]byte("0000000000"))
+	device.WriteAt([]byte("11"), 0)
+	device.Sync()
+	device.WriteAt([]byte("22"), 2)
+	device.Truncate(20)
+
+	device.Crash()
+	data := make([]byte, 10)
+	if _, err := device.ReadAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "1100000000" {
+		t.Fatalf("device holds %q after the crash, only the synced write should be left", data)
+	}
+	if size, _ := device.Size(); size != 10 {
+		t.Fatalf("size %d after the crash, was 10 at the sync", size)
+	}
+}
+
+func TestFaultyDeviceFaults(t *testing.T) {
+	device := NewFaultyDevice(make([]byte, 8))
+
+	device.FailWrite(2)
+	if _, err := device.WriteAt([]byte("a"), 0); err != nil {
+		t.Fatalf("first write: %v", err)
+	}
+	if n, err := device.WriteAt([]byte("b"), 1); n != 0 || !errors.Is(err, ErrInjectedFault) {
+		t.Fatalf("failed write wrote %d bytes, %v", n, err)
+	}
+
+	device.TearWrite(1, 2)
+	if n, err := device.WriteAt([]byte("cccc"), 4); n != 2 || !errors.Is(err, ErrInjectedFault) {
+		t.Fatalf("torn write wrote %d bytes, %v", n, err)
+	}
+	if device.Writes() != 3 {
+		t.Fatalf("%d writes counted, want 3", device.Writes())
+	}
+
+	data := make([]byte, 8)
+	device.ReadAt(data, 0)
+	if !bytes.Equal(data, []byte{'a', 0, 0, 0, 'c', 'c', 0, 0}) {
+		t.Fatalf("device holds %q", data)
+	}
+
+	// faults that haven't happened yet are dropped by a crash
+	device.FailWrite(1)
+	device.Crash()
+	if _, err := device.WriteAt([]byte("d"), 0); err != nil {
+		t.Fatalf("write after the crash: %v", err)
+	}
+}
+
+func TestMountAfterCrash(t *testing.T) {
+	device := NewFaultyDevice(nil)
+	if err := FormatDevice(device, DEFAULT_PAGE_SIZE, ENGINE_INODE); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := MountDevice(device, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced := putValue(t, disk, "synced", bytes.Repeat([]byte("s"), 2*DEFAULT_PAGE_SIZE))
+	if err := disk.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	putValue(t, disk, "lost", bytes.Repeat([]byte("l"), 2*DEFAULT_PAGE_SIZE))
+	if err := disk.FlushPages(); err != nil {
+		t.Fatal(err)
+	}
+
+	device.Crash()
+	if disk, err = MountDevice(device, MountOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := lookupKey(t, disk, "synced"); got != synced {
+		t.Fatalf("synced key is at inode %d, want %d", got, synced)
+	}
+	if lookupKey(t, disk, "lost") != -1 {
+		t.Fatal("a key that was never synced survived the crash")
+	}
+	if report := disk.Check(); !report.Clean() {
+		t.Fatalf("fsck after the crash: %v", report.Problems)
+	}
+}
@@ -6,87 +6,210 @@ import (
 	"fmt"
 	"os"
 	"sync"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/crypt"
 )
 
+// a new disk with the default page size starts with:
 // total pages = 2048
 // superblock = 1 page = 512B
 // inode table = 128 pages = 64KB
 // bitmpa = 1 page = 512B
-// data pages = 1918
+// checksum table = 15 pages = 7.5KB
+// data pages = 1903
+// after that it grows on demand, see Grow, and SuperBlock.TotalPages is the real size of the disk
+//
+// the page size is chosen when the disk is created and stored in the superblock, every offset after
+// Mount is calculated from SuperBlock.Pagesize
+const (
+	VDSK_PATH         = "/Users/yashasav_p/Developer/go-projects/vantadb/.vdsk"
+	DEFAULT_PAGE_SIZE = 512         // bytes
+	MIN_PAGE_SIZE     = 512         // the superblock is always read from the first MIN_PAGE_SIZE bytes
+	MAX_PAGE_SIZE     = 64 * 1024   // the inode table has to start and end on a page boundary
+	INODE_TABLE_SIZE  = 64 * 1024   // 64KB
+	TOTAL_DISK_SIZE   = 1024 * 1024 // 1MB, initial size, the disk grows beyond it
+)
+
+// storage engines, the kv package stores keys directly in inodes, or in an LSM tree whose tables are
+// kept in inodes, see internal/lsm
 const (
-	VDSK_PATH        = "/Users/yashasav_p/Developer/go-projects/vantadb/.vdsk"
-	PAGE_SIZE        = 512 // bytes
-	TOTAL_PAGES      = 2048
-	INODE_TABLE_SIZE = 64 * 1024               // 64KB
-	TOTAL_DISK_SIZE  = TOTAL_PAGES * PAGE_SIZE // 1MB
+	ENGINE_INODE = 0
+	ENGINE_LSM   = 1
 )
 
+var Engines = []string{ENGINE_INODE: "inode", ENGINE_LSM: "lsm"}
+
+// ParseEngine returns the ENGINE_* constant for an engine name
+func ParseEngine(name string) (byte, error) {
+	for engine, engineName := range Engines {
+		if engineName == name {
+			return byte(engine), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown storage engine %q, must be one of %v", name, Engines)
+}
+
 type Disk struct {
-	File       *os.File
+	Device     BlockDevice // see device.go
 	SuperBlock *SuperBlock
 	Inodes     []*Inode
 	Bitmap     *Bitmap
-	Mutex 	*sync.Mutex
+	Checksums  []uint32 // CRC32C of every data page, see checksum.go
+	HashIndex  *HashIndex
+	BTree      *BTree
+	Pool       *BufferPool // data pages, see bufferpool.go
+	Mutex      *sync.Mutex
+
+	mapping  []byte     // the whole file when it is memory mapped, see mapping.go
+	key      *crypt.Key // data pages are encrypted with it, nil when they aren't, see encryption.go
+	readOnly bool
+	memPages map[int][]byte // index pages a read-only disk rebuilt in memory, see allocIndexPages
+	// pages of the stale indexes a read-only disk replaced in memory, they are still used on the disk
+	stalePages []int
+}
+
+type MountOptions struct {
+	// the disk is only read, the file has to be a disk already and nothing is ever written to it
+	// any number of read-only mounts can share a disk, as long as it isn't mounted to write
+	ReadOnly bool
+	// the key of an encrypted disk, nil for one that isn't
+	Key *crypt.Key
 }
 
-func Mount(filePath string) (*Disk, error) {
-	if len(filePath) == 0{
+// returned by every write to a disk mounted read-only
+var ErrReadOnly = errors.New("disk is mounted read-only")
+
+func Mount(filePath string, opts MountOptions) (*Disk, error) {
+	if len(filePath) == 0 {
 		filePath = VDSK_PATH
 	}
-	
+	if opts.ReadOnly {
+		return mountReadOnly(filePath, opts)
+	}
+
 	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
-    if err != nil {
-        return nil, err
-    }
+	if err != nil {
+		return nil, err
+	}
+	// nobody else may write the disk while it is mounted, see lock.go
+	if err := lockFile(file, true); err != nil {
+		file.Close()
+		return nil, err
+	}
 
 	// Get file info to check if it's empty (newly created)
-    fileInfo, err := file.Stat()
-    if err != nil {
-        file.Close()
-        return nil, err
-    }
-
-	// If file is empty or too small, initialize it
-    if fileInfo.Size() < TOTAL_DISK_SIZE {
-        // Initialize the disk storage
-        err = CreateVDSKStorageData(filePath)
-        if err != nil {
-            file.Close()
-            return nil, err
-        }
-        
-        // Reopen the file to read the initialized data
-        file.Close()
-        file, err = os.OpenFile(filePath, os.O_RDWR, 0644)
-        if err != nil {
-            return nil, err
-        }
-    }
-
-	// read the disk storage
-	diskStorage := make([]byte, TOTAL_DISK_SIZE)
-	_, err = file.Read(diskStorage)
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// If file is empty, it is a new disk, initialize it
+	// anything else has to be a valid disk, a short file is never overwritten
+	if fileInfo.Size() == 0 {
+		// Initialize the disk storage, through the file we hold the lock on
+		err = FormatDevice(NewFileDevice(file), DEFAULT_PAGE_SIZE, ENGINE_INODE)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	disk, err := MountDevice(NewFileDevice(file), opts)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return disk, nil
+}
+
+// mountReadOnly never creates or initializes the file, it has to be a disk already
+func mountReadOnly(filePath string, opts MountOptions) (*Disk, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	// readers share the disk, only a writer keeps them out
+	if err := lockFile(file, false); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	disk, err := MountDevice(NewFileDevice(file), opts)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return disk, nil
+}
+
+// MountDevice mounts the disk on device, which has to hold a formatted disk, see FormatDevice
+func MountDevice(device BlockDevice, opts MountOptions) (*Disk, error) {
+	size, err := device.Size()
 	if err != nil {
 		return nil, err
 	}
 
-	// Reset file pointer to beginning for future operations
-    _, err = file.Seek(0, 0)
-    if err != nil {
-        file.Close()
-        return nil, err
-    }
+	// read the superblock first, it tells us the page size and where everything else lives
+	superblock, err := LoadSuperblock(device, size)
+	if err != nil {
+		return nil, err
+	}
 
-	superblock := ReadSuperblock(diskStorage)
-	inodes := ReadInodes(diskStorage, superblock)
-	bitmap := ReadBitmap(diskStorage, superblock)
+	// a resize a crash cut short is finished, or undone, before anything else is read
+	if recovered, err := recoverMove(device, size, int64(superblock.Pagesize), opts.ReadOnly); err != nil {
+		return nil, err
+	} else if recovered != size {
+		size = recovered
+		if superblock, err = LoadSuperblock(device, size); err != nil {
+			return nil, err
+		}
+	}
+
+	if superblock.Version != CURRENT_VERSION {
+		return nil, &UpgradeRequiredError{Version: superblock.Version}
+	}
+	if err := checkKey(superblock, opts.Key); err != nil {
+		return nil, err
+	}
+
+	// the device is the real size of the disk, older disks could grow past TotalPages without updating it
+	pageSize := int64(superblock.Pagesize)
+	if devicePages := uint32((size + pageSize - 1) / pageSize); devicePages > superblock.TotalPages {
+		superblock.TotalPages = devicePages
+	}
+
+	inodes, err := ReadInodes(device, superblock)
+	if err != nil {
+		return nil, err
+	}
+	bitmap, err := ReadBitmap(device, superblock)
+	if err != nil {
+		return nil, err
+	}
+	checksums, err := ReadChecksums(device, superblock)
+	if err != nil {
+		return nil, err
+	}
 
 	disk := &Disk{
-		File:       file,
+		Device:     device,
 		SuperBlock: superblock,
 		Inodes:     inodes,
 		Bitmap:     bitmap,
+		Checksums:  checksums,
+		Pool:       NewBufferPool(DEFAULT_BUFFER_POOL_PAGES),
 		Mutex:      &sync.Mutex{},
+		key:        opts.Key,
+		readOnly:   opts.ReadOnly,
+	}
+
+	// the indexes need the inodes and the bitmap, they are built here if they are missing or stale
+	if err := disk.loadHashIndex(); err != nil {
+		return nil, fmt.Errorf("could not load hash index: %w", err)
+	}
+	if err := disk.loadBTree(); err != nil {
+		return nil, fmt.Errorf("could not load b+tree: %w", err)
 	}
 
 	return disk, nil
@@ -97,12 +220,9 @@ func OpenVDSK(filePath string) (*os.File, error) {
 		filePath = VDSK_PATH
 	}
 
-	file, err := os.Open(filePath)
-	if errors.Is(err, os.ErrNotExist) {
-		file, err = os.Create(VDSK_PATH)
-		if err != nil {
-			return nil, fmt.Errorf("file doesn't exist, and failed to create file: %s", err)
-		}
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open or create file: %s", err)
 	}
 
 	return file, nil
@@ -118,27 +238,61 @@ func CloseVDSK(file *os.File) {
 	file.Close()
 }
 
-func CreateVDSKStorageData(filePath string) error {
+func CreateVDSKStorageData(filePath string, pageSize int, engine byte) error {
+	diskStorage, err := newDiskImage(pageSize, engine)
+	if err != nil {
+		return err
+	}
+	return writeToDisk(diskStorage, filePath)
+}
+
+// FormatDevice writes a new, empty disk to device
+func FormatDevice(device BlockDevice, pageSize int, engine byte) error {
+	diskStorage, err := newDiskImage(pageSize, engine)
+	if err != nil {
+		return err
+	}
+	if err := device.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := device.WriteAt(diskStorage, 0); err != nil {
+		return err
+	}
+	return device.Sync()
+}
+
+// newDiskImage returns the bytes of a new disk
+func newDiskImage(pageSize int, engine byte) ([]byte, error) {
+
+	if err := ValidatePageSize(pageSize); err != nil {
+		return nil, err
+	}
+	if int(engine) >= len(Engines) {
+		return nil, fmt.Errorf("unknown storage engine %d", engine)
+	}
 
 	// init diskstorage object
 	diskStorage := make([]byte, TOTAL_DISK_SIZE)
 
 	// put superblock data in diskstorage
-	superblock := NewSuperBlock()
+	superblock := NewSuperBlock(pageSize)
+	superblock.Engine[0] = engine
 	superblockData := serializeSuperblock(superblock)
-	copy(diskStorage[0:PAGE_SIZE], superblockData)
+	copy(diskStorage[0:pageSize], superblockData)
 
 	// inode table - 64KB zeroes - already zero due to make of byte array
 
 	// bit map
-	bitmap := NewBitmap()
+	bitmap := NewBitmap(superblock.DataPageCount(), pageSize)
 	bitmapData := serializeBitmap(bitmap)
-	bitmapOffset := (PAGE_SIZE + INODE_TABLE_SIZE)                     // 1 page for super block + 128 pages for inode table
-	copy(diskStorage[bitmapOffset:bitmapOffset+PAGE_SIZE], bitmapData) // take 1 page for bitmap
+	bitmapOffset := superblock.BitmapStartOffset                               // 1 page for super block + 128 pages for inode table
+	copy(diskStorage[bitmapOffset:superblock.ChecksumStartOffset], bitmapData) // take 1 page for bitmap
+
+	// checksum table - all zeroes, no page has been written yet
 
 	// data pages - remaining space, no need to fill anything, already zeor due to make
 
-	return writeToDisk(diskStorage, filePath)
+	return diskStorage, nil
 
 }
 
@@ -175,60 +329,362 @@ func ReadDisk(file *os.File) ([]byte, error) {
 	return data, nil
 }
 
+func (disk *Disk) ReadOnly() bool {
+	return disk.readOnly
+}
 
+// PageSize returns how many bytes of a data page hold data, the page size stored in the superblock less
+// the nonce and tag on an encrypted disk, see encryption.go
+func (disk *Disk) PageSize() int {
+	if disk.Encrypted() {
+		return int(disk.SuperBlock.Pagesize) - crypt.OVERHEAD
+	}
+	return int(disk.SuperBlock.Pagesize)
+}
 
-func (disk *Disk) WritePageToDisk(pageNumber int, data [PAGE_SIZE]byte) error {
+// NewPage returns an empty buffer of one page
+func (disk *Disk) NewPage() []byte {
+	return make([]byte, disk.PageSize())
+}
+
+// ValidatePageSize checks that a page size can be used for a disk, it has to be a power of two
+// between MIN_PAGE_SIZE and MAX_PAGE_SIZE
+func ValidatePageSize(pageSize int) error {
+	if pageSize < MIN_PAGE_SIZE || pageSize > MAX_PAGE_SIZE || pageSize&(pageSize-1) != 0 {
+		return fmt.Errorf("invalid page size %d, must be a power of two between %d and %d", pageSize, MIN_PAGE_SIZE, MAX_PAGE_SIZE)
+	}
+	return nil
+}
+
+// WritePageToDisk writes a data page to the buffer pool, it reaches the file when it is written back
+// a memory mapped disk writes it to the mapping right away
+func (disk *Disk) WritePageToDisk(pageNumber int, data []byte) error {
+	if disk.readOnly && !disk.inMemory(pageNumber) {
+		return ErrReadOnly
+	}
+	if len(data) != disk.PageSize() {
+		return fmt.Errorf("page data is %d bytes, page size is %d", len(data), disk.PageSize())
+	}
 
-	offset := disk.SuperBlock.DataStartOffset // offset from where the data starts
-	offset += uint32(pageNumber) * PAGE_SIZE // add to offset the pageNumber where we want to go, each page is PAGE_SIZE bytes
-	
 	disk.Mutex.Lock()
 	defer disk.Mutex.Unlock()
 
-	_, err := disk.File.WriteAt(data[:], int64(offset))
+	if disk.readOnly {
+		copy(disk.memPages[pageNumber], data)
+		return nil
+	}
 
-	return err
+	if disk.mapping != nil {
+		sealed, err := disk.sealPage(pageNumber, data)
+		if err != nil {
+			return err
+		}
+		offset := int64(disk.SuperBlock.DataStartOffset) + int64(pageNumber)*int64(disk.pageBytes())
+		if err := disk.writeAt(sealed, offset); err != nil {
+			return err
+		}
+		return disk.writeChecksum(pageNumber, pageChecksum(sealed))
+	}
+
+	f, err := disk.fetch(pageNumber, false)
+	if err != nil {
+		return err
+	}
+	copy(f.data, data)
+	f.dirty = true
+	disk.Pool.dirty[pageNumber] = f
+	f.pins--
+	return nil
 }
 
-func (disk *Disk) ReadPageFromDisk(pageNumber int) ([PAGE_SIZE]byte, error) {
-    var data [PAGE_SIZE]byte
-    offset := disk.SuperBlock.DataStartOffset + uint32(pageNumber) * PAGE_SIZE
-    
-    disk.Mutex.Lock()
-    defer disk.Mutex.Unlock()
-    
-    _, err := disk.File.ReadAt(data[:], int64(offset))
-    
-    return data, err
+// ReadPageFromDisk reads a data page, from the buffer pool if it is there, a page read from the file is
+// verified against its checksum and a mismatch returns ErrCorruptPage
+// a memory mapped disk returns the page in the mapping, it must not be changed and is only valid until
+// the disk is written to again
+func (disk *Disk) ReadPageFromDisk(pageNumber int) ([]byte, error) {
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	if data, ok := disk.memPages[pageNumber]; ok {
+		return append([]byte{}, data...), nil
+	}
+
+	if disk.mapping != nil {
+		offset := int(disk.SuperBlock.DataStartOffset) + pageNumber*disk.pageBytes()
+		end := offset + disk.pageBytes()
+		if pageNumber < 0 || end > len(disk.mapping) {
+			return disk.NewPage(), fmt.Errorf("data page %d is past the end of the disk", pageNumber)
+		}
+		raw := disk.mapping[offset:end:end]
+		if err := disk.verifyPage(pageNumber, raw); err != nil {
+			return raw, err
+		}
+		// an encrypted page is opened into a copy, the mapping only has it sealed
+		data, err := disk.openPage(pageNumber, raw)
+		if err != nil {
+			return disk.NewPage(), err
+		}
+		return data, nil
+	}
+
+	f, err := disk.fetch(pageNumber, true)
+	if err != nil {
+		return disk.NewPage(), err
+	}
+	f.pins--
+
+	// the caller gets its own copy, the frame can be evicted or changed once unpinned
+	data := disk.NewPage()
+	copy(data, f.data)
+	return data, nil
 }
 
 func (disk *Disk) WriteInodeToDisk(inodeIndex int, inode *Inode) error {
-    offset := disk.SuperBlock.InodeTableStartOffset + uint32(inodeIndex * 64) // Each inode is 64 bytes
-    inodeData := inode.ToBytes()
-    
-    disk.Mutex.Lock()
-    defer disk.Mutex.Unlock()
-    
-    _, err := disk.File.WriteAt(inodeData, int64(offset))
-    
-    return err
+	offset := disk.SuperBlock.InodeTableStartOffset + uint32(inodeIndex*64) // Each inode is 64 bytes
+	inodeData := inode.ToBytes()
+
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	// the pages the inode points at go first
+	if err := disk.flushPages(); err != nil {
+		return err
+	}
+	return disk.writeAt(inodeData, int64(offset))
 }
 
 func (disk *Disk) WriteBitmapToDisk() error {
-    offset := disk.SuperBlock.BitmapStartOffset
-    bitmapData := serializeBitmap(disk.Bitmap)
-    
-    disk.Mutex.Lock()
-    defer disk.Mutex.Unlock()
-    
-    _, err := disk.File.WriteAt(bitmapData, int64(offset))
-    
-    return err
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	return disk.writeBitmap()
+}
+
+// WriteIndexesToDisk writes the hash index and the b+tree, call it after writing the inodes they describe
+// it ends an operation, so the buffer pool is written back too
+func (disk *Disk) WriteIndexesToDisk() error {
+	if err := disk.WriteHashIndexToDisk(); err != nil {
+		return err
+	}
+	if err := disk.WriteBTreeToDisk(); err != nil {
+		return err
+	}
+	return disk.FlushPages()
+}
+
+func (disk *Disk) WriteSuperblockToDisk() error {
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	return disk.writeSuperblock()
+}
+
+// Checkpoint records that everything the WAL holds up to walOffset is on the disk, the pages are synced
+// before the superblock points past them, and the superblock after
+func (disk *Disk) Checkpoint(walOffset int64) error {
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	if disk.readOnly {
+		return ErrReadOnly
+	}
+	if err := disk.flushPages(); err != nil {
+		return err
+	}
+	if err := disk.sync(); err != nil {
+		return err
+	}
+	disk.SuperBlock.WALCheckpoint = uint64(walOffset)
+	if err := disk.writeSuperblock(); err != nil {
+		return err
+	}
+	return disk.sync()
+}
+
+// writeBitmap and writeSuperblock expect the caller to hold disk.Mutex, like inodes they are metadata and
+// dirty pages are written back before them
+func (disk *Disk) writeBitmap() error {
+	if err := disk.flushPages(); err != nil {
+		return err
+	}
+	offset := disk.SuperBlock.BitmapStartOffset
+	bitmapData := serializeBitmap(disk.Bitmap)
+
+	return disk.writeAt(bitmapData, int64(offset))
+}
+
+func (disk *Disk) writeSuperblock() error {
+	if err := disk.flushPages(); err != nil {
+		return err
+	}
+	return disk.writeAt(serializeSuperblock(disk.SuperBlock), 0)
+}
+
+// FindFreePages returns numberOfPages free data pages, as one extent when there is a long enough run, see
+// Bitmap.FindFreeExtent, growing the disk if the bitmap has run out of them
+func (disk *Disk) FindFreePages(numberOfPages int) ([]int, error) {
+	if numberOfPages <= 0 {
+		return []int{}, nil
+	}
+
+	if disk.Bitmap.FreePageCount() < numberOfPages {
+		if err := disk.Grow(numberOfPages); err != nil {
+			return nil, fmt.Errorf("could not grow disk: %v", err)
+		}
+	}
+
+	if start := disk.Bitmap.FindFreeExtent(numberOfPages); start >= 0 {
+		freePages := make([]int, numberOfPages)
+		for i := range freePages {
+			freePages[i] = start + i
+		}
+		return freePages, nil
+	}
+
+	// no run is long enough, the first free pages fill the holes in as few extents as they allow
+	freePages := disk.Bitmap.FindFreePages(numberOfPages)
+	if len(freePages) == 0 {
+		return nil, fmt.Errorf("no free pages available")
+	}
+	return freePages, nil
+}
+
+/*
+allocIndexPages allocates n pages for the hash index or the b+tree and marks them used.
+
+A read-only disk can't write its bitmap, a stale index it finds on mount is rebuilt in memory instead,
+on pages numbered past its last page that only ever live in memPages. The rebuilt index is lost when it
+is unmounted, the next mount that can write rebuilds it for good.
+*/
+func (disk *Disk) allocIndexPages(n int) ([]int, error) {
+	if disk.readOnly {
+		if disk.memPages == nil {
+			disk.memPages = map[int][]byte{}
+		}
+		pages := make([]int, n)
+		for i := range pages {
+			pages[i] = disk.Bitmap.Pages() + len(disk.memPages)
+			disk.memPages[pages[i]] = disk.NewPage()
+		}
+		return pages, nil
+	}
+
+	pages, err := disk.FindFreePages(n)
+	if err != nil {
+		return nil, err
+	}
+	for _, page := range pages {
+		disk.Bitmap.AllocatePage(page)
+	}
+	return pages, nil
+}
+
+// inMemory reports whether page is one allocIndexPages gave a read-only disk
+func (disk *Disk) inMemory(page int) bool {
+	_, ok := disk.memPages[page]
+	return ok
 }
 
+// Grow makes room for at least extraPages more data pages, by default the data region doubles
+func (disk *Disk) Grow(extraPages int) error {
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	oldDataPages := disk.SuperBlock.DataPageCount()
+
+	newDataPages := oldDataPages * 2
+	if newDataPages < oldDataPages+extraPages {
+		newDataPages = oldDataPages + extraPages
+	}
+
+	return disk.resize(newDataPages)
+}
+
+/*
+resize lays the disk out for dataPages data pages, it never shrinks the bitmap or the checksum table.
+
+If the bitmap or the checksum table can't track the new data pages, they need more pages, and since they
+sit right before the data region, the whole data region is moved forward to make space, through the
+journal in journal.go so a crash leaves one layout or the other. Page numbers in the inodes are relative
+to DataStartOffset, so they stay valid after the move.
+
+Caller holds disk.Mutex.
+*/
+func (disk *Disk) resize(dataPages int) error {
+	if disk.readOnly {
+		return ErrReadOnly
+	}
+	sb := disk.SuperBlock
+	pageSize := int64(sb.Pagesize)
+
+	bitmapPages := max(bitmapPagesFor(dataPages, int(pageSize)), sb.BitmapPageCount())
+	checksumPages := max(checksumPagesFor(dataPages, int(pageSize)), int(sb.ChecksumPages))
+
+	checksumStart := int64(sb.BitmapStartOffset) + int64(bitmapPages)*pageSize
+	dataStart := checksumStart + int64(checksumPages)*pageSize
+	totalPages := uint32(dataStart/pageSize) + uint32(dataPages)
+
+	newSB := *sb
+	newSB.BitmapPages = uint32(bitmapPages)
+	newSB.ChecksumStartOffset = uint32(checksumStart)
+	newSB.ChecksumPages = uint32(checksumPages)
+	newSB.DataStartOffset = uint32(dataStart)
+	newSB.TotalPages = totalPages
+
+	checksums := disk.Checksums
+	if entries := checksumPages * int(pageSize) / 4; entries > len(checksums) {
+		checksums = make([]uint32, entries)
+		copy(checksums, disk.Checksums)
+	}
+
+	if dataStart > int64(sb.DataStartOffset) {
+		// the image of the data region is read from the device, it has to hold every page the checksum
+		// table has a checksum for
+		if err := disk.flushPages(); err != nil {
+			return err
+		}
+		if err := disk.sync(); err != nil {
+			return err
+		}
+		bitmap := make([]byte, bitmapPages*int(pageSize))
+		copy(bitmap, disk.Bitmap.GetBits())
+		if err := disk.moveData(&newSB, bitmap, checksums); err != nil {
+			return err
+		}
+
+		*sb = newSB
+		disk.Bitmap.Resize(dataPages)
+		disk.Checksums = checksums
+		return disk.remap()
+	}
+
+	// the bitmap and the checksum table stay where they are, only the device grows
+	if err := disk.Device.Truncate(int64(totalPages) * pageSize); err != nil {
+		return err
+	}
+	if err := disk.remap(); err != nil {
+		return err
+	}
+
+	*sb = newSB
+	disk.Bitmap.Resize(dataPages)
+	disk.Checksums = checksums
+
+	if err := disk.writeBitmap(); err != nil {
+		return err
+	}
+	if err := disk.writeChecksumTable(); err != nil {
+		return err
+	}
+	if err := disk.writeSuperblock(); err != nil {
+		return err
+	}
+
+	return disk.sync()
+}
 
 func serializeSuperblock(sb *SuperBlock) []byte {
-	data := make([]byte, PAGE_SIZE) // Full page for superblock
+	data := make([]byte, sb.Pagesize) // Full page for superblock
 
 	copy(data[0:4], sb.Magic[:])
 	copy(data[4:6], sb.Version[:])
@@ -237,12 +693,25 @@ func serializeSuperblock(sb *SuperBlock) []byte {
 	binary.LittleEndian.PutUint32(data[14:18], sb.InodeTableStartOffset)
 	binary.LittleEndian.PutUint32(data[18:22], sb.BitmapStartOffset)
 	binary.LittleEndian.PutUint32(data[22:26], sb.DataStartOffset)
+	binary.LittleEndian.PutUint32(data[26:30], sb.BitmapPages)
+	binary.LittleEndian.PutUint32(data[34:38], sb.ChecksumStartOffset)
+	binary.LittleEndian.PutUint32(data[38:42], sb.ChecksumPages)
+	binary.LittleEndian.PutUint32(data[42:46], sb.HashIndexPage)
+	binary.LittleEndian.PutUint32(data[46:50], sb.BTreePage)
+	copy(data[50:51], sb.Engine[:])
+	copy(data[51:52], sb.Codec[:])
+	binary.LittleEndian.PutUint32(data[52:56], sb.CompressMinSize)
+	copy(data[56:64], sb.KeyID[:])
+	binary.LittleEndian.PutUint64(data[64:72], sb.WALCheckpoint)
+
+	sb.Checksum = superblockChecksum(data)
+	binary.LittleEndian.PutUint32(data[30:34], sb.Checksum)
 
 	return data
 }
 
 func serializeBitmap(bm *Bitmap) []byte {
-	data := make([]byte, PAGE_SIZE)
+	data := make([]byte, len(bm.GetBits()))
 	copy(data, bm.GetBits()) // You'll need to add this method to Bitmap
 	return data
 }
@@ -259,4 +728,3 @@ func writeToDisk(data []byte, filePath string) error {
 
 	return err
 }
-
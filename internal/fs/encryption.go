@@ -0,0 +1,295 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/crypt"
+)
+
+/*
+Encrypted disks.
+
+A disk can be encrypted when it is created, every data page is then sealed with AES-GCM, see
+internal/crypt, before it is written to the file and opened when it is read back. The nonce and the
+tag take crypt.OVERHEAD bytes of the page, so PageSize is that much smaller than the page size in the
+superblock, which stays the size of a page in the file. The page number is authenticated with the page,
+a page copied somewhere else doesn't open.
+
+The buffer pool holds pages opened, a page is sealed when it is written back, with a new nonce every
+time. The checksum of a page is that of the sealed bytes, a torn write is still told apart from a wrong key.
+
+Only the data pages are encrypted. The superblock, the bitmap and the checksum table say nothing about
+the values, but the inode table holds the first INLINE_KEY_SIZE bytes of every key, see keys.go, and those
+are not encrypted. Small values aren't stored in the inode on an encrypted disk, see inline.go.
+
+The superblock records KeyID, the ID of the key, zero for a disk that isn't encrypted. Mount needs the
+key of an encrypted disk and refuses any other. The pages of a disk created without a key have no room
+for the nonce and tag, it can't be encrypted in place, kv.Rekey copies its pairs to a new encrypted disk.
+*/
+
+var (
+	ErrKeyRequired  = errors.New("disk is encrypted, a key is needed to mount it")
+	ErrWrongKey     = errors.New("disk is encrypted with another key")
+	ErrNotEncrypted = errors.New("disk isn't encrypted, it can't be mounted with a key")
+)
+
+// Encrypted reports whether the data pages of the disk are encrypted
+func (sb *SuperBlock) Encrypted() bool {
+	return sb.KeyID != [8]byte{}
+}
+
+func (disk *Disk) Encrypted() bool {
+	return disk.SuperBlock.Encrypted()
+}
+
+// checkKey makes sure key is the key of the disk, nil if it isn't encrypted
+func checkKey(superblock *SuperBlock, key *crypt.Key) error {
+	switch {
+	case !superblock.Encrypted() && key != nil:
+		return ErrNotEncrypted
+	case superblock.Encrypted() && key == nil:
+		return ErrKeyRequired
+	case superblock.Encrypted() && key.ID != superblock.KeyID:
+		return fmt.Errorf("%w %s, not %s", ErrWrongKey, crypt.KeyID(superblock.KeyID), key.ID)
+	}
+	return nil
+}
+
+// pageBytes returns the size of a data page in the file, PageSize plus the nonce and tag on an encrypted disk
+func (disk *Disk) pageBytes() int {
+	return int(disk.SuperBlock.Pagesize)
+}
+
+// pageAD is authenticated with a sealed page, it ties the page to its place on the disk
+func pageAD(pageNumber int) []byte {
+	return binary.LittleEndian.AppendUint32(nil, uint32(pageNumber))
+}
+
+// sealPage returns data page pageNumber as it is written to the file
+func (disk *Disk) sealPage(pageNumber int, data []byte) ([]byte, error) {
+	if disk.key == nil {
+		return data, nil
+	}
+	sealed, err := disk.key.Seal(data, pageAD(pageNumber))
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt data page %d: %v", pageNumber, err)
+	}
+	return sealed, nil
+}
+
+// openPage returns data page pageNumber from the bytes read from the file, which have been verified
+// against its checksum, caller holds disk.Mutex
+func (disk *Disk) openPage(pageNumber int, raw []byte) ([]byte, error) {
+	if disk.key == nil {
+		return raw, nil
+	}
+	// a page that was never written is all zeroes, there is nothing to open
+	if pageNumber >= len(disk.Checksums) || disk.Checksums[pageNumber] == 0 {
+		return disk.NewPage(), nil
+	}
+	data, err := disk.key.Open(raw, pageAD(pageNumber))
+	if err != nil {
+		return nil, fmt.Errorf("%w: data page %d doesn't decrypt", ErrCorruptPage, pageNumber)
+	}
+	return data, nil
+}
+
+// EncryptNewDisk records key in the superblock of the disk at filePath, whose data pages are encrypted
+// with it from then on, it has to be a new disk no data page was written to yet
+func EncryptNewDisk(filePath string, key *crypt.Key) error {
+	file, err := os.OpenFile(filePath, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := lockFile(file, true); err != nil {
+		return err
+	}
+
+	superblock, checksums, err := readKeyedDisk(file)
+	if err != nil {
+		return err
+	}
+	if superblock.Encrypted() {
+		return fmt.Errorf("disk is already encrypted")
+	}
+	for _, checksum := range checksums {
+		if checksum != 0 {
+			return fmt.Errorf("data pages were written without encryption, only a new disk can be encrypted")
+		}
+	}
+
+	superblock.KeyID = key.ID
+	if _, err := file.WriteAt(serializeSuperblock(superblock), 0); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+/*
+Rekey encrypts the disk at filePath with newKey instead of oldKey. It must not be mounted while this runs.
+
+Like Upgrade it works on a copy, every data page ever written is opened with the old key and sealed
+with the new one, and the copy is renamed over the original once it is done, a crash leaves the disk
+with one key or the other. No backup is kept, it would still be readable with the old key. A disk
+already encrypted with newKey is left as it is, so an interrupted rotation can be run again.
+*/
+func Rekey(filePath string, oldKey *crypt.Key, newKey *crypt.Key) error {
+	original, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer original.Close()
+	if err := lockFile(original, true); err != nil {
+		return err
+	}
+
+	superblock, _, err := readKeyedDisk(original)
+	if err != nil {
+		return err
+	}
+	if superblock.Encrypted() && superblock.KeyID == newKey.ID {
+		return nil
+	}
+	if !superblock.Encrypted() {
+		return fmt.Errorf("%w, its pages have no room for the nonce and tag, it has to be copied to an encrypted disk", ErrNotEncrypted)
+	}
+	if err := checkKey(superblock, oldKey); err != nil {
+		return err
+	}
+
+	tmpPath := filePath + ".rekey"
+	if err := copyFile(original, tmpPath); err != nil {
+		return fmt.Errorf("could not copy disk: %v", err)
+	}
+	defer os.Remove(tmpPath) // no-op once it has been renamed
+
+	if err := rekeyFile(tmpPath, oldKey, newKey); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(filePath))
+}
+
+// rekeyFile seals every data page of the disk at path that was written with newKey instead of oldKey
+func rekeyFile(path string, oldKey *crypt.Key, newKey *crypt.Key) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	superblock, checksums, err := readKeyedDisk(file)
+	if err != nil {
+		return err
+	}
+
+	// free pages are sealed again too, what is left in them must not open with the old key either
+	pageSize := int64(superblock.Pagesize)
+	raw := make([]byte, pageSize)
+	for page := 0; page < superblock.DataPageCount() && page < len(checksums); page++ {
+		if checksums[page] == 0 {
+			continue // never written
+		}
+		offset := int64(superblock.DataStartOffset) + int64(page)*pageSize
+		if _, err := file.ReadAt(raw, offset); err != nil {
+			return fmt.Errorf("could not read data page %d: %v", page, err)
+		}
+		if pageChecksum(raw) != checksums[page] {
+			return fmt.Errorf("%w: data page %d", ErrCorruptPage, page)
+		}
+		data, err := oldKey.Open(raw, pageAD(page))
+		if err != nil {
+			return fmt.Errorf("%w: data page %d doesn't decrypt", ErrCorruptPage, page)
+		}
+		sealed, err := newKey.Seal(data, pageAD(page))
+		if err != nil {
+			return err
+		}
+		if _, err := file.WriteAt(sealed, offset); err != nil {
+			return err
+		}
+		checksums[page] = pageChecksum(sealed)
+	}
+
+	tableData := make([]byte, int64(superblock.ChecksumPages)*pageSize)
+	for i, checksum := range checksums {
+		binary.LittleEndian.PutUint32(tableData[i*4:i*4+4], checksum)
+	}
+	if _, err := file.WriteAt(tableData, int64(superblock.ChecksumStartOffset)); err != nil {
+		return err
+	}
+
+	// the superblock last, until it names the new key the copy isn't used
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	superblock.KeyID = newKey.ID
+	if _, err := file.WriteAt(serializeSuperblock(superblock), 0); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// ReadKeyID returns the ID of the key the disk at filePath is encrypted with without mounting it, zero if
+// it isn't encrypted or there is no disk yet, which Mount creates
+func ReadKeyID(filePath string) (crypt.KeyID, error) {
+	if len(filePath) == 0 {
+		filePath = VDSK_PATH
+	}
+	file, err := os.Open(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return crypt.KeyID{}, nil
+	}
+	if err != nil {
+		return crypt.KeyID{}, err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil || fileInfo.Size() == 0 {
+		return crypt.KeyID{}, err
+	}
+	superblock, err := LoadSuperblock(file, fileInfo.Size())
+	if err != nil {
+		return crypt.KeyID{}, err
+	}
+	// the bytes of the key ID meant nothing before VERSION_10, such a disk is upgraded before it mounts
+	if formatIndex(superblock.Version) < formatIndex(VERSION_10) {
+		return crypt.KeyID{}, nil
+	}
+	return crypt.KeyID(superblock.KeyID), nil
+}
+
+// readKeyedDisk reads the superblock and the checksum table of a disk file that isn't mounted, it has
+// to have the current version, only those can be encrypted
+func readKeyedDisk(file *os.File) (*SuperBlock, []uint32, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	superblock, err := LoadSuperblock(file, fileInfo.Size())
+	if err != nil {
+		return nil, nil, err
+	}
+	if superblock.Version != CURRENT_VERSION {
+		return nil, nil, &UpgradeRequiredError{Version: superblock.Version}
+	}
+	// the pages of an unfinished move are still in its image, see journal.go
+	if j, err := readMoveJournal(file, fileInfo.Size(), int64(superblock.Pagesize)); err != nil {
+		return nil, nil, err
+	} else if j != nil {
+		return nil, nil, ErrUnfinishedMove
+	}
+	checksums, err := ReadChecksums(file, superblock)
+	if err != nil {
+		return nil, nil, err
+	}
+	return superblock, checksums, nil
+}
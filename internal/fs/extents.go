@@ -0,0 +1,136 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+Extent mapped inodes.
+
+An inode with INODE_FLAG_EXTENTS records its data pages as extents, runs of contiguous pages, instead
+of one page number per page. Up to INLINE_EXTENTS extents are kept in PageNumbers as pairs:
+PageNumbers[2i]   - first page of the extent
+PageNumbers[2i+1] - number of pages in it
+and NumberofPages is the number of extents.
+
+A value in more pieces also sets INODE_FLAG_INDIRECT, PageNumbers[0] is then an extent page holding up
+to page size / 8 pairs laid out the same way, a length of 0 ends the list, and NumberofPages is 1.
+
+MapInodePages picks the layout from the pages it is given, see MapPagesNeeded. A value in too many
+pieces for one extent page falls back to the block pointers of blocks.go, and so does a small one that
+fits in the direct page numbers anyway. Inodes written before extents existed keep their layout until
+they are written again.
+*/
+const (
+	INLINE_EXTENTS = MAX_PAGES / 2
+
+	INODE_FLAG_EXTENTS = 1 << 2 // PageNumbers holds extents
+)
+
+// Extent is a run of Length contiguous data pages starting at Start
+type Extent struct {
+	Start  int
+	Length int
+}
+
+// Extents splits pages into runs of contiguous pages, in order
+func Extents(pages []int) []Extent {
+	extents := []Extent{}
+	for _, page := range pages {
+		if n := len(extents); n > 0 && extents[n-1].Start+extents[n-1].Length == page {
+			extents[n-1].Length++
+			continue
+		}
+		extents = append(extents, Extent{Start: page, Length: 1})
+	}
+	return extents
+}
+
+// ExtentsPerPage returns how many extents fit in one extent page
+func (disk *Disk) ExtentsPerPage() int {
+	return disk.PageSize() / 8 // each extent is two uint32
+}
+
+// MapPagesNeeded returns how many pages besides dataPages MapInodePages needs to map them, an extent page
+// or indirect pages, none when the extents or the page numbers fit in the inode
+func (disk *Disk) MapPagesNeeded(dataPages []int) int {
+	extents := len(Extents(dataPages))
+	switch {
+	case extents <= INLINE_EXTENTS || len(dataPages) <= MAX_PAGES:
+		return 0
+	case extents <= disk.ExtentsPerPage():
+		return 1
+	default:
+		return disk.IndirectPagesNeeded(len(dataPages))
+	}
+}
+
+// mapExtents points the inode at extents, writing them to extentPage if they don't fit inline
+func (disk *Disk) mapExtents(inode *Inode, extents []Extent, extentPage int) error {
+	inode.Flags[0] |= INODE_FLAG_EXTENTS
+
+	if len(extents) <= INLINE_EXTENTS {
+		for i, extent := range extents {
+			inode.PageNumbers[2*i] = uint32(extent.Start)
+			inode.PageNumbers[2*i+1] = uint32(extent.Length)
+		}
+		inode.NumberofPages[0] = byte(len(extents))
+		return nil
+	}
+
+	data := disk.NewPage()
+	for i, extent := range extents {
+		binary.LittleEndian.PutUint32(data[i*8:i*8+4], uint32(extent.Start))
+		binary.LittleEndian.PutUint32(data[i*8+4:i*8+8], uint32(extent.Length))
+	}
+	if err := disk.WritePageToDisk(extentPage, data); err != nil {
+		return err
+	}
+	inode.Flags[0] |= INODE_FLAG_INDIRECT
+	inode.PageNumbers[0] = uint32(extentPage)
+	inode.NumberofPages[0] = 1
+	return nil
+}
+
+// extentPages returns the data pages of an extent mapped inode in order, and its extent page if it has one
+func (disk *Disk) extentPages(inode *Inode) ([]int, []int, error) {
+	extents := []Extent{}
+	extentPages := []int{}
+
+	if inode.Flags[0]&INODE_FLAG_INDIRECT == 0 {
+		for i := 0; i < int(inode.NumberofPages[0]) && i < INLINE_EXTENTS; i++ {
+			extents = append(extents, Extent{int(inode.PageNumbers[2*i]), int(inode.PageNumbers[2*i+1])})
+		}
+	} else {
+		page := int(inode.PageNumbers[0])
+		data, err := disk.ReadPageFromDisk(page)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read extent page %d: %w", page, err)
+		}
+		extentPages = append(extentPages, page)
+		for i := 0; i < disk.ExtentsPerPage(); i++ {
+			length := binary.LittleEndian.Uint32(data[i*8+4 : i*8+8])
+			if length == 0 {
+				break
+			}
+			extents = append(extents, Extent{int(binary.LittleEndian.Uint32(data[i*8 : i*8+4])), int(length)})
+		}
+	}
+
+	// a broken length can't make us expand more pages than the value has
+	pagesNeeded := disk.PagesNeeded(inode.valueSize())
+	dataPages := []int{}
+	for _, extent := range extents {
+		if len(dataPages)+extent.Length > pagesNeeded {
+			return nil, nil, fmt.Errorf("inode extents hold more than the %d pages of its value", pagesNeeded)
+		}
+		for page := extent.Start; page < extent.Start+extent.Length; page++ {
+			dataPages = append(dataPages, page)
+		}
+	}
+	if len(dataPages) != pagesNeeded {
+		return nil, nil, fmt.Errorf("inode maps %d pages, expected %d", len(dataPages), pagesNeeded)
+	}
+	return dataPages, extentPages, nil
+}
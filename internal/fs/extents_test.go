@@ -0,0 +1,155 @@
+package fs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// scanFreeRun finds the lowest run of n free pages that starts at from or later one page at a time, what
+// findRun does with the group summaries
+func scanFreeRun(bm *Bitmap, n int, from int) int {
+	run := 0
+	for page := max(from, RESERVED_PAGES); page < bm.Pages(); page++ {
+		if bm.IsAllocated(page) {
+			run = 0
+			continue
+		}
+		run++
+		if run == n {
+			return page - n + 1
+		}
+	}
+	return -1
+}
+
+func TestFindFreeRunMatchesScan(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	// not a whole number of groups or words, the pages past the end must never be handed out
+	const pages = 5*GROUP_PAGES + 100
+
+	for _, density := range []float64{0, 0.05, 0.5, 0.95, 1} {
+		bm := NewBitmap(pages, DEFAULT_PAGE_SIZE)
+		for page := 0; page < pages; page++ {
+			if r.Float64() < density {
+				bm.AllocatePage(page)
+			}
+		}
+		// long runs across group boundaries
+		for page := GROUP_PAGES - 40; page < 3*GROUP_PAGES+20; page++ {
+			if density < 1 {
+				bm.FreePage(page)
+			}
+		}
+
+		for _, n := range []int{1, 2, 7, WORD_PAGES, WORD_PAGES + 1, GROUP_PAGES, 2*GROUP_PAGES + 60, pages} {
+			want := scanFreeRun(bm, n, 0)
+			if got := bm.FindFreeRun(n); got != want {
+				t.Fatalf("density %v: lowest run of %d at %d, want %d", density, n, got, want)
+			}
+
+			// next-fit starts at the group of the last allocation, and wraps around
+			hint := r.Intn(pages)
+			bm.hint = hint
+			want = scanFreeRun(bm, n, hint/GROUP_PAGES*GROUP_PAGES)
+			if want < 0 {
+				want = scanFreeRun(bm, n, 0)
+			}
+			if got := bm.FindFreeExtent(n); got != want {
+				t.Fatalf("density %v: run of %d from hint %d at %d, want %d", density, n, hint, got, want)
+			}
+		}
+
+		// the summaries follow allocations
+		if start := bm.FindFreeRun(5); start >= 0 {
+			bm.AllocatePage(start + 2)
+			if got, want := bm.FindFreeRun(5), scanFreeRun(bm, 5, 0); got != want {
+				t.Fatalf("density %v: run of 5 at %d after an allocation, want %d", density, got, want)
+			}
+			bm.FreePage(start + 2)
+			if got := bm.FindFreeRun(5); got != start {
+				t.Fatalf("density %v: run of 5 at %d after the page was freed again, want %d", density, got, start)
+			}
+		}
+	}
+}
+
+func TestValueGetsOneExtent(t *testing.T) {
+	disk, device := newTestDisk(t)
+	value := patterned(3*MAX_PAGES, disk.PageSize())
+	for _, key := range []string{"first", "second"} {
+		idx := putValue(t, disk, key, value)
+		pages, mapPages, err := disk.InodePages(disk.Inodes[idx])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(Extents(pages)) != 1 || len(mapPages) != 0 || disk.Inodes[idx].Flags[0]&INODE_FLAG_EXTENTS == 0 {
+			t.Fatalf("%s is in %d extents with %d map pages", key, len(Extents(pages)), len(mapPages))
+		}
+	}
+	if err := disk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	disk, err := MountDevice(device, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	for _, key := range []string{"first", "second"} {
+		if got := readValue(t, disk, key); !bytes.Equal(got, value) {
+			t.Fatalf("%s reads back %d bytes that differ, wrote %d", key, len(got), len(value))
+		}
+	}
+	if report := disk.Check(); !report.Clean() {
+		t.Fatalf("fsck: %v", report.Problems)
+	}
+}
+
+// with no run long enough, but enough free pages, the holes are used in order instead of growing the disk
+func TestFragmentedAllocationFallsBack(t *testing.T) {
+	disk, _ := newTestDisk(t)
+	defer disk.Close()
+
+	// holes of 3, 1 and 4 pages, everything else is held
+	holes := []int{100, 101, 102, 200, 300, 301, 302, 303}
+	free := map[int]bool{}
+	for _, page := range holes {
+		free[page] = true
+	}
+	for _, page := range disk.Bitmap.FindFreePages(0) {
+		if !free[page] {
+			disk.Bitmap.AllocatePage(page)
+		}
+	}
+	total := disk.SuperBlock.TotalPages
+
+	pages, err := disk.FindFreePages(4)
+	if err != nil || len(pages) != 4 || len(Extents(pages)) != 1 || pages[0] != 300 {
+		t.Fatalf("4 pages: %v, %v, want the hole at 300", pages, err)
+	}
+	pages, err = disk.FindFreePages(6)
+	if err != nil || len(pages) != 6 {
+		t.Fatalf("6 pages: %v, %v", pages, err)
+	}
+	for i, page := range pages {
+		if page != holes[i] {
+			t.Fatalf("6 pages from the holes are %v, want the first of %v", pages, holes)
+		}
+	}
+	if disk.SuperBlock.TotalPages != total {
+		t.Fatalf("the disk grew to %d pages with the holes free, was %d", disk.SuperBlock.TotalPages, total)
+	}
+
+	// more than the holes hold, the disk grows and the value gets a run past the old end
+	pages, err = disk.FindFreePages(len(holes) + 1)
+	if err != nil || len(pages) != len(holes)+1 {
+		t.Fatalf("%d pages: %v, %v", len(holes)+1, pages, err)
+	}
+	if disk.SuperBlock.TotalPages <= total {
+		t.Fatal("the disk didn't grow")
+	}
+	if len(Extents(pages)) != 1 {
+		t.Fatalf("pages %v after the disk grew, want one extent", pages)
+	}
+}
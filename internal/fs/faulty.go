@@ -0,0 +1,110 @@
+package fs
+
+import (
+	"errors"
+	"sync"
+)
+
+// returned by a write the FaultyDevice was told to fail
+var ErrInjectedFault = errors.New("injected fault")
+
+/*
+FaultyDevice is a MemoryDevice that fails when it is told to, to see what a disk looks like after a
+write went wrong or the machine went down, without killing a process.
+
+It remembers what was on it at the last Sync. Crash throws away every write since then, like a power
+cut throws away what only reached the page cache, and the device can be mounted again to see what
+survived. FailWrite and TearWrite make a later write fail, the first without writing anything and the
+second after writing only part of it.
+*/
+type FaultyDevice struct {
+	mutex   sync.Mutex
+	live    *MemoryDevice
+	durable []byte // the device as of the last Sync
+
+	writes    int // writes so far
+	failAt    int // the write that fails, 0 for none
+	tearAt    int // the write that is torn, 0 for none
+	tearBytes int // how much of the torn write is written
+}
+
+// NewFaultyDevice returns a device holding a copy of data, all of it synced
+func NewFaultyDevice(data []byte) *FaultyDevice {
+	return &FaultyDevice{live: NewMemoryDevice(data), durable: append([]byte{}, data...)}
+}
+
+// FailWrite makes the nth write from now fail with ErrInjectedFault, writing nothing
+func (f *FaultyDevice) FailWrite(n int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failAt = f.writes + n
+}
+
+// TearWrite makes the nth write from now write only its first bytes and fail with ErrInjectedFault,
+// a write torn in the middle of a page
+func (f *FaultyDevice) TearWrite(n int, bytes int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.tearAt = f.writes + n
+	f.tearBytes = bytes
+}
+
+// Crash drops every write since the last Sync, and every fault that hasn't happened yet
+func (f *FaultyDevice) Crash() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.live = NewMemoryDevice(f.durable)
+	f.failAt, f.tearAt = 0, 0
+}
+
+// Writes returns how many writes the device has seen, failed ones included
+func (f *FaultyDevice) Writes() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.writes
+}
+
+func (f *FaultyDevice) ReadAt(p []byte, offset int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.live.ReadAt(p, offset)
+}
+
+func (f *FaultyDevice) WriteAt(p []byte, offset int64) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.writes++
+	switch f.writes {
+	case f.failAt:
+		return 0, ErrInjectedFault
+	case f.tearAt:
+		n, _ := f.live.WriteAt(p[:min(f.tearBytes, len(p))], offset)
+		return n, ErrInjectedFault
+	}
+	return f.live.WriteAt(p, offset)
+}
+
+func (f *FaultyDevice) Sync() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.durable = f.live.Bytes()
+	return nil
+}
+
+func (f *FaultyDevice) Size() (int64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.live.Size()
+}
+
+func (f *FaultyDevice) Truncate(size int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.live.Truncate(size)
+}
+
+// Close keeps the data, like MemoryDevice.Close
+func (f *FaultyDevice) Close() error {
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package fs
+
+import (
+	"errors"
+	"os"
+)
+
+var errLockHeld = errors.New("lock is held")
+
+// there is no flock here, disks aren't locked
+func flock(file *os.File, exclusive bool) error {
+	return nil
+}
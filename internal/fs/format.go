@@ -0,0 +1,392 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+Every on-disk layout change gets a new format version, registered in Formats in order.
+
+A disk is only mounted when it has the current version. Older disks are rewritten by `vantadb upgrade`,
+which runs the Upgrade step of every format newer than the disk, one after the other, on a copy of the
+file. The original file is only replaced once the copy is fully upgraded, and a backup of the original
+is kept next to it.
+*/
+
+// Format is one version of the on-disk layout
+type Format struct {
+	Version     [2]byte
+	Description string
+
+	// Upgrade rewrites a disk of the previous version into this one. It gets the superblock of the
+	// previous version, and returns the new superblock, which the caller stamps with Version and writes
+	Upgrade func(file *os.File, superblock *SuperBlock) (*SuperBlock, error)
+}
+
+var Formats = []Format{
+	{
+		Version:     VERSION_01,
+		Description: "initial layout",
+	},
+	{
+		Version:     VERSION_02,
+		Description: "checksummed superblock, growable bitmap, data page 0 reserved",
+		Upgrade:     upgradeTo02,
+	},
+	{
+		Version:     VERSION_03,
+		Description: "CRC32C checksum table for data pages",
+		Upgrade:     upgradeTo03,
+	},
+	{
+		Version:     VERSION_04,
+		Description: "hash index of the keys",
+		Upgrade:     upgradeTo04,
+	},
+	{
+		Version:     VERSION_05,
+		Description: "b+tree of the keys",
+		Upgrade:     upgradeTo05,
+	},
+	{
+		Version:     VERSION_06,
+		Description: "storage engine in the superblock",
+		Upgrade:     upgradeTo06,
+	},
+	{
+		Version:     VERSION_07,
+		Description: "extent mapped inodes",
+		Upgrade:     upgradeTo07,
+	},
+	{
+		Version:     VERSION_08,
+		Description: "small values inline in the inode",
+		Upgrade:     upgradeTo08,
+	},
+	{
+		Version:     VERSION_09,
+		Description: "compressed values, codec in the superblock and the inode",
+		Upgrade:     upgradeTo09,
+	},
+	{
+		Version:     VERSION_10,
+		Description: "encrypted data pages, key ID in the superblock",
+		Upgrade:     upgradeTo10,
+	},
+	{
+		Version:     VERSION_11,
+		Description: "WAL checkpoint of the inode engine in the superblock",
+		Upgrade:     upgradeTo11,
+	},
+}
+
+// UpgradeRequiredError is returned by Mount for disks with an older format version
+type UpgradeRequiredError struct {
+	Version [2]byte
+}
+
+func (e *UpgradeRequiredError) Error() string {
+	return fmt.Sprintf("disk has format version %q, current version is %q, run `vantadb upgrade` first", e.Version[:], CURRENT_VERSION[:])
+}
+
+// formatIndex returns the position of version in Formats, -1 if it is unknown
+func formatIndex(version [2]byte) int {
+	for i, format := range Formats {
+		if format.Version == version {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+Upgrade rewrites the disk at filePath to CURRENT_VERSION. It must not be mounted while this runs.
+
+The upgrade happens on a temporary copy which is renamed over the original at the end, so the original
+is never left half upgraded. A copy of the original is kept at the returned backup path. Returns the
+version the disk had, and an empty backup path if it was already current.
+*/
+func Upgrade(filePath string) ([2]byte, string, error) {
+	original, err := os.Open(filePath)
+	if err != nil {
+		return [2]byte{}, "", err
+	}
+	defer original.Close()
+	// a mounted disk can't be upgraded under its writer
+	if err := lockFile(original, true); err != nil {
+		return [2]byte{}, "", err
+	}
+
+	fileInfo, err := original.Stat()
+	if err != nil {
+		return [2]byte{}, "", err
+	}
+	superblock, err := LoadSuperblock(original, fileInfo.Size())
+	if err != nil {
+		return [2]byte{}, "", err
+	}
+
+	from := superblock.Version
+	if from == CURRENT_VERSION {
+		return from, "", nil
+	}
+
+	// work on a copy, the original stays untouched until the very end
+	tmpPath := filePath + ".upgrade"
+	if err := copyFile(original, tmpPath); err != nil {
+		return from, "", fmt.Errorf("could not copy disk: %v", err)
+	}
+	defer os.Remove(tmpPath) // no-op once it has been renamed
+
+	if err := upgradeFile(tmpPath, superblock); err != nil {
+		return from, "", err
+	}
+
+	backupPath := fmt.Sprintf("%s.v%s.bak", filePath, from[:])
+	if err := copyFile(original, backupPath); err != nil {
+		return from, "", fmt.Errorf("could not back up disk: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return from, "", err
+	}
+	return from, backupPath, syncDir(filepath.Dir(filePath))
+}
+
+// upgradeFile runs every upgrade step after superblock.Version on the file at path
+func upgradeFile(path string, superblock *SuperBlock) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for _, format := range Formats[formatIndex(superblock.Version)+1:] {
+		superblock, err = format.Upgrade(file, superblock)
+		if err != nil {
+			return fmt.Errorf("upgrade to version %q failed: %v", format.Version[:], err)
+		}
+
+		superblock.Version = format.Version
+		if _, err := file.WriteAt(serializeSuperblock(superblock), 0); err != nil {
+			return err
+		}
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	// make sure what we wrote mounts
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = LoadSuperblock(file, fileInfo.Size())
+	return err
+}
+
+// upgradeTo02 makes the implicit parts of a version 01 superblock explicit, the checksum is added
+// when the superblock is written, and takes data page 0 away from the value that was using it
+func upgradeTo02(file *os.File, superblock *SuperBlock) (*SuperBlock, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	// version 01 disks could grow past TotalPages without updating it
+	pageSize := int64(superblock.Pagesize)
+	if filePages := uint32((fileInfo.Size() + pageSize - 1) / pageSize); filePages > superblock.TotalPages {
+		superblock.TotalPages = filePages
+		if err := file.Truncate(int64(filePages) * pageSize); err != nil {
+			return nil, err
+		}
+	}
+
+	superblock.BitmapPages = uint32(superblock.BitmapPageCount())
+	return superblock, reservePageZero(file, superblock)
+}
+
+// reservePageZero moves the value version 01 kept in data page 0 to a free page, and marks page 0 as used,
+// from version 02 on a page number of 0 means "no page"
+func reservePageZero(file *os.File, superblock *SuperBlock) error {
+	bitmap, err := ReadBitmap(file, superblock)
+	if err != nil {
+		return err
+	}
+	inodes, err := ReadInodes(file, superblock)
+	if err != nil {
+		return err
+	}
+
+	pageSize := int64(superblock.Pagesize)
+	moved := -1
+	for i, inode := range inodes {
+		if inode.InUse[0] != 1 {
+			continue
+		}
+		changed := false
+		for j := 0; j < int(inode.NumberofPages[0]) && j < MAX_PAGES; j++ {
+			if inode.PageNumbers[j] != 0 {
+				continue
+			}
+
+			if moved < 0 {
+				if moved, err = freePageForUpgrade(file, superblock, bitmap); err != nil {
+					return err
+				}
+				data := make([]byte, pageSize)
+				if _, err := file.ReadAt(data, int64(superblock.DataStartOffset)); err != nil && !errors.Is(err, io.EOF) {
+					return err
+				}
+				if _, err := file.WriteAt(data, int64(superblock.DataStartOffset)+int64(moved)*pageSize); err != nil {
+					return err
+				}
+				bitmap.AllocatePage(moved)
+			}
+			inode.PageNumbers[j] = uint32(moved)
+			changed = true
+		}
+
+		if changed {
+			offset := int64(superblock.InodeTableStartOffset) + int64(i)*64
+			if _, err := file.WriteAt(inode.ToBytes(), offset); err != nil {
+				return err
+			}
+		}
+	}
+
+	bitmap.AllocatePage(0)
+	_, err = file.WriteAt(serializeBitmap(bitmap), int64(superblock.BitmapStartOffset))
+	return err
+}
+
+// freePageForUpgrade returns a free data page after page 0, the disk grows by a page when it is full
+func freePageForUpgrade(file *os.File, superblock *SuperBlock, bitmap *Bitmap) (int, error) {
+	for page := RESERVED_PAGES; page < bitmap.Pages(); page++ {
+		if !bitmap.IsAllocated(page) {
+			return page, nil
+		}
+	}
+
+	page := bitmap.Pages()
+	if page >= len(bitmap.GetBits())*8 {
+		return 0, fmt.Errorf("no free page to move data page 0 to")
+	}
+	superblock.TotalPages++
+	bitmap.pages++
+	return page, file.Truncate(int64(superblock.TotalPages) * int64(superblock.Pagesize))
+}
+
+// upgradeTo03 inserts the checksum table between the bitmap and the data region, and checksums every
+// page that is in use
+func upgradeTo03(file *os.File, superblock *SuperBlock) (*SuperBlock, error) {
+	bitmap, err := ReadBitmap(file, superblock)
+	if err != nil {
+		return nil, err
+	}
+
+	disk := &Disk{
+		Device:     NewFileDevice(file),
+		SuperBlock: superblock,
+		Bitmap:     bitmap,
+		Checksums:  make([]uint32, superblock.DataPageCount()),
+		Pool:       NewBufferPool(DEFAULT_BUFFER_POOL_PAGES),
+		Mutex:      &sync.Mutex{},
+	}
+
+	for page := RESERVED_PAGES; page < bitmap.Pages(); page++ {
+		if !bitmap.IsAllocated(page) {
+			continue
+		}
+		data := disk.NewPage()
+		offset := int64(superblock.DataStartOffset) + int64(page)*int64(superblock.Pagesize)
+		if _, err := file.ReadAt(data, offset); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		disk.Checksums[page] = pageChecksum(data)
+	}
+
+	// there is no table yet, it starts right where the data starts now
+	superblock.ChecksumStartOffset = superblock.DataStartOffset
+	superblock.ChecksumPages = 0
+	return superblock, disk.resize(superblock.DataPageCount())
+}
+
+// upgradeTo04 only has to make sure there is no hash index pointer, Mount builds the index
+func upgradeTo04(file *os.File, superblock *SuperBlock) (*SuperBlock, error) {
+	superblock.HashIndexPage = 0
+	return superblock, nil
+}
+
+// upgradeTo05 clears the b+tree pointer, Mount builds the tree
+func upgradeTo05(file *os.File, superblock *SuperBlock) (*SuperBlock, error) {
+	superblock.BTreePage = 0
+	return superblock, nil
+}
+
+// upgradeTo06 records the only engine older disks could use
+func upgradeTo06(file *os.File, superblock *SuperBlock) (*SuperBlock, error) {
+	superblock.Engine[0] = ENGINE_INODE
+	return superblock, nil
+}
+
+// upgradeTo07 has nothing to rewrite, inodes without INODE_FLAG_EXTENTS are read like before, the version
+// only keeps older builds from reading extents as page numbers
+func upgradeTo07(file *os.File, superblock *SuperBlock) (*SuperBlock, error) {
+	return superblock, nil
+}
+
+// upgradeTo08 leaves every value where it is, values are moved into their inode when they are written
+func upgradeTo08(file *os.File, superblock *SuperBlock) (*SuperBlock, error) {
+	return superblock, nil
+}
+
+// upgradeTo09 turns compression off, older builds never compressed a value and the bytes after the engine
+// were never written
+func upgradeTo09(file *os.File, superblock *SuperBlock) (*SuperBlock, error) {
+	superblock.Codec[0] = 0
+	superblock.CompressMinSize = 0
+	return superblock, nil
+}
+
+// upgradeTo10 records that the disk isn't encrypted, kv.Rekey can encrypt it afterwards
+func upgradeTo10(file *os.File, superblock *SuperBlock) (*SuperBlock, error) {
+	superblock.KeyID = [8]byte{}
+	return superblock, nil
+}
+
+// upgradeTo11 starts the checkpoint at the beginning of the log, the first open replays all of it, which
+// leaves every key with the last value it was set to
+func upgradeTo11(file *os.File, superblock *SuperBlock) (*SuperBlock, error) {
+	superblock.WALCheckpoint = 0
+	return superblock, nil
+}
+
+func copyFile(src *os.File, dstPath string) error {
+	dst, err := os.OpenFile(dstPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, io.NewSectionReader(src, 0, 1<<62)); err != nil {
+		return err
+	}
+	return dst.Sync()
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
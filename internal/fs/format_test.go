@@ -0,0 +1,235 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type v01Value struct {
+	key   string
+	value []byte
+	pages []uint32
+}
+
+// writeV01Disk writes a disk the way the first release laid it out, 512B pages, one bitmap page and no
+// page reserved, with every value at the pages it lists
+func writeV01Disk(t *testing.T, path string, values []v01Value) {
+	t.Helper()
+
+	const pageSize = 512
+	image := make([]byte, 2048*pageSize)
+
+	copy(image[0:4], MAGIC[:])
+	copy(image[4:6], VERSION_01[:])
+	binary.LittleEndian.PutUint32(image[6:10], pageSize)
+	binary.LittleEndian.PutUint32(image[10:14], 2048)
+	binary.LittleEndian.PutUint32(image[14:18], pageSize)
+	binary.LittleEndian.PutUint32(image[18:22], pageSize+INODE_TABLE_SIZE)
+	binary.LittleEndian.PutUint32(image[22:26], 65*1024)
+
+	bitmap := image[pageSize+INODE_TABLE_SIZE:]
+	for i, v := range values {
+		var key [32]byte
+		copy(key[:], v.key)
+		var size [4]byte
+		binary.LittleEndian.PutUint32(size[:], uint32(len(v.value)))
+		inode := NewInode(key, size)
+		inode.NumberofPages[0] = byte(len(v.pages))
+		for j, page := range v.pages {
+			inode.PageNumbers[j] = page
+			bitmap[page/8] |= 1 << (page % 8)
+			copy(image[65*1024+int(page)*pageSize:], v.value[j*pageSize:min(len(v.value), (j+1)*pageSize)])
+		}
+		copy(image[pageSize+i*64:], inode.ToBytes())
+	}
+
+	if err := os.WriteFile(path, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readValue(t *testing.T, disk *Disk, key string) []byte {
+	t.Helper()
+
+	idx := lookupKey(t, disk, key)
+	if idx < 0 {
+		t.Fatalf("key %q not found", key)
+	}
+	inode := disk.Inodes[idx]
+	if inode.Inline() {
+		return inode.InlineValue()
+	}
+	pages, _, err := disk.InodePages(inode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value []byte
+	for _, page := range pages {
+		data, err := disk.ReadPageFromDisk(page)
+		if err != nil {
+			t.Fatalf("reading page %d of %q: %v", page, key, err)
+		}
+		value = append(value, data...)
+	}
+	return value[:binary.LittleEndian.Uint32(inode.Size[:])]
+}
+
+func TestUpgradeFromVersion01(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v01.vdsk")
+	values := []v01Value{
+		{key: "first", value: bytes.Repeat([]byte("a"), 300), pages: []uint32{0}},
+		{key: "second", value: bytes.Repeat([]byte("b"), 700), pages: []uint32{1, 2}},
+		{key: "third", value: []byte("short"), pages: []uint32{3}},
+	}
+	writeV01Disk(t, path, values)
+
+	from, backup, err := Upgrade(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != VERSION_01 {
+		t.Fatalf("upgraded from %q, want 01", from[:])
+	}
+	if _, err := os.Stat(backup); err != nil {
+		t.Fatalf("no backup: %v", err)
+	}
+
+	disk, err := Mount(path, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if disk.SuperBlock.Version != CURRENT_VERSION {
+		t.Fatalf("version %q after upgrade", disk.SuperBlock.Version[:])
+	}
+	if report := disk.Check(); !report.Clean() {
+		t.Fatalf("fsck after upgrade: %v", report.Problems)
+	}
+	if !disk.Bitmap.IsAllocated(0) {
+		t.Fatal("data page 0 is not reserved")
+	}
+	for _, v := range values {
+		if got := readValue(t, disk, v.key); !bytes.Equal(got, v.value) {
+			t.Fatalf("%q = %q, want %q", v.key, got, v.value)
+		}
+	}
+	disk.Close()
+
+	// upgrading again does nothing
+	if _, backup, err := Upgrade(path); err != nil || backup != "" {
+		t.Fatalf("second upgrade: backup %q, %v", backup, err)
+	}
+}
+
+func TestUpgradeFullVersion01Disk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "full.vdsk")
+	values := []v01Value{{key: "zero", value: []byte("page zero"), pages: []uint32{0}}}
+	writeV01Disk(t, path, values)
+
+	// mark every data page as used, the value at page 0 has to go past the end
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataPages := 2048 - 65*1024/512
+	full := bytes.Repeat([]byte{0xff}, (dataPages+7)/8)
+	if _, err := file.WriteAt(full, 512+INODE_TABLE_SIZE); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if _, _, err := Upgrade(path); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := Mount(path, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+
+	if page := disk.Inodes[lookupKey(t, disk, "zero")].PageNumbers[0]; page != uint32(dataPages) {
+		t.Fatalf("value moved to page %d, want %d", page, dataPages)
+	}
+	if got := readValue(t, disk, "zero"); string(got) != "page zero" {
+		t.Fatalf("zero = %q", got)
+	}
+	for _, problem := range disk.Check().Problems {
+		if problem.Kind != FSCK_ORPHANED_PAGE {
+			t.Fatalf("fsck after upgrade: %v", problem)
+		}
+	}
+}
+
+func TestPageSizes(t *testing.T) {
+	for _, pageSize := range []int{MIN_PAGE_SIZE, 1024, 8192, MAX_PAGE_SIZE} {
+		t.Run(fmt.Sprint(pageSize), func(t *testing.T) {
+			device := NewMemoryDevice(nil)
+			if err := FormatDevice(device, pageSize, ENGINE_INODE); err != nil {
+				t.Fatal(err)
+			}
+			disk, err := MountDevice(device, MountOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if disk.PageSize() != pageSize || int(disk.SuperBlock.DataStartOffset)%pageSize != 0 {
+				t.Fatalf("pages of %d bytes, data at %d, formatted with %d", disk.PageSize(), disk.SuperBlock.DataStartOffset, pageSize)
+			}
+
+			// one value on several pages, and enough of them that a disk of large pages grows
+			values := map[string][]byte{}
+			for i := 0; i < 20; i++ {
+				key := fmt.Sprintf("key%02d", i)
+				values[key] = bytes.Repeat([]byte{byte('a' + i)}, pageSize+i)
+				putValue(t, disk, key, values[key])
+			}
+			values["several"] = patterned(3, pageSize)
+			putValue(t, disk, "several", values["several"])
+			if err := disk.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			disk, err = MountDevice(device, MountOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer disk.Close()
+			if disk.PageSize() != pageSize {
+				t.Fatalf("pages of %d bytes after a remount, formatted with %d", disk.PageSize(), pageSize)
+			}
+			for key, value := range values {
+				if got := readValue(t, disk, key); !bytes.Equal(got, value) {
+					t.Fatalf("%s reads back %d bytes that differ, wrote %d", key, len(got), len(value))
+				}
+			}
+			if report := disk.Check(); !report.Clean() {
+				t.Fatalf("fsck: %v", report.Problems)
+			}
+		})
+	}
+}
+
+func TestInvalidPageSizes(t *testing.T) {
+	for _, pageSize := range []int{0, -4096, 256, 1000, 4095, 2 * MAX_PAGE_SIZE} {
+		if err := ValidatePageSize(pageSize); err == nil {
+			t.Fatalf("page size %d is valid", pageSize)
+		}
+		device := NewMemoryDevice(nil)
+		if err := FormatDevice(device, pageSize, ENGINE_INODE); err == nil {
+			t.Fatalf("formatted a disk with %d byte pages", pageSize)
+		}
+		if size, _ := device.Size(); size != 0 {
+			t.Fatalf("the rejected format of %d byte pages wrote %d bytes", pageSize, size)
+		}
+		path := filepath.Join(t.TempDir(), "disk.vdsk")
+		if err := CreateVDSKStorageData(path, pageSize, ENGINE_INODE); err == nil {
+			t.Fatalf("created a disk with %d byte pages", pageSize)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("the rejected disk of %d byte pages was created: %v", pageSize, err)
+		}
+	}
+}
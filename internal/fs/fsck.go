@@ -0,0 +1,264 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+/*
+Consistency checks between the inode table and the bitmap.
+
+Check walks every inode in use and collects the pages it owns, data, indirect and key pages, then
+compares that with the bitmap. Pages of the hash index and of the b+tree are owned by inode -1, and
+every key has to be found through both of them. RebuildBitmap throws the bitmap away and builds it again from the
+inodes, which frees orphaned pages and marks owned pages that the bitmap forgot about.
+*/
+
+const (
+	FSCK_ORPHANED_PAGE    = "orphaned page"    // marked used in the bitmap, no inode owns it
+	FSCK_UNMARKED_PAGE    = "unmarked page"    // owned by an inode, marked free in the bitmap
+	FSCK_SHARED_PAGE      = "shared page"      // owned by more than one inode, or twice by one inode
+	FSCK_BAD_PAGE_REF     = "bad page number"  // page 0 or past the end of the disk
+	FSCK_SIZE_MISMATCH    = "size mismatch"    // Size doesn't agree with NumberofPages or the extents
+	FSCK_DUPLICATE_KEY    = "duplicate key"    // more than one inode holds the same key
+	FSCK_UNREADABLE_INODE = "unreadable inode" // pages or key of the inode can't be read
+	FSCK_CORRUPT_PAGE     = "corrupt page"     // page fails its checksum
+	FSCK_UNINDEXED_KEY    = "unindexed key"    // the hash index or the b+tree doesn't find the inode holding the key
+	FSCK_BAD_INDEX        = "bad index"        // an index can't be read
+)
+
+type FsckProblem struct {
+	Kind   string // one of FSCK_*
+	Inode  int    // -1 when the problem isn't about an inode
+	Page   int    // -1 when the problem isn't about a page
+	Detail string
+}
+
+func (p FsckProblem) String() string {
+	s := p.Kind
+	if p.Inode >= 0 {
+		s += fmt.Sprintf(" inode=%d", p.Inode)
+	}
+	if p.Page >= 0 {
+		s += fmt.Sprintf(" page=%d", p.Page)
+	}
+	if p.Detail != "" {
+		s += ": " + p.Detail
+	}
+	return s
+}
+
+type FsckReport struct {
+	InodesInUse int
+	PagesInUse  int
+	Problems    []FsckProblem
+}
+
+func (r *FsckReport) add(kind string, inode int, page int, detail string) {
+	r.Problems = append(r.Problems, FsckProblem{Kind: kind, Inode: inode, Page: page, Detail: detail})
+}
+
+// Clean reports whether the check found no problems
+func (r *FsckReport) Clean() bool {
+	return len(r.Problems) == 0
+}
+
+// Check cross checks the inode table against the bitmap, it doesn't change anything
+func (disk *Disk) Check() *FsckReport {
+	report := &FsckReport{}
+	owners := disk.pageOwners(report)
+
+	for page := RESERVED_PAGES; page < disk.Bitmap.Pages(); page++ {
+		inodes, owned := owners[page]
+		allocated := disk.Bitmap.IsAllocated(page)
+
+		switch {
+		case allocated && !owned:
+			report.add(FSCK_ORPHANED_PAGE, -1, page, "")
+		case !allocated && owned:
+			report.add(FSCK_UNMARKED_PAGE, inodes[0], page, "")
+		}
+		if len(inodes) > 1 {
+			report.add(FSCK_SHARED_PAGE, inodes[0], page, fmt.Sprintf("owned by inodes %v", inodes))
+		}
+		if allocated {
+			report.PagesInUse++
+
+			if _, err := disk.ReadPageFromDisk(page); errors.Is(err, ErrCorruptPage) {
+				report.add(FSCK_CORRUPT_PAGE, -1, page, "")
+			}
+		}
+	}
+
+	return report
+}
+
+// RebuildBitmap marks exactly the pages owned by inodes in use as allocated and writes the bitmap
+func (disk *Disk) RebuildBitmap() error {
+	if disk.readOnly {
+		return fmt.Errorf("the bitmap can't be rebuilt: %w", ErrReadOnly)
+	}
+	owners := disk.pageOwners(&FsckReport{})
+
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	// keep the same number of bitmap pages as on disk
+	bitmap := &Bitmap{
+		bits:     make([]byte, len(disk.Bitmap.bits)),
+		pages:    disk.Bitmap.pages,
+		pageSize: disk.Bitmap.pageSize,
+	}
+	for page := range owners {
+		bitmap.AllocatePage(page)
+	}
+
+	disk.Bitmap = bitmap
+	return disk.writeBitmap()
+}
+
+// pageOwners maps every page owned by an inode in use to the inodes owning it, it reports the inode
+// level problems it runs into along the way
+func (disk *Disk) pageOwners(report *FsckReport) map[int][]int {
+	owners := map[int][]int{}
+	keys := map[string][]int{}
+
+	for i, inode := range disk.Inodes {
+		if inode.InUse[0] != 1 {
+			continue
+		}
+		report.InodesInUse++
+
+		key, err := disk.InodeKey(inode)
+		if err != nil {
+			report.add(FSCK_UNREADABLE_INODE, i, -1, fmt.Sprintf("key: %v", err))
+		} else {
+			keys[key] = append(keys[key], i)
+		}
+
+		if problem := disk.checkInodeSize(inode); problem != "" {
+			report.add(FSCK_SIZE_MISMATCH, i, -1, problem)
+		}
+
+		pages := []int{}
+		dataPages, indirectPages, err := disk.InodePages(inode)
+		if err != nil {
+			report.add(FSCK_UNREADABLE_INODE, i, -1, fmt.Sprintf("pages: %v", err))
+		}
+		pages = append(pages, dataPages...)
+		pages = append(pages, indirectPages...)
+
+		keyPages, err := disk.InodeKeyPages(inode)
+		if err != nil {
+			report.add(FSCK_UNREADABLE_INODE, i, -1, fmt.Sprintf("key pages: %v", err))
+		}
+		pages = append(pages, keyPages...)
+
+		for _, page := range pages {
+			if page < RESERVED_PAGES || page >= disk.Bitmap.Pages() {
+				report.add(FSCK_BAD_PAGE_REF, i, page, "")
+				continue
+			}
+			owners[page] = append(owners[page], i)
+		}
+	}
+
+	// the indexes a read-only disk rebuilt in memory still have their old pages on the disk
+	indexPages := append([]int{}, disk.stalePages...)
+	if disk.HashIndex != nil {
+		indexPages = append(indexPages, disk.HashIndex.Pages()...)
+	}
+	treeKeys := map[string]int{}
+	if disk.BTree != nil {
+		pages, err := disk.BTreePages()
+		if err != nil {
+			report.add(FSCK_BAD_INDEX, -1, -1, fmt.Sprintf("b+tree: %v", err))
+		}
+		indexPages = append(indexPages, pages...)
+
+		entries, err := disk.BTreeRange("", "", 0)
+		if err != nil {
+			report.add(FSCK_BAD_INDEX, -1, -1, fmt.Sprintf("b+tree: %v", err))
+		}
+		for _, entry := range entries {
+			treeKeys[entry.Key] = entry.Inode
+		}
+	}
+	for _, page := range indexPages {
+		// an index a read-only disk rebuilt in memory has no pages on the disk
+		if !disk.inMemory(page) {
+			owners[page] = append(owners[page], -1)
+		}
+	}
+
+	for key, inodes := range keys {
+		if len(inodes) > 1 {
+			report.add(FSCK_DUPLICATE_KEY, inodes[0], -1, fmt.Sprintf("key %q is held by inodes %v", key, inodes))
+		}
+		if disk.HashIndex != nil {
+			// a lookup that fails on the key of another inode doesn't say anything about this key, that
+			// inode is reported as unreadable already
+			if idx, err := disk.LookupKey(key); err == nil && !slices.Contains(inodes, idx) {
+				report.add(FSCK_UNINDEXED_KEY, inodes[0], -1, fmt.Sprintf("key %q is not in the hash index", key))
+			}
+		}
+		if inode, ok := treeKeys[key]; disk.BTree != nil && (!ok || !slices.Contains(inodes, inode)) {
+			report.add(FSCK_UNINDEXED_KEY, inodes[0], -1, fmt.Sprintf("key %q is not in the b+tree", key))
+		}
+	}
+
+	return owners
+}
+
+// checkInodeSize returns what is wrong between the Size and the NumberofPages or extents of an inode, "" if nothing is
+func (disk *Disk) checkInodeSize(inode *Inode) string {
+	pagesNeeded := disk.PagesNeeded(inode.valueSize())
+	slots := int(inode.NumberofPages[0])
+
+	if inode.Inline() {
+		if inode.valueSize() > MAX_INLINE_VALUE || slots != 0 {
+			return fmt.Sprintf("inline value of %d bytes with %d pages, at most %d bytes fit", inode.valueSize(), slots, MAX_INLINE_VALUE)
+		}
+		return ""
+	}
+
+	if inode.Flags[0]&INODE_FLAG_EXTENTS != 0 {
+		if inode.Flags[0]&INODE_FLAG_INDIRECT != 0 {
+			if slots != 1 {
+				return fmt.Sprintf("inode has %d extent pages, expected 1", slots)
+			}
+			return "" // the extents are checked against the size when the page is read
+		}
+		if slots > INLINE_EXTENTS {
+			return fmt.Sprintf("inode has %d extents, at most %d fit inline", slots, INLINE_EXTENTS)
+		}
+		pages := 0
+		for i := 0; i < slots; i++ {
+			pages += int(inode.PageNumbers[2*i+1])
+		}
+		if pages != pagesNeeded {
+			return fmt.Sprintf("size %d needs %d pages, extents hold %d", inode.valueSize(), pagesNeeded, pages)
+		}
+		return ""
+	}
+
+	if inode.Flags[0]&INODE_FLAG_INDIRECT == 0 {
+		if slots != pagesNeeded {
+			return fmt.Sprintf("size %d needs %d pages, inode has %d", inode.valueSize(), pagesNeeded, slots)
+		}
+		return ""
+	}
+
+	if pagesNeeded <= MAX_PAGES {
+		return fmt.Sprintf("size %d fits in direct pages, inode uses indirect pages", inode.valueSize())
+	}
+	expected := SINGLE_INDIRECT + 1
+	if pagesNeeded > DIRECT_PAGES+disk.PointersPerPage() {
+		expected = DOUBLE_INDIRECT + 1
+	}
+	if slots != expected {
+		return fmt.Sprintf("size %d needs %d page pointers, inode has %d", inode.valueSize(), expected, slots)
+	}
+	return ""
+}
@@ -0,0 +1,297 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+// newTestDisk formats and mounts a disk in memory
+func newTestDisk(t *testing.T) (*Disk, *MemoryDevice) {
+	t.Helper()
+
+	device := NewMemoryDevice(nil)
+	if err := FormatDevice(device, DEFAULT_PAGE_SIZE, ENGINE_INODE); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := MountDevice(device, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return disk, device
+}
+
+// putValue stores value in a free inode the way the inode engine does, without looking for the key
+func putValue(t *testing.T, disk *Disk, key string, value []byte) int {
+	t.Helper()
+
+	idx := -1
+	for i, inode := range disk.Inodes {
+		if inode.InUse[0] == 0 {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		t.Fatal("no free inode")
+	}
+	inode := disk.Inodes[idx]
+
+	keyPages, err := disk.FindFreePages(disk.KeyPagesNeeded(len(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, page := range keyPages {
+		disk.Bitmap.AllocatePage(page)
+	}
+	if err := disk.SetInodeKey(inode, key, keyPages); err != nil {
+		t.Fatal(err)
+	}
+	inode.InUse[0] = 1
+	binary.LittleEndian.PutUint32(inode.Size[:], uint32(len(value)))
+
+	if disk.InlineFits(len(value)) {
+		if err := inode.SetInlineValue(value); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		dataPages, err := disk.FindFreePages(disk.PagesNeeded(len(value)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, page := range dataPages {
+			disk.Bitmap.AllocatePage(page)
+		}
+		mapPages, err := disk.FindFreePages(disk.MapPagesNeeded(dataPages))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, page := range mapPages {
+			disk.Bitmap.AllocatePage(page)
+		}
+		for i, page := range dataPages {
+			data := disk.NewPage()
+			copy(data, value[min(len(value), i*disk.PageSize()):])
+			if err := disk.WritePageToDisk(page, data); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := disk.MapInodePages(inode, dataPages, mapPages); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := disk.WriteBitmapToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.WriteInodeToDisk(idx, inode); err != nil {
+		t.Fatal(err)
+	}
+	disk.IndexKey(key, idx)
+	if err := disk.BTreeInsert(key, idx); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.WriteIndexesToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func hasProblem(report *FsckReport, kind string) bool {
+	for _, problem := range report.Problems {
+		if problem.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFsckCleanDisk(t *testing.T) {
+	disk, _ := newTestDisk(t)
+	for i := 0; i < 20; i++ {
+		putValue(t, disk, fmt.Sprintf("key%02d", i), bytes.Repeat([]byte{byte(i)}, i*100))
+	}
+	putValue(t, disk, string(bytes.Repeat([]byte("k"), 300)), []byte("long key"))
+
+	report := disk.Check()
+	if !report.Clean() {
+		t.Fatalf("fresh disk has problems: %v", report.Problems)
+	}
+	if report.InodesInUse != 21 {
+		t.Fatalf("%d inodes in use, want 21", report.InodesInUse)
+	}
+}
+
+func TestFsckFindsProblems(t *testing.T) {
+	value := bytes.Repeat([]byte("v"), 3*DEFAULT_PAGE_SIZE)
+
+	cases := []struct {
+		kind string
+		// breaks the disk, a and b are the inodes of the keys "a" and "b"
+		corrupt func(t *testing.T, disk *Disk, device *MemoryDevice, a int, b int) *Disk
+		// whether rebuilding the bitmap and the indexes fixes it
+		repairable bool
+	}{
+		{
+			kind: FSCK_ORPHANED_PAGE,
+			corrupt: func(t *testing.T, disk *Disk, device *MemoryDevice, a int, b int) *Disk {
+				disk.Bitmap.AllocatePage(disk.Bitmap.FindFreePage())
+				return disk
+			},
+			repairable: true,
+		},
+		{
+			kind: FSCK_UNMARKED_PAGE,
+			corrupt: func(t *testing.T, disk *Disk, device *MemoryDevice, a int, b int) *Disk {
+				pages, _, _ := disk.InodePages(disk.Inodes[a])
+				disk.Bitmap.FreePage(pages[1])
+				return disk
+			},
+			repairable: true,
+		},
+		{
+			kind: FSCK_SHARED_PAGE,
+			corrupt: func(t *testing.T, disk *Disk, device *MemoryDevice, a int, b int) *Disk {
+				disk.Inodes[b].PageNumbers = disk.Inodes[a].PageNumbers
+				return disk
+			},
+		},
+		{
+			kind: FSCK_BAD_PAGE_REF,
+			corrupt: func(t *testing.T, disk *Disk, device *MemoryDevice, a int, b int) *Disk {
+				disk.Inodes[a].PageNumbers[0] = uint32(disk.Bitmap.Pages())
+				return disk
+			},
+		},
+		{
+			kind: FSCK_SIZE_MISMATCH,
+			corrupt: func(t *testing.T, disk *Disk, device *MemoryDevice, a int, b int) *Disk {
+				binary.LittleEndian.PutUint32(disk.Inodes[a].Size[:], uint32(10*DEFAULT_PAGE_SIZE))
+				return disk
+			},
+		},
+		{
+			kind: FSCK_DUPLICATE_KEY,
+			corrupt: func(t *testing.T, disk *Disk, device *MemoryDevice, a int, b int) *Disk {
+				putValue(t, disk, "a", []byte("again"))
+				return disk
+			},
+		},
+		{
+			kind: FSCK_UNREADABLE_INODE,
+			corrupt: func(t *testing.T, disk *Disk, device *MemoryDevice, a int, b int) *Disk {
+				// the extent page is past the end of the disk
+				inode := disk.Inodes[a]
+				inode.Flags[0] |= INODE_FLAG_EXTENTS | INODE_FLAG_INDIRECT
+				inode.NumberofPages[0] = 1
+				inode.PageNumbers[0] = uint32(disk.Bitmap.Pages() + 10)
+				return disk
+			},
+		},
+		{
+			kind: FSCK_CORRUPT_PAGE,
+			corrupt: func(t *testing.T, disk *Disk, device *MemoryDevice, a int, b int) *Disk {
+				pages, _, _ := disk.InodePages(disk.Inodes[b])
+				if err := disk.FlushPages(); err != nil {
+					t.Fatal(err)
+				}
+				offset := int64(disk.SuperBlock.DataStartOffset) + int64(pages[0]*disk.pageBytes())
+				device.WriteAt([]byte("garbage"), offset)
+
+				// mount again so the page isn't read from the buffer pool
+				disk, err := MountDevice(device, MountOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return disk
+			},
+		},
+		{
+			kind: FSCK_UNINDEXED_KEY,
+			corrupt: func(t *testing.T, disk *Disk, device *MemoryDevice, a int, b int) *Disk {
+				disk.UnindexKey("a", a)
+				if err := disk.BTreeDelete("b"); err != nil {
+					t.Fatal(err)
+				}
+				return disk
+			},
+			repairable: true,
+		},
+		{
+			kind: FSCK_BAD_INDEX,
+			corrupt: func(t *testing.T, disk *Disk, device *MemoryDevice, a int, b int) *Disk {
+				// the root of the b+tree is a data page
+				pages, _, _ := disk.InodePages(disk.Inodes[a])
+				disk.BTree.root = pages[0]
+				return disk
+			},
+			repairable: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.kind, func(t *testing.T) {
+			disk, device := newTestDisk(t)
+			a := putValue(t, disk, "a", value)
+			b := putValue(t, disk, "b", value)
+			putValue(t, disk, "c", []byte("inline"))
+
+			disk = c.corrupt(t, disk, device, a, b)
+			report := disk.Check()
+			if !hasProblem(report, c.kind) {
+				t.Fatalf("fsck didn't find a %s: %v", c.kind, report.Problems)
+			}
+			if !c.repairable {
+				return
+			}
+
+			if err := disk.RebuildBitmap(); err != nil {
+				t.Fatal(err)
+			}
+			if err := disk.RebuildHashIndex(); err != nil {
+				t.Fatal(err)
+			}
+			if err := disk.RebuildBTree(); err != nil {
+				t.Fatal(err)
+			}
+			if report := disk.Check(); !report.Clean() {
+				t.Fatalf("still broken after the repair: %v", report.Problems)
+			}
+		})
+	}
+}
+
+func TestRebuildBitmapFreesOrphans(t *testing.T) {
+	disk, device := newTestDisk(t)
+	idx := putValue(t, disk, "kept", bytes.Repeat([]byte("x"), 2*DEFAULT_PAGE_SIZE))
+	free := disk.Bitmap.FreePageCount()
+
+	orphan := disk.Bitmap.FindFreePage()
+	disk.Bitmap.AllocatePage(orphan)
+	pages, _, err := disk.InodePages(disk.Inodes[idx])
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk.Bitmap.FreePage(pages[0])
+
+	if err := disk.RebuildBitmap(); err != nil {
+		t.Fatal(err)
+	}
+	if disk.Bitmap.IsAllocated(orphan) || !disk.Bitmap.IsAllocated(pages[0]) {
+		t.Fatalf("orphan %d allocated: %v, owned page %d allocated: %v", orphan, disk.Bitmap.IsAllocated(orphan), pages[0], disk.Bitmap.IsAllocated(pages[0]))
+	}
+	if disk.Bitmap.FreePageCount() != free {
+		t.Fatalf("%d free pages after the rebuild, %d before", disk.Bitmap.FreePageCount(), free)
+	}
+
+	// the rebuilt bitmap is on the device
+	disk.FlushPages()
+	mounted, err := MountDevice(device, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report := mounted.Check(); !report.Clean() {
+		t.Fatalf("problems after mounting again: %v", report.Problems)
+	}
+}
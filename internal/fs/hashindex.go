@@ -0,0 +1,323 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+)
+
+/*
+Hash index from keys to inode numbers, so a lookup doesn't have to scan the inode table.
+
+It is an open addressing hash table with linear probing, twice as many slots as there are inodes so
+it never fills up. A slot is 8 bytes, the FNV-1a hash of the key and the inode number + 1, 0 meaning
+the slot is empty. Slots only narrow the search down, the key of the inode is always compared.
+
+The slots live in data pages like everything else, listed in a header page that SuperBlock.HashIndexPage
+points to. Header layout:
+[0:4]   - "HIDX"
+[4:8]   - number of slots
+[8:12]  - digest of the inode table the index was built from, see inodeDigest
+[12:16] - number of slot pages
+[16:]   - page numbers of the slot pages
+
+The index is written after the inodes it describes. If a crash happens in between, the digest in the
+header no longer matches the inode table and Mount builds the index again, same as when it is missing.
+*/
+
+const HASH_SLOT_SIZE = 8
+
+var HASH_INDEX_MAGIC = [4]byte{'H', 'I', 'D', 'X'}
+
+type hashSlot struct {
+	hash  uint32
+	inode uint32 // inode number + 1, 0 = empty
+}
+
+type HashIndex struct {
+	slots  []hashSlot
+	header int          // page of the header
+	pages  []int        // pages holding the slots
+	dirty  map[int]bool // slot pages changed since the last write
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// hashSlotsFor returns the number of slots for an inode table of inodes inodes, a power of two
+func hashSlotsFor(inodes int) int {
+	slots := 1
+	for slots < 2*inodes {
+		slots *= 2
+	}
+	return slots
+}
+
+// inodeDigest sums up what the index depends on, which inodes are in use and their keys
+func (disk *Disk) inodeDigest() uint32 {
+	digest := uint32(0)
+	data := make([]byte, 4+INLINE_KEY_SIZE+1)
+
+	for i, inode := range disk.Inodes {
+		if inode.InUse[0] != 1 {
+			continue
+		}
+		binary.LittleEndian.PutUint32(data[0:4], uint32(i))
+		copy(data[4:], inode.Key[:])
+		data[len(data)-1] = inode.Flags[0] & INODE_FLAG_LONG_KEY
+		digest ^= crc32.Checksum(data, crcTable)
+	}
+	return digest
+}
+
+// LookupKey returns the inode holding key, -1 if no inode does
+// a long key that can't be read back might be key, so that is an error and not a miss
+func (disk *Disk) LookupKey(key string) (int, error) {
+	index := disk.HashIndex
+	hash := hashKey(key)
+	mask := uint32(len(index.slots) - 1)
+
+	for pos := hash & mask; index.slots[pos].inode != 0; pos = (pos + 1) & mask {
+		slot := index.slots[pos]
+		if slot.hash != hash {
+			continue
+		}
+		if int(slot.inode) > len(disk.Inodes) {
+			continue // stale, an index read with such a slot is rebuilt, see readHashIndex
+		}
+		inode := disk.Inodes[slot.inode-1]
+		if inode.InUse[0] != 1 {
+			continue
+		}
+		found, err := disk.InodeKeyEquals(inode, key)
+		if err != nil {
+			return -1, fmt.Errorf("could not read the key of inode %d: %w", slot.inode-1, err)
+		}
+		if found {
+			return int(slot.inode - 1), nil
+		}
+	}
+	return -1, nil
+}
+
+// IndexKey adds key, held by inode inodeIndex, to the hash index
+func (disk *Disk) IndexKey(key string, inodeIndex int) {
+	index := disk.HashIndex
+	hash := hashKey(key)
+	mask := uint32(len(index.slots) - 1)
+
+	pos := hash & mask
+	for index.slots[pos].inode != 0 {
+		pos = (pos + 1) & mask
+	}
+	index.setSlot(int(pos), hashSlot{hash: hash, inode: uint32(inodeIndex) + 1})
+}
+
+// UnindexKey removes key, held by inode inodeIndex, from the hash index
+func (disk *Disk) UnindexKey(key string, inodeIndex int) {
+	index := disk.HashIndex
+	hash := hashKey(key)
+	mask := uint32(len(index.slots) - 1)
+
+	pos := hash & mask
+	for index.slots[pos].inode != uint32(inodeIndex)+1 {
+		if index.slots[pos].inode == 0 {
+			return // not indexed
+		}
+		pos = (pos + 1) & mask
+	}
+
+	// backward shift deletion, move later slots of the probe sequence up so no lookup stops early
+	for {
+		index.setSlot(int(pos), hashSlot{})
+		next := pos
+		for {
+			next = (next + 1) & mask
+			if index.slots[next].inode == 0 {
+				return
+			}
+			home := index.slots[next].hash & mask
+			// the slot can stay where it is if its home lies cyclically in (pos, next]
+			if pos <= next && pos < home && home <= next || pos > next && (pos < home || home <= next) {
+				continue
+			}
+			break
+		}
+		index.setSlot(int(pos), index.slots[next])
+		pos = next
+	}
+}
+
+func (index *HashIndex) setSlot(pos int, slot hashSlot) {
+	index.slots[pos] = slot
+	index.dirty[pos/index.slotsPerPage()] = true
+}
+
+func (index *HashIndex) slotsPerPage() int {
+	return len(index.slots) / len(index.pages)
+}
+
+// Pages returns every page used by the hash index, the header first
+func (index *HashIndex) Pages() []int {
+	return append([]int{index.header}, index.pages...)
+}
+
+// WriteHashIndexToDisk writes the slot pages changed since the last write, then the header
+func (disk *Disk) WriteHashIndexToDisk() error {
+	index := disk.HashIndex
+	slotsPerPage := index.slotsPerPage()
+
+	for i := range index.dirty {
+		pageData := disk.NewPage()
+		for j, slot := range index.slots[i*slotsPerPage : (i+1)*slotsPerPage] {
+			binary.LittleEndian.PutUint32(pageData[j*HASH_SLOT_SIZE:], slot.hash)
+			binary.LittleEndian.PutUint32(pageData[j*HASH_SLOT_SIZE+4:], slot.inode)
+		}
+		if err := disk.WritePageToDisk(index.pages[i], pageData); err != nil {
+			return fmt.Errorf("could not write hash index page: %v", err)
+		}
+		delete(index.dirty, i)
+	}
+
+	header := disk.NewPage()
+	copy(header[0:4], HASH_INDEX_MAGIC[:])
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(index.slots)))
+	binary.LittleEndian.PutUint32(header[8:12], disk.inodeDigest())
+	binary.LittleEndian.PutUint32(header[12:16], uint32(len(index.pages)))
+	for i, page := range index.pages {
+		binary.LittleEndian.PutUint32(header[16+i*4:], uint32(page))
+	}
+	return disk.WritePageToDisk(index.header, header)
+}
+
+// loadHashIndex reads the hash index of the disk, and builds it again when it is missing or stale
+func (disk *Disk) loadHashIndex() error {
+	index, digest, err := disk.readHashIndex()
+	if err == nil && digest == disk.inodeDigest() && len(index.slots) == hashSlotsFor(len(disk.Inodes)) {
+		disk.HashIndex = index
+		return nil
+	}
+
+	disk.HashIndex = index // nil if it couldn't be read at all, its pages are given back by the rebuild
+	return disk.RebuildHashIndex()
+}
+
+// readHashIndex reads the index SuperBlock.HashIndexPage points to, it returns the digest from its header
+func (disk *Disk) readHashIndex() (*HashIndex, uint32, error) {
+	headerPage := int(disk.SuperBlock.HashIndexPage)
+	if headerPage < RESERVED_PAGES || headerPage >= disk.Bitmap.Pages() {
+		return nil, 0, fmt.Errorf("disk has no hash index")
+	}
+
+	header, err := disk.ReadPageFromDisk(headerPage)
+	if err != nil {
+		return nil, 0, err
+	}
+	if [4]byte(header[0:4]) != HASH_INDEX_MAGIC {
+		return nil, 0, fmt.Errorf("hash index header has a bad magic")
+	}
+
+	slots := int(binary.LittleEndian.Uint32(header[4:8]))
+	digest := binary.LittleEndian.Uint32(header[8:12])
+	numPages := int(binary.LittleEndian.Uint32(header[12:16]))
+	if numPages == 0 || 16+numPages*4 > len(header) || slots%numPages != 0 || slots/numPages*HASH_SLOT_SIZE > disk.PageSize() {
+		return nil, 0, fmt.Errorf("hash index header is corrupted")
+	}
+
+	index := &HashIndex{
+		slots:  make([]hashSlot, 0, slots),
+		header: headerPage,
+		pages:  make([]int, numPages),
+		dirty:  map[int]bool{},
+	}
+	for i := range index.pages {
+		index.pages[i] = int(binary.LittleEndian.Uint32(header[16+i*4:]))
+		if index.pages[i] < RESERVED_PAGES || index.pages[i] >= disk.Bitmap.Pages() {
+			return nil, 0, fmt.Errorf("hash index page %d is out of range", index.pages[i])
+		}
+	}
+
+	for _, page := range index.pages {
+		pageData, err := disk.ReadPageFromDisk(page)
+		if err != nil {
+			return index, 0, err
+		}
+		for j := 0; j < slots/numPages; j++ {
+			slot := hashSlot{
+				hash:  binary.LittleEndian.Uint32(pageData[j*HASH_SLOT_SIZE:]),
+				inode: binary.LittleEndian.Uint32(pageData[j*HASH_SLOT_SIZE+4:]),
+			}
+			// the digest only covers the inodes, a slot can still be garbage
+			if int(slot.inode) > len(disk.Inodes) {
+				return index, 0, fmt.Errorf("hash index slot %d points to inode %d, there are %d", len(index.slots), slot.inode, len(disk.Inodes))
+			}
+			index.slots = append(index.slots, slot)
+		}
+	}
+	return index, digest, nil
+}
+
+// RebuildHashIndex builds the hash index from the inode table on new pages and writes it, the pages of
+// the old index are freed. A read-only disk builds it in memory and writes nothing, see allocIndexPages
+func (disk *Disk) RebuildHashIndex() error {
+	if disk.HashIndex != nil {
+		for _, page := range disk.HashIndex.Pages() {
+			if disk.readOnly {
+				disk.stalePages = append(disk.stalePages, page)
+			} else {
+				disk.Bitmap.FreePage(page)
+			}
+		}
+	}
+
+	// every page holds the same power of two of slots, the pages of an encrypted disk aren't a power of two
+	slots := hashSlotsFor(len(disk.Inodes))
+	slotsPerPage := 1
+	for 2*slotsPerPage*HASH_SLOT_SIZE <= disk.PageSize() {
+		slotsPerPage *= 2
+	}
+	numPages := max(1, slots/slotsPerPage)
+
+	pages, err := disk.allocIndexPages(numPages + 1)
+	if err != nil {
+		return fmt.Errorf("could not allocate hash index: %v", err)
+	}
+
+	disk.HashIndex = &HashIndex{
+		slots:  make([]hashSlot, slots),
+		header: pages[0],
+		pages:  pages[1:],
+		dirty:  map[int]bool{},
+	}
+	for i := range disk.HashIndex.pages {
+		disk.HashIndex.dirty[i] = true
+	}
+
+	for i, inode := range disk.Inodes {
+		if inode.InUse[0] != 1 {
+			continue
+		}
+		key, err := disk.InodeKey(inode)
+		if err != nil {
+			continue // the key can't be read back, fsck reports the inode
+		}
+		disk.IndexKey(key, i)
+	}
+	if disk.readOnly {
+		return nil // the slots are all in memory
+	}
+
+	// the pages are written and marked used before the superblock points to them
+	if err := disk.WriteHashIndexToDisk(); err != nil {
+		return err
+	}
+	if err := disk.WriteBitmapToDisk(); err != nil {
+		return err
+	}
+	disk.SuperBlock.HashIndexPage = uint32(disk.HashIndex.header)
+	return disk.WriteSuperblockToDisk()
+}
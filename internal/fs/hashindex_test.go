@@ -0,0 +1,108 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func lookupKey(t *testing.T, disk *Disk, key string) int {
+	t.Helper()
+	idx, err := disk.LookupKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func TestHashIndexLookup(t *testing.T) {
+	disk, _ := newTestDisk(t)
+	inodes := map[string]int{}
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		inodes[key] = putValue(t, disk, key, []byte("v"))
+	}
+	for i := 0; i < 200; i += 2 {
+		deleteValue(t, disk, fmt.Sprintf("key%03d", i))
+	}
+
+	for key, idx := range inodes {
+		want := idx
+		if key[len(key)-1]%2 == 0 {
+			want = -1
+		}
+		if got := lookupKey(t, disk, key); got != want {
+			t.Fatalf("%s is at inode %d, want %d", key, got, want)
+		}
+	}
+	if lookupKey(t, disk, "missing") != -1 {
+		t.Fatal("found a key that was never set")
+	}
+}
+
+func TestHashIndexSlotOutOfRange(t *testing.T) {
+	disk, device := newTestDisk(t)
+	idx := putValue(t, disk, "a", []byte("v"))
+	putValue(t, disk, "b", []byte("v"))
+
+	// point the slot of "a" past the inode table, the digest of the inodes still matches
+	index := disk.HashIndex
+	mask := uint32(len(index.slots) - 1)
+	pos := hashKey("a") & mask
+	for index.slots[pos].inode != uint32(idx)+1 {
+		pos = (pos + 1) & mask
+	}
+	index.setSlot(int(pos), hashSlot{hash: hashKey("a"), inode: uint32(len(disk.Inodes)) + 5})
+
+	// a stale slot in memory is skipped
+	if got := lookupKey(t, disk, "a"); got != -1 {
+		t.Fatalf("a stale slot found inode %d", got)
+	}
+	if err := disk.WriteHashIndexToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.FlushPages(); err != nil {
+		t.Fatal(err)
+	}
+
+	// and one read from the disk gets the index rebuilt
+	mounted, err := MountDevice(device, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lookupKey(t, mounted, "a"); got != idx {
+		t.Fatalf("a is at inode %d after mounting, want %d", got, idx)
+	}
+	if report := mounted.Check(); !report.Clean() {
+		t.Fatalf("fsck: %v", report.Problems)
+	}
+}
+
+func TestLookupKeyUnreadableKey(t *testing.T) {
+	disk, device := newTestDisk(t)
+	long := strings.Repeat("k", 300)
+	idx := putValue(t, disk, long, []byte("v"))
+
+	// the overflow page of the key is corrupted, the lookup can't tell whether the inode holds it
+	pages, err := disk.InodeKeyPages(disk.Inodes[idx])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.FlushPages(); err != nil {
+		t.Fatal(err)
+	}
+	device.WriteAt([]byte("garbage"), int64(disk.SuperBlock.DataStartOffset)+int64(pages[0]*disk.pageBytes()))
+
+	mounted, err := MountDevice(device, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx, err := mounted.LookupKey(long); !errors.Is(err, ErrCorruptPage) {
+		t.Fatalf("lookup of a key that can't be read returned inode %d, %v", idx, err)
+	}
+	// a key with another hash never reads it
+	if idx, err := mounted.LookupKey("other"); idx != -1 || err != nil {
+		t.Fatalf("lookup of a missing key returned inode %d, %v", idx, err)
+	}
+}
@@ -0,0 +1,59 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+Values of up to MAX_INLINE_VALUE bytes are stored in the inode itself, in the 24 bytes PageNumbers
+takes otherwise, and the inode sets INODE_FLAG_INLINE. Size is the length of the value and
+NumberofPages is 0, the inode owns no data pages, so reading the value never touches one.
+
+The bytes are laid out as they are in the inode table, PageNumbers[0] holds the first 4 bytes of the
+value in little endian order and so on. MapInodePages clears the flag when a value grows out of the inode.
+
+The inode table isn't encrypted, an encrypted disk keeps even the smallest value in a data page.
+*/
+const (
+	MAX_INLINE_VALUE = MAX_PAGES * 4
+
+	INODE_FLAG_INLINE = 1 << 3 // PageNumbers holds the value
+)
+
+// InlineFits reports whether a value of size bytes is stored in its inode on this disk
+func (disk *Disk) InlineFits(size int) bool {
+	return size <= MAX_INLINE_VALUE && !disk.Encrypted()
+}
+
+// Inline reports whether the value of the inode is stored in the inode
+func (i *Inode) Inline() bool {
+	return i.Flags[0]&INODE_FLAG_INLINE != 0
+}
+
+// InlineValue returns the value stored in an inline inode
+func (i *Inode) InlineValue() []byte {
+	data := make([]byte, MAX_INLINE_VALUE)
+	for j, word := range i.PageNumbers {
+		binary.LittleEndian.PutUint32(data[j*4:j*4+4], word)
+	}
+	return data[:min(i.valueSize(), MAX_INLINE_VALUE)]
+}
+
+// SetInlineValue stores value in the inode, the pages it had have to be freed first
+func (i *Inode) SetInlineValue(value []byte) error {
+	if len(value) > MAX_INLINE_VALUE {
+		return fmt.Errorf("value is %d bytes, at most %d fit in the inode", len(value), MAX_INLINE_VALUE)
+	}
+
+	data := make([]byte, MAX_INLINE_VALUE)
+	copy(data, value)
+	for j := range i.PageNumbers {
+		i.PageNumbers[j] = binary.LittleEndian.Uint32(data[j*4 : j*4+4])
+	}
+	binary.LittleEndian.PutUint32(i.Size[:], uint32(len(value)))
+	i.NumberofPages[0] = 0
+	i.Flags[0] &^= INODE_FLAG_INDIRECT | INODE_FLAG_EXTENTS
+	i.Flags[0] |= INODE_FLAG_INLINE
+	return nil
+}
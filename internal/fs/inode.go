@@ -2,6 +2,8 @@ package fs
 
 import (
 	"encoding/binary"
+	"fmt"
+	"io"
 )
 
 /*
@@ -15,14 +17,26 @@ change the implementation to use only the number of pages need
 // Thus, since inode table size = 64KB = 65536 B, we get 65536/64 = 1024 unique inodes in the table
 const (
 	MAX_PAGES = 6
+
+	// values that need more than MAX_PAGES pages use indirect pages, like a classic unix inode
+	// PageNumbers[0:4] - direct pages
+	// PageNumbers[4]   - single indirect page, holds page numbers of data pages
+	// PageNumbers[5]   - double indirect page, holds page numbers of single indirect pages
+	// an indirect page holds page size / 4 page numbers, see Disk.PointersPerPage
+	DIRECT_PAGES    = 4
+	SINGLE_INDIRECT = 4
+	DOUBLE_INDIRECT = 5
+
+	INODE_FLAG_INDIRECT = 1 << 0 // PageNumbers uses the indirect layout
 )
 
 type Inode struct {
 	Key           [32]byte
 	Size          [4]byte // size of that value corresponding to this key in bytes - that number can be represented in 4 bytes because it won't be bigger than 2^32
-	NumberofPages [1]byte // can be max 6
+	NumberofPages [1]byte // number of entries used in PageNumbers, can be max 6, or of extents, see extents.go
 	InUse         [1]byte
 	PageNumbers   [6]uint32
+	Flags         [1]byte // INODE_FLAG_* bits, older inodes have 0 here
 }
 
 func NewInode(key [32]byte, fileSize [4]byte) *Inode {
@@ -32,6 +46,7 @@ func NewInode(key [32]byte, fileSize [4]byte) *Inode {
 		NumberofPages: [1]byte{0},
 		InUse:         [1]byte{1},
 		PageNumbers:   [6]uint32{},
+		Flags:         [1]byte{0},
 	}
 }
 
@@ -43,12 +58,14 @@ func (i *Inode) ToBytes() []byte {
 	copy(byteData[36:37], i.NumberofPages[:])
 	copy(byteData[37:38], i.InUse[:])
 
-	// Store up to 6 page numbers (6 * 4 = 24 bytes, total = 61 bytes, fits in 64)
+	// Store up to 6 page numbers (6 * 4 = 24 bytes, total = 62 bytes, then 1 byte of flags, fits in 64)
 	for j := 0; j < MAX_PAGES && j < len(i.PageNumbers); j++ {
 		offset := 38 + (j * 4)
 		binary.LittleEndian.PutUint32(byteData[offset:offset+4], i.PageNumbers[j])
 	}
 
+	copy(byteData[62:63], i.Flags[:])
+
 	return byteData
 }
 
@@ -59,6 +76,7 @@ func FromBytes(data []byte) *Inode {
 	var numpages [1]byte
 	var inuse [1]byte
 	var pageNumbers [MAX_PAGES]uint32
+	var flags [1]byte
 
 	copy(key[:], chunk[:32])
 	copy(size[:], chunk[32:36])
@@ -70,6 +88,7 @@ func FromBytes(data []byte) *Inode {
 		offset := 38 + (i * 4)
 		pageNumbers[i] = binary.LittleEndian.Uint32(chunk[offset : offset+4])
 	}
+	copy(flags[:], chunk[62:63])
 
 	return &Inode{
 		Key:           key,
@@ -77,21 +96,28 @@ func FromBytes(data []byte) *Inode {
 		NumberofPages: numpages,
 		InUse:         inuse,
 		PageNumbers:   pageNumbers,
+		Flags:         flags,
 	}
 }
 
-func ReadInodes(dataBytes []byte, superblock *SuperBlock) []*Inode {
+func ReadInodes(r io.ReaderAt, superblock *SuperBlock) ([]*Inode, error) {
 	var inodes []*Inode
 	inodeTableOffset := superblock.InodeTableStartOffset
 
+	inodeTable := make([]byte, INODE_TABLE_SIZE)
+	_, err := r.ReadAt(inodeTable, int64(inodeTableOffset))
+	if err != nil {
+		return nil, fmt.Errorf("could not read inode table: %v", err)
+	}
+
 	// Read 64 bytes chunk by chunk, because each inode struct is padded to 64 bytes
 	for i := 0; i < INODE_TABLE_SIZE; i += 64 {
-		chunk := dataBytes[inodeTableOffset+uint32(i) : inodeTableOffset+uint32(i)+64]
+		chunk := inodeTable[i : i+64]
 
 		// Use FromBytes to properly deserialize the inode
 		inode := FromBytes(chunk)
 		inodes = append(inodes, inode)
 	}
 
-	return inodes
+	return inodes, nil
 }
@@ -0,0 +1,213 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+When the bitmap or the checksum table needs more pages the whole data region moves forward, see resize.
+Moving it in place would leave a crash in the middle with neither the old nor the new layout on the
+device, so the move is journaled:
+
+ 1. a journal page is written past the end of the grown disk, it holds the new superblock and says the
+    move is MOVE_PREPARED
+ 2. an image of everything after the inode table in the new layout, the bitmap and the checksum table
+    from memory and the data pages from the device, is written between the end of the grown disk and
+    the journal page, and synced
+ 3. the journal page is written again as MOVE_COMMITTED and synced, from here on the move is decided
+ 4. the image is copied over the old layout, the new superblock is written and synced, and the device
+    is cut back to the end of the grown disk, which drops the image and the journal
+
+Mounting a disk whose last page is a journal finishes what the crash interrupted: a prepared move never
+touched the old layout and is dropped, a committed one is done again from step 4, which only reads the
+image, as often as it takes.
+*/
+
+var MOVE_MAGIC = [4]byte{'V', 'M', 'O', 'V'}
+
+// states of a journaled move
+const (
+	MOVE_PREPARED  = 1
+	MOVE_COMMITTED = 2
+)
+
+// returned, wrapped, when a read-only mount finds a move it can't finish
+var ErrUnfinishedMove = errors.New("the disk was being resized when it crashed, mount it to write once to finish")
+
+// moveJournal is the last page of the device while the data region is moved, it is laid out like a
+// superblock, with MOVE_MAGIC, and the move after it
+type moveJournal struct {
+	superblock  *SuperBlock // the superblock once the data is moved
+	state       byte
+	imageOffset int64 // where the image of the new layout is on the device
+	imageLength int64
+	oldSize     int64 // the size of the device before the move
+}
+
+func (j *moveJournal) offset() int64 {
+	return j.imageOffset + j.imageLength
+}
+
+func (j *moveJournal) toBytes() []byte {
+	sb := *j.superblock
+	sb.Magic = MOVE_MAGIC
+	data := serializeSuperblock(&sb)
+
+	data[72] = j.state
+	binary.LittleEndian.PutUint64(data[80:88], uint64(j.imageOffset))
+	binary.LittleEndian.PutUint64(data[88:96], uint64(j.imageLength))
+	binary.LittleEndian.PutUint64(data[96:104], uint64(j.oldSize))
+	binary.LittleEndian.PutUint32(data[30:34], superblockChecksum(data))
+	return data
+}
+
+// readMoveJournal returns the journal at the end of a device of size bytes that holds a disk with
+// pageSize pages, nil if there is none
+func readMoveJournal(r io.ReaderAt, size int64, pageSize int64) (*moveJournal, error) {
+	if size < 2*pageSize {
+		return nil, nil
+	}
+	data := make([]byte, pageSize)
+	if _, err := r.ReadAt(data, size-pageSize); err != nil {
+		return nil, fmt.Errorf("could not read the last page: %v", err)
+	}
+	sb := ReadSuperblock(data)
+	if sb.Magic != MOVE_MAGIC || superblockChecksum(data) != sb.Checksum {
+		return nil, nil
+	}
+
+	j := &moveJournal{
+		superblock:  sb,
+		state:       data[72],
+		imageOffset: int64(binary.LittleEndian.Uint64(data[80:88])),
+		imageLength: int64(binary.LittleEndian.Uint64(data[88:96])),
+		oldSize:     int64(binary.LittleEndian.Uint64(data[96:104])),
+	}
+	sb.Magic = MAGIC
+	if (j.state != MOVE_PREPARED && j.state != MOVE_COMMITTED) || j.offset() != size-pageSize ||
+		int64(sb.Pagesize) != pageSize || j.imageOffset != int64(sb.TotalPages)*pageSize {
+		return nil, fmt.Errorf("%w: journal of the move at %d doesn't match the device", ErrCorruptSuperblock, size-pageSize)
+	}
+	if err := sb.validateLayout(); err != nil {
+		return nil, fmt.Errorf("journal of the move: %w", err)
+	}
+	return j, nil
+}
+
+/*
+moveData moves the data region of the disk to the layout of newSB, with bitmap and checksums as its
+bitmap and checksum table, through the journal, see the top of this file. The caller holds disk.Mutex,
+has written back the buffer pool and updates the disk once it returns.
+*/
+func (disk *Disk) moveData(newSB *SuperBlock, bitmap []byte, checksums []uint32) error {
+	sb := disk.SuperBlock
+	pageSize := int64(sb.Pagesize)
+	oldSize, err := disk.Device.Size()
+	if err != nil {
+		return err
+	}
+
+	// the bitmap and the checksum table go first in the image, the data pages after them
+	meta := make([]byte, int64(newSB.DataStartOffset-newSB.BitmapStartOffset))
+	copy(meta, bitmap)
+	tableStart := newSB.ChecksumStartOffset - newSB.BitmapStartOffset
+	for i, checksum := range checksums {
+		binary.LittleEndian.PutUint32(meta[tableStart+uint32(i)*4:], checksum)
+	}
+	dataLength := int64(sb.DataPageCount()) * pageSize
+
+	j := &moveJournal{
+		superblock:  newSB,
+		state:       MOVE_PREPARED,
+		imageOffset: int64(newSB.TotalPages) * pageSize,
+		imageLength: int64(len(meta)) + dataLength,
+		oldSize:     oldSize,
+	}
+	if _, err := disk.Device.WriteAt(j.toBytes(), j.offset()); err != nil {
+		return err
+	}
+	if _, err := disk.Device.WriteAt(meta, j.imageOffset); err != nil {
+		return err
+	}
+	if err := copyRange(disk.Device, int64(sb.DataStartOffset), j.imageOffset+int64(len(meta)), dataLength); err != nil {
+		return err
+	}
+	if err := disk.Device.Sync(); err != nil {
+		return err
+	}
+
+	j.state = MOVE_COMMITTED
+	if _, err := disk.Device.WriteAt(j.toBytes(), j.offset()); err != nil {
+		return err
+	}
+	if err := disk.Device.Sync(); err != nil {
+		return err
+	}
+	return finishMove(disk.Device, j)
+}
+
+// finishMove copies the image of a committed move into place and drops the journal, it can run again
+// after a crash as it only reads the image
+func finishMove(device BlockDevice, j *moveJournal) error {
+	sb := j.superblock
+	if err := copyRange(device, j.imageOffset, int64(sb.BitmapStartOffset), j.imageLength); err != nil {
+		return fmt.Errorf("could not copy the moved data into place: %w", err)
+	}
+	if _, err := device.WriteAt(serializeSuperblock(sb), 0); err != nil {
+		return err
+	}
+	if err := device.Sync(); err != nil {
+		return err
+	}
+	if err := device.Truncate(int64(sb.TotalPages) * int64(sb.Pagesize)); err != nil {
+		return err
+	}
+	return device.Sync()
+}
+
+// recoverMove finishes or drops a move the device was left with, and returns the size of the device
+// the disk is mounted with
+func recoverMove(device BlockDevice, size int64, pageSize int64, readOnly bool) (int64, error) {
+	j, err := readMoveJournal(device, size, pageSize)
+	if err != nil || j == nil {
+		return size, err
+	}
+
+	switch {
+	case j.state == MOVE_PREPARED && readOnly:
+		// the old layout is untouched, only the image after it has to be ignored
+		return j.oldSize, nil
+	case j.state == MOVE_PREPARED:
+		if err := device.Truncate(j.oldSize); err != nil {
+			return size, err
+		}
+		return j.oldSize, device.Sync()
+	case readOnly:
+		return size, ErrUnfinishedMove
+	}
+	if err := finishMove(device, j); err != nil {
+		return size, fmt.Errorf("could not finish moving the data region: %w", err)
+	}
+	return device.Size()
+}
+
+// copyRange copies length bytes from src to dst on device, the two ranges must not overlap
+func copyRange(device BlockDevice, src int64, dst int64, length int64) error {
+	const chunkSize = 64 * 1024
+	buf := make([]byte, chunkSize)
+
+	for done := int64(0); done < length; {
+		chunk := buf[:min(chunkSize, length-done)]
+		if _, err := device.ReadAt(chunk, src+done); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if _, err := device.WriteAt(chunk, dst+done); err != nil {
+			return err
+		}
+		done += int64(len(chunk))
+	}
+	return nil
+}
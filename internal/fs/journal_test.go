@@ -0,0 +1,124 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// putResizeValues fills the disk with values of a few pages, each with its own bytes so a page that was
+// moved to the wrong place shows
+func putResizeValues(t *testing.T, disk *Disk) map[string][]byte {
+	t.Helper()
+
+	values := map[string][]byte{}
+	for i := 0; i < 40; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		values[key] = bytes.Repeat([]byte{byte(i + 1)}, (i%5+1)*DEFAULT_PAGE_SIZE)
+		putValue(t, disk, key, values[key])
+	}
+	return values
+}
+
+func checkResizeValues(t *testing.T, disk *Disk, values map[string][]byte) {
+	t.Helper()
+
+	for key, want := range values {
+		if got := readValue(t, disk, key); !bytes.Equal(got, want) {
+			t.Fatalf("%s doesn't read back after the resize", key)
+		}
+	}
+	if report := disk.Check(); !report.Clean() {
+		t.Fatalf("fsck after the resize: %v", report.Problems)
+	}
+}
+
+func TestResizeMovesDataRegion(t *testing.T) {
+	disk, device := newTestDisk(t)
+	values := putResizeValues(t, disk)
+	dataStart := disk.SuperBlock.DataStartOffset
+
+	// the checksum table of a new disk only has room for the pages it has, doubling them moves the data
+	if err := disk.Grow(1); err != nil {
+		t.Fatal(err)
+	}
+	if disk.SuperBlock.DataStartOffset == dataStart {
+		t.Fatal("the data region didn't move")
+	}
+	checkResizeValues(t, disk, values)
+
+	size, _ := device.Size()
+	if size != int64(disk.SuperBlock.TotalPages)*DEFAULT_PAGE_SIZE {
+		t.Fatalf("device is %d bytes after the resize, the disk has %d pages", size, disk.SuperBlock.TotalPages)
+	}
+	mounted, err := MountDevice(device, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkResizeValues(t, mounted, values)
+}
+
+// a resize that fails at any of its writes leaves a disk that mounts with every value in place, whether
+// the process died, keeping what it wrote, or the power went, dropping what wasn't synced
+func TestResizeSurvivesCrash(t *testing.T) {
+	disk, device := newTestDisk(t)
+	values := putResizeValues(t, disk)
+	if err := disk.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	image := device.Bytes()
+
+	mountFaulty := func(t *testing.T) (*Disk, *FaultyDevice) {
+		t.Helper()
+		device := NewFaultyDevice(image)
+		disk, err := MountDevice(device, MountOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return disk, device
+	}
+
+	// how many writes a resize takes
+	disk, counter := mountFaulty(t)
+	before := counter.Writes()
+	if err := disk.Grow(1); err != nil {
+		t.Fatal(err)
+	}
+	writes := counter.Writes() - before
+
+	unfinished := 0
+	for n := 1; n <= writes; n++ {
+		for _, powerLoss := range []bool{false, true} {
+			disk, device := mountFaulty(t)
+			device.FailWrite(n)
+			if err := disk.Grow(1); !errors.Is(err, ErrInjectedFault) {
+				t.Fatalf("write %d of %d didn't fail the resize: %v", n, writes, err)
+			}
+			if powerLoss {
+				device.Crash()
+			}
+
+			// a reader can't finish the move, it either reads the old layout or is told to wait
+			if readOnly, err := MountDevice(device, MountOptions{ReadOnly: true}); errors.Is(err, ErrUnfinishedMove) {
+				unfinished++
+			} else if err != nil {
+				t.Fatalf("read-only mount after write %d failed, power lost %v: %v", n, powerLoss, err)
+			} else {
+				checkResizeValues(t, readOnly, values)
+			}
+
+			mounted, err := MountDevice(device, MountOptions{})
+			if err != nil {
+				t.Fatalf("mount after write %d failed, power lost %v: %v", n, powerLoss, err)
+			}
+			checkResizeValues(t, mounted, values)
+			if size, _ := device.Size(); size != int64(mounted.SuperBlock.TotalPages)*DEFAULT_PAGE_SIZE {
+				t.Fatalf("device is %d bytes after write %d failed, the disk has %d pages", size, n, mounted.SuperBlock.TotalPages)
+			}
+		}
+	}
+	if unfinished == 0 {
+		t.Fatal("no failed write left a committed move to finish")
+	}
+}
@@ -0,0 +1,180 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+/*
+Keys of up to INLINE_KEY_SIZE bytes are stored directly in Inode.Key, padded with zeroes, like always.
+
+Longer keys set INODE_FLAG_LONG_KEY and the 32 byte Key field is used as:
+Key[0:24]  - first 24 bytes of the key, so most lookups can rule out an inode without reading any page
+Key[24:28] - length of the key
+Key[28:32] - first key overflow page
+
+The whole key is stored in a chain of overflow pages, each page holds page size - 4 bytes of the key
+and the page number of the next page in its last 4 bytes, 0 ends the chain.
+*/
+const (
+	INLINE_KEY_SIZE = 32
+	MAX_KEY_SIZE    = 1024
+	LONG_KEY_PREFIX = 24
+
+	INODE_FLAG_LONG_KEY = 1 << 1 // key is stored in overflow pages
+)
+
+// keyPagePayload returns how many bytes of a key fit in one overflow page
+func (disk *Disk) keyPagePayload() int {
+	return disk.PageSize() - 4
+}
+
+// KeyPagesNeeded returns how many overflow pages are needed to store a key of keyLen bytes
+func (disk *Disk) KeyPagesNeeded(keyLen int) int {
+	if keyLen <= INLINE_KEY_SIZE {
+		return 0
+	}
+	payload := disk.keyPagePayload()
+	return (keyLen + payload - 1) / payload // ceil division
+}
+
+// SetInodeKey stores key in the inode, writing it to keyPages when it doesn't fit inline
+// len(keyPages) must be KeyPagesNeeded(len(key))
+func (disk *Disk) SetInodeKey(inode *Inode, key string, keyPages []int) error {
+	if len(key) > MAX_KEY_SIZE {
+		return fmt.Errorf("key is %d bytes, max key size is %d bytes", len(key), MAX_KEY_SIZE)
+	}
+	if len(keyPages) != disk.KeyPagesNeeded(len(key)) {
+		return fmt.Errorf("got %d key pages, need %d", len(keyPages), disk.KeyPagesNeeded(len(key)))
+	}
+
+	inode.Key = [INLINE_KEY_SIZE]byte{}
+
+	if len(key) <= INLINE_KEY_SIZE {
+		inode.Flags[0] &^= INODE_FLAG_LONG_KEY
+		copy(inode.Key[:], key)
+		return nil
+	}
+
+	if err := disk.writeKeyPages(key, keyPages); err != nil {
+		return err
+	}
+
+	inode.Flags[0] |= INODE_FLAG_LONG_KEY
+	copy(inode.Key[:LONG_KEY_PREFIX], key)
+	binary.LittleEndian.PutUint32(inode.Key[24:28], uint32(len(key)))
+	binary.LittleEndian.PutUint32(inode.Key[28:32], uint32(keyPages[0]))
+
+	return nil
+}
+
+// InodeKey returns the full key of an inode
+func (disk *Disk) InodeKey(inode *Inode) (string, error) {
+	if inode.Flags[0]&INODE_FLAG_LONG_KEY == 0 {
+		return strings.TrimRight(string(inode.Key[:]), "\x00"), nil
+	}
+
+	keyLen := int(binary.LittleEndian.Uint32(inode.Key[24:28]))
+	return disk.readKeyPages(binary.LittleEndian.Uint32(inode.Key[28:32]), keyLen)
+}
+
+// InodeKeyEquals reports whether the inode holds key, it only reads overflow pages when the length
+// and the prefix of a long key already match
+func (disk *Disk) InodeKeyEquals(inode *Inode, key string) (bool, error) {
+	if inode.Flags[0]&INODE_FLAG_LONG_KEY == 0 {
+		return len(key) <= INLINE_KEY_SIZE && strings.TrimRight(string(inode.Key[:]), "\x00") == key, nil
+	}
+
+	keyLen := int(binary.LittleEndian.Uint32(inode.Key[24:28]))
+	if keyLen != len(key) || !bytes.Equal(inode.Key[:LONG_KEY_PREFIX], []byte(key[:LONG_KEY_PREFIX])) {
+		return false, nil
+	}
+
+	fullKey, err := disk.InodeKey(inode)
+	if err != nil {
+		return false, err
+	}
+	return fullKey == key, nil
+}
+
+// InodeKeyPages returns the overflow pages holding the key of an inode, none for inline keys
+func (disk *Disk) InodeKeyPages(inode *Inode) ([]int, error) {
+	if inode.Flags[0]&INODE_FLAG_LONG_KEY == 0 {
+		return []int{}, nil
+	}
+
+	keyLen := int(binary.LittleEndian.Uint32(inode.Key[24:28]))
+	return disk.keyPages(binary.LittleEndian.Uint32(inode.Key[28:32]), keyLen)
+}
+
+// FreeInodeKeyPages marks the key overflow pages of the inode as free in the bitmap
+func (disk *Disk) FreeInodeKeyPages(inode *Inode) error {
+	pages, err := disk.InodeKeyPages(inode)
+	if err != nil {
+		return err
+	}
+
+	for _, page := range pages {
+		disk.Bitmap.FreePage(page)
+	}
+	return nil
+}
+
+// writeKeyPages writes key to a chain of overflow pages
+func (disk *Disk) writeKeyPages(key string, keyPages []int) error {
+	payload := disk.keyPagePayload()
+	remaining := []byte(key)
+	for i, page := range keyPages {
+		pageData := disk.NewPage()
+		n := copy(pageData[:payload], remaining)
+		remaining = remaining[n:]
+
+		if i+1 < len(keyPages) {
+			binary.LittleEndian.PutUint32(pageData[payload:], uint32(keyPages[i+1]))
+		}
+		if err := disk.WritePageToDisk(page, pageData); err != nil {
+			return fmt.Errorf("could not write key page: %v", err)
+		}
+	}
+	return nil
+}
+
+// readKeyPages reads a key of keyLen bytes from the chain of overflow pages starting at page
+func (disk *Disk) readKeyPages(page uint32, keyLen int) (string, error) {
+	key := make([]byte, 0, keyLen)
+	payload := disk.keyPagePayload()
+
+	for len(key) < keyLen {
+		if page == 0 {
+			return "", fmt.Errorf("key overflow chain ends after %d of %d bytes", len(key), keyLen)
+		}
+		pageData, err := disk.ReadPageFromDisk(int(page))
+		if err != nil {
+			return "", fmt.Errorf("could not read key page %d: %w", page, err)
+		}
+
+		n := min(keyLen-len(key), payload)
+		key = append(key, pageData[:n]...)
+		page = binary.LittleEndian.Uint32(pageData[payload:])
+	}
+
+	return string(key), nil
+}
+
+// keyPages returns the pages of the chain of overflow pages starting at page
+func (disk *Disk) keyPages(page uint32, keyLen int) ([]int, error) {
+	pages := []int{}
+	for i := 0; i < disk.KeyPagesNeeded(keyLen) && page != 0; i++ {
+		pages = append(pages, int(page))
+
+		pageData, err := disk.ReadPageFromDisk(int(page))
+		if err != nil {
+			return nil, fmt.Errorf("could not read key page %d: %w", page, err)
+		}
+		page = binary.LittleEndian.Uint32(pageData[disk.keyPagePayload():])
+	}
+
+	return pages, nil
+}
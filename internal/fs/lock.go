@@ -0,0 +1,64 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+/*
+A disk is only ever mounted by one writer. Mount takes an advisory flock on the disk file, exclusive
+for a writer and shared for a reader, so any number of readers can have it mounted as long as no writer
+does. The kv package takes the same lock on the WAL, a WAL is only appended to by one database.
+
+The locks belong to the open file, they go away when it is closed or the process dies, there is
+nothing to clean up after a crash. flock doesn't say who holds a lock, on Linux the holder is looked
+up in /proc/locks so the error can name it.
+*/
+
+var ErrLocked = errors.New("database is locked")
+
+// LockedError is returned when a file is locked by another process, it matches ErrLocked
+type LockedError struct {
+	Path string
+	PID  int // 0 when the holder isn't known
+}
+
+func (e *LockedError) Error() string {
+	if e.PID > 0 {
+		return fmt.Sprintf("%s: database is locked by pid %d", e.Path, e.PID)
+	}
+	return fmt.Sprintf("%s: database is locked by another process", e.Path)
+}
+
+func (e *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// lockFile locks file, without waiting, until it is closed
+func lockFile(file *os.File, exclusive bool) error {
+	err := flock(file, exclusive)
+	if errors.Is(err, errLockHeld) {
+		return &LockedError{Path: file.Name(), PID: lockHolder(file)}
+	}
+	return err
+}
+
+// LockFile opens the file at path and locks it like Mount locks a disk, the lock is held until the
+// returned file is closed
+// an exclusive lock creates the file if it doesn't exist, a shared one is only taken on an existing file
+func LockFile(path string, exclusive bool) (*os.File, error) {
+	flag := os.O_RDONLY
+	if exclusive {
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	file, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file, exclusive); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
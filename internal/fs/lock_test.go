@@ -0,0 +1,75 @@
+//go:build unix
+
+package fs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func newDiskPath(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "disk.vdsk")
+	if err := CreateVDSKStorageData(path, DEFAULT_PAGE_SIZE, ENGINE_INODE); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// flock locks belong to the open file, a second Mount in the same process is turned away like one from
+// another process
+func TestMountLocksDisk(t *testing.T) {
+	path := newDiskPath(t)
+	writer, err := Mount(path, MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, readOnly := range []bool{false, true} {
+		_, err := Mount(path, MountOptions{ReadOnly: readOnly})
+		var locked *LockedError
+		if !errors.Is(err, ErrLocked) || !errors.As(err, &locked) || locked.Path != path {
+			t.Fatalf("read-only %v mount of a mounted disk: %v", readOnly, err)
+		}
+		if runtime.GOOS == "linux" && locked.PID != os.Getpid() {
+			t.Fatalf("the lock is held by pid %d, not %d", locked.PID, os.Getpid())
+		}
+	}
+
+	// the lock goes with the mount
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writer, err = Mount(path, MountOptions{})
+	if err != nil {
+		t.Fatalf("mount after the first one was closed: %v", err)
+	}
+	writer.Close()
+}
+
+func TestReadersShareLock(t *testing.T) {
+	path := newDiskPath(t)
+	readers := []*Disk{}
+	for i := 0; i < 2; i++ {
+		reader, err := Mount(path, MountOptions{ReadOnly: true})
+		if err != nil {
+			t.Fatalf("read-only mount %d: %v", i, err)
+		}
+		readers = append(readers, reader)
+	}
+	if _, err := Mount(path, MountOptions{}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("mount for writing while the disk is read: %v", err)
+	}
+
+	for _, reader := range readers {
+		reader.Close()
+	}
+	writer, err := Mount(path, MountOptions{})
+	if err != nil {
+		t.Fatalf("mount after the readers left: %v", err)
+	}
+	writer.Close()
+}
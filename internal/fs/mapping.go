@@ -0,0 +1,75 @@
+package fs
+
+import (
+	"fmt"
+)
+
+/*
+A disk can be memory mapped instead of going through read and write calls on its file.
+
+The whole file is mapped shared, so the mapping and the file are the same bytes. ReadPageFromDisk hands
+out a slice of the mapping instead of copying the page, and WritePageToDisk copies the page into the
+mapping and updates its checksum, the buffer pool isn't used for data pages since the kernel's page
+cache already is one. Metadata is written to the mapping as well, everything goes through readAt and
+writeAt.
+
+Nothing written to the mapping is durable until Sync, which waits for msync before syncing the file.
+When the disk grows the file is truncated to its new size first and mapped again, a slice handed out
+before that points at the old mapping and must not be used, the kv package never keeps one.
+*/
+
+// EnableMmap maps the file and serves every read and write from the mapping from now on
+func (disk *Disk) EnableMmap() error {
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+
+	if disk.mapping != nil {
+		return nil
+	}
+	file, ok := disk.Device.(*FileDevice)
+	if !ok {
+		return fmt.Errorf("only a disk on a file can be memory mapped")
+	}
+	// pages still in the pool would be missed by reads from the mapping
+	if err := disk.flushPages(); err != nil {
+		return err
+	}
+	return disk.mapDevice(file)
+}
+
+func (disk *Disk) Mapped() bool {
+	return disk.mapping != nil
+}
+
+// MappedSize returns how many bytes of the file are mapped, 0 if it isn't
+func (disk *Disk) MappedSize() int64 {
+	disk.Mutex.Lock()
+	defer disk.Mutex.Unlock()
+	return int64(len(disk.mapping))
+}
+
+// remap maps the file again after its size changed, caller holds disk.Mutex
+func (disk *Disk) remap() error {
+	if disk.mapping == nil {
+		return nil
+	}
+	if err := unmapFile(disk.mapping); err != nil {
+		return err
+	}
+	disk.mapping = nil
+	return disk.mapDevice(disk.Device.(*FileDevice))
+}
+
+// mapDevice maps the whole file, at its current size
+func (disk *Disk) mapDevice(file *FileDevice) error {
+	size, err := file.Size()
+	if err != nil {
+		return err
+	}
+	mapping, err := mapFile(file.File, int(size), !disk.readOnly)
+	if err != nil {
+		return fmt.Errorf("could not map %s: %v", file.Name(), err)
+	}
+	disk.mapping = mapping
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package fs
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mapFile maps size bytes of file, shared so writes to the mapping go to the file
+func mapFile(file *os.File, size int, writable bool) ([]byte, error) {
+	prot := syscall.PROT_READ
+	if writable {
+		prot |= syscall.PROT_WRITE
+	}
+	return syscall.Mmap(int(file.Fd()), 0, size, prot, syscall.MAP_SHARED)
+}
+
+func unmapFile(mapping []byte) error {
+	return syscall.Munmap(mapping)
+}
+
+// syncMapping waits for the dirty pages of the mapping to reach the file
+func syncMapping(mapping []byte) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&mapping[0])), uintptr(len(mapping)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package fs
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoMmap = errors.New("mmap is not supported on this platform")
+
+func mapFile(file *os.File, size int, writable bool) ([]byte, error) {
+	return nil, errNoMmap
+}
+
+func unmapFile(mapping []byte) error {
+	return errNoMmap
+}
+
+func syncMapping(mapping []byte) error {
+	return errNoMmap
+}
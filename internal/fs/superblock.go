@@ -1,52 +1,129 @@
 package fs
 
-import "encoding/binary"
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
 
-// Total allocated size for superblock = 1 page = 512B
+// Total allocated size for superblock = 1 page = Pagesize bytes, at least 512B
 
-// Superblock actual size = 26 B total
+// format versions, see Formats in format.go
+var (
+	MAGIC           = [4]byte{'V', 'D', 'S', 'K'}
+	VERSION_01      = [2]byte{'0', '1'}
+	VERSION_02      = [2]byte{'0', '2'}
+	VERSION_03      = [2]byte{'0', '3'}
+	VERSION_04      = [2]byte{'0', '4'}
+	VERSION_05      = [2]byte{'0', '5'}
+	VERSION_06      = [2]byte{'0', '6'}
+	VERSION_07      = [2]byte{'0', '7'}
+	VERSION_08      = [2]byte{'0', '8'}
+	VERSION_09      = [2]byte{'0', '9'}
+	VERSION_10      = [2]byte{'1', '0'}
+	VERSION_11      = [2]byte{'1', '1'}
+	CURRENT_VERSION = Formats[len(Formats)-1].Version
+)
+
+var (
+	ErrBadMagic           = errors.New("not a vantadb disk: bad magic")
+	ErrTruncatedDisk      = errors.New("disk is truncated")
+	ErrSuperblockChecksum = errors.New("superblock checksum mismatch, superblock is corrupted")
+	ErrCorruptSuperblock  = errors.New("superblock is corrupted")
+)
+
+// UnsupportedVersionError is returned when a disk has a format version this build doesn't know
+type UnsupportedVersionError struct {
+	Version [2]byte
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported disk format version %q, this build supports up to %q", e.Version[:], CURRENT_VERSION[:])
+}
+
+// CRC32C (Castagnoli), used for the superblock checksum
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Superblock actual size = 72 B total
 type SuperBlock struct {
 	Magic                 [4]byte // 4B
 	Version               [2]byte // 2B
 	Pagesize              uint32  // 32 bits = 4 byte
-	TotalPages            uint32  // 32 bits = 4 byte
+	TotalPages            uint32  // 32 bits = 4 byte - every page in the file, including superblock, inodes and bitmap
 	InodeTableStartOffset uint32  // 32 bits = 4 byte
 	BitmapStartOffset     uint32  // 32 bits = 4 byte
 	DataStartOffset       uint32  // 32 bits = 4 byte
+	BitmapPages           uint32  // 32 bits = 4 byte - older disks have 0 here, which means 1 page
+	Checksum              uint32  // 32 bits = 4 byte - CRC32C of the superblock page with this field zeroed
+	ChecksumStartOffset   uint32  // 32 bits = 4 byte - page checksum table, between the bitmap and the data
+	ChecksumPages         uint32  // 32 bits = 4 byte
+	HashIndexPage         uint32  // 32 bits = 4 byte - header page of the hash index, 0 = no index yet
+	BTreePage             uint32  // 32 bits = 4 byte - header page of the b+tree, 0 = no tree yet
+	Engine                [1]byte // 1B - ENGINE_*, picked when the disk is created
+	Codec                 [1]byte // 1B - codec new values are compressed with, 0 = none, see compression.go
+	CompressMinSize       uint32  // 32 bits = 4 byte - smaller values are stored as they are
+	KeyID                 [8]byte // 8B - ID of the key the data pages are encrypted with, zero = not encrypted, see encryption.go
+	WALCheckpoint         uint64  // 64 bits = 8 byte - WAL offset the inode engine is synced up to, replayed from on open
 }
 
-func NewSuperBlock() *SuperBlock {
+func NewSuperBlock(pageSize int) *SuperBlock {
+
+	// inode table offset - 1 page (Superblock tages first page then inode)
+	inodeTableOffset := pageSize
 
-	// inode table offset - 512B (Superblock tages first page then inode)
-	inodeTableOffset := 512
+	// bitmap start offset - 1 page + 64KB (inodes + super block)
+	bitmapStartOffset := pageSize + INODE_TABLE_SIZE
 
-	// bitmap start offset - 512B + 64KB (inodes + super block)
-	bitmapStartOffset := (512) + (64 * 1024)
+	// checksum table start offset - 1 page + 64KB + 1 page (inodes + superblock of 1 page + bitmap of 1 page)
+	// 65KB with 512B pages
+	checksumStartOffset := bitmapStartOffset + pageSize
 
-	// data start offset - 512B + 64KB + 512B (inodes + superblock of 1 page + bitmap of 1 page)
-	// 65KB
-	dataStartOffset := 65 * 1024
+	// the checksum table takes 4B for every data page, split what is left of the disk between the two
+	remainingPages := TOTAL_DISK_SIZE/pageSize - checksumStartOffset/pageSize
+	checksumPages := (remainingPages*4 + pageSize + 4 - 1) / (pageSize + 4) // ceil division
+
+	// data start offset - after the checksum table
+	dataStartOffset := checksumStartOffset + checksumPages*pageSize
 
 	return &SuperBlock{
-		Magic:                 [4]byte{'V', 'D', 'S', 'K'},
-		Version:               [2]byte{'0', '1'},
-		Pagesize:              uint32(512),
-		TotalPages:            uint32(2048),
+		Magic:                 MAGIC,
+		Version:               CURRENT_VERSION,
+		Pagesize:              uint32(pageSize),
+		TotalPages:            uint32(TOTAL_DISK_SIZE / pageSize),
 		InodeTableStartOffset: uint32(inodeTableOffset),
 		BitmapStartOffset:     uint32(bitmapStartOffset),
 		DataStartOffset:       uint32(dataStartOffset),
+		BitmapPages:           uint32(1),
+		ChecksumStartOffset:   uint32(checksumStartOffset),
+		ChecksumPages:         uint32(checksumPages),
 	}
 
 }
 
-func ReadSuperblock(blockData []byte) *SuperBlock{
+func ReadSuperblock(blockData []byte) *SuperBlock {
 
-	pagesize := blockData[6:10] // 32 bits = 8 bytes
-	totalpages := blockData[10:14] // 32 bits = 8 bytes
+	pagesize := blockData[6:10]               // 32 bits = 8 bytes
+	totalpages := blockData[10:14]            // 32 bits = 8 bytes
 	inodeTableStartOffset := blockData[14:18] // 32 bits = 8 bytes
-	bitmapStartOffset := blockData[18:22] // 32 bits = 8 bytes
-	dataStartOffset := blockData[22:26] // 32 bits = 8 bytes
-	
+	bitmapStartOffset := blockData[18:22]     // 32 bits = 8 bytes
+	dataStartOffset := blockData[22:26]       // 32 bits = 8 bytes
+	bitmapPages := blockData[26:30]           // 32 bits = 8 bytes
+	checksum := blockData[30:34]              // 32 bits = 8 bytes
+	checksumStartOffset := blockData[34:38]   // 32 bits = 8 bytes
+	checksumPages := blockData[38:42]         // 32 bits = 8 bytes
+	hashIndexPage := blockData[42:46]         // 32 bits = 8 bytes
+	btreePage := blockData[46:50]             // 32 bits = 8 bytes
+	compressMinSize := blockData[52:56]       // 32 bits = 8 bytes
+	keyID := blockData[56:64]                 // 64 bits = 8 bytes
+	walCheckpoint := blockData[64:72]         // 64 bits = 8 bytes
+
+	var engine [1]byte
+	copy(engine[:], blockData[50:51])
+	var codec [1]byte
+	copy(codec[:], blockData[51:52])
+
 	var magic [4]byte
 	var version [2]byte
 
@@ -54,13 +131,121 @@ func ReadSuperblock(blockData []byte) *SuperBlock{
 	copy(version[:], blockData[4:6])
 
 	return &SuperBlock{
-		Magic: magic,
-		Version: version,
+		Magic:                 magic,
+		Version:               version,
 		Pagesize:              binary.LittleEndian.Uint32(pagesize[:4]),
-        TotalPages:            binary.LittleEndian.Uint32(totalpages[:4]),
-        InodeTableStartOffset: binary.LittleEndian.Uint32(inodeTableStartOffset[:4]),
-        BitmapStartOffset:     binary.LittleEndian.Uint32(bitmapStartOffset[:4]),
-        DataStartOffset:       binary.LittleEndian.Uint32(dataStartOffset[:4]),
-    }
+		TotalPages:            binary.LittleEndian.Uint32(totalpages[:4]),
+		InodeTableStartOffset: binary.LittleEndian.Uint32(inodeTableStartOffset[:4]),
+		BitmapStartOffset:     binary.LittleEndian.Uint32(bitmapStartOffset[:4]),
+		DataStartOffset:       binary.LittleEndian.Uint32(dataStartOffset[:4]),
+		BitmapPages:           binary.LittleEndian.Uint32(bitmapPages[:4]),
+		Checksum:              binary.LittleEndian.Uint32(checksum[:4]),
+		ChecksumStartOffset:   binary.LittleEndian.Uint32(checksumStartOffset[:4]),
+		ChecksumPages:         binary.LittleEndian.Uint32(checksumPages[:4]),
+		HashIndexPage:         binary.LittleEndian.Uint32(hashIndexPage[:4]),
+		BTreePage:             binary.LittleEndian.Uint32(btreePage[:4]),
+		Engine:                engine,
+		Codec:                 codec,
+		CompressMinSize:       binary.LittleEndian.Uint32(compressMinSize[:4]),
+		KeyID:                 [8]byte(keyID),
+		WALCheckpoint:         binary.LittleEndian.Uint64(walCheckpoint[:8]),
+	}
+
+}
+
+/*
+LoadSuperblock reads and validates the superblock of a disk of fileSize bytes.
+
+It rejects files without the VDSK magic, format versions newer than this build, a superblock page
+whose checksum doesn't match and disks that are shorter than the superblock says they are.
+Older format versions are accepted, it is up to the caller to upgrade them.
+*/
+func LoadSuperblock(r io.ReaderAt, fileSize int64) (*SuperBlock, error) {
+	if fileSize < MIN_PAGE_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes is smaller than a superblock", ErrTruncatedDisk, fileSize)
+	}
+
+	// the page size is stored in the superblock, so first read the smallest possible page
+	blockData := make([]byte, MIN_PAGE_SIZE)
+	if _, err := r.ReadAt(blockData, 0); err != nil {
+		return nil, fmt.Errorf("could not read superblock: %v", err)
+	}
+	superblock := ReadSuperblock(blockData)
+
+	if superblock.Magic != MAGIC {
+		return nil, ErrBadMagic
+	}
+	if formatIndex(superblock.Version) < 0 {
+		return nil, &UnsupportedVersionError{Version: superblock.Version}
+	}
+	if err := ValidatePageSize(int(superblock.Pagesize)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptSuperblock, err)
+	}
+
+	// version 01 disks were written without a checksum
+	if superblock.Version != VERSION_01 {
+		pageData := make([]byte, superblock.Pagesize)
+		if _, err := r.ReadAt(pageData, 0); err != nil {
+			return nil, fmt.Errorf("%w: could not read superblock page: %v", ErrTruncatedDisk, err)
+		}
+		if superblockChecksum(pageData) != superblock.Checksum {
+			return nil, ErrSuperblockChecksum
+		}
+	}
+
+	if err := superblock.validateLayout(); err != nil {
+		return nil, err
+	}
+
+	if fileSize < int64(superblock.DataStartOffset) || fileSize < int64(superblock.TotalPages)*int64(superblock.Pagesize) {
+		return nil, fmt.Errorf("%w: file is %d bytes, superblock expects %d", ErrTruncatedDisk, fileSize, int64(superblock.TotalPages)*int64(superblock.Pagesize))
+	}
+
+	return superblock, nil
+}
+
+// validateLayout checks that the regions described by the superblock are in order and page aligned
+func (sb *SuperBlock) validateLayout() error {
+	pageSize := sb.Pagesize
+	switch {
+	case sb.InodeTableStartOffset != pageSize:
+		return fmt.Errorf("%w: inode table starts at %d", ErrCorruptSuperblock, sb.InodeTableStartOffset)
+	case sb.BitmapStartOffset != sb.InodeTableStartOffset+INODE_TABLE_SIZE:
+		return fmt.Errorf("%w: bitmap starts at %d", ErrCorruptSuperblock, sb.BitmapStartOffset)
+	case sb.DataStartOffset < sb.BitmapStartOffset+uint32(sb.BitmapPageCount())*pageSize || sb.DataStartOffset%pageSize != 0:
+		return fmt.Errorf("%w: data starts at %d", ErrCorruptSuperblock, sb.DataStartOffset)
+	case formatIndex(sb.Version) >= formatIndex(VERSION_03) && (sb.ChecksumPages == 0 ||
+		sb.ChecksumStartOffset != sb.BitmapStartOffset+uint32(sb.BitmapPageCount())*pageSize ||
+		sb.DataStartOffset < sb.ChecksumStartOffset+sb.ChecksumPages*pageSize):
+		return fmt.Errorf("%w: checksum table at %d, %d pages", ErrCorruptSuperblock, sb.ChecksumStartOffset, sb.ChecksumPages)
+	case formatIndex(sb.Version) >= formatIndex(VERSION_03) && int(sb.ChecksumPages)*int(pageSize)/4 < sb.DataPageCount():
+		return fmt.Errorf("%w: checksum table is too small for %d data pages", ErrCorruptSuperblock, sb.DataPageCount())
+	case int(sb.Engine[0]) >= len(Engines):
+		return fmt.Errorf("%w: unknown storage engine %d", ErrCorruptSuperblock, sb.Engine[0])
+	case sb.Codec[0] > MAX_CODEC_ID:
+		return fmt.Errorf("%w: unknown codec %d", ErrCorruptSuperblock, sb.Codec[0])
+	case sb.TotalPages < sb.DataStartOffset/pageSize:
+		return fmt.Errorf("%w: %d total pages", ErrCorruptSuperblock, sb.TotalPages)
+	}
+	return nil
+}
+
+// superblockChecksum returns the CRC32C of a superblock page, skipping the checksum field itself
+func superblockChecksum(pageData []byte) uint32 {
+	checksum := crc32.Update(0, crcTable, pageData[:30])
+	checksum = crc32.Update(checksum, crcTable, []byte{0, 0, 0, 0})
+	return crc32.Update(checksum, crcTable, pageData[34:])
+}
 
-}
\ No newline at end of file
+// BitmapPageCount returns the number of pages used by the bitmap
+func (sb *SuperBlock) BitmapPageCount() int {
+	if sb.BitmapPages == 0 { // disks created before the bitmap could grow
+		return 1
+	}
+	return int(sb.BitmapPages)
+}
+
+// DataPageCount returns the number of data pages, i.e. every page after DataStartOffset
+func (sb *SuperBlock) DataPageCount() int {
+	return int(sb.TotalPages) - int(sb.DataStartOffset/sb.Pagesize)
+}
@@ -0,0 +1,113 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMountRejectsBadSuperblock(t *testing.T) {
+	device := NewMemoryDevice(nil)
+	if err := FormatDevice(device, DEFAULT_PAGE_SIZE, ENGINE_INODE); err != nil {
+		t.Fatal(err)
+	}
+	image := device.Bytes()
+
+	// resum fixes the checksum after a change, so it is the field itself that gets the disk rejected
+	resum := func(disk []byte) {
+		binary.LittleEndian.PutUint32(disk[30:34], superblockChecksum(disk[:DEFAULT_PAGE_SIZE]))
+	}
+	cases := []struct {
+		name    string
+		corrupt func(disk []byte) []byte
+		want    error
+	}{
+		{"bad magic", func(disk []byte) []byte {
+			copy(disk, "NOPE")
+			return disk
+		}, ErrBadMagic},
+		{"flipped byte", func(disk []byte) []byte {
+			disk[DEFAULT_PAGE_SIZE/2] ^= 0xff
+			return disk
+		}, ErrSuperblockChecksum},
+		{"flipped field", func(disk []byte) []byte {
+			disk[10] ^= 0x01 // total pages
+			return disk
+		}, ErrSuperblockChecksum},
+		{"invalid page size", func(disk []byte) []byte {
+			binary.LittleEndian.PutUint32(disk[6:10], 1000)
+			resum(disk)
+			return disk
+		}, ErrCorruptSuperblock},
+		{"bitmap offset", func(disk []byte) []byte {
+			binary.LittleEndian.PutUint32(disk[18:22], DEFAULT_PAGE_SIZE)
+			resum(disk)
+			return disk
+		}, ErrCorruptSuperblock},
+		{"unknown engine", func(disk []byte) []byte {
+			disk[50] = byte(len(Engines))
+			resum(disk)
+			return disk
+		}, ErrCorruptSuperblock},
+		{"unknown codec", func(disk []byte) []byte {
+			disk[51] = MAX_CODEC_ID + 1
+			resum(disk)
+			return disk
+		}, ErrCorruptSuperblock},
+		{"truncated", func(disk []byte) []byte {
+			return disk[:len(disk)/2]
+		}, ErrTruncatedDisk},
+		{"shorter than a superblock", func(disk []byte) []byte {
+			return disk[:MIN_PAGE_SIZE-1]
+		}, ErrTruncatedDisk},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			corrupted := c.corrupt(bytes.Clone(image))
+			device := NewMemoryDevice(corrupted)
+			disk, err := MountDevice(device, MountOptions{})
+			if err == nil {
+				disk.Close()
+				t.Fatal("mounted")
+			}
+			if !errors.Is(err, c.want) {
+				t.Fatalf("mount: %v, want %v", err, c.want)
+			}
+			if !bytes.Equal(device.Bytes(), corrupted) {
+				t.Fatal("the failed mount wrote to the disk")
+			}
+		})
+	}
+}
+
+func TestMountRejectsUnknownVersion(t *testing.T) {
+	device := NewMemoryDevice(nil)
+	if err := FormatDevice(device, DEFAULT_PAGE_SIZE, ENGINE_INODE); err != nil {
+		t.Fatal(err)
+	}
+	image := device.Bytes()
+
+	// a version from a later build, with a checksum that matches
+	copy(image[4:6], "99")
+	binary.LittleEndian.PutUint32(image[30:34], superblockChecksum(image[:DEFAULT_PAGE_SIZE]))
+	for _, readOnly := range []bool{false, true} {
+		_, err := MountDevice(NewMemoryDevice(image), MountOptions{ReadOnly: readOnly})
+		var unsupported *UnsupportedVersionError
+		if !errors.As(err, &unsupported) || unsupported.Version != [2]byte{'9', '9'} {
+			t.Fatalf("read-only %v mount of version 99: %v", readOnly, err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "v99.vdsk")
+	if err := os.WriteFile(path, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Mount(path, MountOptions{}); !errors.As(err, new(*UnsupportedVersionError)) {
+		t.Fatalf("mount of the file: %v", err)
+	}
+	if _, _, err := Upgrade(path); err == nil {
+		t.Fatal("upgraded a disk of an unknown version")
+	}
+}
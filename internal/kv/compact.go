@@ -0,0 +1,105 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+)
+
+// ----------------------------------- compaction -----------------------------------
+
+// a pass moves what it can into the holes that are there when it starts, a value moved out of the way
+// leaves a hole the next pass can fill, passes stop once one moves nothing
+const MAX_COMPACT_PASSES = 4
+
+var ErrCompacting = errors.New("a compaction is already running")
+
+/*
+Compact moves the pages of every value into contiguous runs at the front of the disk, see
+fs.Disk.RelocateInode, then rebuilds the indexes so they land there too and truncates the free pages
+off the end of the file.
+
+The write lock is only held while one inode is moved, reads and writes go on between two moves, so
+it can run while the DB is serving. A write landing in between is just one more inode for the next
+pass. Values of the inode engine and files of the lsm engine are moved alike, each is one inode.
+*/
+func (db *DB) Compact() (fs.CompactReport, error) {
+	report := fs.CompactReport{}
+	if db.disk == nil {
+		return report, fmt.Errorf("the engine has no disk to compact")
+	}
+	if db.readOnly() {
+		return report, ErrReadOnly
+	}
+	if !db.compacting.CompareAndSwap(false, true) {
+		return report, ErrCompacting
+	}
+	defer db.compacting.Store(false)
+
+	// everything the engine holds is written first, the moves only see what is on the disk
+	db.mutex.Lock()
+	err := db.engine.Flush()
+	report.PagesBefore = db.disk.SuperBlock.TotalPages
+	order := db.disk.CompactionOrder()
+	report.FragmentedBefore = db.fragmented(order)
+	db.mutex.Unlock()
+	if err != nil {
+		return report, err
+	}
+
+	moved := map[int]bool{}
+	for pass := 0; pass < MAX_COMPACT_PASSES; pass++ {
+		pagesMoved := 0
+		for _, idx := range order {
+			db.mutex.Lock()
+			n, err := db.disk.RelocateInode(idx)
+			db.mutex.Unlock()
+			if err != nil {
+				return report, err
+			}
+			if n > 0 {
+				moved[idx] = true
+				pagesMoved += n
+			}
+		}
+		report.PagesMoved += pagesMoved
+		if pagesMoved == 0 {
+			break
+		}
+
+		db.mutex.RLock()
+		order = db.disk.CompactionOrder()
+		db.mutex.RUnlock()
+	}
+	report.InodesMoved = len(moved)
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	// the index pages were allocated as the indexes grew, built again they take the lowest free pages
+	if err := db.disk.RebuildHashIndex(); err != nil {
+		return report, err
+	}
+	if err := db.disk.RebuildBTree(); err != nil {
+		return report, err
+	}
+	if _, err := db.disk.Shrink(); err != nil {
+		return report, fmt.Errorf("could not truncate the disk: %v", err)
+	}
+	report.PagesAfter = db.disk.SuperBlock.TotalPages
+	report.BytesReclaimed = (int64(report.PagesBefore) - int64(report.PagesAfter)) * int64(db.disk.SuperBlock.Pagesize)
+	report.FragmentedAfter = db.fragmented(db.disk.CompactionOrder())
+	return report, nil
+}
+
+// fragmented counts the inodes whose pages aren't contiguous, caller holds db.mutex
+func (db *DB) fragmented(inodes []int) int {
+	count := 0
+	for _, idx := range inodes {
+		if db.disk.Fragmented(idx) {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,147 @@
+package kv
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+)
+
+// putChurn sets n values of 4 to 12 pages and deletes all but every tenth, it returns what is left
+func putChurn(t *testing.T, db *DB, n int) map[string]string {
+	t.Helper()
+	values := map[string]string{}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("churn%04d", i)
+		values[key] = strings.Repeat(string(rune('a'+i%26)), 4*(1+i%3)*fs.DEFAULT_PAGE_SIZE)
+		if _, err := db.SetWithDurability(key, values[key], DURABILITY_NONE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if i%10 == 0 {
+			continue
+		}
+		key := fmt.Sprintf("churn%04d", i)
+		if msg := db.Del(key); msg != "OK" {
+			t.Fatal(msg)
+		}
+		delete(values, key)
+	}
+	return values
+}
+
+func checkValues(t *testing.T, db *DB, values map[string]string) {
+	t.Helper()
+	pairs, err := db.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != len(values) {
+		t.Fatalf("%d pairs, want %d", len(pairs), len(values))
+	}
+	for _, pair := range pairs {
+		if values[pair.Key] != pair.Value {
+			t.Fatalf("%s reads back %d bytes, wrote %d", pair.Key, len(pair.Value), len(values[pair.Key]))
+		}
+	}
+	if report := db.Check(); !report.Clean() {
+		t.Fatalf("fsck: %v", report.Problems)
+	}
+}
+
+func TestCompactShrinksDisk(t *testing.T) {
+	path := newDiskFile(t, fs.ENGINE_INODE, nil)
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 400 values of 8 pages on average grow the disk well past its size when it was created
+	values := putChurn(t, db, 400)
+
+	report, err := db.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.PagesAfter >= report.PagesBefore || report.BytesReclaimed <= 0 || report.FragmentedAfter != 0 {
+		t.Fatalf("report %+v, the disk didn't shrink", report)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := int64(report.PagesAfter) * fs.DEFAULT_PAGE_SIZE; info.Size() != size {
+		t.Fatalf("file is %d bytes, the disk is %d", info.Size(), size)
+	}
+	checkValues(t, db, values)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if pages := db.disk.SuperBlock.TotalPages; pages != report.PagesAfter {
+		t.Fatalf("%d pages after a remount, compaction left %d", pages, report.PagesAfter)
+	}
+	checkValues(t, db, values)
+
+	// the disk grows again from where it was cut
+	if _, err := db.Set("after", strings.Repeat("x", 3*fs.DEFAULT_PAGE_SIZE)); err != nil {
+		t.Fatal(err)
+	}
+	values["after"] = strings.Repeat("x", 3*fs.DEFAULT_PAGE_SIZE)
+	checkValues(t, db, values)
+}
+
+// writes go on while a compaction moves the values around them
+func TestCompactWithConcurrentSets(t *testing.T) {
+	path := newDiskFile(t, fs.ENGINE_INODE, nil)
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	values := putChurn(t, db, 300)
+
+	var wg sync.WaitGroup
+	written := map[string]string{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			key := fmt.Sprintf("during%03d", i)
+			value := strings.Repeat(string(rune('A'+i%26)), (1+i%2)*fs.DEFAULT_PAGE_SIZE)
+			if _, err := db.SetWithDurability(key, value, DURABILITY_NONE); err != nil {
+				t.Error(err)
+				return
+			}
+			written[key] = value
+		}
+	}()
+	_, err = db.Compact()
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, value := range written {
+		values[key] = value
+	}
+	checkValues(t, db, values)
+
+	// a second compaction finds the writes in the holes the first one left and tidies them up
+	report, err := db.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FragmentedAfter != 0 {
+		t.Fatalf("report %+v, values still fragmented", report)
+	}
+	checkValues(t, db, values)
+}
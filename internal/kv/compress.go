@@ -0,0 +1,132 @@
+package kv
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/codec"
+	"github.com/Yashasv-Prajapati/vantadb/internal/wal"
+)
+
+// ----------------------------------- compression -----------------------------------
+
+// a compressed value is stored as the 4 bytes of its uncompressed size, little endian, and what the
+// codec made of it, the size tells Decompress how much to expect
+const COMPRESSED_HEADER_SIZE = 4
+
+// CompressionStats describes how much compression saves on a disk, LogicalBytes is the size of every
+// value and StoredBytes what they take on the disk, Ratio is the first over the second
+type CompressionStats struct {
+	Codec        string  `json:"codec"`
+	MinSize      int     `json:"min_size"`
+	Values       int     `json:"values"`
+	Compressed   int     `json:"compressed"`
+	LogicalBytes int64   `json:"logical_bytes"`
+	StoredBytes  int64   `json:"stored_bytes"`
+	Ratio        float64 `json:"ratio"`
+}
+
+// engines that compress values and can tell how well
+type compressor interface {
+	CompressionStats() (CompressionStats, error)
+}
+
+// loadCompression sets the engine up to compress new values the way the superblock says, the lsm engine
+// doesn't call it, its tables are read in parts and are kept as they are
+func (e *InodeEngine) loadCompression() error {
+	id, minSize := e.disk.Compression()
+	c, err := codec.ByID(id)
+	if err != nil {
+		return fmt.Errorf("disk compresses values with %w", err)
+	}
+	e.codec = c
+	e.compressMin = minSize
+	return nil
+}
+
+// encodeValue returns the bytes to store for value and the codec they were compressed with, the value
+// itself and codec.NONE when it is too small or compressing wouldn't make it smaller
+func (e *InodeEngine) encodeValue(value []byte) ([]byte, byte, error) {
+	if e.codec == nil || len(value) < e.compressMin {
+		return value, codec.NONE, nil
+	}
+	compressed, err := e.codec.Compress(value)
+	if err != nil {
+		return nil, codec.NONE, fmt.Errorf("could not compress value with %s: %v", e.codec.Name(), err)
+	}
+	if COMPRESSED_HEADER_SIZE+len(compressed) >= len(value) {
+		return value, codec.NONE, nil
+	}
+
+	stored := make([]byte, COMPRESSED_HEADER_SIZE+len(compressed))
+	binary.LittleEndian.PutUint32(stored, uint32(len(value)))
+	copy(stored[COMPRESSED_HEADER_SIZE:], compressed)
+	return stored, e.codec.ID(), nil
+}
+
+// maxValueSize is the size of the largest value, compressed or not, it has to fit in the pages of an
+// inode as it is and in a record of the log, setInternal refuses anything larger and decodeValue doesn't
+// believe a header beyond it
+func (e *InodeEngine) maxValueSize() int64 {
+	return min(int64(e.disk.MaxInodePages())*int64(e.disk.PageSize()), wal.MAX_VALUE_SIZE)
+}
+
+// decodeValue returns the value an inode with the codec id holds as stored
+func (e *InodeEngine) decodeValue(id byte, stored []byte) ([]byte, error) {
+	if id == codec.NONE {
+		return stored, nil
+	}
+	c, err := codec.ByID(id)
+	if err != nil {
+		return nil, fmt.Errorf("value is compressed with %w", err)
+	}
+	if len(stored) < COMPRESSED_HEADER_SIZE {
+		return nil, fmt.Errorf("compressed value of %d bytes has no header", len(stored))
+	}
+	size := binary.LittleEndian.Uint32(stored)
+	if maxSize := e.maxValueSize(); int64(size) > maxSize {
+		return nil, fmt.Errorf("compressed value claims %d bytes, a value has at most %d", size, maxSize)
+	}
+	return c.Decompress(stored[COMPRESSED_HEADER_SIZE:], int(size))
+}
+
+// CompressionStats goes through every value, only the header of a compressed one is read
+func (e *InodeEngine) CompressionStats() (CompressionStats, error) {
+	id, minSize := e.disk.Compression()
+	stats := CompressionStats{Codec: codec.Name(id), MinSize: minSize, Ratio: 1}
+
+	header := make([]byte, COMPRESSED_HEADER_SIZE)
+	for idx, inode := range e.disk.Inodes {
+		if inode.InUse[0] == 0 {
+			continue
+		}
+		size := int64(binary.LittleEndian.Uint32(inode.Size[:]))
+		stats.Values++
+		stats.StoredBytes += size
+		if inode.Codec() == codec.NONE {
+			stats.LogicalBytes += size
+			continue
+		}
+		if err := e.readBlobAt(idx, header, 0); err != nil {
+			return stats, fmt.Errorf("could not read header of a compressed value: %w", err)
+		}
+		stats.Compressed++
+		stats.LogicalBytes += int64(binary.LittleEndian.Uint32(header))
+	}
+	if stats.StoredBytes > 0 {
+		stats.Ratio = float64(stats.LogicalBytes) / float64(stats.StoredBytes)
+	}
+	return stats, nil
+}
+
+// CompressionStats reports how much smaller compression makes the values of the DB, an engine that
+// doesn't compress reports no codec
+func (db *DB) CompressionStats() (CompressionStats, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	if c, ok := db.engine.(compressor); ok {
+		return c.CompressionStats()
+	}
+	return CompressionStats{Codec: codec.Name(codec.NONE), Ratio: 1}, nil
+}
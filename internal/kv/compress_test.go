@@ -0,0 +1,111 @@
+package kv
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/codec"
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+)
+
+// newCompressedDevice formats a disk on a memory device that deflates values of minSize bytes and more
+func newCompressedDevice(t *testing.T, pageSize int, minSize int) *fs.MemoryDevice {
+	t.Helper()
+	device := fs.NewMemoryDevice(nil)
+	if err := fs.FormatDevice(device, pageSize, fs.ENGINE_INODE); err != nil {
+		t.Fatal(err)
+	}
+	disk, err := fs.MountDevice(device, fs.MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.SetCompression(codec.DEFLATE, minSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return device
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	device := newCompressedDevice(t, fs.DEFAULT_PAGE_SIZE, 128)
+	db, err := OpenDevice(device, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	random := make([]byte, 3*fs.DEFAULT_PAGE_SIZE)
+	rand.New(rand.NewSource(1)).Read(random)
+	values := map[string]string{
+		"small":  strings.Repeat("a", 100),                      // under the minimum size
+		"text":   strings.Repeat("compress me ", 2000),          // several pages, a few once compressed
+		"random": string(random),                                // doesn't get any smaller
+		"json":   strings.Repeat(`{"id": 1, "name": "x"},`, 50), // one page
+	}
+	for key, value := range values {
+		if _, err := db.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := db.CompressionStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Codec != "deflate" || stats.Values != len(values) || stats.Compressed != 2 {
+		t.Fatalf("stats %+v, want 2 of %d values deflated", stats, len(values))
+	}
+	if stats.StoredBytes >= stats.LogicalBytes || stats.Ratio <= 1 {
+		t.Fatalf("stats %+v, compression saved nothing", stats)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDevice(device, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for key, value := range values {
+		if got, err := db.Get(key); err != nil || got != value {
+			t.Fatalf("%s: %v, read %d bytes of %d", key, err, len(got), len(value))
+		}
+	}
+	if report := db.Check(); !report.Clean() {
+		t.Fatalf("fsck: %v", report.Problems)
+	}
+}
+
+// a value that compresses to a few pages is still limited by its own size, it has to be read back whole
+func TestCompressedValueSizeLimit(t *testing.T) {
+	device := newCompressedDevice(t, 512, 128)
+	db, err := OpenDevice(device, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	maxSize := db.engine.(*InodeEngine).maxValueSize()
+
+	atLimit := strings.Repeat("a", int(maxSize))
+	if _, err := db.Set("max", atLimit); err != nil {
+		t.Fatalf("set of a value of %d bytes, the limit: %v", maxSize, err)
+	}
+	if got, err := db.Get("max"); err != nil || got != atLimit {
+		t.Fatalf("get of a value at the limit: %v, read %d bytes", err, len(got))
+	}
+
+	if _, err := db.Set("over", atLimit+"a"); err == nil {
+		t.Fatalf("set of a value of %d bytes went through, the limit is %d", maxSize+1, maxSize)
+	}
+	if _, err := db.Get("over"); err == nil {
+		t.Fatal("the value over the limit was stored")
+	}
+	if _, err := db.Set("max", atLimit+"a"); err == nil {
+		t.Fatal("update to a value over the limit went through")
+	}
+	if got, err := db.Get("max"); err != nil || got != atLimit {
+		t.Fatalf("the rejected update changed the value: %v, read %d bytes", err, len(got))
+	}
+}
@@ -0,0 +1,126 @@
+package kv
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/wal"
+)
+
+// ----------------------------------- durability -----------------------------------
+
+// when a write is on stable storage, a write is only ever lost with the WAL records that weren't synced
+const (
+	// the WAL is synced before the write returns
+	DURABILITY_ALWAYS = "always"
+	// the WAL is synced in the background every sync interval, a crash loses at most that much
+	DURABILITY_INTERVAL = "interval"
+	// the WAL is never synced, the OS writes it out when it wants to
+	DURABILITY_NONE = "none"
+
+	DEFAULT_SYNC_INTERVAL = 100 * time.Millisecond
+)
+
+var Durabilities = []string{DURABILITY_ALWAYS, DURABILITY_INTERVAL, DURABILITY_NONE}
+
+// ValidateDurability returns an error if mode isn't one of Durabilities
+func ValidateDurability(mode string) error {
+	for _, durability := range Durabilities {
+		if mode == durability {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown durability %q, must be one of %v", mode, Durabilities)
+}
+
+// what the stats show about durability
+type DurabilityStats struct {
+	Mode           string `json:"mode"`
+	SyncIntervalMS int64  `json:"sync_interval_ms"`
+	WALSyncs       uint64 `json:"wal_syncs"`
+
+	// what replaying the WAL did when the database was opened
+	ReplayedWrites int   `json:"replayed_writes"`
+	SkippedWrites  int   `json:"skipped_writes"` // logged writes the engine refused, they are lost
+	TornBytes      int64 `json:"torn_bytes"`     // the end of the log a crash cut short, it was truncated
+}
+
+// syncer syncs the WAL in the background for writes made with DURABILITY_INTERVAL
+type syncer struct {
+	start    sync.Once
+	interval time.Duration
+	pending  atomic.Bool   // a record was appended since the last sync
+	syncs    atomic.Uint64 // syncs of the WAL, by writes and in the background
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// startSyncer starts the background sync, once, the first time a write asks for it
+func (db *DB) startSyncer() {
+	db.syncer.start.Do(func() {
+		db.syncer.stop = make(chan struct{})
+		db.syncer.done = make(chan struct{})
+		go db.syncLoop()
+	})
+}
+
+func (db *DB) syncLoop() {
+	defer close(db.syncer.done)
+
+	ticker := time.NewTicker(db.syncer.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.syncer.stop:
+			db.syncPending()
+			return
+		case <-ticker.C:
+			db.syncPending()
+		}
+	}
+}
+
+// syncPending syncs the WAL if anything was appended since the last sync
+// records are appended under the DB lock, syncing doesn't need it
+func (db *DB) syncPending() {
+	if !db.syncer.pending.Swap(false) {
+		return
+	}
+	if err := wal.Sync(db.walPath); err != nil {
+		db.syncer.pending.Store(true) // try again on the next tick
+		return
+	}
+	db.syncer.syncs.Add(1)
+}
+
+// stopSyncer syncs what is pending and stops the background sync, if it was started
+func (db *DB) stopSyncer() {
+	db.syncer.start.Do(func() {}) // no sync can start after this
+	if db.syncer.stop != nil {
+		close(db.syncer.stop)
+		<-db.syncer.done
+	}
+}
+
+// durability returns the mode a write asking for mode gets, the DB's when it is empty
+func (db *DB) durabilityFor(mode string) (string, error) {
+	if mode == "" {
+		mode = db.durability
+	}
+	return mode, ValidateDurability(mode)
+}
+
+func (db *DB) DurabilityStats() DurabilityStats {
+	stats := DurabilityStats{
+		Mode:           db.durability,
+		SyncIntervalMS: db.syncer.interval.Milliseconds(),
+		WALSyncs:       db.syncer.syncs.Load(),
+	}
+	if r, ok := db.engine.(replayer); ok {
+		replayed := r.Replayed()
+		stats.ReplayedWrites, stats.SkippedWrites, stats.TornBytes = replayed.Records, replayed.Skipped, replayed.TornBytes
+	}
+	return stats
+}
@@ -0,0 +1,160 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/crypt"
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+	"github.com/Yashasv-Prajapati/vantadb/internal/wal"
+)
+
+// ----------------------------------- encryption -----------------------------------
+
+// how many pairs are copied at a time when a disk is encrypted
+const ENCRYPT_BATCH = 256
+
+/*
+Rekey encrypts the database at path with newKey, the disk with fs.Rekey and its WAL, wal.PathFor(path)
+unless walPath says otherwise, with wal.Rekey. oldKey is the key it is encrypted with, nil if it isn't
+encrypted yet, its pairs are then copied to a new encrypted disk, see encryptDisk. It can't be open
+while this runs, both are locked like Open locks them.
+
+Each of the two is replaced in one rename, a crash in between leaves the disk on the new key and the
+WAL on the old one, or the other way round, and running Rekey again with the same keys finishes it.
+*/
+func Rekey(path string, walPath string, oldKey *crypt.Key, newKey *crypt.Key) error {
+	if walPath == "" {
+		walPath = wal.PathFor(path)
+	}
+	// the WAL first, Open locks the disk before it, whoever comes second gets an error
+	walLock, err := fs.LockFile(walPath, true)
+	if err != nil {
+		return err
+	}
+	defer walLock.Close()
+
+	err = fs.Rekey(path, oldKey, newKey)
+	if errors.Is(err, fs.ErrNotEncrypted) {
+		err = encryptDisk(path, newKey)
+	}
+	if err != nil {
+		return err
+	}
+	return wal.Rekey(walPath, oldKey, newKey)
+}
+
+/*
+encryptDisk encrypts the disk at path, which isn't encrypted, with key. Its pages have no room for the
+nonce and tag, so every pair is copied to a new disk encrypted with key, with the same page size, engine
+and compression, which is renamed over the original once it holds them all. A crash leaves the disk as
+it was or encrypted, the copy left behind is thrown away by the next run.
+
+Only what is on the disk is copied. The new disk has no WAL checkpoint, its first open replays the whole
+log, which leaves every key the log has with the last value it was set to, and the offsets of the
+old disk would be wrong anyway once wal.Rekey has sealed the records.
+*/
+func encryptDisk(path string, key *crypt.Key) error {
+	// mounted to write, a disk that was never mounted has no indexes to read it with yet, and it keeps
+	// everybody else out until it has been replaced
+	src, err := fs.Mount(path, fs.MountOptions{})
+	if err != nil {
+		return err
+	}
+	srcDB, err := openEngine(src, "", Options{})
+	if err != nil {
+		return err
+	}
+	defer srcDB.Close()
+
+	tmpPath := path + ".encrypt"
+	if err := os.Remove(tmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	defer os.Remove(tmpPath) // no-op once it has been renamed
+
+	if err := fs.CreateVDSKStorageData(tmpPath, int(src.SuperBlock.Pagesize), src.SuperBlock.Engine[0]); err != nil {
+		return err
+	}
+	// before anything mounts it, the first mount already writes the indexes to data pages
+	if err := fs.EncryptNewDisk(tmpPath, key); err != nil {
+		return err
+	}
+	dst, err := fs.Mount(tmpPath, fs.MountOptions{Key: key})
+	if err != nil {
+		return err
+	}
+	if err := dst.SetCompression(src.Compression()); err != nil {
+		dst.Close()
+		return err
+	}
+	dstDB, err := openEngine(dst, "", Options{Key: key})
+	if err != nil {
+		return err
+	}
+	// whatever goes wrong from here on, the copy is closed before the Remove above throws it away
+	closed := false
+	defer func() {
+		if !closed {
+			dstDB.Close()
+		}
+	}()
+
+	if err := copyPairs(srcDB, dstDB); err != nil {
+		return fmt.Errorf("could not copy the pairs to the encrypted disk: %v", err)
+	}
+	// closing the disk doesn't sync it, the rename must not reach the file before the pairs do
+	if err := dstDB.Flush(); err != nil {
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	closed = true
+	if err := dstDB.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// copyPairs sets every pair of src in dst, ENCRYPT_BATCH at a time
+func copyPairs(src *DB, dst *DB) error {
+	dst.EnableBatchMode()
+	start := ""
+	for {
+		pairs, err := src.Range(start, "", ENCRYPT_BATCH)
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			if _, err := dst.Set(pair.Key, pair.Value); err != nil {
+				return err
+			}
+		}
+		if len(pairs) < ENCRYPT_BATCH {
+			return dst.DisableBatchMode()
+		}
+		// the smallest key after the last one
+		start = pairs[len(pairs)-1].Key + "\x00"
+	}
+}
+
+// WALRecords returns every record of the log, opened if they are sealed
+func (db *DB) WALRecords() ([]*wal.WALRecord, error) {
+	records := wal.GetAllWALRecords(db.walPath)
+	if err := wal.OpenRecords(records, db.key); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
@@ -0,0 +1,278 @@
+package kv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/crypt"
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+	"github.com/Yashasv-Prajapati/vantadb/internal/wal"
+)
+
+func testKey(t *testing.T, fill string) *crypt.Key {
+	t.Helper()
+	key, err := crypt.ParseKey(strings.Repeat(fill, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// newDiskFile creates a disk in a temporary directory, encrypted with key unless it is nil
+func newDiskFile(t *testing.T, engine byte, key *crypt.Key) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "disk.vdsk")
+	if err := fs.CreateVDSKStorageData(path, fs.DEFAULT_PAGE_SIZE, engine); err != nil {
+		t.Fatal(err)
+	}
+	if key != nil {
+		if err := fs.EncryptNewDisk(path, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// putSecrets sets n pairs whose values are easy to find in the file, small ones and some of several pages
+func putSecrets(t *testing.T, db *DB, n int) map[string]string {
+	t.Helper()
+	values := map[string]string{}
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		values[key] = fmt.Sprintf("secret%05d", i)
+		if i%100 == 0 {
+			values[key] += strings.Repeat("s", 3*fs.DEFAULT_PAGE_SIZE)
+		}
+		if _, err := db.SetWithDurability(key, values[key], DURABILITY_NONE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return values
+}
+
+func checkSecrets(t *testing.T, path string, key *crypt.Key, values map[string]string) {
+	t.Helper()
+	db, err := Open(path, Options{ReadOnly: true, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	pairs, err := db.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != len(values) {
+		t.Fatalf("%d pairs, wrote %d", len(pairs), len(values))
+	}
+	for _, pair := range pairs {
+		if values[pair.Key] != pair.Value {
+			t.Fatalf("%s reads back %d bytes, wrote %d", pair.Key, len(pair.Value), len(values[pair.Key]))
+		}
+	}
+	if _, err := db.WALRecords(); err != nil {
+		t.Fatal(err)
+	}
+	if report := db.Check(); !report.Clean() {
+		t.Fatalf("fsck: %v", report.Problems)
+	}
+}
+
+// checkSealed makes sure nothing of the values can be read from the disk and its log without the key
+func checkSealed(t *testing.T, path string, key *crypt.Key) {
+	t.Helper()
+	if id, err := fs.ReadKeyID(path); err != nil || id != key.ID {
+		t.Fatalf("disk is encrypted with key %s, %v, not %s", id, err, key.ID)
+	}
+	for _, file := range []string{path, wal.PathFor(path)} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(data, []byte("secret")) {
+			t.Fatalf("%s has a value in plaintext", file)
+		}
+	}
+	for _, record := range wal.GetAllWALRecords(wal.PathFor(path)) {
+		if !record.Encrypted() {
+			t.Fatalf("record of %q isn't sealed", record.Key)
+		}
+	}
+}
+
+func TestRekeyRotatesKey(t *testing.T) {
+	oldKey, newKey := testKey(t, "1"), testKey(t, "2")
+	path := newDiskFile(t, fs.ENGINE_INODE, oldKey)
+
+	db, err := Open(path, Options{Key: oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := putSecrets(t, db, 200)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, Options{Key: newKey}); !errors.Is(err, fs.ErrWrongKey) {
+		t.Fatalf("open with another key: %v", err)
+	}
+
+	if err := Rekey(path, "", oldKey, newKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, Options{Key: oldKey}); !errors.Is(err, fs.ErrWrongKey) {
+		t.Fatalf("open with the old key after the rotation: %v", err)
+	}
+	checkSecrets(t, path, newKey, values)
+	checkSealed(t, path, newKey)
+
+	// a second run finds everything on the new key already
+	if err := Rekey(path, "", oldKey, newKey); err != nil {
+		t.Fatal(err)
+	}
+	checkSecrets(t, path, newKey, values)
+}
+
+func TestRekeyEncryptsPlainDisk(t *testing.T) {
+	for _, engine := range []byte{fs.ENGINE_INODE, fs.ENGINE_LSM} {
+		t.Run(fs.Engines[engine], func(t *testing.T) {
+			key := testKey(t, "3")
+			path := newDiskFile(t, engine, nil)
+
+			db, err := Open(path, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// more than a batch, the copy has to go on after the first one
+			values := putSecrets(t, db, ENCRYPT_BATCH+50)
+			if msg := db.Del("key00007"); msg != "OK" {
+				t.Fatal(msg)
+			}
+			delete(values, "key00007")
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := Rekey(path, "", nil, key); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Open(path, Options{}); !errors.Is(err, fs.ErrKeyRequired) {
+				t.Fatalf("open without a key after encrypting: %v", err)
+			}
+			checkSecrets(t, path, key, values)
+			checkSealed(t, path, key)
+			if _, err := os.Stat(path + ".encrypt"); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("the copy was left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestRekeyEncryptKeepsCompression(t *testing.T) {
+	key := testKey(t, "4")
+	path := newDiskFile(t, fs.ENGINE_INODE, nil)
+	disk, err := fs.Mount(path, fs.MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.SetCompression(1, 64); err != nil {
+		t.Fatal(err)
+	}
+	if err := disk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := putSecrets(t, db, 20)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Rekey(path, "", nil, key); err != nil {
+		t.Fatal(err)
+	}
+
+	checkSecrets(t, path, key, values)
+	db, err = Open(path, Options{ReadOnly: true, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if codec, minSize := db.disk.Compression(); codec != 1 || minSize != 64 {
+		t.Fatalf("compression is %d from %d bytes after encrypting, was 1 from 64", codec, minSize)
+	}
+	stats, err := db.CompressionStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Compressed == 0 {
+		t.Fatal("no value was compressed on the encrypted disk")
+	}
+}
+
+// a run that was interrupted after the disk was replaced left the log in plaintext, running it again
+// seals the log without needing a key the disk never had
+func TestRekeyFinishesInterruptedEncryption(t *testing.T) {
+	key := testKey(t, "5")
+	path := newDiskFile(t, fs.ENGINE_INODE, nil)
+
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := putSecrets(t, db, 20)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := encryptDisk(path, key); err != nil {
+		t.Fatal(err)
+	}
+	checkSecrets(t, path, key, values)
+
+	if err := Rekey(path, "", nil, key); err != nil {
+		t.Fatal(err)
+	}
+	checkSecrets(t, path, key, values)
+	checkSealed(t, path, key)
+}
+
+// a value that fits the pages of the plain disk but not the smaller ones of an encrypted disk stops the
+// copy, the plain disk is left as it was and the copy is closed and removed
+func TestRekeyFailedCopyClosesDisk(t *testing.T) {
+	key := testKey(t, "6")
+	path := filepath.Join(t.TempDir(), "disk.vdsk")
+	if err := fs.CreateVDSKStorageData(path, 512, fs.ENGINE_INODE); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{"small": "secret", "large": strings.Repeat("l", 8<<20)}
+	for k, value := range values {
+		if _, err := db.SetWithDurability(k, value, DURABILITY_NONE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fds, _ := os.ReadDir("/proc/self/fd")
+	if err := Rekey(path, "", nil, key); err == nil {
+		t.Fatal("encrypted a disk with a value too large for it")
+	}
+	if after, err := os.ReadDir("/proc/self/fd"); err == nil && len(after) != len(fds) {
+		t.Fatalf("%d files are open after the failed copy, %d were before", len(after), len(fds))
+	}
+	if _, err := os.Stat(path + ".encrypt"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("the copy was left behind: %v", err)
+	}
+	checkSecrets(t, path, nil, values)
+}
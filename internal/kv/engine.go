@@ -0,0 +1,50 @@
+package kv
+
+import (
+	"errors"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/wal"
+)
+
+// ----------------------------------- storage engines -----------------------------------
+
+// Engine stores the keys of a database, the kv package logs every write to the WAL before handing it
+// to the engine, so engines don't touch the WAL and recovering is replaying it through them
+// engines aren't safe for concurrent use, DB locks around them
+type Engine interface {
+	// returns ErrKeyNotFound, wrapped, if the key doesn't exist
+	Get(key string) (string, error)
+	Set(key string, value string) error
+	// returns ErrKeyNotFound, wrapped, if the key doesn't exist
+	Delete(key string) error
+	// returns the pairs with start <= key < end ordered by key, at most limit of them
+	// an empty end has no upper bound, limit <= 0 has no limit
+	Scan(start string, end string, limit int) ([]KeyValue, error)
+	// writes out whatever the engine still holds in memory
+	Flush() error
+	Close() error
+}
+
+var ErrKeyNotFound = errors.New("key not found")
+
+// engines that can list keys without reading their values
+type keyScanner interface {
+	ScanKeys(start string, end string, limit int) ([]string, error)
+}
+
+// engines that can hold writes back until they are flushed, used while replaying the WAL
+type batcher interface {
+	EnableBatchMode()
+	DisableBatchMode() error
+}
+
+// engines that refuse some writes, e.g. a value too large, DB checks a write before it is logged so the
+// log only has writes the engine takes, replaying one it refuses would lose it
+type validator interface {
+	Validate(key string, value string) error
+}
+
+// engines that replay the WAL themselves when they are opened
+type replayer interface {
+	Replayed() wal.ReplayStats
+}
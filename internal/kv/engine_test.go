@@ -0,0 +1,210 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+)
+
+// engineCase opens a database on one of the engines, open can be called again after a Close and finds
+// what was written before
+type engineCase struct {
+	name string
+	open func(t *testing.T) *DB
+}
+
+func engineCases(t *testing.T) []engineCase {
+	cases := []engineCase{}
+	for _, engine := range []byte{fs.ENGINE_INODE, fs.ENGINE_LSM} {
+		device := fs.NewMemoryDevice(nil)
+		if err := fs.FormatDevice(device, fs.DEFAULT_PAGE_SIZE, engine); err != nil {
+			t.Fatal(err)
+		}
+		walPath := filepath.Join(t.TempDir(), "disk.wal")
+		cases = append(cases, engineCase{fs.Engines[engine], func(t *testing.T) *DB {
+			return openLogged(t, device, walPath)
+		}})
+	}
+
+	// nothing but the log outlives a memory engine
+	walPath := filepath.Join(t.TempDir(), "memory.wal")
+	cases = append(cases, engineCase{"memory", func(t *testing.T) *DB {
+		db := OpenEngine(NewMemoryEngine(), Options{WALPath: walPath})
+		db.RecoverFromLogs()
+		return db
+	}})
+	return cases
+}
+
+// forEachEngine runs test on a new database of every engine
+func forEachEngine(t *testing.T, test func(t *testing.T, c engineCase)) {
+	for _, c := range engineCases(t) {
+		t.Run(c.name, func(t *testing.T) {
+			test(t, c)
+		})
+	}
+}
+
+func checkPairs(t *testing.T, db *DB, want map[string]string) {
+	t.Helper()
+	for key, value := range want {
+		if got, err := db.Get(key); err != nil || got != value {
+			t.Fatalf("%.20s: %v, read %d bytes, wrote %d", key, err, len(got), len(value))
+		}
+	}
+	pairs, err := db.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != len(want) {
+		t.Fatalf("%d pairs, want %d", len(pairs), len(want))
+	}
+}
+
+func TestEngineSetGetDelete(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, c engineCase) {
+		db := c.open(t)
+		defer db.Close()
+
+		want := map[string]string{
+			"a":                         "1",
+			"b":                         "2",
+			"several pages":             strings.Repeat("p", 3*fs.DEFAULT_PAGE_SIZE+1),
+			strings.Repeat("long", 200): "a key of several hundred bytes",
+		}
+		for key, value := range want {
+			if _, err := db.Set(key, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.Set("a", "changed"); err != nil {
+			t.Fatal(err)
+		}
+		want["a"] = "changed"
+		checkPairs(t, db, want)
+
+		if _, err := db.Get("missing"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("get of a missing key: %v", err)
+		}
+		if msg := db.Del("b"); msg != "OK" {
+			t.Fatal(msg)
+		}
+		delete(want, "b")
+		if msg := db.Del("b"); msg != "key not found" {
+			t.Fatalf("second delete: %s", msg)
+		}
+		if _, err := db.Get("b"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("get of a deleted key: %v", err)
+		}
+		checkPairs(t, db, want)
+
+		if _, err := db.Set(strings.Repeat("k", fs.MAX_KEY_SIZE+1), "v"); err == nil {
+			t.Fatal("set of a key over the limit went through")
+		}
+	})
+}
+
+func TestEngineRange(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, c engineCase) {
+		db := c.open(t)
+		defer db.Close()
+
+		keys := []string{}
+		for i := 0; i < 60; i++ {
+			keys = append(keys, fmt.Sprintf("key%03d", i))
+		}
+		for _, i := range rand.New(rand.NewSource(1)).Perm(len(keys)) {
+			if _, err := db.Set(keys[i], "value of "+keys[i]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < len(keys); i += 3 {
+			if msg := db.Del(keys[i]); msg != "OK" {
+				t.Fatal(msg)
+			}
+		}
+		live := []string{}
+		for i, key := range keys {
+			if i%3 != 0 {
+				live = append(live, key)
+			}
+		}
+
+		cases := []struct {
+			start, end string
+			limit      int
+		}{
+			{"", "", 0},
+			{"key010", "key020", 0},
+			{"key010", "", 5},
+			{"", "key005", 0},
+			{"zzz", "", 0},
+		}
+		for _, r := range cases {
+			want := []string{}
+			for _, key := range live {
+				if key >= r.start && (r.end == "" || key < r.end) && (r.limit <= 0 || len(want) < r.limit) {
+					want = append(want, key)
+				}
+			}
+
+			pairs, err := db.Range(r.start, r.end, r.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, pair := range pairs {
+				if pair.Value != "value of "+pair.Key {
+					t.Fatalf("%s has value %q", pair.Key, pair.Value)
+				}
+				got = append(got, pair.Key)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Fatalf("range %q to %q limit %d: %v, want %v", r.start, r.end, r.limit, got, want)
+			}
+
+			listed, err := db.Keys(r.start, r.end, r.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sort.StringsAreSorted(listed) || fmt.Sprint(listed) != fmt.Sprint(want) {
+				t.Fatalf("keys %q to %q limit %d: %v, want %v", r.start, r.end, r.limit, listed, want)
+			}
+		}
+	})
+}
+
+func TestEngineReopen(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, c engineCase) {
+		db := c.open(t)
+		want := map[string]string{}
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("key%02d", i)
+			want[key] = strings.Repeat(key, i*50)
+			if _, err := db.Set(key, want[key]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if msg := db.Del("key07"); msg != "OK" {
+			t.Fatal(msg)
+		}
+		delete(want, "key07")
+		if _, err := db.Set("key08", "changed"); err != nil {
+			t.Fatal(err)
+		}
+		want["key08"] = "changed"
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db = c.open(t)
+		defer db.Close()
+		checkPairs(t, db, want)
+	})
+}
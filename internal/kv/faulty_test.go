@@ -0,0 +1,130 @@
+package kv
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+)
+
+// a value of several pages, so a write touches more than one page
+var faultyValue = strings.Repeat("x", 3000)
+
+func faultyKey(i int) string {
+	return fmt.Sprintf("k%03d", i)
+}
+
+// checkSurvivors checks the keys synced before a crash are all there, and that no other key is torn
+func checkSurvivors(t *testing.T, db *DB, synced int) {
+	t.Helper()
+
+	keys, err := db.Keys("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) < synced {
+		t.Fatalf("%d keys after the crash, %d were synced", len(keys), synced)
+	}
+	for i := 0; i < synced; i++ {
+		if keys[i] != faultyKey(i) {
+			t.Fatalf("key %d is %q after the crash, want %q", i, keys[i], faultyKey(i))
+		}
+	}
+	for _, key := range keys {
+		if value, err := db.Get(key); err != nil || value != faultyValue {
+			t.Fatalf("%s after the crash: %v, read %d bytes", key, err, len(value))
+		}
+	}
+	if report := db.Check(); !report.Clean() {
+		t.Fatalf("fsck after the crash: %v", report.Problems)
+	}
+}
+
+func TestCrashKeepsSyncedWrites(t *testing.T) {
+	for _, engine := range []byte{fs.ENGINE_INODE, fs.ENGINE_LSM} {
+		t.Run(fs.Engines[engine], func(t *testing.T) {
+			device := fs.NewFaultyDevice(nil)
+			if err := fs.FormatDevice(device, fs.DEFAULT_PAGE_SIZE, engine); err != nil {
+				t.Fatal(err)
+			}
+			db, err := OpenDevice(device, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 300; i++ {
+				if _, err := db.Set(faultyKey(i), faultyValue); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.disk.Sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			// nothing is synced after this, the crash loses it
+			for i := 300; i < 600; i++ {
+				if _, err := db.Set(faultyKey(i), faultyValue); err != nil {
+					t.Fatal(err)
+				}
+			}
+			device.Crash()
+
+			if db, err = OpenDevice(device, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			checkSurvivors(t, db, 300)
+		})
+	}
+}
+
+func TestFailedWrites(t *testing.T) {
+	for _, engine := range []byte{fs.ENGINE_INODE, fs.ENGINE_LSM} {
+		t.Run(fs.Engines[engine], func(t *testing.T) {
+			device := fs.NewFaultyDevice(nil)
+			if err := fs.FormatDevice(device, fs.DEFAULT_PAGE_SIZE, engine); err != nil {
+				t.Fatal(err)
+			}
+			db, err := OpenDevice(device, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				if _, err := db.Set(faultyKey(i), faultyValue); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.disk.Sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			// a write torn in the middle of a page, then one that fails outright, they have to be
+			// reported by the set or the flush that does them
+			failed := 0
+			for _, fault := range []func(){func() { device.TearWrite(1, 100) }, func() { device.FailWrite(1) }} {
+				fault()
+				_, err := db.Set(faultyKey(100+failed), faultyValue)
+				if err == nil {
+					err = db.Flush()
+				}
+				// the engines wrap errors with %v, only the message is left
+				if err == nil || !strings.Contains(err.Error(), fs.ErrInjectedFault.Error()) {
+					t.Fatalf("write with an injected fault returned %v", err)
+				}
+				failed++
+			}
+
+			device.Crash()
+			if db, err = OpenDevice(device, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			checkSurvivors(t, db, 100)
+		})
+	}
+}
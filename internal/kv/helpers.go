@@ -3,209 +3,291 @@ package kv
 import (
 	"encoding/binary"
 	"fmt"
-	"strings"
 	"time"
 	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
-	"github.com/Yashasv-Prajapati/vantadb/internal/wal"
 )
 
-// ----------------------------------- internal functions to this package -----------------------------------
+// ----------------------------------- internal functions of the inode engine -----------------------------------
 
-func autoFlush() {
-	if batchMode && time.Since(lastFlush) > 5*time.Second {
-		FlushToDisk()
+func (e *InodeEngine) autoFlush() {
+	if e.batchMode && time.Since(e.lastFlush) > 5*time.Second {
+		e.Flush()
 	}
 }
 
-func setInternal(key string, value string, writeWAL bool) (string, error) {
+// refuses a key or a value the engine can't hold, DB checks a write with it before logging it
+func (e *InodeEngine) Validate(key string, value string) error {
+	// keys are never truncated, a key that doesn't fit is rejected
+	if len(key) > fs.MAX_KEY_SIZE {
+		return fmt.Errorf("key too large, max key size is %d bytes", fs.MAX_KEY_SIZE)
+	}
+
+	// the limit is on the value as it is read back, a value that compresses well would get past it otherwise
+	if maxSize := e.maxValueSize(); int64(len(value)) > maxSize {
+		return fmt.Errorf("value too large, max value size is %d bytes", maxSize)
+	}
+	return nil
+}
 
-	keyBytes := [32]byte{}
-	copy(keyBytes[:], key)
+func (e *InodeEngine) setInternal(key string, value string) error {
 
-	valueBytes := []byte(value)
+	if err := e.Validate(key, value); err != nil {
+		return err
+	}
+
+	// a compressed value is stored, and takes pages, like any other, only its inode knows the codec
+	valueBytes, codecID, err := e.encodeValue([]byte(value))
+	if err != nil {
+		return err
+	}
 	valueSize := len(valueBytes)
-	pagesNeeded := (valueSize + fs.PAGE_SIZE - 1) / fs.PAGE_SIZE // ceil division
+	pagesNeeded := e.disk.PagesNeeded(valueSize)
 
-	if pagesNeeded > 6 {
-		return "value too large, can't be accomodated in 6 pages", fmt.Errorf("value too large, can't be accomodated in 6 pages") // can only allot 6 pages
+	if pagesNeeded > e.disk.MaxInodePages() {
+		return fmt.Errorf("value too large, can't be accomodated in %d pages", e.disk.MaxInodePages()) // an inode can only map MaxInodePages pages
 	}
 
 	// first we have to search if this key exists or not
-	idx := searchKeyInInodes(key)
+	// a key that couldn't be compared might be this one, creating it again would hold it twice
+	idx, err := e.searchKeyInInodes(key)
+	if err != nil {
+		return fmt.Errorf("could not look up key: %v", err)
+	}
 	if idx >= 0 { // key found
 
-		check, err := updateExistingKey(idx, keyBytes, valueBytes, valueSize, pagesNeeded, key, value, writeWAL)
+		check, err := e.updateExistingKey(idx, valueBytes, valueSize, pagesNeeded, codecID)
 		if check && (err == nil) {
-			autoFlush()
-			return "UPDATE OK", nil
+			e.autoFlush()
+			return nil
 		}
+		return fmt.Errorf("could not update key: %v", err)
 	}
 
 	// does not exist, find empty place in array
-	for i := 0; i < len(disk.Inodes); i++ {
-		if disk.Inodes[i].InUse[0] == 0 { // not in use
+	for i := 0; i < len(e.disk.Inodes); i++ {
+		if e.disk.Inodes[i].InUse[0] == 0 { // not in use
 
-			check, err := createNewKey(i, keyBytes, valueBytes, valueSize, pagesNeeded, key, value, writeWAL)
+			check, err := e.createNewKey(i, valueBytes, valueSize, pagesNeeded, key, codecID)
 			if check && (err == nil) {
-				autoFlush()
-				return "SET OK", nil
+				e.autoFlush()
+				return nil
 			}
+			return fmt.Errorf("could not create key: %v", err)
 		}
 	}
 
-	return "empty space not found to insert key", fmt.Errorf("empty space not found to insert key")
+	return fmt.Errorf("empty space not found to insert key")
 }
 
-func delInternal(key string, writeWAL bool) string {
+func (e *InodeEngine) delInternal(key string) error {
 
-	idx := searchKeyInInodes(key) // idx of the inode
-	if idx == -1 {                // key not found - does not exist
-		return "key not found"
+	idx, err := e.searchKeyInInodes(key) // idx of the inode
+	if err != nil {
+		return fmt.Errorf("could not look up key: %v", err)
 	}
-
-	// everything is fine, first write this command to wal for safety
-	if writeWAL{
-		wr := wal.NewWALRecord("delete", key, "")
-		wr.WriteWALRecordToFile(0)
+	if idx == -1 { // key not found - does not exist
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, key)
 	}
 
-	// free its pages from bitmap
-	inode := disk.Inodes[idx]
-	for i := 0; i < len(inode.PageNumbers); i++ {
-		disk.Bitmap.FreePage(int(inode.PageNumbers[i]))
+	// free its pages from bitmap, data, indirect and key pages
+	inode := e.disk.Inodes[idx]
+	if err := e.disk.FreeInodePages(inode); err != nil {
+		return fmt.Errorf("could not free pages: %v", err)
+	}
+	if err := e.disk.FreeInodeKeyPages(inode); err != nil {
+		return fmt.Errorf("could not free key pages: %v", err)
 	}
 
 	// free the inode space
-	disk.Inodes[idx].InUse[0] = 0
+	e.disk.UnindexKey(key, idx)
+	if err := e.disk.BTreeDelete(key); err != nil {
+		return fmt.Errorf("could not remove key from the b+tree: %v", err)
+	}
+	e.disk.Inodes[idx].InUse[0] = 0
 
 	// Flush to disk if not in batch mode
-    batchMutex.RLock()
-    shouldFlush := !batchMode
-    batchMutex.RUnlock()
+    e.batchMutex.RLock()
+    shouldFlush := !e.batchMode
+    e.batchMutex.RUnlock()
     
     if shouldFlush {
-        disk.WriteBitmapToDisk()
-        disk.WriteInodeToDisk(idx, inode)
+        if err := e.disk.WriteBitmapToDisk(); err != nil {
+            return fmt.Errorf("could not write bitmap: %v", err)
+        }
+        if err := e.disk.WriteInodeToDisk(idx, inode); err != nil {
+            return fmt.Errorf("could not write inode: %v", err)
+        }
+        if err := e.disk.WriteIndexesToDisk(); err != nil {
+            return fmt.Errorf("could not write indexes: %v", err)
+        }
     } else {
-        autoFlush()
+        e.autoFlush()
     }
 
-	return "OK"
+	return nil
 }
 
-func searchKeyInInodes(key string) int {
-	for i := 0; i < len(disk.Inodes); i++ {
-		inode := disk.Inodes[i]
-		if (inode.InUse[0] == 1) && strings.TrimRight(string(inode.Key[:]), "\x00") == key { // the inode is in use and in that inode we have found the key
-			return i
-		}
-	}
-	return -1
+// returns the inode holding key, -1 if there is none, through the hash index of the disk
+func (e *InodeEngine) searchKeyInInodes(key string) (int, error) {
+	return e.disk.LookupKey(key)
 }
 
-func updateExistingKey(
+func (e *InodeEngine) updateExistingKey(
 	inodeIndex int,
-	keyBytes [32]byte,
 	valueBytes []byte,
 	valueSize int,
 	pagesNeeded int,
-	key string,
-	value string,
-	writeWAL bool) (bool, error) {
-	inode := disk.Inodes[inodeIndex]
+	codecID byte) (bool, error) {
+	inode := e.disk.Inodes[inodeIndex]
 
 	// first we will free the pages from the bitmap
 	// basically we will set all those pages we have occupied free in the bitmap and search for new ones
-	for i := 0; i < int(inode.NumberofPages[0]); i++ {
-		if inode.PageNumbers[i] != 0 {
-			disk.Bitmap.FreePage(int(inode.PageNumbers[i]))
-		}
+	if err := e.disk.FreeInodePages(inode); err != nil {
+		return false, err
 	}
-	return allocatePagesAndWriteData(inodeIndex, keyBytes, valueBytes, valueSize, pagesNeeded, key, value, writeWAL)
+	return e.allocatePagesAndWriteData(inodeIndex, valueBytes, valueSize, pagesNeeded, codecID)
 }
 
-func createNewKey(
+func (e *InodeEngine) createNewKey(
 	inodeIndex int,
-	keyBytes [32]byte,
 	valueBytes []byte,
 	valueSize,
 	pagesNeeded int,
 	key string,
-	value string,
-	writeWAL bool) (bool, error) {
-	disk.Inodes[inodeIndex].InUse[0] = 1
-	return allocatePagesAndWriteData(inodeIndex, keyBytes, valueBytes, valueSize, pagesNeeded, key, value, writeWAL)
+	codecID byte) (bool, error) {
+	inode := e.disk.Inodes[inodeIndex]
+
+	// long keys go to their own overflow pages, the inode only keeps a prefix
+	keyPages, err := e.disk.FindFreePages(e.disk.KeyPagesNeeded(len(key)))
+	if err != nil {
+		return false, err
+	}
+	for _, page := range keyPages {
+		e.disk.Bitmap.AllocatePage(page)
+	}
+	if err := e.disk.SetInodeKey(inode, key, keyPages); err != nil {
+		for _, page := range keyPages {
+			e.disk.Bitmap.FreePage(page)
+		}
+		return false, err
+	}
+
+	inode.InUse[0] = 1
+	check, err := e.allocatePagesAndWriteData(inodeIndex, valueBytes, valueSize, pagesNeeded, codecID)
+	if !check || err != nil {
+		// give the inode and its key pages back
+		e.disk.FreeInodeKeyPages(inode)
+		inode.InUse[0] = 0
+		return check, err
+	}
+
+	// the indexes are written after the inode, if we crash in between they are rebuilt on mount
+	e.disk.IndexKey(key, inodeIndex)
+	if err := e.disk.BTreeInsert(key, inodeIndex); err != nil {
+		return false, err
+	}
+
+	e.batchMutex.RLock()
+	shouldFlush := !e.batchMode
+	e.batchMutex.RUnlock()
+
+	if shouldFlush {
+		if err := e.disk.WriteIndexesToDisk(); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
 }
 
-func allocatePagesAndWriteData(
+func (e *InodeEngine) allocatePagesAndWriteData(
 	inodeIndex int,
-	keyBytes [32]byte,
 	valueBytes []byte,
 	valueSize,
 	pagesNeeded int,
-	key string,
-	value string,
-	writeWAL bool) (bool, error) {
+	codecID byte) (bool, error) {
 
-	inode := disk.Inodes[inodeIndex]
+	inode := e.disk.Inodes[inodeIndex]
 
 	// set inode metadata
-	inode.Key = keyBytes
 	sizeBytes := [4]byte{} // size of the value it is holding - value corresponding to key
 
 	binary.LittleEndian.PutUint32(sizeBytes[:], uint32(valueSize))
 
 	inode.Size = sizeBytes
-	inode.NumberofPages[0] = byte(pagesNeeded)
 
-	// ------- Now, time to allocate pages and write data
-	// find free pages
-	freePageNumbers := disk.Bitmap.FindFreePages(pagesNeeded)
+	// small values are kept in the inode itself, no page is allocated or written for them
+	if e.disk.InlineFits(valueSize) {
+		if err := inode.SetInlineValue(valueBytes); err != nil {
+			return false, err
+		}
+	} else if err := e.writeValuePages(inode, valueBytes, pagesNeeded); err != nil {
+		return false, err
+	}
+	if err := inode.SetCodec(codecID); err != nil {
+		return false, err
+	}
+
+	// flush to disk if not in batch mode
+	e.batchMutex.RLock()
+	shouldFlush := !e.batchMode
+	e.batchMutex.RUnlock()
 
-	if len(freePageNumbers) == 0 {
-		return false, fmt.Errorf("no free pages available")
+	if shouldFlush {
+		if err := e.disk.WriteBitmapToDisk(); err != nil {
+			return false, fmt.Errorf("failed to write bitmap: %v", err)
+		}
+		if err := e.disk.WriteInodeToDisk(inodeIndex, inode); err != nil {
+			return false, fmt.Errorf("failed to write inode: %v", err)
+		}
 	}
 
-	// everything is alright, we can write to WAL then to disk
-	// first write to WAL - this function is only used in set, so we can fix that
-	// fmt.Println("WRITING TO WAL FILE")
-	if writeWAL {
-		wr := wal.NewWALRecord("set", key, value)
-		wr.WriteWALRecordToFile(0)
+
+	return true, nil
+
+}
+
+// writes value to newly allocated data pages and points inode at them
+func (e *InodeEngine) writeValuePages(inode *fs.Inode, valueBytes []byte, pagesNeeded int) error {
+	// find free pages, in one extent if there is room for it, see fs.Disk.FindFreePages
+	freePageNumbers, err := e.disk.FindFreePages(pagesNeeded)
+	if err != nil {
+		return err
+	}
+	for _, page := range freePageNumbers {
+		e.disk.Bitmap.AllocatePage(page)
+	}
+
+	// a value in many pieces needs an extent page or indirect pages to hold them, they come after
+	mapPages, err := e.disk.FindFreePages(e.disk.MapPagesNeeded(freePageNumbers))
+	if err != nil {
+		for _, page := range freePageNumbers {
+			e.disk.Bitmap.FreePage(page)
+		}
+		return err
+	}
+	for _, page := range mapPages {
+		e.disk.Bitmap.AllocatePage(page)
 	}
 
 	dataOffset := 0
 	for i := 0; i < pagesNeeded; i++ {
-		// mark this page as allocated in bitmap - pageNumber
-		disk.Bitmap.AllocatePage(freePageNumbers[i])
-
-		inode.PageNumbers[i] = uint32(freePageNumbers[i])
-
 		// now fill the pages with data
-		pageData := [512]byte{}
-		bytesToCopy := fs.PAGE_SIZE
+		pageData := e.disk.NewPage()
+		bytesToCopy := e.disk.PageSize()
 		if dataOffset+bytesToCopy > len(valueBytes) {
 			bytesToCopy = len(valueBytes) - dataOffset
 		}
 
-		copy(pageData[:fs.PAGE_SIZE], valueBytes[dataOffset:dataOffset+bytesToCopy])
+		copy(pageData, valueBytes[dataOffset:dataOffset+bytesToCopy])
 		dataOffset += bytesToCopy
-		if err := disk.WritePageToDisk(freePageNumbers[i], pageData); err != nil {
-			return false, fmt.Errorf("failed to write to disk: %v", err)
+		if err := e.disk.WritePageToDisk(freePageNumbers[i], pageData); err != nil {
+			return fmt.Errorf("failed to write to disk: %v", err)
 		}
 	}
 
-	// flush to disk if not in batch mode
-	batchMutex.RLock()
-	shouldFlush := !batchMode
-	batchMutex.RUnlock()
-
-	if shouldFlush {
-		disk.WriteBitmapToDisk()
-		disk.WriteInodeToDisk(inodeIndex, inode)
+	// point the inode at the data pages, this also writes the extent or indirect pages
+	if err := e.disk.MapInodePages(inode, freePageNumbers, mapPages); err != nil {
+		return fmt.Errorf("failed to map pages: %v", err)
 	}
-
-
-	return true, nil
-
+	return nil
 }
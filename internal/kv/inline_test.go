@@ -0,0 +1,112 @@
+package kv
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+)
+
+// inodeOf returns the inode holding key
+func inodeOf(t *testing.T, db *DB, key string) *fs.Inode {
+	t.Helper()
+	engine := db.engine.(*InodeEngine)
+	idx, err := engine.searchKeyInInodes(key)
+	if err != nil || idx < 0 {
+		t.Fatalf("%s has no inode: %d, %v", key, idx, err)
+	}
+	return engine.disk.Inodes[idx]
+}
+
+func TestInlineValueLimit(t *testing.T) {
+	device, walPath := newLoggedDisk(t)
+	db := openLogged(t, device, walPath)
+	disk := db.engine.(*InodeEngine).disk
+
+	atLimit := strings.Repeat("i", fs.MAX_INLINE_VALUE)
+	overLimit := atLimit + "o"
+	free := disk.Bitmap.FreePageCount()
+	for key, value := range map[string]string{"empty": "", "one": "1", "max": atLimit} {
+		if _, err := db.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+		if inode := inodeOf(t, db, key); !inode.Inline() || inode.NumberofPages[0] != 0 {
+			t.Fatalf("a value of %d bytes isn't in its inode", len(value))
+		}
+	}
+	if disk.Bitmap.FreePageCount() != free {
+		t.Fatalf("%d pages were allocated for inline values", free-disk.Bitmap.FreePageCount())
+	}
+
+	if _, err := db.Set("over", overLimit); err != nil {
+		t.Fatal(err)
+	}
+	if inode := inodeOf(t, db, "over"); inode.Inline() || inode.NumberofPages[0] == 0 {
+		t.Fatalf("a value of %d bytes, one over the limit, is in its inode", len(overLimit))
+	}
+	if disk.Bitmap.FreePageCount() != free-1 {
+		t.Fatalf("a value of %d bytes took %d pages, want 1", len(overLimit), free-disk.Bitmap.FreePageCount())
+	}
+
+	// growing out of the inode takes a page, shrinking back into it gives the page back
+	if _, err := db.Set("max", overLimit); err != nil {
+		t.Fatal(err)
+	}
+	if inodeOf(t, db, "max").Inline() || disk.Bitmap.FreePageCount() != free-2 {
+		t.Fatal("the value that grew past the limit stayed in its inode")
+	}
+	if _, err := db.Set("over", atLimit); err != nil {
+		t.Fatal(err)
+	}
+	if !inodeOf(t, db, "over").Inline() || disk.Bitmap.FreePageCount() != free-1 {
+		t.Fatal("the value that shrank to the limit didn't move into its inode and free its page")
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openLogged(t, device, walPath)
+	defer db.Close()
+	checkPairs(t, db, map[string]string{"empty": "", "one": "1", "max": overLimit, "over": atLimit})
+	if report := db.Check(); !report.Clean() {
+		t.Fatalf("fsck: %v", report.Problems)
+	}
+}
+
+// the inode table isn't encrypted, even the smallest value goes to a sealed data page
+func TestNothingInlineWhenEncrypted(t *testing.T) {
+	key := testKey(t, "5")
+	path := newDiskFile(t, fs.ENGINE_INODE, key)
+	db, err := Open(path, Options{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]string{
+		"small":  "secret",
+		"max":    "secret" + strings.Repeat("m", fs.MAX_INLINE_VALUE-len("secret")),
+		"over":   "secret" + strings.Repeat("o", fs.MAX_INLINE_VALUE),
+		"update": "secret" + strings.Repeat("u", fs.MAX_INLINE_VALUE),
+	}
+	for k, value := range values {
+		if _, err := db.Set(k, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// shrinking to a size that would be inline on a plain disk keeps it in a page
+	values["update"] = "secret"
+	if _, err := db.Set("update", values["update"]); err != nil {
+		t.Fatal(err)
+	}
+	for k := range values {
+		if inode := inodeOf(t, db, k); inode.Inline() || inode.NumberofPages[0] == 0 {
+			t.Fatalf("%s is in its inode on an encrypted disk", k)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkSecrets(t, path, key, values)
+	checkSealed(t, path, key)
+}
@@ -0,0 +1,302 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/codec"
+	"github.com/Yashasv-Prajapati/vantadb/internal/crypt"
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+	"github.com/Yashasv-Prajapati/vantadb/internal/wal"
+)
+
+// ----------------------------------- inode engine -----------------------------------
+
+// InodeEngine keeps every key in an inode of the disk, with its value in data pages, the hash index
+// finds a key and the b+tree keeps them in order
+type InodeEngine struct {
+	disk       *fs.Disk
+	batchMode  bool
+	batchMutex sync.RWMutex
+	lastFlush  time.Time
+
+	// writes are logged here before they reach the engine, a flush checkpoints it in the superblock,
+	// empty when they aren't logged
+	walPath string
+
+	// new values of at least compressMin bytes are compressed with codec, nil stores them as they are
+	codec       codec.Codec
+	compressMin int
+
+	replayed wal.ReplayStats // see replay
+}
+
+func NewInodeEngine(d *fs.Disk) *InodeEngine {
+	return &InodeEngine{disk: d}
+}
+
+// opens the keys of a disk created with the inode engine, replaying the WAL at walPath written since the
+// last checkpoint, records sealed with key are opened with it
+func OpenInodeEngine(d *fs.Disk, walPath string, key *crypt.Key) (*InodeEngine, error) {
+	e := NewInodeEngine(d)
+	if err := e.loadCompression(); err != nil {
+		return nil, err
+	}
+	e.walPath = walPath
+	// a read-only disk can't take the writes, it is read as of the last checkpoint
+	if walPath == "" || d.ReadOnly() {
+		return e, nil
+	}
+	if err := e.replay(key); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// replay applies the records logged after the checkpoint, the writes a crash may have kept from the disk
+func (e *InodeEngine) replay(key *crypt.Key) error {
+	// a log shorter than the checkpoint was replaced since, everything in it is newer than the disk
+	offset := int64(e.disk.SuperBlock.WALCheckpoint)
+	if offset > wal.Size(e.walPath) {
+		offset = 0
+	}
+	records, end, err := wal.ReadRecords(e.walPath, offset)
+	if errors.Is(err, wal.ErrTornRecord) {
+		// the append was cut short by a crash and never returned, everything before it is replayed
+		e.replayed.TornBytes = wal.Size(e.walPath) - end
+		if err := wal.TruncateTorn(e.walPath, end); err != nil {
+			return fmt.Errorf("could not truncate the WAL: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("could not replay the WAL: %w", err)
+	}
+	if err := wal.OpenRecords(records, key); err != nil {
+		return fmt.Errorf("could not replay the WAL: %w", err)
+	}
+	e.replayed.Records = len(records)
+	if len(records) == 0 {
+		return nil
+	}
+
+	e.EnableBatchMode()
+	for _, record := range records {
+		name := strings.TrimRight(string(record.Key), "\x00")
+		var err error
+		switch record.EntryType[0] {
+		case wal.SET_FLAT:
+			err = e.Set(name, string(record.Value))
+		case wal.DELETE_FLAG:
+			err = e.Delete(name)
+		}
+		// sets and deletes are replayed over what they may already have done, writes are checked before
+		// they are logged, see DB.validate, but one can still fail, e.g. on a full disk, it is counted
+		if err != nil && !errors.Is(err, ErrKeyNotFound) {
+			e.replayed.Skipped++
+		}
+	}
+	// writes the replayed keys out and moves the checkpoint to the end of the log
+	return e.DisableBatchMode()
+}
+
+// returns what replaying the WAL did when the engine was opened
+func (e *InodeEngine) Replayed() wal.ReplayStats {
+	return e.replayed
+}
+
+// Enable batch mode - operations won't immediately flush to disk
+func (e *InodeEngine) EnableBatchMode() {
+	e.batchMutex.Lock()
+	defer e.batchMutex.Unlock()
+	e.batchMode = true
+}
+
+// Disable batch mode and flush all pending changes
+func (e *InodeEngine) DisableBatchMode() error {
+	e.batchMutex.Lock()
+	defer e.batchMutex.Unlock()
+	e.batchMode = false
+	return e.Flush()
+}
+
+// Force flush all in-memory changes to disk
+func (e *InodeEngine) Flush() error {
+	// Write bitmap
+	if err := e.disk.WriteBitmapToDisk(); err != nil {
+		return err
+	}
+
+	// Write all inodes
+	for i, inode := range e.disk.Inodes {
+		if err := e.disk.WriteInodeToDisk(i, inode); err != nil {
+			return err
+		}
+	}
+
+	// the indexes last, they describe the inodes
+	if err := e.disk.WriteIndexesToDisk(); err != nil {
+		return err
+	}
+
+	// a flush in the middle of a batch leaves the checkpoint where it is, the batch may be a replay that
+	// hasn't applied the rest of the log yet
+	if e.walPath != "" && !e.batchMode {
+		if err := e.checkpoint(); err != nil {
+			return err
+		}
+	}
+
+	e.lastFlush = time.Now()
+	return nil
+}
+
+// checkpoint syncs the log and then the disk, a crash from now on only replays what is logged after it
+// the log is synced first so the checkpoint is never past its durable end
+func (e *InodeEngine) checkpoint() error {
+	if err := wal.Sync(e.walPath); err != nil {
+		return fmt.Errorf("could not sync the WAL: %v", err)
+	}
+	if err := e.disk.Checkpoint(wal.Size(e.walPath)); err != nil {
+		return fmt.Errorf("could not checkpoint the WAL: %v", err)
+	}
+	return nil
+}
+
+func (e *InodeEngine) Close() error {
+	return e.Flush()
+}
+
+// upserts key-value pair in db - key - max fs.MAX_KEY_SIZE (1KB) value, max fs.MAX_INODE_PAGES pages (~8MB)
+func (e *InodeEngine) Set(key string, value string) error {
+	return e.setInternal(key, value)
+}
+
+func (e *InodeEngine) Get(key string) (string, error) {
+	// first we have to search if this key exists or not
+	idx, err := e.searchKeyInInodes(key)
+	if err != nil {
+		return "", fmt.Errorf("could not look up key: %w", err)
+	}
+	if idx == -1 { // key not found
+		return "", fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+
+	// else found the key
+	return e.readValue(idx)
+}
+
+func (e *InodeEngine) Delete(key string) error {
+	return e.delInternal(key)
+}
+
+func (e *InodeEngine) Scan(start string, end string, limit int) ([]KeyValue, error) {
+	entries, err := e.disk.BTreeRange(start, end, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not scan keys: %w", err)
+	}
+
+	pairs := make([]KeyValue, 0, len(entries))
+	for _, entry := range entries {
+		value, err := e.readValue(entry.Inode)
+		if err != nil {
+			return nil, fmt.Errorf("could not read value of %q: %w", entry.Key, err)
+		}
+		pairs = append(pairs, KeyValue{Key: entry.Key, Value: value})
+	}
+	return pairs, nil
+}
+
+// like Scan, only the b+tree is read
+func (e *InodeEngine) ScanKeys(start string, end string, limit int) ([]string, error) {
+	entries, err := e.disk.BTreeRange(start, end, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not scan keys: %w", err)
+	}
+
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+	return keys, nil
+}
+
+// reads the value held by the inode at idx, decompressed
+func (e *InodeEngine) readValue(idx int) (string, error) {
+	stored, err := e.readBlob(idx)
+	if err != nil {
+		return "", err
+	}
+	value, err := e.decodeValue(e.disk.Inodes[idx].Codec(), stored)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(value), "\x00"), nil
+}
+
+// reads the value held by the inode at idx as it is stored
+func (e *InodeEngine) readBlob(idx int) ([]byte, error) {
+	inode := e.disk.Inodes[idx]
+	// a small value is in the inode, no page is read for it
+	if inode.Inline() {
+		return inode.InlineValue(), nil
+	}
+	pageNumbers, _, err := e.disk.InodePages(inode)
+	if err != nil {
+		return nil, fmt.Errorf("could not read pages of key: %w", err)
+	}
+	numPages := len(pageNumbers)
+	if numPages == 0 {
+		return []byte{}, nil
+	}
+
+	actualSize := binary.LittleEndian.Uint32(inode.Size[:])
+	value := make([]byte, actualSize) // stores the value for corresponding key
+
+	offset := 0 // to read one page size chunk from each page
+	for i := 0; i < numPages; i++ {
+		pageData, err := e.disk.ReadPageFromDisk(int(pageNumbers[i]))
+		if err != nil {
+			return nil, fmt.Errorf("could not read page from disk: %w", err)
+		}
+
+		bytesToCopy := e.disk.PageSize()
+		if offset+bytesToCopy > int(actualSize) {
+			bytesToCopy = int(actualSize) - offset
+		}
+
+		copy(value[offset:offset+bytesToCopy], pageData[:bytesToCopy])
+		offset += bytesToCopy
+	}
+	return value, nil
+
+}
+
+// reads len(p) bytes of the value held by the inode at idx, starting at offset, only the pages needed
+func (e *InodeEngine) readBlobAt(idx int, p []byte, offset int) error {
+	inode := e.disk.Inodes[idx]
+	if size := int(binary.LittleEndian.Uint32(inode.Size[:])); offset < 0 || offset+len(p) > size {
+		return fmt.Errorf("read of %d bytes at %d is past the end of a %d bytes value", len(p), offset, size)
+	}
+	if inode.Inline() {
+		copy(p, inode.InlineValue()[offset:])
+		return nil
+	}
+
+	pageNumbers, _, err := e.disk.InodePages(inode)
+	if err != nil {
+		return fmt.Errorf("could not read pages of key: %w", err)
+	}
+
+	for n := 0; n < len(p); {
+		page := (offset + n) / e.disk.PageSize()
+		pageData, err := e.disk.ReadPageFromDisk(pageNumbers[page])
+		if err != nil {
+			return fmt.Errorf("could not read page from disk: %w", err)
+		}
+		n += copy(p[n:], pageData[(offset+n)%e.disk.PageSize():])
+	}
+	return nil
+}
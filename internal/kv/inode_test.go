@@ -0,0 +1,232 @@
+package kv
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+	"github.com/Yashasv-Prajapati/vantadb/internal/wal"
+)
+
+// openLogged opens an inode engine database on device, logging to walPath
+func openLogged(t *testing.T, device fs.BlockDevice, walPath string) *DB {
+	t.Helper()
+	db, err := OpenDevice(device, Options{WALPath: walPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// crash drops what the device didn't sync and lets go of the WAL like a killed process would, db
+// can't be used afterwards
+func crash(db *DB, device *fs.FaultyDevice) {
+	device.Crash()
+	if db.walLock != nil {
+		db.walLock.Close()
+	}
+}
+
+func newLoggedDisk(t *testing.T) (*fs.FaultyDevice, string) {
+	t.Helper()
+	device := fs.NewFaultyDevice(nil)
+	if err := fs.FormatDevice(device, fs.DEFAULT_PAGE_SIZE, fs.ENGINE_INODE); err != nil {
+		t.Fatal(err)
+	}
+	return device, filepath.Join(t.TempDir(), "disk.wal")
+}
+
+func TestInodeReplayAfterCrash(t *testing.T) {
+	device, walPath := newLoggedDisk(t)
+	db := openLogged(t, device, walPath)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := db.Set(key, faultyValue); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if db.disk.SuperBlock.WALCheckpoint != uint64(wal.Size(walPath)) {
+		t.Fatalf("checkpoint at %d after the flush, the log ends at %d", db.disk.SuperBlock.WALCheckpoint, wal.Size(walPath))
+	}
+
+	// only the log is synced from here on
+	if _, err := db.Set("b", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := db.Del("c"); msg != "OK" {
+		t.Fatal(msg)
+	}
+	if _, err := db.Set("d", faultyValue); err != nil {
+		t.Fatal(err)
+	}
+	crash(db, device)
+
+	db = openLogged(t, device, walPath)
+	defer db.Close()
+	want := map[string]string{"a": faultyValue, "b": "changed", "d": faultyValue}
+	keys, err := db.Keys("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("keys %v after the replay", keys)
+	}
+	for key, value := range want {
+		if got, err := db.Get(key); err != nil || got != value {
+			t.Fatalf("%s after the replay: %v, read %d bytes", key, err, len(got))
+		}
+	}
+	if report := db.Check(); !report.Clean() {
+		t.Fatalf("fsck after the replay: %v", report.Problems)
+	}
+
+	// the replay is checkpointed, a second crash has nothing left to replay
+	if db.disk.SuperBlock.WALCheckpoint != uint64(wal.Size(walPath)) {
+		t.Fatalf("checkpoint at %d after the replay, the log ends at %d", db.disk.SuperBlock.WALCheckpoint, wal.Size(walPath))
+	}
+}
+
+func TestInodeReplayStartsAtCheckpoint(t *testing.T) {
+	device, walPath := newLoggedDisk(t)
+	db := openLogged(t, device, walPath)
+
+	if _, err := db.Set("a", "logged"); err != nil {
+		t.Fatal(err)
+	}
+	// a write that isn't in the log, replaying the whole log would undo it
+	if err := db.engine.Set("a", "unlogged"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db = openLogged(t, device, walPath)
+	defer db.Close()
+	if got, err := db.Get("a"); err != nil || got != "unlogged" {
+		t.Fatalf("a is %q, %v, the log before the checkpoint was replayed", got, err)
+	}
+}
+
+func TestInodeReplayTornTail(t *testing.T) {
+	device, walPath := newLoggedDisk(t)
+	db := openLogged(t, device, walPath)
+
+	if _, err := db.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	whole := wal.Size(walPath)
+
+	// half of a record, the crash hit in the middle of the append
+	record := wal.NewWALRecord("set", "b", "2").ToBytes()
+	file, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(record[:len(record)/2])
+	file.Close()
+	crash(db, device)
+
+	db = openLogged(t, device, walPath)
+	defer db.Close()
+	if got, err := db.Get("a"); err != nil || got != "1" {
+		t.Fatalf("a is %q, %v after the replay", got, err)
+	}
+	if _, err := db.Get("b"); err == nil {
+		t.Fatal("the torn record was replayed")
+	}
+	if wal.Size(walPath) != whole {
+		t.Fatalf("log is %d bytes, the torn record wasn't cut off at %d", wal.Size(walPath), whole)
+	}
+	if stats := db.DurabilityStats(); stats.TornBytes != int64(len(record)/2) || stats.SkippedWrites != 0 {
+		t.Fatalf("stats %+v, want %d torn bytes", stats, len(record)/2)
+	}
+}
+
+// a logged write the engine refuses on replay is lost, the open goes on and the stats count it
+func TestInodeReplayCountsSkippedWrites(t *testing.T) {
+	device := fs.NewFaultyDevice(nil)
+	if err := fs.FormatDevice(device, 512, fs.ENGINE_INODE); err != nil {
+		t.Fatal(err)
+	}
+	walPath := filepath.Join(t.TempDir(), "disk.wal")
+	db := openLogged(t, device, walPath)
+	tooLarge := strings.Repeat("v", int(db.engine.(*InodeEngine).maxValueSize())+1)
+
+	if _, err := db.Set("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	// logged the way writes were before they were checked first
+	if !wal.NewWALRecord("set", "big", tooLarge).WriteWALRecordToFile(walPath, true) {
+		t.Fatal("could not append to the log")
+	}
+	crash(db, device)
+
+	db = openLogged(t, device, walPath)
+	defer db.Close()
+	if got, err := db.Get("a"); err != nil || got != "1" {
+		t.Fatalf("a is %q, %v after the replay", got, err)
+	}
+	if _, err := db.Get("big"); err == nil {
+		t.Fatal("the value over the limit was stored")
+	}
+	if stats := db.DurabilityStats(); stats.ReplayedWrites != 2 || stats.SkippedWrites != 1 || stats.TornBytes != 0 {
+		t.Fatalf("stats %+v, want 2 writes replayed and 1 skipped", stats)
+	}
+}
+
+func TestSetStopsOnUnreadableKey(t *testing.T) {
+	device := fs.NewMemoryDevice(nil)
+	if err := fs.FormatDevice(device, fs.DEFAULT_PAGE_SIZE, fs.ENGINE_INODE); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDevice(device, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("k", 300)
+	if _, err := db.Set(long, "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the overflow page holding the key is corrupted
+	idx, err := db.disk.LookupKey(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages, err := db.disk.InodeKeyPages(db.disk.Inodes[idx])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sb := db.disk.SuperBlock
+	device.WriteAt([]byte("garbage"), int64(sb.DataStartOffset)+int64(pages[0])*int64(sb.Pagesize))
+
+	if db, err = OpenDevice(device, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get(long); !errors.Is(err, ErrCorruptPage) {
+		t.Fatalf("get of a key that can't be read: %v", err)
+	}
+	if _, err := db.Set(long, "again"); err == nil {
+		t.Fatal("set went ahead without knowing whether the key exists")
+	}
+	inUse := 0
+	for _, inode := range db.disk.Inodes {
+		if inode.InUse[0] == 1 {
+			inUse++
+		}
+	}
+	if inUse != 1 {
+		t.Fatalf("%d inodes in use, the key was created a second time", inUse)
+	}
+}
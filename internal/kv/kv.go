@@ -1,128 +1,501 @@
 package kv
 
 import (
-	"encoding/binary"
+	"errors"
 	"fmt"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"github.com/Yashasv-Prajapati/vantadb/internal/crypt"
 	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
 	"github.com/Yashasv-Prajapati/vantadb/internal/wal"
 )
 
-var disk *fs.Disk
-var batchMode bool
-var batchMutex sync.RWMutex
-var lastFlush time.Time
+// returned, wrapped, when a page of the value fails its checksum
+var ErrCorruptPage = fs.ErrCorruptPage
 
-func Init(d *fs.Disk) {
-	disk = d
+// returned by writes to a database opened with Options.ReadOnly
+var ErrReadOnly = fs.ErrReadOnly
+
+type Options struct {
+	// where writes are logged, defaults to the disk path with WAL_FILE_EXTENSION added
+	WALPath string
+	// how many pages the buffer pool of the disk holds, 0 for fs.DEFAULT_BUFFER_POOL_PAGES
+	BufferPoolPages int
+	// how the disk file is accessed, IO_FILE or IO_MMAP, empty for IO_FILE
+	IO string
+	// when writes are synced, one of Durabilities, empty for DURABILITY_ALWAYS
+	Durability string
+	// how often DURABILITY_INTERVAL syncs, 0 for DEFAULT_SYNC_INTERVAL
+	SyncInterval time.Duration
+	// the disk is mounted read-only, writes return ErrReadOnly, see fs.MountOptions
+	ReadOnly bool
+	// the key of an encrypted disk, WAL records are sealed with it as well, nil for none
+	Key *crypt.Key
+}
+
+func (opts Options) validate() error {
+	if opts.IO != "" && opts.IO != IO_FILE && opts.IO != IO_MMAP {
+		return fmt.Errorf("unknown io %q, use %s or %s", opts.IO, IO_FILE, IO_MMAP)
+	}
+	if opts.Durability != "" {
+		return ValidateDurability(opts.Durability)
+	}
+	return nil
+}
+
+const (
+	IO_FILE = "file"
+	IO_MMAP = "mmap"
+)
+
+// DB is an open database, a disk and the engine holding its keys, it is safe for concurrent use
+type DB struct {
+	disk    *fs.Disk // nil when the engine doesn't live on a disk
+	engine  Engine
+	walPath string   // empty when writes aren't logged
+	walLock *os.File // held open for the lock on the WAL, nil when it isn't locked
+	key     *crypt.Key // WAL records are sealed with it, nil when they aren't, see encrypt.go
+
+	durability string // the mode of writes that don't ask for one, see durability.go
+	syncer     syncer
+
+	compacting atomic.Bool // see Compact, one runs at a time
+
+	// engines aren't safe for concurrent use, writes take the lock exclusively and reads share it
+	// a write covers its WAL record, so the log has writes in the order they were applied
+	mutex sync.RWMutex
+}
+
+// mounts the disk at path and opens the engine it was created with
+func Open(path string, opts Options) (*DB, error) {
+	if path == "" {
+		path = fs.VDSK_PATH
+	}
+	walPath := opts.WALPath
+	if walPath == "" {
+		walPath = wal.PathFor(path)
+	}
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	d, err := fs.Mount(path, fs.MountOptions{ReadOnly: opts.ReadOnly, Key: opts.Key})
+	if err != nil {
+		return nil, err
+	}
+	if opts.WALPath == "" {
+		if err := importLegacyWAL(d, path, walPath); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	return openDisk(d, walPath, opts)
+}
+
+var ErrLegacyWAL = errors.New("the working directory has a WAL from before logs were kept next to their disk")
+
+/*
+importLegacyWAL moves wal.log, where every write was logged before logs were kept in <disk>.wal, to the
+log of the disk at path, its writes are replayed when the engine is opened
+
+wal.log was always the log of the default disk, the disk at any other path, a read-only one, or one that
+already has a log of its own refuses to open while it is there, its writes would be dropped otherwise
+the disk is mounted, nothing else can be appending to walPath
+*/
+func importLegacyWAL(d *fs.Disk, path string, walPath string) error {
+	if wal.Size(wal.LEGACY_WAL_PATH) == 0 {
+		return nil
+	}
+	if path != fs.VDSK_PATH {
+		return fmt.Errorf("%w: move %s to %s if it is the log of that disk, remove it otherwise", ErrLegacyWAL, wal.LEGACY_WAL_PATH, walPath)
+	}
+	if d.ReadOnly() {
+		return fmt.Errorf("%w: open the disk read-write once to replay %s", ErrLegacyWAL, wal.LEGACY_WAL_PATH)
+	}
+	if wal.Size(walPath) > 0 {
+		return fmt.Errorf("%w: %s has writes of its own, move one of the logs away", ErrLegacyWAL, walPath)
+	}
+	if err := os.Rename(wal.LEGACY_WAL_PATH, walPath); err != nil {
+		return fmt.Errorf("%w: could not move it to %s: %v", ErrLegacyWAL, walPath, err)
+	}
+	return nil
+}
+
+// mounts the disk on device, e.g. an fs.MemoryDevice, and opens the engine it was created with
+// writes are only logged if opts has a WALPath
+func OpenDevice(device fs.BlockDevice, opts Options) (*DB, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.IO == IO_MMAP {
+		return nil, fmt.Errorf("io %q needs a disk file, a device is read and written directly", opts.IO)
+	}
+	d, err := fs.MountDevice(device, fs.MountOptions{ReadOnly: opts.ReadOnly, Key: opts.Key})
+	if err != nil {
+		return nil, err
+	}
+	return openDisk(d, opts.WALPath, opts)
+}
+
+func openDisk(d *fs.Disk, walPath string, opts Options) (*DB, error) {
+	// the WAL is locked like the disk, a second writer must not append to it
+	// a read-only database only reads it, if there is one
+	var walLock *os.File
+	if walPath != "" {
+		var err error
+		walLock, err = fs.LockFile(walPath, !opts.ReadOnly)
+		if opts.ReadOnly && errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	db, err := openEngine(d, walPath, opts)
+	if err != nil {
+		if walLock != nil {
+			walLock.Close()
+		}
+		return nil, err
+	}
+	db.walLock = walLock
+	return db, nil
+}
+
+func openEngine(d *fs.Disk, walPath string, opts Options) (*DB, error) {
+	if opts.BufferPoolPages > 0 {
+		if err := d.SetBufferPoolSize(opts.BufferPoolPages); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	if opts.IO == IO_MMAP {
+		if err := d.EnableMmap(); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+
+	var engine Engine
+	var err error
+	if d.SuperBlock.Engine[0] == fs.ENGINE_LSM {
+		engine, err = NewLSMEngine(d, walPath, opts.Key)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+	} else {
+		engine, err = OpenInodeEngine(d, walPath, opts.Key)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	return newDB(d, engine, walPath, opts), nil
+}
+
+func newDB(d *fs.Disk, engine Engine, walPath string, opts Options) *DB {
+	db := &DB{disk: d, engine: engine, walPath: walPath, key: opts.Key, durability: opts.Durability}
+	if db.durability == "" {
+		db.durability = DURABILITY_ALWAYS
+	}
+	db.syncer.interval = opts.SyncInterval
+	if db.syncer.interval <= 0 {
+		db.syncer.interval = DEFAULT_SYNC_INTERVAL
+	}
+	if db.durability == DURABILITY_INTERVAL && walPath != "" && !db.readOnly() {
+		db.startSyncer()
+	}
+	return db
+}
+
+// opens a database over an engine that isn't kept on a disk, e.g. a MemoryEngine
+// writes are only logged if opts has a WALPath, which isn't locked
+func OpenEngine(engine Engine, opts Options) *DB {
+	return newDB(nil, engine, opts.WALPath, opts)
+}
+
+// the disk was mounted read-only, nothing may be written to it
+func (db *DB) readOnly() bool {
+	return db.disk != nil && db.disk.ReadOnly()
+}
+
+// returns the path of the log, empty if writes aren't logged
+func (db *DB) WALPath() string {
+	return db.walPath
 }
 
 // Enable batch mode - operations won't immediately flush to disk
-func EnableBatchMode() {
-	batchMutex.Lock()
-	defer batchMutex.Unlock()
-	batchMode = true
+func (db *DB) EnableBatchMode() {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	db.enableBatchMode()
 }
 
 // Disable batch mode and flush all pending changes
-func DisableBatchMode() error {
-	batchMutex.Lock()
-	defer batchMutex.Unlock()
-	batchMode = false
-	return FlushToDisk()
+func (db *DB) DisableBatchMode() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return db.disableBatchMode()
+}
+
+func (db *DB) enableBatchMode() {
+	if b, ok := db.engine.(batcher); ok {
+		b.EnableBatchMode()
+	}
+}
+
+func (db *DB) disableBatchMode() error {
+	if db.readOnly() {
+		return nil
+	}
+	if b, ok := db.engine.(batcher); ok {
+		return b.DisableBatchMode()
+	}
+	return db.engine.Flush()
 }
 
 // Force flush all in-memory changes to disk
-func FlushToDisk() error {
-	// Write bitmap
-	if err := disk.WriteBitmapToDisk(); err != nil {
+func (db *DB) Flush() error {
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	if db.readOnly() {
+		return nil // nothing was written
+	}
+	if err := db.engine.Flush(); err != nil {
 		return err
 	}
+	// writes to a mapping only reach the file with msync
+	if db.disk != nil && db.disk.Mapped() {
+		return db.disk.Sync()
+	}
+	return nil
+}
 
-	// Write all inodes
-	for i, inode := range disk.Inodes {
-		if err := disk.WriteInodeToDisk(i, inode); err != nil {
-			return err
+// flushes the engine and closes the disk, the DB can't be used afterwards
+func (db *DB) Close() error {
+	db.stopSyncer()
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	// closing an engine flushes it, a read-only one only holds what it read
+	var err error
+	if !db.readOnly() {
+		err = db.engine.Close()
+	}
+	if db.disk != nil {
+		if closeErr := db.disk.Close(); err == nil {
+			err = closeErr
 		}
 	}
+	if db.walLock != nil {
+		db.walLock.Close()
+	}
+	return err
+}
 
-	lastFlush = time.Now()
+// appends a record to the log, if the DB has one, and syncs it as durability says
+func (db *DB) log(entryType string, key string, value string, durability string) error {
+	if db.walPath == "" {
+		return nil
+	}
+	wr := wal.NewWALRecord(entryType, key, value)
+	if db.key != nil {
+		if err := wr.Seal(db.key); err != nil {
+			return fmt.Errorf("could not encrypt WAL record: %v", err)
+		}
+	}
+	if !wr.WriteWALRecordToFile(db.walPath, durability == DURABILITY_ALWAYS) {
+		return fmt.Errorf("could not write to the WAL %s", db.walPath)
+	}
+
+	switch durability {
+	case DURABILITY_ALWAYS:
+		db.syncer.syncs.Add(1)
+	case DURABILITY_INTERVAL:
+		db.syncer.pending.Store(true)
+		db.startSyncer()
+	}
 	return nil
 }
 
-// upserts key-value pair in db - key - max 32B value, max 6 pages = 3072B
-func Set(key string, value string) (string, error){
-	return setInternal(key, value, true)
+// refuses a write before it is logged, a logged write the engine refuses would be lost when it is replayed
+func (db *DB) validate(key string, value string) error {
+	// keys are never truncated, a key that doesn't fit is rejected
+	if len(key) > fs.MAX_KEY_SIZE {
+		return fmt.Errorf("key too large, max key size is %d bytes", fs.MAX_KEY_SIZE)
+	}
+	// a larger record is read back as corruption
+	if db.walPath != "" && len(value) > wal.MAX_VALUE_SIZE {
+		return fmt.Errorf("value too large, max value size is %d bytes", wal.MAX_VALUE_SIZE)
+	}
+	if v, ok := db.engine.(validator); ok {
+		return v.Validate(key, value)
+	}
+	return nil
+}
+
+// upserts key-value pair in db - key - max fs.MAX_KEY_SIZE (1KB)
+func (db *DB) Set(key string, value string) (string, error){
+	return db.SetWithDurability(key, value, "")
 }
 
-func Get(key string) (string, error) {
-	// first we have to search if this key exists or not
-	idx := searchKeyInInodes(key)
-	if idx == -1 { // key not found
-		return "", fmt.Errorf("key not found")
+// like Set, with one of Durabilities instead of the DB's durability
+func (db *DB) SetWithDurability(key string, value string, durability string) (string, error) {
+	if err := db.validate(key, value); err != nil {
+		return err.Error(), err
+	}
+	if db.readOnly() {
+		return ErrReadOnly.Error(), ErrReadOnly
 	}
+	durability, err := db.durabilityFor(durability)
+	if err != nil {
+		return err.Error(), err
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
 
-	// else found the key
-	inode := disk.Inodes[idx]
-	pageNumbers := inode.PageNumbers
-	numPages := int(inode.NumberofPages[0])
-	if numPages == 0 {
-		return "", nil
+	// first write to WAL, then to the engine
+	if err := db.log("set", key, value, durability); err != nil {
+		return err.Error(), err
 	}
 
-	actualSize := binary.LittleEndian.Uint32(inode.Size[:])
-	value := make([]byte, actualSize) // stores the value for corresponding key
+	if err := db.engine.Set(key, value); err != nil {
+		return err.Error(), err
+	}
+	return "SET OK", nil
+}
 
-	offset := 0 // to read PAGE_SIZE chunk from each page
-	for i := 0; i < numPages; i++ {
-		if pageNumbers[i] == 0 {
-			break // no more pages
-		}
-		pageData, err := disk.ReadPageFromDisk(int(pageNumbers[i]))
-		if err != nil {
-			return "", fmt.Errorf("could not read page from disk")
-		}
+func (db *DB) Get(key string) (string, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.engine.Get(key)
+}
 
-		bytesToCopy := fs.PAGE_SIZE
-		if offset+bytesToCopy > int(actualSize) {
-			bytesToCopy = int(actualSize) - offset
-		}
+// a key and its value, as returned by Range
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// returns the pairs with start <= key < end ordered by key, at most limit of them
+// an empty end has no upper bound, limit <= 0 has no limit
+func (db *DB) Range(start string, end string, limit int) ([]KeyValue, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	return db.engine.Scan(start, end, limit)
+}
+
+// returns the keys with start <= key < end ordered by key, like Range without reading the values
+// when the engine can
+func (db *DB) Keys(start string, end string, limit int) ([]string, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
 
-		copy(value[offset:offset+bytesToCopy], pageData[:bytesToCopy])
-		offset += bytesToCopy
+	if scanner, ok := db.engine.(keyScanner); ok {
+		return scanner.ScanKeys(start, end, limit)
 	}
-	return strings.TrimRight(string(value), "\x00"), nil
 
+	pairs, err := db.engine.Scan(start, end, limit)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		keys = append(keys, pair.Key)
+	}
+	return keys, nil
+}
+
+// returns the end to pass to Range or Keys to get the keys starting with prefix, "" when there is no bound
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+	if len(end) == 0 {
+		return ""
+	}
+	end[len(end)-1]++
+	return string(end)
 }
 
-func Del(key string) string {
-	return delInternal(key, true)
+func (db *DB) Del(key string) string {
+	return db.DelWithDurability(key, "")
 }
 
+// like Del, with one of Durabilities instead of the DB's durability
+func (db *DB) DelWithDurability(key string, durability string) string {
+	if db.readOnly() {
+		return ErrReadOnly.Error()
+	}
+	durability, err := db.durabilityFor(durability)
+	if err != nil {
+		return err.Error()
+	}
 
-func RecoverFromLogs() string {
-	EnableBatchMode()
-	defer DisableBatchMode()
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
 
-	wals := wal.GetAllWALRecords()
+	// first write this command to wal for safety
+	if err := db.log("delete", key, "", durability); err != nil {
+		return err.Error()
+	}
+
+	err = db.engine.Delete(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		return "key not found"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	return "OK"
+}
+
+
+// replays the whole log into the engine
+func (db *DB) RecoverFromLogs() string {
+	if db.walPath == "" {
+		return "no WAL file"
+	}
+	if db.readOnly() {
+		return ErrReadOnly.Error()
+	}
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.enableBatchMode()
+	defer db.disableBatchMode()
+
+	wals := wal.GetAllWALRecords(db.walPath)
 	if len(wals) == 0 {
 		return "no records in WAL file"
 	}
+	if err := wal.OpenRecords(wals, db.key); err != nil {
+		return err.Error()
+	}
 	for i := 0; i < len(wals); i++ {
 		record := wals[i]
-		fmt.Println("RECOVERING ", string(record.Key[:]), string(record.Value))
-		
-		key := strings.TrimRight(string(record.Key[:]), "\x00")
+		if record == nil {
+			continue // record could not be decoded
+		}
+		key := strings.TrimRight(string(record.Key), "\x00")
 		value := string(record.Value)
 
 		switch record.EntryType[0] {
 		case wal.SET_FLAT:
-			setInternal(key, value, false)
+			db.engine.Set(key, value)
 			continue
 		case wal.DELETE_FLAG:
-			delInternal(key, false)
+			db.engine.Delete(key)
 			continue
 		default:
 			continue
@@ -131,3 +504,22 @@ func RecoverFromLogs() string {
 
 	return "OK"
 }
+
+// returns the statistics of the buffer pool, all zero for a DB without a disk
+func (db *DB) BufferPoolStats() fs.BufferPoolStats {
+	if db.disk == nil {
+		return fs.BufferPoolStats{}
+	}
+	return db.disk.BufferPoolStats()
+}
+
+// cross checks the disk of the DB, see fs.Disk.Check, a DB without a disk has nothing to check
+func (db *DB) Check() *fs.FsckReport {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	if db.disk == nil {
+		return &fs.FsckReport{}
+	}
+	return db.disk.Check()
+}
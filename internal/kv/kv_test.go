@@ -0,0 +1,133 @@
+package kv
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+	"github.com/Yashasv-Prajapati/vantadb/internal/wal"
+)
+
+// chdir moves the test to a temporary directory, wal.log is looked for in the working directory
+func chdir(t *testing.T) {
+	t.Helper()
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(cwd) })
+}
+
+func TestLegacyWAL(t *testing.T) {
+	chdir(t)
+	path := newDiskFile(t, fs.ENGINE_INODE, nil)
+	walPath := wal.PathFor(path)
+	if !wal.NewWALRecord("set", "old", "value").WriteWALRecordToFile(wal.LEGACY_WAL_PATH, true) {
+		t.Fatal("could not write wal.log")
+	}
+
+	// it is the log of the default disk, any other one can't tell if the writes are its own
+	if _, err := Open(path, Options{}); !errors.Is(err, ErrLegacyWAL) {
+		t.Fatalf("open with wal.log around: %v", err)
+	}
+	if _, err := Open(path, Options{ReadOnly: true}); !errors.Is(err, ErrLegacyWAL) {
+		t.Fatalf("read-only open with wal.log around: %v", err)
+	}
+
+	disk, err := fs.Mount(path, fs.MountOptions{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = importLegacyWAL(disk, fs.VDSK_PATH, walPath)
+	disk.Close()
+	if !errors.Is(err, ErrLegacyWAL) {
+		t.Fatalf("import on a read-only disk: %v", err)
+	}
+
+	// as if path were the default disk
+	disk, err = fs.Mount(path, fs.MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = importLegacyWAL(disk, fs.VDSK_PATH, walPath)
+	disk.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(wal.LEGACY_WAL_PATH); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("wal.log is still there: %v", err)
+	}
+
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("old"); err != nil || value != "value" {
+		t.Fatalf("the write from wal.log reads %q, %v", value, err)
+	}
+}
+
+// a disk with writes in its own log doesn't take wal.log over them
+func TestLegacyWALWithNewLog(t *testing.T) {
+	chdir(t)
+	path := newDiskFile(t, fs.ENGINE_INODE, nil)
+	walPath := wal.PathFor(path)
+	for _, log := range []string{wal.LEGACY_WAL_PATH, walPath} {
+		if !wal.NewWALRecord("set", "key", log).WriteWALRecordToFile(log, true) {
+			t.Fatalf("could not write %s", log)
+		}
+	}
+
+	disk, err := fs.Mount(path, fs.MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	if err := importLegacyWAL(disk, fs.VDSK_PATH, walPath); !errors.Is(err, ErrLegacyWAL) {
+		t.Fatalf("import over a log with writes: %v", err)
+	}
+	if wal.Size(wal.LEGACY_WAL_PATH) == 0 || wal.Size(walPath) == 0 {
+		t.Fatal("a log was lost")
+	}
+}
+
+// a write the engine would refuse is never logged, replaying it would only fail again
+func TestSetValidatedBeforeLogging(t *testing.T) {
+	for _, engine := range []byte{fs.ENGINE_INODE, fs.ENGINE_LSM} {
+		t.Run(fs.Engines[engine], func(t *testing.T) {
+			device := fs.NewMemoryDevice(nil)
+			if err := fs.FormatDevice(device, 512, engine); err != nil {
+				t.Fatal(err)
+			}
+			walPath := filepath.Join(t.TempDir(), "disk.wal")
+			db := openLogged(t, device, walPath)
+			defer db.Close()
+
+			// more than an inode of 512 byte pages maps
+			tooLarge := strings.Repeat("v", int(db.disk.MaxInodePages()*512)+1)
+			if _, err := db.Set("big", tooLarge); err == nil {
+				t.Fatal("set of a value over the limit went through")
+			}
+			if _, err := db.Set(strings.Repeat("k", fs.MAX_KEY_SIZE+1), "v"); err == nil {
+				t.Fatal("set of a key over the limit went through")
+			}
+			if size := wal.Size(walPath); size != 0 {
+				t.Fatalf("the refused writes left %d bytes in the log", size)
+			}
+
+			if _, err := db.Set("small", "v"); err != nil {
+				t.Fatal(err)
+			}
+			if wal.Size(walPath) == 0 {
+				t.Fatal("the write wasn't logged")
+			}
+		})
+	}
+}
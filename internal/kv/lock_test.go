@@ -0,0 +1,58 @@
+//go:build unix
+
+package kv
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+)
+
+func TestOpenLockedDisk(t *testing.T) {
+	path := newDiskFile(t, fs.ENGINE_INODE, nil)
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, readOnly := range []bool{false, true} {
+		if _, err := Open(path, Options{ReadOnly: readOnly}); !errors.Is(err, fs.ErrLocked) {
+			t.Fatalf("read-only %v open of an open database: %v", readOnly, err)
+		}
+	}
+	if _, err := db.Set("a", "1"); err != nil {
+		t.Fatalf("the failed opens got in the way of the first one: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(path, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got, err := db.Get("a"); err != nil || got != "1" {
+		t.Fatalf("a is %q, %v", got, err)
+	}
+}
+
+// two disks can't share a log, the second one would append to it too
+func TestOpenLockedWAL(t *testing.T) {
+	walPath := filepath.Join(t.TempDir(), "shared.wal")
+	devices := []*fs.MemoryDevice{}
+	for i := 0; i < 2; i++ {
+		device := fs.NewMemoryDevice(nil)
+		if err := fs.FormatDevice(device, fs.DEFAULT_PAGE_SIZE, fs.ENGINE_INODE); err != nil {
+			t.Fatal(err)
+		}
+		devices = append(devices, device)
+	}
+
+	db := openLogged(t, devices[0], walPath)
+	defer db.Close()
+	if _, err := OpenDevice(devices[1], Options{WALPath: walPath}); !errors.Is(err, fs.ErrLocked) {
+		t.Fatalf("open of a second disk on the same log: %v", err)
+	}
+}
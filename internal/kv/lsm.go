@@ -0,0 +1,146 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/crypt"
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+	"github.com/Yashasv-Prajapati/vantadb/internal/lsm"
+	"github.com/Yashasv-Prajapati/vantadb/internal/wal"
+)
+
+// ----------------------------------- lsm engine -----------------------------------
+
+// LSMEngine keeps the keys in an lsm tree, whose files are inodes of the disk
+type LSMEngine struct {
+	tree  *lsm.Tree
+	files *InodeEngine
+}
+
+// opens the tree of a disk created with the lsm engine, replaying the WAL at walPath written since its
+// last flush
+func NewLSMEngine(d *fs.Disk, walPath string, key *crypt.Key) (*LSMEngine, error) {
+	files := NewInodeEngine(d)
+	tree, err := lsm.Open(inodeFiles{files}, walPath, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lsm tree: %w", err)
+	}
+	return &LSMEngine{tree: tree, files: files}, nil
+}
+
+// the files of the lsm tree, each one is kept in the inode whose key is its name
+type inodeFiles struct {
+	e *InodeEngine
+}
+
+func (f inodeFiles) ReadFile(name string) ([]byte, error) {
+	idx, err := f.e.searchKeyInInodes(name)
+	if err != nil {
+		return nil, fmt.Errorf("could not look up %s: %w", name, err)
+	}
+	if idx == -1 {
+		return nil, fmt.Errorf("%w: %s", lsm.ErrNotFound, name)
+	}
+	return f.e.readBlob(idx)
+}
+
+func (f inodeFiles) ReadFileAt(name string, p []byte, offset int) error {
+	idx, err := f.e.searchKeyInInodes(name)
+	if err != nil {
+		return fmt.Errorf("could not look up %s: %w", name, err)
+	}
+	if idx == -1 {
+		return fmt.Errorf("%w: %s", lsm.ErrNotFound, name)
+	}
+	return f.e.readBlobAt(idx, p, offset)
+}
+
+func (f inodeFiles) ReadOnly() bool {
+	return f.e.disk.ReadOnly()
+}
+
+func (f inodeFiles) WriteFile(name string, data []byte) error {
+	return f.e.Set(name, string(data))
+}
+
+func (f inodeFiles) DeleteFile(name string) error {
+	if err := f.e.Delete(name); err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return fmt.Errorf("could not delete %s: %v", name, err)
+	}
+	return nil
+}
+
+func (f inodeFiles) MaxFileSize() int {
+	return f.e.disk.MaxInodePages() * f.e.disk.PageSize()
+}
+
+// refuses a key or a value the tree can't hold, DB checks a write with it before logging it
+func (e *LSMEngine) Validate(key string, value string) error {
+	if len(key) > fs.MAX_KEY_SIZE {
+		return fmt.Errorf("key too large, max key size is %d bytes", fs.MAX_KEY_SIZE)
+	}
+	if len(key)+len(value) > e.tree.MaxEntrySize() {
+		return fmt.Errorf("value too large, key and value can be at most %d bytes", e.tree.MaxEntrySize())
+	}
+	return nil
+}
+
+// returns what replaying the WAL did when the tree was opened
+func (e *LSMEngine) Replayed() wal.ReplayStats {
+	return e.tree.Replayed()
+}
+
+func (e *LSMEngine) Set(key string, value string) error {
+	if err := e.Validate(key, value); err != nil {
+		return err
+	}
+	if err := e.tree.Set(key, value); err != nil {
+		return fmt.Errorf("could not set key: %v", err)
+	}
+	return nil
+}
+
+func (e *LSMEngine) Get(key string) (string, error) {
+	value, found, err := e.tree.Get(key)
+	if err != nil {
+		return "", fmt.Errorf("could not read key: %w", err)
+	}
+	if !found {
+		return "", fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+	return value, nil
+}
+
+func (e *LSMEngine) Delete(key string) error {
+	found, err := e.tree.Delete(key)
+	if err != nil {
+		return fmt.Errorf("could not delete key: %v", err)
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+	return nil
+}
+
+func (e *LSMEngine) Scan(start string, end string, limit int) ([]KeyValue, error) {
+	pairs, err := e.tree.Scan(start, end, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not scan keys: %w", err)
+	}
+
+	keyValues := make([]KeyValue, 0, len(pairs))
+	for _, pair := range pairs {
+		keyValues = append(keyValues, KeyValue{Key: pair.Key, Value: pair.Value})
+	}
+	return keyValues, nil
+}
+
+// writes the memtable to a table, the WAL offset of the manifest then covers everything applied so far
+func (e *LSMEngine) Flush() error {
+	return e.tree.Flush()
+}
+
+func (e *LSMEngine) Close() error {
+	return e.tree.Close()
+}
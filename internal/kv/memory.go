@@ -0,0 +1,65 @@
+package kv
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ----------------------------------- memory engine -----------------------------------
+
+// MemoryEngine keeps the keys in a map, nothing survives a restart except what the WAL replays
+type MemoryEngine struct {
+	pairs map[string]string
+}
+
+func NewMemoryEngine() *MemoryEngine {
+	return &MemoryEngine{pairs: map[string]string{}}
+}
+
+func (e *MemoryEngine) Get(key string) (string, error) {
+	value, ok := e.pairs[key]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+	return value, nil
+}
+
+func (e *MemoryEngine) Set(key string, value string) error {
+	e.pairs[key] = value
+	return nil
+}
+
+func (e *MemoryEngine) Delete(key string) error {
+	if _, ok := e.pairs[key]; !ok {
+		return fmt.Errorf("%w: %s", ErrKeyNotFound, key)
+	}
+	delete(e.pairs, key)
+	return nil
+}
+
+func (e *MemoryEngine) Scan(start string, end string, limit int) ([]KeyValue, error) {
+	keys := []string{}
+	for key := range e.pairs {
+		if key >= start && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	pairs := make([]KeyValue, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, KeyValue{Key: key, Value: e.pairs[key]})
+	}
+	return pairs, nil
+}
+
+func (e *MemoryEngine) Flush() error {
+	return nil
+}
+
+func (e *MemoryEngine) Close() error {
+	return nil
+}
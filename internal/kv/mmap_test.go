@@ -0,0 +1,95 @@
+//go:build unix
+
+package kv
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+)
+
+// checkMapping makes sure the whole file is mapped, a mapping of the old size would miss the pages a resize
+// added or still reach past the end of a shrunk file
+func checkMapping(t *testing.T, db *DB, path string) {
+	t.Helper()
+	if !db.disk.Mapped() {
+		t.Fatal("the disk isn't mapped")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mapped := db.disk.MappedSize(); mapped != info.Size() {
+		t.Fatalf("%d bytes mapped, the file is %d", mapped, info.Size())
+	}
+}
+
+func TestMmapRoundTrip(t *testing.T) {
+	path := newDiskFile(t, fs.ENGINE_INODE, nil)
+	db, err := Open(path, Options{IO: IO_MMAP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMapping(t, db, path)
+	pages := db.disk.SuperBlock.TotalPages
+
+	// about 2700 pages, the disk has to grow and each growth maps the file again
+	values := map[string]string{}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		values[key] = strings.Repeat(string(rune('a'+i%26)), 2*(1+i%8)*fs.DEFAULT_PAGE_SIZE+i)
+		if _, err := db.SetWithDurability(key, values[key], DURABILITY_NONE); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.disk.SuperBlock.TotalPages <= pages {
+		t.Fatalf("the disk didn't grow from %d pages", pages)
+	}
+	checkMapping(t, db, path)
+	checkValues(t, db, values)
+
+	// a compaction shrinks the file under the mapping
+	for i := 0; i < 300; i += 2 {
+		key := fmt.Sprintf("key%03d", i)
+		if msg := db.Del(key); msg != "OK" {
+			t.Fatal(msg)
+		}
+		delete(values, key)
+	}
+	if report, err := db.Compact(); err != nil || report.PagesAfter >= report.PagesBefore {
+		t.Fatalf("compaction: %+v, %v", report, err)
+	}
+	checkMapping(t, db, path)
+	checkValues(t, db, values)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the writes made through the mapping are in the file, read with and without one
+	for _, io := range []string{IO_FILE, IO_MMAP} {
+		db, err := Open(path, Options{IO: io})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, db, values)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMmapNeedsDiskFile(t *testing.T) {
+	device := fs.NewMemoryDevice(nil)
+	if err := fs.FormatDevice(device, fs.DEFAULT_PAGE_SIZE, fs.ENGINE_INODE); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDevice(device, Options{IO: IO_MMAP}); err == nil {
+		t.Fatal("mapped a memory device")
+	}
+	if _, err := Open(newDiskFile(t, fs.ENGINE_INODE, nil), Options{IO: "direct"}); err == nil {
+		t.Fatal("opened with an unknown io")
+	}
+}
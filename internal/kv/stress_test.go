@@ -0,0 +1,204 @@
+package kv
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/fs"
+)
+
+/*
+Concurrent writers and readers on one database, run it with the race detector when touching the storage
+code:
+
+	go test -race -run Stress ./internal/kv
+
+Every writer owns its keys and sets or deletes them, reading each one back right away. Readers get and
+scan keys while that happens and check every value they see belongs to its key and is whole. At the end
+every key must hold the last value its writer set, fsck must find no page owned twice, and the same
+must hold after the disk is closed and opened again.
+*/
+
+const (
+	STRESS_WORKERS = 8 // writers
+	STRESS_READERS = 2
+	STRESS_OPS     = 200 // per writer
+	STRESS_KEYS    = 40  // per writer
+)
+
+func stressKey(worker int, i int) string {
+	return fmt.Sprintf("w%02d-%04d", worker, i)
+}
+
+// values name their writer and carry their own length, a reader can tell a whole value of the key from
+// a torn one or one written for another key
+func stressValue(worker int, op int, r *rand.Rand) string {
+	padding := r.Intn(4 * fs.DEFAULT_PAGE_SIZE)
+	return fmt.Sprintf("%02d:%d:%d:%s", worker, op, padding, strings.Repeat("x", padding))
+}
+
+func validStressValue(key string, value string) bool {
+	parts := strings.SplitN(value, ":", 4)
+	if len(parts) != 4 || !strings.HasPrefix(key, "w"+parts[0]+"-") {
+		return false
+	}
+	padding, err := strconv.Atoi(parts[2])
+	return err == nil && parts[3] == strings.Repeat("x", padding)
+}
+
+func TestStress(t *testing.T) {
+	for _, engine := range []byte{fs.ENGINE_INODE, fs.ENGINE_LSM} {
+		t.Run(fs.Engines[engine], func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), ".vdsk")
+			if err := fs.CreateVDSKStorageData(path, fs.DEFAULT_PAGE_SIZE, engine); err != nil {
+				t.Fatal(err)
+			}
+			db, err := Open(path, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ops := STRESS_OPS
+			if testing.Short() {
+				ops /= 4
+			}
+			models := runStress(t, db, ops)
+			checkStress(t, db, models)
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// everything has to be there after opening the disk again
+			db, err = Open(path, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			checkStress(t, db, models)
+		})
+	}
+}
+
+// runStress runs the writers and the readers, and returns what every writer left in its keys
+func runStress(t *testing.T, db *DB, ops int) []map[string]string {
+	models := make([]map[string]string, STRESS_WORKERS)
+	done := make(chan struct{})
+	var writers, readers sync.WaitGroup
+
+	for w := 0; w < STRESS_WORKERS; w++ {
+		models[w] = map[string]string{}
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			r := rand.New(rand.NewSource(int64(w)))
+			model := models[w]
+
+			for op := 0; op < ops; op++ {
+				key := stressKey(w, r.Intn(STRESS_KEYS))
+				if r.Intn(5) == 0 {
+					_, exists := model[key]
+					if msg := db.Del(key); (msg == "OK") != exists {
+						t.Errorf("del %s: %s, key exists: %v", key, msg, exists)
+					}
+					delete(model, key)
+					continue
+				}
+
+				value := stressValue(w, op, r)
+				if _, err := db.Set(key, value); err != nil {
+					t.Errorf("set %s: %v", key, err)
+					continue
+				}
+				model[key] = value
+
+				// nobody else writes this key, it has to read back as it was set
+				if got, err := db.Get(key); err != nil || got != value {
+					t.Errorf("get %s right after set: %v, read %d bytes, set %d", key, err, len(got), len(value))
+				}
+			}
+		}(w)
+	}
+
+	for w := 0; w < STRESS_READERS; w++ {
+		readers.Add(1)
+		go func(w int) {
+			defer readers.Done()
+			r := rand.New(rand.NewSource(int64(STRESS_WORKERS + w)))
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				if r.Intn(2) == 0 {
+					key := stressKey(r.Intn(STRESS_WORKERS), r.Intn(STRESS_KEYS))
+					if value, err := db.Get(key); err == nil && !validStressValue(key, value) {
+						t.Errorf("get %s read a value that isn't its own: %.40q", key, value)
+					}
+					continue
+				}
+
+				prefix := fmt.Sprintf("w%02d-", r.Intn(STRESS_WORKERS))
+				pairs, err := db.Range(prefix, PrefixEnd(prefix), 10)
+				if err != nil {
+					t.Errorf("range %s: %v", prefix, err)
+					continue
+				}
+				for i, pair := range pairs {
+					if !validStressValue(pair.Key, pair.Value) {
+						t.Errorf("range %s read a value that isn't its own for %s: %.40q", prefix, pair.Key, pair.Value)
+					}
+					if i > 0 && pairs[i-1].Key >= pair.Key {
+						t.Errorf("range %s is out of order at %s", prefix, pair.Key)
+					}
+				}
+			}
+		}(w)
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	return models
+}
+
+// checkStress checks every key holds what its writer set last, and that no page is owned twice
+func checkStress(t *testing.T, db *DB, models []map[string]string) {
+	t.Helper()
+
+	total := 0
+	for w, model := range models {
+		total += len(model)
+		for i := 0; i < STRESS_KEYS; i++ {
+			key := stressKey(w, i)
+			value, err := db.Get(key)
+			want, exists := model[key]
+			if exists && (err != nil || value != want) {
+				t.Errorf("%s lost its last update: %v", key, err)
+			}
+			if !exists && err == nil {
+				t.Errorf("%s was deleted but still has a value", key)
+			}
+		}
+	}
+
+	keys, err := db.Keys("", "", 0)
+	if err != nil {
+		t.Errorf("keys: %v", err)
+	} else if len(keys) != total {
+		t.Errorf("%d keys listed, %d expected", len(keys), total)
+	}
+
+	for _, problem := range db.Check().Problems {
+		t.Errorf("fsck: %v", problem)
+	}
+}
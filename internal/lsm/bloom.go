@@ -0,0 +1,61 @@
+package lsm
+
+import "hash/fnv"
+
+// bloom filter over the keys of a table, a lookup for a key that isn't in the table skips reading
+// any of its blocks most of the time, ~1% false positives with 10 bits per key and 7 hashes
+const (
+	BLOOM_BITS_PER_KEY = 10
+	BLOOM_HASHES       = 7
+)
+
+type bloom struct {
+	bits   []byte
+	hashes int
+}
+
+func newBloom(keys int) *bloom {
+	bits := max(64, keys*BLOOM_BITS_PER_KEY)
+	return &bloom{bits: make([]byte, (bits+7)/8), hashes: BLOOM_HASHES}
+}
+
+// bloomHash returns the two hashes every bit position is derived from (double hashing)
+func bloomHash(key []byte) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write(key)
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func (b *bloom) add(key []byte) {
+	h1, h2 := bloomHash(key)
+	bits := uint32(len(b.bits) * 8)
+	for i := 0; i < b.hashes; i++ {
+		bit := (h1 + uint32(i)*h2) % bits
+		b.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (b *bloom) mayContain(key []byte) bool {
+	h1, h2 := bloomHash(key)
+	bits := uint32(len(b.bits) * 8)
+	for i := 0; i < b.hashes; i++ {
+		bit := (h1 + uint32(i)*h2) % bits
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// encode: number of hashes (1B), bits
+func (b *bloom) encode() []byte {
+	return append([]byte{byte(b.hashes)}, b.bits...)
+}
+
+func decodeBloom(data []byte) *bloom {
+	if len(data) < 2 {
+		return nil
+	}
+	return &bloom{hashes: int(data[0]), bits: data[1:]}
+}
@@ -0,0 +1,119 @@
+package lsm
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+)
+
+// maxLevelSize returns how many bytes a level can hold before it is compacted, level >= 1
+func maxLevelSize(level int) int {
+	size := L1_MAX_SIZE
+	for i := 1; i < level; i++ {
+		size *= LEVEL_SIZE_MULTIPLIER
+	}
+	return size
+}
+
+func levelSize(tables []*table) int {
+	size := 0
+	for _, tab := range tables {
+		size += tab.size
+	}
+	return size
+}
+
+// pickCompaction returns the level to compact next, -1 if none needs it
+func (t *Tree) pickCompaction() int {
+	if len(t.levels[0]) >= L0_COMPACTION_TRIGGER {
+		return 0
+	}
+	for level := 1; level < MAX_LEVELS-1; level++ {
+		if levelSize(t.levels[level]) > maxLevelSize(level) {
+			return level
+		}
+	}
+	return -1
+}
+
+// compact compacts levels until none is over its limit
+func (t *Tree) compact() error {
+	for level := t.pickCompaction(); level >= 0; level = t.pickCompaction() {
+		if err := t.compactLevel(level); err != nil {
+			return fmt.Errorf("could not compact level %d: %v", level, err)
+		}
+	}
+	return nil
+}
+
+// compactLevel merges tables of level with the tables they overlap in the next level, all of level 0
+// at once, or the oldest table of any other level
+func (t *Tree) compactLevel(level int) error {
+	inputs := t.levels[level]
+	if level > 0 {
+		oldest := slices.MinFunc(inputs, func(a, b *table) int {
+			return int(a.id) - int(b.id)
+		})
+		inputs = []*table{oldest}
+	}
+
+	minKey, maxKey := inputs[0].minKey, inputs[0].maxKey
+	for _, tab := range inputs[1:] {
+		if bytes.Compare(tab.minKey, minKey) < 0 {
+			minKey = tab.minKey
+		}
+		if bytes.Compare(tab.maxKey, maxKey) > 0 {
+			maxKey = tab.maxKey
+		}
+	}
+	overlapping := []*table{}
+	for _, tab := range t.levels[level+1] {
+		if tab.overlaps(minKey, maxKey) {
+			overlapping = append(overlapping, tab)
+		}
+	}
+
+	// newest first, the inputs are newer than anything in the next level
+	sources := []iterator{}
+	for _, tab := range append(slices.Clone(inputs), overlapping...) {
+		it, err := newTableIterator(t.store, tab, nil)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, it)
+	}
+	merged, err := newMergeIterator(sources)
+	if err != nil {
+		return err
+	}
+
+	// tombstones only have to shadow older entries, there are none below the last level with data
+	dropDeleted := true
+	for _, tables := range t.levels[level+2:] {
+		if len(tables) > 0 {
+			dropDeleted = false
+		}
+	}
+
+	outputs, err := t.writeTables(merged, level+1, dropDeleted)
+	if err != nil {
+		return err
+	}
+
+	removed := append(slices.Clone(inputs), overlapping...)
+	t.levels[level] = slices.DeleteFunc(t.levels[level], func(tab *table) bool { return slices.Contains(inputs, tab) })
+	t.levels[level+1] = slices.DeleteFunc(t.levels[level+1], func(tab *table) bool { return slices.Contains(overlapping, tab) })
+	t.levels[level+1] = append(t.levels[level+1], outputs...)
+	t.sortLevels()
+
+	// the old tables can only go once the manifest doesn't list them anymore
+	if err := t.saveManifest(); err != nil {
+		return err
+	}
+	for _, tab := range removed {
+		if err := t.store.DeleteFile(tab.name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package lsm
+
+import "bytes"
+
+// iterator walks entries in key order
+type iterator interface {
+	valid() bool
+	entry() entry
+	next() error
+}
+
+// sliceIterator walks sorted entries in memory, the memtable
+type sliceIterator struct {
+	entries []entry
+	pos     int
+}
+
+func (it *sliceIterator) valid() bool  { return it.pos < len(it.entries) }
+func (it *sliceIterator) entry() entry { return it.entries[it.pos] }
+func (it *sliceIterator) next() error  { it.pos++; return nil }
+
+// tableIterator walks a table one block at a time
+type tableIterator struct {
+	store   Store
+	table   *table
+	block   int
+	entries []entry
+	pos     int
+}
+
+// newTableIterator returns an iterator positioned at the first entry >= start
+func newTableIterator(store Store, t *table, start []byte) (*tableIterator, error) {
+	it := &tableIterator{store: store, table: t, block: max(t.block(start), 0)}
+	if err := it.load(); err != nil {
+		return nil, err
+	}
+	for it.valid() && bytes.Compare(it.entry().key, start) < 0 {
+		if err := it.next(); err != nil {
+			return nil, err
+		}
+	}
+	return it, nil
+}
+
+// load reads the current block, skipping to the next one while it is empty
+func (it *tableIterator) load() error {
+	it.entries, it.pos = nil, 0
+	for it.block < len(it.table.index) && len(it.entries) == 0 {
+		entries, err := it.table.readBlock(it.store, it.block)
+		if err != nil {
+			return err
+		}
+		it.entries = entries
+		if len(entries) == 0 {
+			it.block++
+		}
+	}
+	return nil
+}
+
+func (it *tableIterator) valid() bool  { return it.pos < len(it.entries) }
+func (it *tableIterator) entry() entry { return it.entries[it.pos] }
+
+func (it *tableIterator) next() error {
+	it.pos++
+	if it.pos < len(it.entries) {
+		return nil
+	}
+	it.block++
+	return it.load()
+}
+
+// mergeIterator merges iterators ordered from newest to oldest, for a key in more than one of them
+// only the newest entry is returned
+type mergeIterator struct {
+	sources []iterator
+	current entry
+	ok      bool
+}
+
+func newMergeIterator(sources []iterator) (*mergeIterator, error) {
+	it := &mergeIterator{sources: sources}
+	return it, it.next()
+}
+
+func (it *mergeIterator) valid() bool  { return it.ok }
+func (it *mergeIterator) entry() entry { return it.current }
+
+func (it *mergeIterator) next() error {
+	best := -1
+	for i, source := range it.sources {
+		if !source.valid() {
+			continue
+		}
+		// on equal keys the first, newest, source wins
+		if best < 0 || bytes.Compare(source.entry().key, it.sources[best].entry().key) < 0 {
+			best = i
+		}
+	}
+	if best < 0 {
+		it.ok = false
+		return nil
+	}
+
+	it.current, it.ok = it.sources[best].entry(), true
+	for _, source := range it.sources {
+		for source.valid() && bytes.Equal(source.entry().key, it.current.key) {
+			if err := source.next(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package lsm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/crypt"
+	"github.com/Yashasv-Prajapati/vantadb/internal/wal"
+)
+
+/*
+Log structured merge tree, the storage engine picked with `vantadb init --engine lsm`.
+
+The caller logs writes to the WAL, then they go to the memtable, nothing is rewritten in place. Once
+the memtable holds MEMTABLE_SIZE bytes it is flushed to a new table in level 0, and the manifest
+records how far into the WAL the tables go, on Open everything after that is replayed into the
+memtable again.
+
+Tables in level 0 can overlap, newer ones win. From level 1 on the tables of a level don't overlap and
+a level can hold LEVEL_SIZE_MULTIPLIER times more than the one before it. When level 0 has
+L0_COMPACTION_TRIGGER tables, or a level is over its size, its tables are merged into the next level
+(leveled compaction). Deletes are tombstones, dropped once they reach the last level holding data.
+
+Tables and the manifest are files of a Store, the kv package keeps them in inodes of the disk.
+*/
+
+const (
+	MEMTABLE_SIZE         = 256 * 1024
+	TARGET_TABLE_SIZE     = 512 * 1024
+	L0_COMPACTION_TRIGGER = 4
+	L1_MAX_SIZE           = 2 * 1024 * 1024
+	LEVEL_SIZE_MULTIPLIER = 10
+	MAX_LEVELS            = 7
+)
+
+// ErrNotFound is returned, wrapped, by a Store for a file that doesn't exist
+var ErrNotFound = errors.New("file not found")
+
+// Store keeps the files of a tree
+type Store interface {
+	ReadFile(name string) ([]byte, error)
+	ReadFileAt(name string, p []byte, offset int) error
+	WriteFile(name string, data []byte) error
+	DeleteFile(name string) error
+	MaxFileSize() int
+}
+
+// stores that can't be written to, a tree on one is only read and keeps what it replays in memory
+type readOnlyStore interface {
+	ReadOnly() bool
+}
+
+func isReadOnly(store Store) bool {
+	s, ok := store.(readOnlyStore)
+	return ok && s.ReadOnly()
+}
+
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+type Tree struct {
+	store    Store
+	walPath  string
+	memtable map[string]entry
+	memSize  int
+	levels   [MAX_LEVELS][]*table // level 0 newest first, the others by key
+	manifest *manifest
+	replayed wal.ReplayStats // what Open replayed
+}
+
+// Open opens the tree kept in store, and replays the WAL at walPath written since the last flush, records
+// sealed with key are opened with it
+func Open(store Store, walPath string, key *crypt.Key) (*Tree, error) {
+	m, err := readManifest(store)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tree{store: store, walPath: walPath, memtable: map[string]entry{}, manifest: m}
+	for _, meta := range m.tables {
+		tab, err := openTable(store, meta)
+		if err != nil {
+			return nil, err
+		}
+		t.levels[meta.level] = append(t.levels[meta.level], tab)
+	}
+	t.sortLevels()
+
+	// a log shorter than the offset was replaced since, everything in it is newer than the tables
+	if m.walOffset > wal.Size(walPath) {
+		m.walOffset = 0
+	}
+	records, end, err := wal.ReadRecords(walPath, m.walOffset)
+	if errors.Is(err, wal.ErrTornRecord) {
+		// the append was cut short by a crash and never returned, everything before it is replayed
+		t.replayed.TornBytes = wal.Size(walPath) - end
+		if !isReadOnly(store) {
+			if err := wal.TruncateTorn(walPath, end); err != nil {
+				return nil, fmt.Errorf("could not truncate the WAL: %w", err)
+			}
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("could not replay the WAL: %w", err)
+	}
+	if err := wal.OpenRecords(records, key); err != nil {
+		return nil, fmt.Errorf("could not replay the WAL: %w", err)
+	}
+	for _, record := range records {
+		t.Apply(record)
+	}
+	t.replayed.Records = len(records)
+
+	// flushing while replaying would record a WAL offset past what the memtable holds
+	if t.memSize >= MEMTABLE_SIZE && !isReadOnly(store) {
+		return t, t.Flush()
+	}
+	return t, nil
+}
+
+// Replayed returns what Open replayed from the WAL, the memtable takes every record
+func (t *Tree) Replayed() wal.ReplayStats {
+	return t.replayed
+}
+
+// Apply puts a WAL record in the memtable without logging it again
+func (t *Tree) Apply(record *wal.WALRecord) {
+	switch record.EntryType[0] {
+	case wal.SET_FLAT:
+		t.put(entry{key: record.Key, value: record.Value})
+	case wal.DELETE_FLAG:
+		t.put(entry{key: record.Key, deleted: true})
+	}
+}
+
+func (t *Tree) put(e entry) {
+	if old, ok := t.memtable[string(e.key)]; ok {
+		t.memSize -= len(old.key) + len(old.value)
+	}
+	t.memtable[string(e.key)] = e
+	t.memSize += len(e.key) + len(e.value)
+}
+
+// MaxEntrySize returns the biggest key and value, together, the tree can hold
+func (t *Tree) MaxEntrySize() int {
+	// a table is cut after TARGET_TABLE_SIZE, one more entry and its index and bloom filter have to fit
+	return t.store.MaxFileSize() - 2*TARGET_TABLE_SIZE
+}
+
+// Set puts key in the memtable, the caller has logged it to the WAL already
+func (t *Tree) Set(key string, value string) error {
+	if len(key)+len(value) > t.MaxEntrySize() {
+		return fmt.Errorf("value too large, key and value can be at most %d bytes", t.MaxEntrySize())
+	}
+
+	t.put(entry{key: []byte(key), value: []byte(value)})
+	return t.maybeFlush()
+}
+
+// Delete puts a tombstone for key in the memtable, it returns false if the key doesn't exist
+func (t *Tree) Delete(key string) (bool, error) {
+	if _, found, err := t.Get(key); err != nil || !found {
+		return false, err
+	}
+
+	t.put(entry{key: []byte(key), deleted: true})
+	return true, t.maybeFlush()
+}
+
+// Get looks in the memtable, then in the levels from newest to oldest
+func (t *Tree) Get(key string) (string, bool, error) {
+	if e, ok := t.memtable[key]; ok {
+		return string(e.value), !e.deleted, nil
+	}
+
+	k := []byte(key)
+	for level, tables := range t.levels {
+		for _, tab := range t.candidates(level, tables, k) {
+			e, found, err := tab.get(t.store, k)
+			if err != nil {
+				return "", false, err
+			}
+			if found {
+				return string(e.value), !e.deleted, nil
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// candidates returns the tables of a level that can hold key, newest first
+func (t *Tree) candidates(level int, tables []*table, key []byte) []*table {
+	if level == 0 {
+		return tables
+	}
+	i := sort.Search(len(tables), func(i int) bool {
+		return bytes.Compare(tables[i].maxKey, key) >= 0
+	})
+	if i < len(tables) && bytes.Compare(tables[i].minKey, key) <= 0 {
+		return tables[i : i+1]
+	}
+	return nil
+}
+
+// Scan returns the pairs with start <= key < end in order, at most limit of them
+// an empty end means no upper bound, limit <= 0 means no limit
+func (t *Tree) Scan(start string, end string, limit int) ([]KeyValue, error) {
+	startKey := []byte(start)
+	endKey := []byte(end)
+
+	memtable := &sliceIterator{}
+	for _, e := range t.sortedMemtable() {
+		if bytes.Compare(e.key, startKey) >= 0 {
+			memtable.entries = append(memtable.entries, e)
+		}
+	}
+
+	sources := []iterator{memtable}
+	for _, tables := range t.levels {
+		for _, tab := range tables {
+			if bytes.Compare(tab.maxKey, startKey) < 0 || end != "" && bytes.Compare(tab.minKey, endKey) >= 0 {
+				continue
+			}
+			it, err := newTableIterator(t.store, tab, startKey)
+			if err != nil {
+				return nil, err
+			}
+			sources = append(sources, it)
+		}
+	}
+
+	merged, err := newMergeIterator(sources)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := []KeyValue{}
+	for ; merged.valid(); err = merged.next() {
+		if err != nil {
+			return nil, err
+		}
+		e := merged.entry()
+		if end != "" && bytes.Compare(e.key, endKey) >= 0 || limit > 0 && len(pairs) >= limit {
+			break
+		}
+		if !e.deleted {
+			pairs = append(pairs, KeyValue{Key: string(e.key), Value: string(e.value)})
+		}
+	}
+	return pairs, err
+}
+
+func (t *Tree) sortedMemtable() []entry {
+	entries := make([]entry, 0, len(t.memtable))
+	for _, e := range t.memtable {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+	return entries
+}
+
+func (t *Tree) maybeFlush() error {
+	if t.memSize < MEMTABLE_SIZE {
+		return nil
+	}
+	return t.Flush()
+}
+
+// Flush writes the memtable to level 0, and compacts the levels that need it
+func (t *Tree) Flush() error {
+	if len(t.memtable) == 0 {
+		return nil
+	}
+
+	tables, err := t.writeTables(&sliceIterator{entries: t.sortedMemtable()}, 0, false)
+	if err != nil {
+		return fmt.Errorf("could not flush memtable: %v", err)
+	}
+	t.levels[0] = append(tables, t.levels[0]...)
+	t.sortLevels()
+
+	// everything in the WAL up to here is in a table now
+	t.manifest.walOffset = wal.Size(t.walPath)
+	if err := t.saveManifest(); err != nil {
+		return err
+	}
+
+	t.memtable = map[string]entry{}
+	t.memSize = 0
+
+	return t.compact()
+}
+
+// Close flushes the memtable
+func (t *Tree) Close() error {
+	return t.Flush()
+}
+
+// writeTables writes the entries of it to new tables of about TARGET_TABLE_SIZE bytes
+func (t *Tree) writeTables(it iterator, level int, dropDeleted bool) ([]*table, error) {
+	tables := []*table{}
+	builder := &tableBuilder{}
+
+	finish := func() error {
+		t.manifest.nextID++
+		data, tab := builder.finish(t.manifest.nextID-1, level)
+		if err := t.store.WriteFile(tab.name(), data); err != nil {
+			return err
+		}
+		tables = append(tables, tab)
+		builder = &tableBuilder{}
+		return nil
+	}
+
+	for it.valid() {
+		if e := it.entry(); !e.deleted || !dropDeleted {
+			builder.add(e)
+		}
+		if builder.size() >= TARGET_TABLE_SIZE {
+			if err := finish(); err != nil {
+				return nil, err
+			}
+		}
+		if err := it.next(); err != nil {
+			return nil, err
+		}
+	}
+	if builder.entries > 0 {
+		if err := finish(); err != nil {
+			return nil, err
+		}
+	}
+	return tables, nil
+}
+
+func (t *Tree) sortLevels() {
+	sort.Slice(t.levels[0], func(i, j int) bool {
+		return t.levels[0][i].id > t.levels[0][j].id
+	})
+	for _, tables := range t.levels[1:] {
+		sort.Slice(tables, func(i, j int) bool {
+			return bytes.Compare(tables[i].minKey, tables[j].minKey) < 0
+		})
+	}
+}
+
+func (t *Tree) saveManifest() error {
+	t.manifest.tables = t.manifest.tables[:0]
+	for level, tables := range t.levels {
+		for _, tab := range tables {
+			tab.level = level
+			t.manifest.tables = append(t.manifest.tables, tab.tableMeta)
+		}
+	}
+	if err := writeManifest(t.store, t.manifest); err != nil {
+		return fmt.Errorf("could not write manifest: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/wal"
+)
+
+// memoryStore keeps the files of a tree in a map
+type memoryStore struct {
+	files map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{files: map[string][]byte{}}
+}
+
+func (s *memoryStore) ReadFile(name string) ([]byte, error) {
+	data, ok := s.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	return data, nil
+}
+
+func (s *memoryStore) ReadFileAt(name string, p []byte, offset int) error {
+	data, ok := s.files[name]
+	if !ok {
+		return fmt.Errorf("%s: %w", name, ErrNotFound)
+	}
+	if offset+len(p) > len(data) {
+		return fmt.Errorf("%s: read past the end", name)
+	}
+	copy(p, data[offset:])
+	return nil
+}
+
+func (s *memoryStore) WriteFile(name string, data []byte) error {
+	s.files[name] = append([]byte{}, data...)
+	return nil
+}
+
+func (s *memoryStore) DeleteFile(name string) error {
+	delete(s.files, name)
+	return nil
+}
+
+func (s *memoryStore) MaxFileSize() int {
+	return 8 * 1024 * 1024
+}
+
+// set logs a write and applies it, like the kv package does
+func set(t *testing.T, tree *Tree, walPath string, key string, value string) {
+	t.Helper()
+	if !wal.NewWALRecord("set", key, value).WriteWALRecordToFile(walPath, false) {
+		t.Fatal("could not log set")
+	}
+	if err := tree.Set(key, value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func del(t *testing.T, tree *Tree, walPath string, key string) {
+	t.Helper()
+	if !wal.NewWALRecord("delete", key, "").WriteWALRecordToFile(walPath, false) {
+		t.Fatal("could not log delete")
+	}
+	if _, err := tree.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkTree(t *testing.T, tree *Tree, model map[string]string) {
+	t.Helper()
+
+	keys := []string{}
+	for key := range model {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs, err := tree.Scan("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != len(keys) {
+		t.Fatalf("scan has %d pairs, want %d", len(pairs), len(keys))
+	}
+	for i, pair := range pairs {
+		if pair.Key != keys[i] || pair.Value != model[keys[i]] {
+			t.Fatalf("pair %d is %q, want %q", i, pair.Key, keys[i])
+		}
+	}
+	for key, want := range model {
+		value, found, err := tree.Get(key)
+		if err != nil || !found || value != want {
+			t.Fatalf("get %q: found %v, %v", key, found, err)
+		}
+	}
+}
+
+func TestReplayAfterLastFlush(t *testing.T) {
+	store := newMemoryStore()
+	walPath := filepath.Join(t.TempDir(), "tree.wal")
+
+	tree, err := Open(store, walPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(t, tree, walPath, "flushed", "1")
+	set(t, tree, walPath, "gone", "1")
+	if err := tree.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	set(t, tree, walPath, "logged", "2")
+	del(t, tree, walPath, "gone")
+
+	// the memtable is lost, only the tables and the log are left
+	tree, err = Open(store, walPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, tree, map[string]string{"flushed": "1", "logged": "2"})
+	if len(tree.memtable) != 2 {
+		t.Fatalf("replayed %d records, only the 2 after the flush are needed", len(tree.memtable))
+	}
+}
+
+func TestReplayTornTail(t *testing.T) {
+	store := newMemoryStore()
+	walPath := filepath.Join(t.TempDir(), "tree.wal")
+
+	tree, err := Open(store, walPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(t, tree, walPath, "a", "1")
+	set(t, tree, walPath, "b", "2")
+	whole := wal.Size(walPath)
+
+	// half of a third record, the crash hit in the middle of the append
+	record := wal.NewWALRecord("set", "c", "3").ToBytes()
+	file, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(record[:len(record)/2])
+	file.Close()
+
+	tree, err = Open(store, walPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, tree, map[string]string{"a": "1", "b": "2"})
+	if wal.Size(walPath) != whole {
+		t.Fatalf("log is %d bytes, the torn record wasn't cut off at %d", wal.Size(walPath), whole)
+	}
+
+	// what is logged from now on is replayed as well
+	set(t, tree, walPath, "d", "4")
+	if tree, err = Open(store, walPath, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, tree, map[string]string{"a": "1", "b": "2", "d": "4"})
+}
+
+// corrupt writes data at offset in the first of two records logged, or in the second, the last one
+func corruptLog(t *testing.T, last bool, offset int64, data []byte) (*memoryStore, string) {
+	t.Helper()
+	store := newMemoryStore()
+	walPath := filepath.Join(t.TempDir(), "tree.wal")
+
+	tree, err := Open(store, walPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(t, tree, walPath, "akey", "avalue")
+	if last {
+		offset += wal.Size(walPath)
+	}
+	set(t, tree, walPath, "bkey", "bvalue")
+
+	file, err := os.OpenFile(walPath, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteAt(data, offset); err != nil {
+		t.Fatal(err)
+	}
+	return store, walPath
+}
+
+// where the parts of a record of "?key" and "?value" are
+const (
+	SIZE_AT     = 0
+	KEY_LEN_AT  = 5
+	KEY_AT      = 9
+	VALUE_AT    = KEY_AT + 4 + 4
+	CHECKSUM_AT = VALUE_AT + 6
+)
+
+func TestReplayCorruptRecord(t *testing.T) {
+	cases := []struct {
+		name   string
+		offset int64
+		data   []byte
+	}{
+		{"size zeroed", SIZE_AT, []byte{0, 0, 0, 0}},
+		{"size too large", SIZE_AT, []byte{0xff, 0xff, 0xff, 0xff}},
+		{"key length too large", KEY_LEN_AT, []byte{0xff, 0xff, 0xff, 0xff}},
+		{"key", KEY_AT, []byte{'x'}},
+		{"value", VALUE_AT + 2, []byte{'x'}},
+		{"checksum", CHECKSUM_AT, []byte{0}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// the record is followed by another one, it wasn't the append a crash cut short
+			store, walPath := corruptLog(t, false, c.offset, c.data)
+			_, err := Open(store, walPath, nil)
+			if err == nil || errors.Is(err, wal.ErrTornRecord) {
+				t.Fatalf("opened over a corrupt log: %v", err)
+			}
+			if !errors.Is(err, wal.ErrCorruptRecord) {
+				t.Fatalf("corrupt record not reported as such: %v", err)
+			}
+		})
+	}
+}
+
+// a last record that doesn't read back whole is the append a crash interrupted, it is cut off
+func TestReplayCorruptLastRecord(t *testing.T) {
+	cases := []struct {
+		name   string
+		offset int64
+		data   []byte
+	}{
+		{"size past the end", SIZE_AT, []byte{0, 0, 0x10, 0}},
+		{"key", KEY_AT, []byte{'x'}},
+		{"value", VALUE_AT + 2, []byte{'x'}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			store, walPath := corruptLog(t, true, c.offset, c.data)
+			whole := wal.Size(walPath)
+
+			tree, err := Open(store, walPath, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkTree(t, tree, map[string]string{"akey": "avalue"})
+			if size := wal.Size(walPath); size >= whole {
+				t.Fatalf("log is %d bytes, the corrupt record wasn't cut off", size)
+			}
+		})
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	store := newMemoryStore()
+	walPath := filepath.Join(t.TempDir(), "tree.wal")
+
+	tree, err := Open(store, walPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// enough overwrites and deletes for many flushes
+	r := rand.New(rand.NewSource(1))
+	model := map[string]string{}
+	for i := 0; i < 12000; i++ {
+		key := fmt.Sprintf("key%05d", r.Intn(3000))
+		if r.Intn(5) == 0 {
+			if _, ok := model[key]; ok {
+				if _, err := tree.Delete(key); err != nil {
+					t.Fatal(err)
+				}
+				delete(model, key)
+			}
+			continue
+		}
+		value := fmt.Sprintf("%d-%s", i, strings.Repeat("v", r.Intn(500)))
+		if err := tree.Set(key, value); err != nil {
+			t.Fatal(err)
+		}
+		model[key] = value
+	}
+	checkTree(t, tree, model)
+
+	if len(tree.levels[0]) >= L0_COMPACTION_TRIGGER {
+		t.Fatalf("level 0 has %d tables, it is compacted at %d", len(tree.levels[0]), L0_COMPACTION_TRIGGER)
+	}
+	if len(tree.levels[1]) == 0 {
+		t.Fatal("nothing was compacted into level 1")
+	}
+	for level := 1; level < MAX_LEVELS; level++ {
+		tables := tree.levels[level]
+		for i := 1; i < len(tables); i++ {
+			if string(tables[i-1].maxKey) >= string(tables[i].minKey) {
+				t.Fatalf("tables %d and %d of level %d overlap", tables[i-1].id, tables[i].id, level)
+			}
+		}
+	}
+
+	// only the tables in the manifest are left in the store
+	names := map[string]bool{manifestNames[0]: true, manifestNames[1]: true}
+	for _, meta := range tree.manifest.tables {
+		names[meta.name()] = true
+	}
+	for name := range store.files {
+		if !names[name] {
+			t.Fatalf("%s was compacted away but is still in the store", name)
+		}
+	}
+
+	if err := tree.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if tree, err = Open(store, walPath, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, tree, model)
+}
@@ -0,0 +1,146 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+The manifest lists the tables of every level, and how far into the WAL the tables go.
+
+It is written to MANIFEST-0 and MANIFEST-1 in turn, a crash while writing one leaves the other
+intact. Open reads both and keeps the valid one with the highest sequence number.
+
+Layout: "LSMM", sequence (8B), next table id (8B), WAL offset (8B), number of tables (4B), tables, CRC32C
+Table:  level (1B), id (8B), size (4B), entries (4B), min key length (uvarint), min key, max key length (uvarint), max key
+*/
+
+var MANIFEST_MAGIC = [4]byte{'L', 'S', 'M', 'M'}
+
+var manifestNames = [2]string{"lsm/MANIFEST-0", "lsm/MANIFEST-1"}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type manifest struct {
+	sequence  uint64
+	nextID    uint64
+	walOffset int64
+	tables    []tableMeta
+}
+
+func (m *manifest) encode() []byte {
+	data := append([]byte{}, MANIFEST_MAGIC[:]...)
+	data = binary.LittleEndian.AppendUint64(data, m.sequence)
+	data = binary.LittleEndian.AppendUint64(data, m.nextID)
+	data = binary.LittleEndian.AppendUint64(data, uint64(m.walOffset))
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(m.tables)))
+
+	for _, t := range m.tables {
+		data = append(data, byte(t.level))
+		data = binary.LittleEndian.AppendUint64(data, t.id)
+		data = binary.LittleEndian.AppendUint32(data, uint32(t.size))
+		data = binary.LittleEndian.AppendUint32(data, uint32(t.entries))
+		data = binary.AppendUvarint(data, uint64(len(t.minKey)))
+		data = append(data, t.minKey...)
+		data = binary.AppendUvarint(data, uint64(len(t.maxKey)))
+		data = append(data, t.maxKey...)
+	}
+
+	return binary.LittleEndian.AppendUint32(data, crc32.Checksum(data, crcTable))
+}
+
+var errBadManifest = errors.New("manifest is corrupted")
+
+func decodeManifest(data []byte) (*manifest, error) {
+	if len(data) < 32+4 || [4]byte(data[0:4]) != MANIFEST_MAGIC {
+		return nil, errBadManifest
+	}
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, errBadManifest
+	}
+
+	m := &manifest{
+		sequence:  binary.LittleEndian.Uint64(body[4:12]),
+		nextID:    binary.LittleEndian.Uint64(body[12:20]),
+		walOffset: int64(binary.LittleEndian.Uint64(body[20:28])),
+	}
+	count := int(binary.LittleEndian.Uint32(body[28:32]))
+	body = body[32:]
+
+	readKey := func() ([]byte, bool) {
+		keyLen, n := binary.Uvarint(body)
+		if n <= 0 || len(body) < n+int(keyLen) {
+			return nil, false
+		}
+		key := body[n : n+int(keyLen)]
+		body = body[n+int(keyLen):]
+		return key, true
+	}
+
+	for i := 0; i < count; i++ {
+		if len(body) < 17 {
+			return nil, errBadManifest
+		}
+		t := tableMeta{
+			level:   int(body[0]),
+			id:      binary.LittleEndian.Uint64(body[1:9]),
+			size:    int(binary.LittleEndian.Uint32(body[9:13])),
+			entries: int(binary.LittleEndian.Uint32(body[13:17])),
+		}
+		body = body[17:]
+
+		var ok bool
+		if t.minKey, ok = readKey(); !ok {
+			return nil, errBadManifest
+		}
+		if t.maxKey, ok = readKey(); !ok {
+			return nil, errBadManifest
+		}
+		if t.level >= MAX_LEVELS {
+			return nil, errBadManifest
+		}
+		m.tables = append(m.tables, t)
+	}
+	return m, nil
+}
+
+// readManifest returns the newest valid manifest, an empty one if there is none yet
+func readManifest(store Store) (*manifest, error) {
+	var newest *manifest
+	found := false
+
+	for _, name := range manifestNames {
+		data, err := store.ReadFile(name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		found = true
+		if err != nil {
+			continue
+		}
+		m, err := decodeManifest(data)
+		if err != nil {
+			continue
+		}
+		if newest == nil || m.sequence > newest.sequence {
+			newest = m
+		}
+	}
+
+	if newest == nil {
+		if found {
+			return nil, fmt.Errorf("no valid manifest: %w", errBadManifest)
+		}
+		return &manifest{nextID: 1}, nil
+	}
+	return newest, nil
+}
+
+// writeManifest writes m with the next sequence number, over the older of the two manifests
+func writeManifest(store Store, m *manifest) error {
+	m.sequence++
+	return store.WriteFile(manifestNames[m.sequence%2], m.encode())
+}
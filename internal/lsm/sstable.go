@@ -0,0 +1,267 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+/*
+SSTable layout, a table is immutable once written:
+
+data blocks - entries sorted by key, BLOCK_SIZE bytes or a little more
+index       - for every block: first key length (uvarint), first key, offset (4B), length (4B)
+bloom       - see bloom.go
+footer      - index offset, index length, bloom offset, bloom length, entries (4B each), "SSTB"
+
+Entry: key length (uvarint), value length (uvarint), flags (1B), key, value
+*/
+
+const (
+	BLOCK_SIZE  = 4 * 1024
+	FOOTER_SIZE = 5*4 + 4
+
+	ENTRY_DELETED = 1 << 0 // tombstone, the key was deleted
+)
+
+var SSTABLE_MAGIC = [4]byte{'S', 'S', 'T', 'B'}
+
+type entry struct {
+	key     []byte
+	value   []byte
+	deleted bool
+}
+
+// tableMeta is what the manifest knows about a table
+type tableMeta struct {
+	id      uint64
+	level   int
+	size    int
+	entries int
+	minKey  []byte
+	maxKey  []byte
+}
+
+func (m tableMeta) name() string {
+	return fmt.Sprintf("lsm/%06d.sst", m.id)
+}
+
+func (m tableMeta) overlaps(start []byte, end []byte) bool {
+	return bytes.Compare(m.maxKey, start) >= 0 && bytes.Compare(m.minKey, end) <= 0
+}
+
+type blockHandle struct {
+	firstKey []byte
+	offset   int
+	length   int
+}
+
+// table is an open table, its index and bloom filter are kept in memory
+type table struct {
+	tableMeta
+	index  []blockHandle
+	filter *bloom
+}
+
+// tableBuilder encodes sorted entries into a table
+type tableBuilder struct {
+	data    bytes.Buffer
+	block   bytes.Buffer
+	index   []blockHandle
+	keys    [][]byte
+	entries int
+	minKey  []byte
+	maxKey  []byte
+}
+
+func (b *tableBuilder) add(e entry) {
+	if b.block.Len() == 0 {
+		b.index = append(b.index, blockHandle{firstKey: e.key, offset: b.data.Len()})
+	}
+	if b.entries == 0 {
+		b.minKey = e.key
+	}
+	b.maxKey = e.key
+	b.keys = append(b.keys, e.key)
+	b.entries++
+
+	flags := byte(0)
+	if e.deleted {
+		flags |= ENTRY_DELETED
+	}
+	b.block.Write(binary.AppendUvarint(nil, uint64(len(e.key))))
+	b.block.Write(binary.AppendUvarint(nil, uint64(len(e.value))))
+	b.block.WriteByte(flags)
+	b.block.Write(e.key)
+	b.block.Write(e.value)
+
+	if b.block.Len() >= BLOCK_SIZE {
+		b.finishBlock()
+	}
+}
+
+func (b *tableBuilder) finishBlock() {
+	if b.block.Len() == 0 {
+		return
+	}
+	b.index[len(b.index)-1].length = b.block.Len()
+	b.data.Write(b.block.Bytes())
+	b.block.Reset()
+}
+
+// size returns roughly how big the table is so far
+func (b *tableBuilder) size() int {
+	return b.data.Len() + b.block.Len()
+}
+
+// finish returns the encoded table and what the manifest has to know about it
+func (b *tableBuilder) finish(id uint64, level int) ([]byte, *table) {
+	b.finishBlock()
+
+	filter := newBloom(len(b.keys))
+	for _, key := range b.keys {
+		filter.add(key)
+	}
+
+	indexOffset := b.data.Len()
+	for _, handle := range b.index {
+		b.data.Write(binary.AppendUvarint(nil, uint64(len(handle.firstKey))))
+		b.data.Write(handle.firstKey)
+		b.data.Write(binary.LittleEndian.AppendUint32(nil, uint32(handle.offset)))
+		b.data.Write(binary.LittleEndian.AppendUint32(nil, uint32(handle.length)))
+	}
+	bloomOffset := b.data.Len()
+	b.data.Write(filter.encode())
+
+	footer := make([]byte, FOOTER_SIZE)
+	binary.LittleEndian.PutUint32(footer[0:4], uint32(indexOffset))
+	binary.LittleEndian.PutUint32(footer[4:8], uint32(bloomOffset-indexOffset))
+	binary.LittleEndian.PutUint32(footer[8:12], uint32(bloomOffset))
+	binary.LittleEndian.PutUint32(footer[12:16], uint32(b.data.Len()-bloomOffset))
+	binary.LittleEndian.PutUint32(footer[16:20], uint32(b.entries))
+	copy(footer[20:24], SSTABLE_MAGIC[:])
+	b.data.Write(footer)
+
+	t := &table{
+		tableMeta: tableMeta{
+			id:      id,
+			level:   level,
+			size:    b.data.Len(),
+			entries: b.entries,
+			minKey:  b.minKey,
+			maxKey:  b.maxKey,
+		},
+		index:  b.index,
+		filter: filter,
+	}
+	return b.data.Bytes(), t
+}
+
+// openTable reads the index and the bloom filter of a table
+func openTable(store Store, meta tableMeta) (*table, error) {
+	if meta.size < FOOTER_SIZE {
+		return nil, fmt.Errorf("table %s is too small", meta.name())
+	}
+	footer := make([]byte, FOOTER_SIZE)
+	if err := store.ReadFileAt(meta.name(), footer, meta.size-FOOTER_SIZE); err != nil {
+		return nil, fmt.Errorf("could not read table %s: %w", meta.name(), err)
+	}
+	if [4]byte(footer[20:24]) != SSTABLE_MAGIC {
+		return nil, fmt.Errorf("table %s has a bad magic", meta.name())
+	}
+
+	indexOffset := int(binary.LittleEndian.Uint32(footer[0:4]))
+	indexLen := int(binary.LittleEndian.Uint32(footer[4:8]))
+	bloomOffset := int(binary.LittleEndian.Uint32(footer[8:12]))
+	bloomLen := int(binary.LittleEndian.Uint32(footer[12:16]))
+	if bloomOffset != indexOffset+indexLen || bloomOffset+bloomLen != meta.size-FOOTER_SIZE {
+		return nil, fmt.Errorf("table %s has a bad footer", meta.name())
+	}
+
+	tail := make([]byte, indexLen+bloomLen)
+	if err := store.ReadFileAt(meta.name(), tail, indexOffset); err != nil {
+		return nil, fmt.Errorf("could not read table %s: %w", meta.name(), err)
+	}
+
+	t := &table{tableMeta: meta, filter: decodeBloom(tail[indexLen:])}
+	for data := tail[:indexLen]; len(data) > 0; {
+		keyLen, n := binary.Uvarint(data)
+		if n <= 0 || len(data) < n+int(keyLen)+8 {
+			return nil, fmt.Errorf("table %s has a corrupted index", meta.name())
+		}
+		data = data[n:]
+		t.index = append(t.index, blockHandle{
+			firstKey: data[:keyLen],
+			offset:   int(binary.LittleEndian.Uint32(data[keyLen:])),
+			length:   int(binary.LittleEndian.Uint32(data[keyLen+4:])),
+		})
+		data = data[keyLen+8:]
+	}
+	if t.filter == nil {
+		return nil, fmt.Errorf("table %s has a corrupted bloom filter", meta.name())
+	}
+	return t, nil
+}
+
+func (t *table) readBlock(store Store, i int) ([]entry, error) {
+	handle := t.index[i]
+	data := make([]byte, handle.length)
+	if err := store.ReadFileAt(t.name(), data, handle.offset); err != nil {
+		return nil, fmt.Errorf("could not read table %s: %w", t.name(), err)
+	}
+
+	entries := []entry{}
+	for len(data) > 0 {
+		keyLen, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("table %s has a corrupted block", t.name())
+		}
+		data = data[n:]
+		valueLen, n := binary.Uvarint(data)
+		if n <= 0 || len(data) < n+1+int(keyLen)+int(valueLen) {
+			return nil, fmt.Errorf("table %s has a corrupted block", t.name())
+		}
+		flags := data[n]
+		data = data[n+1:]
+
+		entries = append(entries, entry{
+			key:     data[:keyLen],
+			value:   data[keyLen : keyLen+valueLen],
+			deleted: flags&ENTRY_DELETED != 0,
+		})
+		data = data[keyLen+valueLen:]
+	}
+	return entries, nil
+}
+
+// block returns the position of the block that would hold key, -1 if key is before the first block
+func (t *table) block(key []byte) int {
+	return sort.Search(len(t.index), func(i int) bool {
+		return bytes.Compare(t.index[i].firstKey, key) > 0
+	}) - 1
+}
+
+// get returns the entry of key in the table, found is false if the table doesn't have one
+func (t *table) get(store Store, key []byte) (entry, bool, error) {
+	if !t.filter.mayContain(key) {
+		return entry{}, false, nil
+	}
+	i := t.block(key)
+	if i < 0 {
+		return entry{}, false, nil
+	}
+
+	entries, err := t.readBlock(store, i)
+	if err != nil {
+		return entry{}, false, err
+	}
+	for _, e := range entries {
+		if c := bytes.Compare(e.key, key); c == 0 {
+			return e, true, nil
+		} else if c > 0 {
+			break
+		}
+	}
+	return entry{}, false, nil
+}
@@ -0,0 +1,158 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/crypt"
+)
+
+/*
+A record of an encrypted database is sealed before it is written. Its key and value are sealed together
+with the key length, the record is left with no key and a value of:
+[0:8] - ID of the key it was sealed with
+[8:]  - nonce, ciphertext and tag, see crypt.Key.Seal
+and ENCRYPTED_FLAG set in EntryType. The entry type and the timestamp stay readable, they are
+authenticated with the payload. Checksum and EntrySize are those of the sealed record.
+*/
+const ENCRYPTED_FLAG = 1 << 7
+
+var ErrNoKey = errors.New("record is encrypted with a key that wasn't given")
+
+// Encrypted reports whether the key and value of the record are sealed
+func (wr *WALRecord) Encrypted() bool {
+	return wr.EntryType[0]&ENCRYPTED_FLAG != 0
+}
+
+// recordAD is authenticated with the payload of a sealed record
+func (wr *WALRecord) recordAD() []byte {
+	ad := []byte{wr.EntryType[0] | ENCRYPTED_FLAG}
+	return binary.LittleEndian.AppendUint64(ad, wr.Timestamp)
+}
+
+// Seal encrypts the key and value of the record with key
+func (wr *WALRecord) Seal(key *crypt.Key) error {
+	if wr.Encrypted() {
+		return fmt.Errorf("record is already encrypted")
+	}
+	plaintext := binary.LittleEndian.AppendUint32(nil, uint32(len(wr.Key)))
+	plaintext = append(append(plaintext, wr.Key...), wr.Value...)
+
+	sealed, err := key.Seal(plaintext, wr.recordAD())
+	if err != nil {
+		return err
+	}
+	wr.EntryType[0] |= ENCRYPTED_FLAG
+	wr.setPayload(nil, append(key.ID[:], sealed...))
+	return nil
+}
+
+// Open decrypts the key and value of a sealed record with whichever of keys it was sealed with, a record
+// that isn't sealed is left as it is
+func (wr *WALRecord) Open(keys ...*crypt.Key) error {
+	if !wr.Encrypted() {
+		return nil
+	}
+	if len(wr.Value) < len(crypt.KeyID{}) {
+		return fmt.Errorf("encrypted record is too short")
+	}
+	id := crypt.KeyID(wr.Value[:8])
+
+	for _, key := range keys {
+		if key == nil || key.ID != id {
+			continue
+		}
+		plaintext, err := key.Open(wr.Value[8:], wr.recordAD())
+		if err != nil {
+			return err
+		}
+		keyLen := int(binary.LittleEndian.Uint32(plaintext))
+		if keyLen > len(plaintext)-4 {
+			return fmt.Errorf("encrypted record has a key of %d bytes, more than it holds", keyLen)
+		}
+		wr.EntryType[0] &^= ENCRYPTED_FLAG
+		wr.setPayload(plaintext[4:4+keyLen], plaintext[4+keyLen:])
+		return nil
+	}
+	return fmt.Errorf("%w, key %s", ErrNoKey, id)
+}
+
+// setPayload replaces the key and value and updates the fields that depend on them
+func (wr *WALRecord) setPayload(key []byte, value []byte) {
+	wr.Key = key
+	wr.KeyLen = uint32(len(key))
+	wr.Value = value
+	wr.ValueLen = uint32(len(value))
+	wr.Checksum = crc32.ChecksumIEEE(append(append([]byte{}, key...), value...))
+	wr.EntrySize = uint32(RECORD_OVERHEAD + len(key) + len(value))
+}
+
+// OpenRecords opens every sealed record of records in place, records that couldn't be decoded are skipped
+func OpenRecords(records []*WALRecord, keys ...*crypt.Key) error {
+	for _, record := range records {
+		if record == nil {
+			continue
+		}
+		if err := record.Open(keys...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Rekey rewrites the log at path with every record sealed with newKey. A record is opened with oldKey, or
+with newKey if it already was sealed with it, so a rotation that was interrupted can be run again.
+Records that weren't sealed at all are sealed too.
+
+The log is rewritten to a copy that is renamed over it, the caller has to hold the lock on it.
+*/
+func Rekey(path string, oldKey *crypt.Key, newKey *crypt.Key) error {
+	records, end := ReadWALRecords(path, 0)
+	if end < Size(path) {
+		return fmt.Errorf("%s has a torn or undecodable record at %d, it can't be rewritten", path, end)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	tmpPath := path + ".rekey"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // no-op once it has been renamed
+	defer file.Close()
+
+	for _, record := range records {
+		if record == nil {
+			return fmt.Errorf("%s has a record that can't be decoded, it can't be rewritten", path)
+		}
+		if err := record.Open(oldKey, newKey); err != nil {
+			return err
+		}
+		if err := record.Seal(newKey); err != nil {
+			return err
+		}
+		if _, err := file.Write(record.ToBytes()); err != nil {
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
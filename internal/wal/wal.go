@@ -3,40 +3,54 @@ package wal
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
 	"time"
+
+	"github.com/Yashasv-Prajapati/vantadb/internal/crypt"
 )
 
 const (
-	WAL_LOG_FILENAME = "wal.log"
+	WAL_FILE_EXTENSION = ".wal" // the log of a disk is kept next to it, in <disk path>.wal
+	LEGACY_WAL_PATH = "wal.log" // every write went here, in the working directory, before that
 	DELETE_FLAG = 1
 	SET_FLAT = 0
 )
 
 // log file schema
+// older records always stored a zero padded 32B key, Decode still reads them
 type WALRecord struct {
-	EntrySize uint32   // 4B
-	EntryType [1]byte  // 0 - set, 1 - delete
-	KeyLen    uint32   // 4B
-	Key       [32]byte // 32B key
-	ValueLen  uint32   // 4B
-	Value     []byte   // variable
-	Checksum  uint32   // 4B
-	Timestamp uint64   // time
+	EntrySize uint32  // 4B
+	EntryType [1]byte // 0 - set, 1 - delete
+	KeyLen    uint32  // 4B
+	Key       []byte  // variable, KeyLen bytes
+	ValueLen  uint32  // 4B
+	Value     []byte  // variable
+	Checksum  uint32  // 4B
+	Timestamp uint64  // time
 }
 
+const (
+	LEGACY_KEY_SIZE = 32
+	RECORD_OVERHEAD = 4 + 1 + 4 + 4 + 4 + 8 // everything except the key and the value
+	MAX_KEY_SIZE    = 1024                  // fs.MAX_KEY_SIZE, a longer key is never logged
+	MAX_VALUE_SIZE  = 1 << 30               // the largest value that is logged, kv refuses larger ones
+	SEAL_OVERHEAD   = 8 + 4 + crypt.OVERHEAD // what sealing adds to the key and value, see encryption.go
+
+	// no record is larger, a size beyond it is corruption wherever it is in the log
+	MAX_RECORD_SIZE = RECORD_OVERHEAD + SEAL_OVERHEAD + MAX_KEY_SIZE + MAX_VALUE_SIZE
+)
+
 func NewWALRecord(entryType string, key string, value string) *WALRecord {
 	wr := &WALRecord{}
 
 	actualKeyLen := len(key)
 	wr.KeyLen = uint32(actualKeyLen)
 
-	keyBytes := [32]byte{}
-	copy(keyBytes[:], key)
-	wr.Key = keyBytes
+	wr.Key = []byte(key)
 
 	wr.Value = []byte(value)
 
@@ -51,20 +65,21 @@ func NewWALRecord(entryType string, key string, value string) *WALRecord {
 		wr.EntryType[0] = DELETE_FLAG
 	}
 
-	wr.Checksum = crc32.ChecksumIEEE(append(wr.Key[:], wr.Value...))
+	wr.Checksum = crc32.ChecksumIEEE(append(append([]byte{}, wr.Key...), wr.Value...))
 
-	entrySize := 4 + 1 + 4 + 32 + 4 + len(wr.Value) + 4 + 8 // sequentially from entrysize --> timestamp
+	entrySize := 4 + 1 + 4 + len(wr.Key) + 4 + len(wr.Value) + 4 + 8 // sequentially from entrysize --> timestamp
 	wr.EntrySize = uint32(entrySize)
 
 	return wr
 }
 
-func (wr *WALRecord) WriteWALRecordToFile(index int) bool {
+// appends the record to the log at path, with sync it is on stable storage when this returns
+func (wr *WALRecord) WriteWALRecordToFile(path string, sync bool) bool {
 
 	data := wr.ToBytes()
 	// fmt.Println("SAVING DATA LEN ", len(data))
 
-	file, err := os.OpenFile(WAL_LOG_FILENAME, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		return false
 	}
@@ -72,14 +87,30 @@ func (wr *WALRecord) WriteWALRecordToFile(index int) bool {
 	defer file.Close()
 
 	_, err = file.Write(data)
+	if err == nil && sync {
+		err = file.Sync()
+	}
 
 	return err == nil
 
 }
 
+// Sync puts every record appended to the log at path so far on stable storage
+func Sync(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // nothing logged yet
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
 func (wr *WALRecord) ToBytes() []byte {
-	// Calculate total size: 4 + 1 + 4 + 32 + 4 + valueLen + 4 + 8
-	totalSize := 4 + 1 + 4 + 32 + 4 + len(wr.Value) + 4 + 8 // sequentially from entrysize --> timestamp
+	// Calculate total size: 4 + 1 + 4 + keyLen + 4 + valueLen + 4 + 8
+	totalSize := 4 + 1 + 4 + len(wr.Key) + 4 + len(wr.Value) + 4 + 8 // sequentially from entrysize --> timestamp
 	data := make([]byte, totalSize)
 
 	offset := 0
@@ -96,9 +127,9 @@ func (wr *WALRecord) ToBytes() []byte {
 	binary.LittleEndian.PutUint32(data[offset:offset+4], wr.KeyLen)
 	offset += 4
 
-	// Key (32 bytes)
-	copy(data[offset:offset+32], wr.Key[:])
-	offset += 32
+	// Key (variable length)
+	copy(data[offset:offset+len(wr.Key)], wr.Key)
+	offset += len(wr.Key)
 
 	// ValueLen (4 bytes)
 	binary.LittleEndian.PutUint32(data[offset:offset+4], wr.ValueLen)
@@ -118,9 +149,53 @@ func (wr *WALRecord) ToBytes() []byte {
 	return data
 }
 
+// returned, wrapped, for a record that can't be decoded or whose checksum doesn't match
+var ErrCorruptRecord = errors.New("corrupt record")
+
+// Decode returns the record in data, nil if it can't be decoded or its checksum doesn't match
 func Decode(data []byte) *WALRecord {
+	record, err := decodeRecord(data)
+	if err != nil {
+		return nil
+	}
+	return record
+}
 
-	if len(data) < 53 { // min size = 1+4+32+4+0+4+8
+// decodeRecord returns the record in data, or an error wrapping ErrCorruptRecord
+func decodeRecord(data []byte) (*WALRecord, error) {
+
+	if len(data) < RECORD_OVERHEAD { // min size = 4+1+4+0+4+0+4+8
+		return nil, fmt.Errorf("%w, %d bytes is too short", ErrCorruptRecord, len(data))
+	}
+
+	// records store KeyLen bytes of key, records written before that always stored 32 bytes
+	// the entry size tells them apart - it only adds up for one of the two layouts
+	keyFieldSize := LEGACY_KEY_SIZE
+	keyLen := binary.LittleEndian.Uint32(data[5:9])
+	if keyLen <= MAX_KEY_SIZE && int(keyLen) <= len(data)-RECORD_OVERHEAD {
+		valueLen := binary.LittleEndian.Uint32(data[9+keyLen : 13+keyLen])
+		if RECORD_OVERHEAD+int64(keyLen)+int64(valueLen) == int64(len(data)) {
+			keyFieldSize = int(keyLen)
+		}
+	}
+
+	record := decode(data, keyFieldSize)
+	if record == nil {
+		return nil, fmt.Errorf("%w, its sizes don't add up", ErrCorruptRecord)
+	}
+	// the checksum covers the key field as it was written, zero padding of a legacy key included, and the value
+	checksum := crc32.Update(crc32.ChecksumIEEE(data[9:9+keyFieldSize]), crc32.IEEETable, record.Value)
+	if checksum != record.Checksum {
+		return nil, fmt.Errorf("%w, its checksum is %08x, not %08x", ErrCorruptRecord, checksum, record.Checksum)
+	}
+	return record, nil
+
+}
+
+// decode reads a record whose key field is keyFieldSize bytes long
+func decode(data []byte, keyFieldSize int) *WALRecord {
+
+	if len(data) < RECORD_OVERHEAD+keyFieldSize {
 		return nil
 	}
 	wr := &WALRecord{}
@@ -137,16 +212,18 @@ func Decode(data []byte) *WALRecord {
 	wr.KeyLen = binary.LittleEndian.Uint32(data[offset : offset+4])
 	offset += 4
 
-	// Key (32 bytes)
-	copy(wr.Key[:], data[offset:offset+32])
-	offset += 32
+	// Key (keyFieldSize bytes, legacy keys are zero padded to 32)
+	keyLen := min(int(wr.KeyLen), keyFieldSize)
+	wr.Key = make([]byte, keyLen)
+	copy(wr.Key, data[offset:offset+keyLen])
+	offset += keyFieldSize
 
 	// ValueLen (4 bytes)
 	wr.ValueLen = binary.LittleEndian.Uint32(data[offset : offset+4])
 	offset += 4
 
 	// Value (variable length)
-	if len(data) < offset+int(wr.ValueLen)+8 { // Check if enough data remains
+	if int64(len(data)) < int64(offset)+int64(wr.ValueLen)+12 { // Check if enough data remains
 		return nil
 	}
 	wr.Value = make([]byte, wr.ValueLen)
@@ -164,16 +241,61 @@ func Decode(data []byte) *WALRecord {
 
 }
 
-func GetAllWALRecords() []*WALRecord {
+// returns the path of the log of the disk at diskPath
+func PathFor(diskPath string) string {
+	return diskPath + WAL_FILE_EXTENSION
+}
+
+func GetAllWALRecords(path string) []*WALRecord {
+	wals, _ := ReadWALRecords(path, 0)
+	return wals
+}
+
+// ReadWALRecords returns the records starting at offset in the log at path, and the offset right
+// after the last one it read. It stops at the first record it can't read and prints why, see ReadRecords
+func ReadWALRecords(path string, offset int64) ([]*WALRecord, int64) {
+	records, end, err := ReadRecords(path, offset)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return records, end
+}
+
+// returned, wrapped, by ReadRecords when the last record of the log is cut short
+var ErrTornRecord = errors.New("torn record at the end of the log")
+
+/*
+ReadRecords returns the records starting at offset in the log at path, and the offset right after the
+last one it read. A log that doesn't exist has no records.
 
-	file, err := os.Open(WAL_LOG_FILENAME)
+A crash in the middle of an append leaves the last record cut short, or with bytes that don't match its
+checksum, the write it was for never returned, so the records before it are returned with an error
+wrapping ErrTornRecord. Any other record that can't be read is corruption, ErrCorruptRecord, and an
+error reading the file is returned as it is.
+*/
+func ReadRecords(path string, offset int64) ([]*WALRecord, int64, error) {
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, offset, nil
+	}
 	if err != nil {
-		return nil
+		return nil, offset, err
 	}
 
 	defer file.Close()
 
-	var wals []*WALRecord 
+	info, err := file.Stat()
+	if err != nil {
+		return nil, offset, err
+	}
+	size := info.Size()
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+
+	var wals []*WALRecord
 
 	reader := bufio.NewReader(file)
 	for {
@@ -182,32 +304,72 @@ func GetAllWALRecords() []*WALRecord {
 		if err == io.EOF {
 			break // reached end of file — normal
 		}
+		if err == io.ErrUnexpectedEOF {
+			return wals, offset, fmt.Errorf("%s: %w at %d", path, ErrTornRecord, offset)
+		}
 		if err != nil {
-			// something went wrong (e.g. partial write)
-			fmt.Println("failed to read entry size:", err)
-			break
+			return wals, offset, fmt.Errorf("%s: could not read the record at %d: %v", path, offset, err)
 		}
 		entrySize := binary.LittleEndian.Uint32(entrySizeBytes)
+		if entrySize < RECORD_OVERHEAD || entrySize > MAX_RECORD_SIZE {
+			return wals, offset, fmt.Errorf("%s: %w at %d, it has a bad size %d", path, ErrCorruptRecord, offset, entrySize)
+		}
+		// a record can't be larger than what is left of the log, one that says so was cut short, and
+		// nothing is allocated for it
+		if int64(entrySize) > size-offset {
+			return wals, offset, fmt.Errorf("%s: %w at %d", path, ErrTornRecord, offset)
+		}
 
 		entryBuf := make([]byte, entrySize-4)
 		_, err = io.ReadFull(reader, entryBuf)
-		if err == io.EOF {
-			fmt.Println("partial WAL entry detected at end — ignoring")
-			break
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return wals, offset, fmt.Errorf("%s: %w at %d", path, ErrTornRecord, offset)
 		}
 		if err != nil {
-			fmt.Println("failed to read full WAL entry:", err)
-			break
+			return wals, offset, fmt.Errorf("%s: could not read the record at %d: %v", path, offset, err)
 		}
 		walBuf := append(entrySizeBytes, entryBuf...)
-		record := Decode(walBuf)
+		record, err := decodeRecord(walBuf)
+		if err != nil && offset+int64(entrySize) == size {
+			// the last record, its bytes didn't all make it to the disk
+			return wals, offset, fmt.Errorf("%s: %w at %d: %v", path, ErrTornRecord, offset, err)
+		}
+		if err != nil {
+			return wals, offset, fmt.Errorf("%s: record at %d: %w", path, offset, err)
+		}
 
 		// append to wals array
 		wals = append(wals, record)
+		offset += int64(entrySize)
 	}
 
-	return wals
+	return wals, offset, nil
+
+}
 
+// what replaying the log did when a database was opened
+type ReplayStats struct {
+	Records   int   // records after the checkpoint
+	Skipped   int   // records the engine refused, writes that were logged and are lost
+	TornBytes int64 // the end of the log a crash cut short, it was truncated
+}
+
+// TruncateTorn cuts the log at path at end, the offset ReadRecords stopped at, so records appended from
+// now on aren't behind a torn one
+func TruncateTorn(path string, end int64) error {
+	if end >= Size(path) {
+		return nil
+	}
+	return os.Truncate(path, end)
+}
+
+// Size returns the size of the log at path, i.e. the offset the next record will be written at
+func Size(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
 }
 
 // func RecoverFromLogs() {